@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/senyc/jason/pkg/auth"
+	"github.com/senyc/jason/pkg/config"
+)
+
+const keygenUsage = `usage: jason [flags] keygen [-out path] [-activate]
+
+Generates a P-256 key for signing jwts. With a keyring configured the key is written next to
+it as <kid>.pem and added to it, otherwise it is written to the jwt pem path. Existing files
+are never overwritten.
+
+  -out path    write the key here instead
+  -activate    sign new tokens with the key, the first key of a keyring always is. Leaving a
+               new key inactive until other services have fetched the jwks avoids them
+               rejecting tokens signed with it`
+
+func keygen(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), keygenUsage) }
+	out := fs.String("out", "", "")
+	activate := fs.Bool("activate", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	keyringPath := cfg.Auth.KeyringPath
+	if keyringPath == "" && *activate {
+		return errors.New("-activate needs a keyring")
+	}
+
+	// Read up front so a broken keyring does not leave a stray key behind, a missing one is created
+	var keyringFile auth.KeyringFile
+	if keyringPath != "" {
+		var err error
+		keyringFile, err = auth.ReadKeyringFile(keyringPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	privateKey, err := auth.GenerateJwtPrivateKey()
+	if err != nil {
+		return err
+	}
+	kid := auth.KeyId(&privateKey.PublicKey)
+
+	path := *out
+	switch {
+	case path != "":
+	case keyringPath != "":
+		path = filepath.Join(filepath.Dir(keyringPath), kid+".pem")
+	case cfg.Auth.JwtPemPath != "":
+		path = cfg.Auth.JwtPemPath
+	default:
+		return errors.New("No keyring or jwt pem path configured, pass -out")
+	}
+
+	if err = writeKey(path, privateKey); err != nil {
+		return err
+	}
+	fmt.Printf("wrote key %s to %s\n", kid, path)
+
+	if keyringPath == "" {
+		return nil
+	}
+	return addToKeyring(keyringPath, keyringFile, path, kid, *activate)
+}
+
+// writeKey creates the file readable by its owner only and fails if it already exists
+func writeKey(path string, privateKey *ecdsa.PrivateKey) error {
+	encoded, err := auth.EncodeJwtPrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(encoded); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func addToKeyring(keyringPath string, keyringFile auth.KeyringFile, keyPath string, kid string, activate bool) error {
+	// Keys next to the keyring are listed relative to it so the directory can be moved
+	pem := keyPath
+	if relative, err := filepath.Rel(filepath.Dir(keyringPath), keyPath); err == nil && filepath.IsLocal(relative) {
+		pem = relative
+	}
+	keyringFile.Keys = append(keyringFile.Keys, auth.KeyringEntry{Kid: kid, Pem: pem})
+	if activate || keyringFile.Active == "" {
+		keyringFile.Active = kid
+	}
+
+	if err := auth.WriteKeyringFile(keyringPath, keyringFile); err != nil {
+		return err
+	}
+	fmt.Printf("added key %s to %s, active key is %s\n", kid, keyringPath, keyringFile.Active)
+	fmt.Println("send SIGHUP to running servers to load it")
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/senyc/jason/pkg/auth"
+	"github.com/senyc/jason/pkg/config"
+)
+
+// expectKey checks the key at path is only readable by its owner and returns its kid
+func expectKey(t *testing.T, path string) string {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("key %s has mode %o", path, mode)
+	}
+	key, err := auth.GetJwtPrivateKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth.KeyId(&key.PublicKey)
+}
+
+func TestKeygenPem(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.JwtPemPath = filepath.Join(t.TempDir(), "jwt.pem")
+
+	if err := keygen(cfg, []string{"-activate"}); err == nil {
+		t.Fatal("activated a key without a keyring")
+	}
+	if _, err := os.Stat(cfg.Auth.JwtPemPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("rejected keygen wrote a key: %v", err)
+	}
+
+	if err := keygen(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	expectKey(t, cfg.Auth.JwtPemPath)
+	written, err := os.ReadFile(cfg.Auth.JwtPemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An existing key is never replaced, whether it is the configured path or -out
+	for _, args := range [][]string{nil, {"-out", cfg.Auth.JwtPemPath}} {
+		if err = keygen(cfg, args); !errors.Is(err, os.ErrExist) {
+			t.Fatalf("got %v writing over a key with %v", err, args)
+		}
+	}
+	if contents, err := os.ReadFile(cfg.Auth.JwtPemPath); err != nil || !bytes.Equal(contents, written) {
+		t.Fatalf("existing key changed: %v", err)
+	}
+}
+
+func TestKeygenKeyring(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Auth.KeyringPath = filepath.Join(dir, "keyring.yaml")
+	readKeyring := func() auth.KeyringFile {
+		t.Helper()
+		keyringFile, err := auth.ReadKeyringFile(cfg.Auth.KeyringPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keyringFile
+	}
+
+	// The first key creates the keyring and is active without -activate
+	if err := keygen(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	keyringFile := readKeyring()
+	if len(keyringFile.Keys) != 1 {
+		t.Fatalf("got keyring %+v", keyringFile)
+	}
+	first := keyringFile.Keys[0]
+	if first.Pem != first.Kid+".pem" || keyringFile.Active != first.Kid || expectKey(t, filepath.Join(dir, first.Pem)) != first.Kid {
+		t.Fatalf("got keyring %+v", keyringFile)
+	}
+
+	if err := keygen(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if keyringFile = readKeyring(); len(keyringFile.Keys) != 2 || keyringFile.Active != first.Kid {
+		t.Fatalf("adding a key without -activate changed the keyring to %+v", keyringFile)
+	}
+
+	// Keys written elsewhere are listed by their absolute path
+	out := filepath.Join(t.TempDir(), "elsewhere.pem")
+	if err := keygen(cfg, []string{"-activate", "-out", out}); err != nil {
+		t.Fatal(err)
+	}
+	keyringFile = readKeyring()
+	if len(keyringFile.Keys) != 3 {
+		t.Fatalf("got keyring %+v", keyringFile)
+	}
+	activated := keyringFile.Keys[2]
+	if activated.Pem != out || keyringFile.Active != activated.Kid || expectKey(t, out) != activated.Kid {
+		t.Fatalf("got keyring %+v after activating a key", keyringFile)
+	}
+
+	keyring, err := auth.LoadKeyring(cfg.Auth.KeyringPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := keyring.Jwks().Keys; len(keys) != 3 {
+		t.Fatalf("got jwks %+v", keys)
+	}
+}
+
+func TestKeygenBrokenKeyring(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Auth.KeyringPath = filepath.Join(dir, "keyring.yaml")
+	if err := os.WriteFile(cfg.Auth.KeyringPath, []byte("active: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keygen(cfg, nil); err == nil {
+		t.Fatal("added a key to a broken keyring")
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("keygen left %v behind: %v", entries, err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/db"
+)
+
+const migrateUsage = `usage: jason [flags] migrate <command>
+
+commands:
+  up           apply every pending migration
+  down [n]     roll back the latest n migrations (default 1)
+  status       list migrations and when they were applied`
+
+func migrate(cfg config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	if err := cfg.Database.Validate(); err != nil {
+		return err
+	}
+
+	store, err := db.Open(cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	migrator, ok := store.(db.Migrator)
+	if !ok {
+		return db.NoMigratorError
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Migrate()
+		fmt.Printf("applied %d migrations\n", applied)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+		}
+		reverted, err := migrator.Rollback(steps)
+		fmt.Printf("rolled back %d migrations\n", reverted)
+		return err
+	case "status":
+		statuses, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+}
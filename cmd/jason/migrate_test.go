@@ -0,0 +1,86 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/db"
+)
+
+// pendingMigrations opens the database on its own, migrate closes the store it uses
+func pendingMigrations(t *testing.T, cfg config.Database) (int, int) {
+	t.Helper()
+
+	store := db.New(cfg)
+	if err := store.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	statuses, err := store.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := 0
+	for _, status := range statuses {
+		if status.AppliedAt == nil {
+			pending++
+		}
+	}
+	return pending, len(statuses)
+}
+
+func TestMigrate(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database = config.Database{Driver: config.DriverSQLite, Path: filepath.Join(t.TempDir(), "jason.db")}
+
+	if err := migrate(cfg, []string{"up"}); err != nil {
+		t.Fatal(err)
+	}
+	pending, total := pendingMigrations(t, cfg.Database)
+	if pending != 0 || total == 0 {
+		t.Fatalf("%d of %d migrations pending after up", pending, total)
+	}
+
+	if err := migrate(cfg, []string{"down", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ = pendingMigrations(t, cfg.Database); pending != 2 {
+		t.Fatalf("%d migrations pending after rolling back 2", pending)
+	}
+	if err := migrate(cfg, []string{"status"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rolled back migrations apply again
+	if err := migrate(cfg, []string{"up"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ = pendingMigrations(t, cfg.Database); pending != 0 {
+		t.Fatalf("%d migrations pending after up", pending)
+	}
+
+	if err := migrate(cfg, []string{"down", "none"}); err == nil {
+		t.Fatal("an invalid number of migrations was accepted")
+	}
+	if err := migrate(cfg, []string{"sideways"}); err == nil {
+		t.Fatal("an unknown command was accepted")
+	}
+}
+
+func TestMigrateFullRollback(t *testing.T) {
+	cfg := config.Default()
+	cfg.Database = config.Database{Driver: config.DriverSQLite, Path: filepath.Join(t.TempDir(), "jason.db")}
+
+	if err := migrate(cfg, []string{"up"}); err != nil {
+		t.Fatal(err)
+	}
+	_, total := pendingMigrations(t, cfg.Database)
+	if err := migrate(cfg, []string{"down", "100"}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := pendingMigrations(t, cfg.Database); pending != total {
+		t.Fatalf("%d of %d migrations pending after rolling back all of them", pending, total)
+	}
+}
@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
@@ -9,6 +10,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"os"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 
@@ -46,10 +48,9 @@ func EncryptPassword(clearText string) (string, error) {
 	return string(hash), err
 }
 
-func GetJwtPrivateKey() (*ecdsa.PrivateKey, error) {
+func GetJwtPrivateKey(pemFilePath string) (*ecdsa.PrivateKey, error) {
 	var privateKey *ecdsa.PrivateKey
 
-	pemFilePath := os.Getenv("AUTH_JWT_PEM_PATH")
 	if pemFilePath == "" {
 		return privateKey, errors.New("No secret file found")
 	}
@@ -58,18 +59,43 @@ func GetJwtPrivateKey() (*ecdsa.PrivateKey, error) {
 		return privateKey, err
 	}
 	pemBlock, _ := pem.Decode(pemFileBytes)
+	if pemBlock == nil {
+		return privateKey, errors.New("No pem block found in secret file")
+	}
 	privateKey, err = x509.ParseECPrivateKey(pemBlock.Bytes)
 	return privateKey, err
 }
 
-func GetNewJWT(uuid string) (string, error) {
-	var encodedJwt string
-	claims := types.JwtClaims{Uuid: uuid}
-	j := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
-	privateKey, err := GetJwtPrivateKey()
+// GenerateJwtPrivateKey creates a P-256 key for signing jwts
+func GenerateJwtPrivateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// EncodeJwtPrivateKey returns the key as the pem GetJwtPrivateKey reads
+func EncodeJwtPrivateKey(privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(privateKey)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// GetNewJWT issues an access token for the session that expires after ttl
+func GetNewJWT(keyring *Keyring, uuid string, sessionId string, ttl time.Duration) (string, error) {
+	jti, err := GetSecureRandomString()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := types.JwtClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		Uuid:      uuid,
+		SessionId: sessionId,
 	}
-	encodedJwt, err = j.SignedString(privateKey)
-	return encodedJwt, err
+	return keyring.Sign(claims)
 }
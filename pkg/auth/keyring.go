@@ -0,0 +1,231 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+var (
+	NoActiveKeyError = errors.New("The keyring has no usable active key")
+	UnknownKeyError  = errors.New("Token was not signed by a known key")
+)
+
+// KeyringFile lists the jwt signing keys, pem paths are relative to the keyring file
+type KeyringFile struct {
+	// Kid of the key new tokens are signed with
+	Active string         `yaml:"active"`
+	Keys   []KeyringEntry `yaml:"keys"`
+}
+
+type KeyringEntry struct {
+	Kid string `yaml:"kid"`
+	Pem string `yaml:"pem"`
+	// Retired keys no longer verify tokens and are left out of the jwks
+	Retired bool `yaml:"retired,omitempty"`
+}
+
+func ReadKeyringFile(path string) (KeyringFile, error) {
+	var keyringFile KeyringFile
+	file, err := os.Open(path)
+	if err != nil {
+		return keyringFile, err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&keyringFile); err != nil {
+		return keyringFile, fmt.Errorf("Invalid keyring %s: %w", path, err)
+	}
+	return keyringFile, nil
+}
+
+// WriteKeyringFile replaces the keyring in one step, so a reload never sees it half written
+func WriteKeyringFile(path string, keyringFile KeyringFile) error {
+	contents, err := yaml.Marshal(keyringFile)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err = temp.Write(contents); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// Keyring holds the ES256 keys jwts are signed and verified with. Keys are read once and
+// again on Reload, it is safe for concurrent use
+type Keyring struct {
+	keyringPath string
+	pemPath     string
+
+	mu     sync.RWMutex
+	active string
+	// Only the keys that are not retired
+	keys map[string]*ecdsa.PrivateKey
+}
+
+// LoadKeyring reads the keyring file, or when there is none the single key at pemPath whose kid
+// is then its thumbprint
+func LoadKeyring(keyringPath string, pemPath string) (*Keyring, error) {
+	keyring := &Keyring{keyringPath: keyringPath, pemPath: pemPath}
+	return keyring, keyring.Reload()
+}
+
+// Reload reads the keys again, a keyring that fails to load keeps the keys it had
+func (k *Keyring) Reload() error {
+	active, keys, err := k.load()
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.active, k.keys = active, keys
+	return nil
+}
+
+func (k *Keyring) load() (string, map[string]*ecdsa.PrivateKey, error) {
+	if k.keyringPath == "" {
+		key, err := readSigningKey(k.pemPath)
+		if err != nil {
+			return "", nil, err
+		}
+		kid := KeyId(&key.PublicKey)
+		return kid, map[string]*ecdsa.PrivateKey{kid: key}, nil
+	}
+
+	keyringFile, err := ReadKeyringFile(k.keyringPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys := map[string]*ecdsa.PrivateKey{}
+	seen := map[string]bool{}
+	for _, entry := range keyringFile.Keys {
+		if entry.Kid == "" {
+			return "", nil, errors.New("Every key in the keyring needs a kid")
+		}
+		if seen[entry.Kid] {
+			return "", nil, fmt.Errorf("Kid %q is used by more than one key", entry.Kid)
+		}
+		seen[entry.Kid] = true
+		if entry.Retired {
+			continue
+		}
+
+		path := entry.Pem
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(k.keyringPath), path)
+		}
+		key, err := readSigningKey(path)
+		if err != nil {
+			return "", nil, fmt.Errorf("Key %s: %w", entry.Kid, err)
+		}
+		keys[entry.Kid] = key
+	}
+
+	if _, ok := keys[keyringFile.Active]; !ok {
+		return "", nil, NoActiveKeyError
+	}
+	return keyringFile.Active, keys, nil
+}
+
+// readSigningKey only accepts the P-256 keys ES256 is defined for
+func readSigningKey(pemFilePath string) (*ecdsa.PrivateKey, error) {
+	key, err := GetJwtPrivateKey(pemFilePath)
+	if err != nil {
+		return key, err
+	}
+	if key.Curve != elliptic.P256() {
+		return key, errors.New("Jwt keys must be on the P-256 curve")
+	}
+	return key, nil
+}
+
+// Sign signs the claims with the active key, naming it in the kid header
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	kid, key := k.active, k.keys[k.active]
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// Keyfunc picks the key named by the kid header of a token being parsed
+func (k *Keyring) Keyfunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, UnknownKeyError
+	}
+	return &key.PublicKey, nil
+}
+
+// Jwks lists the public half of every key that verifies tokens
+func (k *Keyring) Jwks() types.JwkSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	jwks := types.JwkSet{Keys: []types.Jwk{}}
+	for kid, key := range k.keys {
+		jwk := publicJwk(&key.PublicKey)
+		jwk.Kid, jwk.Use, jwk.Alg = kid, "sig", jwt.SigningMethodES256.Alg()
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].Kid < jwks.Keys[j].Kid
+	})
+	return jwks
+}
+
+func publicJwk(key *ecdsa.PublicKey) types.Jwk {
+	encode := func(coordinate []byte) string {
+		return base64.RawURLEncoding.EncodeToString(coordinate)
+	}
+	// Coordinates are padded to the size of the curve
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return types.Jwk{
+		Kty: "EC",
+		Crv: key.Curve.Params().Name,
+		X:   encode(key.X.FillBytes(make([]byte, size))),
+		Y:   encode(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// KeyId is the RFC 7638 thumbprint of the key
+func KeyId(key *ecdsa.PublicKey) string {
+	jwk := publicJwk(key)
+	// The members are required to be in lexicographic order without whitespace
+	thumbprint := fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk.Crv, jwk.Kty, jwk.X, jwk.Y)
+	sum := sha256.Sum256([]byte(thumbprint))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeKey stores a new P-256 key as dir/name.pem
+func writeKey(t *testing.T, dir string, name string) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := GenerateJwtPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := EncodeJwtPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, name+".pem"), encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func sign(t *testing.T, keyring *Keyring) string {
+	t.Helper()
+
+	token, err := GetNewJWT(keyring, "user", "session", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// signWith signs a token the way Sign does, with any key under any kid
+func signWith(t *testing.T, key *ecdsa.PrivateKey, kid string) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// verify parses the token like the auth middleware and returns the kid it was signed with
+func verify(keyring *Keyring, token string) (string, error) {
+	parsed, err := jwt.Parse(token, keyring.Keyfunc, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}))
+	if err != nil {
+		return "", err
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid, nil
+}
+
+func jwksKids(keyring *Keyring) []string {
+	var kids []string
+	for _, jwk := range keyring.Jwks().Keys {
+		kids = append(kids, jwk.Kid)
+	}
+	return kids
+}
+
+func TestKeyId(t *testing.T) {
+	key, err := GenerateJwtPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// RFC 7638 hashes the required members only, sorted and without whitespace, which is what
+	// encoding/json produces for a map
+	jwk := publicJwk(&key.PublicKey)
+	members, err := json.Marshal(map[string]string{"kty": jwk.Kty, "crv": jwk.Crv, "x": jwk.X, "y": jwk.Y})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(members)
+	if kid := KeyId(&key.PublicKey); kid != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("got kid %q for %s", kid, members)
+	}
+
+	// Coordinates keep their leading zeros
+	if x, err := base64.RawURLEncoding.DecodeString(jwk.X); err != nil || len(x) != 32 {
+		t.Fatalf("got x coordinate %q: %v", jwk.X, err)
+	}
+}
+
+func TestLoadKeyringFromPem(t *testing.T) {
+	dir := t.TempDir()
+	key := writeKey(t, dir, "jwt")
+
+	keyring, err := LoadKeyring("", filepath.Join(dir, "jwt.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := KeyId(&key.PublicKey)
+	if signedWith, err := verify(keyring, sign(t, keyring)); err != nil || signedWith != kid {
+		t.Fatalf("token was signed with %q, expected the thumbprint %q: %v", signedWith, kid, err)
+	}
+
+	jwks := keyring.Jwks()
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("got jwks %+v", jwks)
+	}
+	if jwk := jwks.Keys[0]; jwk.Kid != kid || jwk.Kty != "EC" || jwk.Crv != "P-256" || jwk.Use != "sig" || jwk.Alg != "ES256" {
+		t.Fatalf("got jwk %+v", jwk)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	dir := t.TempDir()
+	current, previous, retired := writeKey(t, dir, "current"), writeKey(t, dir, "previous"), writeKey(t, dir, "retired")
+	keyringPath := filepath.Join(dir, "keyring.yaml")
+	err := WriteKeyringFile(keyringPath, KeyringFile{Active: "current", Keys: []KeyringEntry{
+		{Kid: "current", Pem: "current.pem"},
+		{Kid: "previous", Pem: filepath.Join(dir, "previous.pem")},
+		{Kid: "retired", Pem: "retired.pem", Retired: true},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := LoadKeyring(keyringPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid, err := verify(keyring, sign(t, keyring)); err != nil || kid != "current" {
+		t.Fatalf("token was signed with %q: %v", kid, err)
+	}
+
+	// Keys that are no longer active keep verifying the tokens they signed until they are retired
+	if _, err = verify(keyring, signWith(t, previous, "previous")); err != nil {
+		t.Fatalf("token of the previous key did not verify: %v", err)
+	}
+	for kid, key := range map[string]*ecdsa.PrivateKey{"retired": retired, "unknown": current, "": current} {
+		if _, err = verify(keyring, signWith(t, key, kid)); !errors.Is(err, UnknownKeyError) {
+			t.Fatalf("got %v for a token with kid %q", err, kid)
+		}
+	}
+	if _, err = verify(keyring, signWith(t, previous, "current")); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Fatalf("got %v for a token signed by another key than its kid", err)
+	}
+
+	if kids := jwksKids(keyring); len(kids) != 2 || kids[0] != "current" || kids[1] != "previous" {
+		t.Fatalf("got jwks kids %v", kids)
+	}
+}
+
+func TestKeyringReload(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "first")
+	writeKey(t, dir, "second")
+	keyringPath := filepath.Join(dir, "keyring.yaml")
+	write := func(keyringFile KeyringFile) {
+		t.Helper()
+		if err := WriteKeyringFile(keyringPath, keyringFile); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(KeyringFile{Active: "first", Keys: []KeyringEntry{{Kid: "first", Pem: "first.pem"}}})
+	keyring, err := LoadKeyring(keyringPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := sign(t, keyring)
+
+	write(KeyringFile{Active: "second", Keys: []KeyringEntry{{Kid: "first", Pem: "first.pem"}, {Kid: "second", Pem: "second.pem"}}})
+	if err = keyring.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if kid, err := verify(keyring, sign(t, keyring)); err != nil || kid != "second" {
+		t.Fatalf("token was signed with %q after rotating: %v", kid, err)
+	}
+	if _, err = verify(keyring, before); err != nil {
+		t.Fatalf("token signed before rotating did not verify: %v", err)
+	}
+
+	// A keyring that fails to load leaves the loaded keys in place
+	write(KeyringFile{Active: "second", Keys: []KeyringEntry{{Kid: "second", Pem: "missing.pem"}}})
+	if err = keyring.Reload(); err == nil {
+		t.Fatal("reloading a keyring with a missing pem succeeded")
+	}
+	if kid, err := verify(keyring, sign(t, keyring)); err != nil || kid != "second" {
+		t.Fatalf("token was signed with %q after a failed reload: %v", kid, err)
+	}
+	if kids := jwksKids(keyring); len(kids) != 2 {
+		t.Fatalf("got jwks kids %v after a failed reload", kids)
+	}
+}
+
+func TestLoadKeyringErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "key")
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := EncodeJwtPrivateKey(p384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "p384.pem"), encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		keyring  string
+		expected error
+	}{
+		{"no active key", "keys:\n  - kid: key\n    pem: key.pem\n", NoActiveKeyError},
+		{"retired active key", "active: key\nkeys:\n  - kid: key\n    pem: key.pem\n    retired: true\n", NoActiveKeyError},
+		{"missing kid", "active: key\nkeys:\n  - pem: key.pem\n", nil},
+		{"repeated kid", "active: key\nkeys:\n  - kid: key\n    pem: key.pem\n  - kid: key\n    pem: key.pem\n", nil},
+		{"unknown member", "active: key\nkeys:\n  - kid: key\n    pem: key.pem\n    path: key.pem\n", nil},
+		{"wrong curve", "active: key\nkeys:\n  - kid: key\n    pem: p384.pem\n", nil},
+	}
+	for _, test := range tests {
+		keyringPath := filepath.Join(dir, "keyring.yaml")
+		if err = os.WriteFile(keyringPath, []byte(test.keyring), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err = LoadKeyring(keyringPath, "")
+		if err == nil || (test.expected != nil && !errors.Is(err, test.expected)) {
+			t.Fatalf("%s: got %v", test.name, err)
+		}
+	}
+
+	if _, err = LoadKeyring("", filepath.Join(dir, "p384.pem")); err == nil {
+		t.Fatal("loaded a P-384 key")
+	}
+}
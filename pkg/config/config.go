@@ -0,0 +1,354 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Database drivers, kept in sync with the drivers db.Open understands
+const (
+	DriverMySQL  = "mysql"
+	DriverSQLite = "sqlite"
+	DriverMemory = "memory"
+)
+
+type Config struct {
+	ListenAddr      string        `yaml:"listenAddr"`
+	CorsOrigins     []string      `yaml:"corsOrigins"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	Database        Database      `yaml:"database"`
+	Auth            Auth          `yaml:"auth"`
+	Email           Email         `yaml:"email"`
+	Trash           Trash         `yaml:"trash"`
+	ApiKeys         ApiKeys       `yaml:"apiKeys"`
+}
+
+type Database struct {
+	Driver      string `yaml:"driver"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	Host        string `yaml:"host"`
+	Port        string `yaml:"port"`
+	Path        string `yaml:"path"`
+	AutoMigrate bool   `yaml:"autoMigrate"`
+}
+
+type Auth struct {
+	// A keyring holds every signing key by kid, without one the single key at JwtPemPath is used
+	KeyringPath string `yaml:"keyringPath"`
+	JwtPemPath  string `yaml:"jwtPemPath"`
+	// How long a jwt is valid, and how long a session lasts without being refreshed
+	AccessTokenTtl  time.Duration `yaml:"accessTokenTtl"`
+	RefreshTokenTtl time.Duration `yaml:"refreshTokenTtl"`
+}
+
+// Trash controls how long deleted tasks can be restored
+type Trash struct {
+	Retention     time.Duration `yaml:"retention"`
+	PurgeInterval time.Duration `yaml:"purgeInterval"`
+}
+
+// ApiKeys controls how often api key usage is written and when owners hear about expiring keys
+type ApiKeys struct {
+	LastUsedFlushInterval time.Duration `yaml:"lastUsedFlushInterval"`
+	// How long before a key expires its owner is emailed
+	ExpiryNotice        time.Duration `yaml:"expiryNotice"`
+	ExpiryCheckInterval time.Duration `yaml:"expiryCheckInterval"`
+}
+
+type Email struct {
+	ApiKey      string `yaml:"apiKey"`
+	SenderName  string `yaml:"senderName"`
+	SenderEmail string `yaml:"senderEmail"`
+	ResetUrl    string `yaml:"resetUrl"`
+}
+
+func Default() Config {
+	return Config{
+		ListenAddr:  ":8080",
+		CorsOrigins: []string{"*"},
+		// Leaves headroom within the default kubernetes termination grace period of 30s
+		ShutdownTimeout: 25 * time.Second,
+		Database: Database{
+			Driver: DriverMySQL,
+			User:   "root",
+			Host:   "localhost",
+			Port:   "3306",
+			Path:   "jason.db",
+		},
+		Auth: Auth{
+			AccessTokenTtl:  15 * time.Minute,
+			RefreshTokenTtl: 30 * 24 * time.Hour,
+		},
+		Email: Email{
+			SenderName:  "Contact",
+			SenderEmail: "contact@jasontasks.com",
+			ResetUrl:    "https://jasontasks.com/login/reset",
+		},
+		Trash: Trash{
+			Retention:     30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		ApiKeys: ApiKeys{
+			LastUsedFlushInterval: time.Minute,
+			ExpiryNotice:          7 * 24 * time.Hour,
+			ExpiryCheckInterval:   time.Hour,
+		},
+	}
+}
+
+// Load builds the configuration from, in increasing precedence, the defaults, the yaml file
+// given by -config or JASON_CONFIG, environment variables and command line flags. It returns
+// the arguments left over after the flags, which hold the subcommand if there is one
+func Load(args []string) (Config, []string, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("jason", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("JASON_CONFIG"), "path to a yaml config file")
+	listenAddr := fs.String("listen", "", "address the http server listens on")
+	corsOrigins := fs.String("cors-origins", "", "comma separated list of allowed CORS origins")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 0, "how long to wait for in flight requests when shutting down")
+	driver := fs.String("db-driver", "", "database driver, one of mysql, sqlite or memory")
+	dbUser := fs.String("db-user", "", "mysql user")
+	dbPass := fs.String("db-pass", "", "mysql password")
+	dbHost := fs.String("db-host", "", "mysql host")
+	dbPort := fs.String("db-port", "", "mysql port")
+	dbPath := fs.String("db-path", "", "sqlite database file")
+	autoMigrate := fs.Bool("db-auto-migrate", false, "apply pending migrations when the server starts")
+	keyringPath := fs.String("keyring-path", "", "path to the keyring listing the keys used to sign jwts")
+	jwtPemPath := fs.String("jwt-pem-path", "", "path to the EC private key used to sign jwts")
+	accessTokenTtl := fs.Duration("access-token-ttl", 0, "how long a jwt is valid")
+	refreshTokenTtl := fs.Duration("refresh-token-ttl", 0, "how long a login lasts without being refreshed")
+	emailApiKey := fs.String("email-api-key", "", "brevo api key used to send emails")
+	trashRetention := fs.Duration("trash-retention", 0, "how long deleted tasks stay in the trash")
+	trashPurgeInterval := fs.Duration("trash-purge-interval", 0, "how often the trash is purged")
+	lastUsedFlushInterval := fs.Duration("api-key-last-used-flush-interval", 0, "how often the last use of api keys is written")
+	expiryNotice := fs.Duration("api-key-expiry-notice", 0, "how long before an api key expires its owner is emailed")
+	expiryCheckInterval := fs.Duration("api-key-expiry-check-interval", 0, "how often to look for api keys about to expire")
+
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, err
+	}
+
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return cfg, nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, nil, err
+	}
+
+	// Only flags that were passed explicitly override the values loaded so far
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listenAddr
+		case "cors-origins":
+			cfg.CorsOrigins = splitList(*corsOrigins)
+		case "shutdown-timeout":
+			cfg.ShutdownTimeout = *shutdownTimeout
+		case "db-driver":
+			cfg.Database.Driver = *driver
+		case "db-user":
+			cfg.Database.User = *dbUser
+		case "db-pass":
+			cfg.Database.Password = *dbPass
+		case "db-host":
+			cfg.Database.Host = *dbHost
+		case "db-port":
+			cfg.Database.Port = *dbPort
+		case "db-path":
+			cfg.Database.Path = *dbPath
+		case "db-auto-migrate":
+			cfg.Database.AutoMigrate = *autoMigrate
+		case "keyring-path":
+			cfg.Auth.KeyringPath = *keyringPath
+		case "jwt-pem-path":
+			cfg.Auth.JwtPemPath = *jwtPemPath
+		case "access-token-ttl":
+			cfg.Auth.AccessTokenTtl = *accessTokenTtl
+		case "refresh-token-ttl":
+			cfg.Auth.RefreshTokenTtl = *refreshTokenTtl
+		case "email-api-key":
+			cfg.Email.ApiKey = *emailApiKey
+		case "trash-retention":
+			cfg.Trash.Retention = *trashRetention
+		case "trash-purge-interval":
+			cfg.Trash.PurgeInterval = *trashPurgeInterval
+		case "api-key-last-used-flush-interval":
+			cfg.ApiKeys.LastUsedFlushInterval = *lastUsedFlushInterval
+		case "api-key-expiry-notice":
+			cfg.ApiKeys.ExpiryNotice = *expiryNotice
+		case "api-key-expiry-check-interval":
+			cfg.ApiKeys.ExpiryCheckInterval = *expiryCheckInterval
+		}
+	})
+
+	return cfg, fs.Args(), nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("Invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	setFromEnv(&c.ListenAddr, "LISTEN_ADDR")
+	if origins := os.Getenv("CORS_ORIGINS"); origins != "" {
+		c.CorsOrigins = splitList(origins)
+	}
+	if err := durationFromEnv(&c.ShutdownTimeout, "SHUTDOWN_TIMEOUT"); err != nil {
+		return err
+	}
+
+	setFromEnv(&c.Database.Driver, "DB_DRIVER")
+	setFromEnv(&c.Database.User, "DB_USER")
+	setFromEnv(&c.Database.Password, "DB_PASS")
+	setFromEnv(&c.Database.Host, "MARIADB_SERVICE_SERVICE_HOST")
+	setFromEnv(&c.Database.Port, "MARIADB_SERVICE_SERVICE_PORT")
+	setFromEnv(&c.Database.Path, "DB_PATH")
+	if autoMigrate := os.Getenv("DB_AUTO_MIGRATE"); autoMigrate != "" {
+		value, err := strconv.ParseBool(autoMigrate)
+		if err != nil {
+			return fmt.Errorf("Invalid DB_AUTO_MIGRATE %q", autoMigrate)
+		}
+		c.Database.AutoMigrate = value
+	}
+
+	setFromEnv(&c.Auth.KeyringPath, "AUTH_KEYRING_PATH")
+	setFromEnv(&c.Auth.JwtPemPath, "AUTH_JWT_PEM_PATH")
+	if err := durationFromEnv(&c.Auth.AccessTokenTtl, "AUTH_ACCESS_TOKEN_TTL"); err != nil {
+		return err
+	}
+	if err := durationFromEnv(&c.Auth.RefreshTokenTtl, "AUTH_REFRESH_TOKEN_TTL"); err != nil {
+		return err
+	}
+	setFromEnv(&c.Email.ApiKey, "EMAIL_API_KEY")
+
+	if err := durationFromEnv(&c.Trash.Retention, "TRASH_RETENTION"); err != nil {
+		return err
+	}
+	if err := durationFromEnv(&c.Trash.PurgeInterval, "TRASH_PURGE_INTERVAL"); err != nil {
+		return err
+	}
+
+	if err := durationFromEnv(&c.ApiKeys.LastUsedFlushInterval, "API_KEY_LAST_USED_FLUSH_INTERVAL"); err != nil {
+		return err
+	}
+	if err := durationFromEnv(&c.ApiKeys.ExpiryNotice, "API_KEY_EXPIRY_NOTICE"); err != nil {
+		return err
+	}
+	return durationFromEnv(&c.ApiKeys.ExpiryCheckInterval, "API_KEY_EXPIRY_CHECK_INTERVAL")
+}
+
+func setFromEnv(field *string, name string) {
+	if value := os.Getenv(name); value != "" {
+		*field = value
+	}
+}
+
+func durationFromEnv(field *time.Duration, name string) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("Invalid %s %q", name, value)
+	}
+	*field = duration
+	return nil
+}
+
+func splitList(list string) []string {
+	var result []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Validate checks everything needed to serve requests
+func (c Config) Validate() error {
+	if c.ListenAddr == "" {
+		return errors.New("No listen address configured")
+	}
+
+	if len(c.CorsOrigins) == 0 {
+		return errors.New("No CORS origins configured")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("Shutdown timeout must be positive")
+	}
+
+	if c.Trash.Retention <= 0 || c.Trash.PurgeInterval <= 0 {
+		return errors.New("Trash retention and purge interval must be positive")
+	}
+
+	if c.ApiKeys.LastUsedFlushInterval <= 0 || c.ApiKeys.ExpiryNotice <= 0 || c.ApiKeys.ExpiryCheckInterval <= 0 {
+		return errors.New("Api key flush interval, expiry notice and expiry check interval must be positive")
+	}
+
+	if c.Auth.AccessTokenTtl <= 0 || c.Auth.RefreshTokenTtl <= 0 {
+		return errors.New("Access and refresh token lifetimes must be positive")
+	}
+
+	if c.Auth.KeyringPath != "" {
+		if _, err := os.Stat(c.Auth.KeyringPath); err != nil {
+			return fmt.Errorf("Keyring is not readable: %w", err)
+		}
+	} else {
+		if c.Auth.JwtPemPath == "" {
+			return errors.New("No keyring or jwt pem path configured")
+		}
+		if _, err := os.Stat(c.Auth.JwtPemPath); err != nil {
+			return fmt.Errorf("Jwt pem file is not readable: %w", err)
+		}
+	}
+
+	return c.Database.Validate()
+}
+
+// Validate checks only what is needed to connect, commands like migrate do not need the rest
+func (d Database) Validate() error {
+	switch d.Driver {
+	case DriverMySQL:
+		if d.Password == "" {
+			return errors.New("No password found")
+		}
+		if _, err := strconv.Atoi(d.Port); err != nil {
+			return fmt.Errorf("Invalid database port %q", d.Port)
+		}
+	case DriverSQLite:
+		if d.Path == "" {
+			return errors.New("No sqlite database path configured")
+		}
+	case DriverMemory:
+	default:
+		return fmt.Errorf("Unknown database driver %q", d.Driver)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		env   map[string]string
+		flags []string
+		check func(t *testing.T, cfg Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.ListenAddr != ":8080" || cfg.Database.Driver != DriverMySQL || cfg.Trash.Retention != 30*24*time.Hour {
+					t.Fatalf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "file over defaults",
+			file: "listenAddr: \":9000\"\ndatabase:\n  driver: sqlite\n  path: file.db\n",
+			check: func(t *testing.T, cfg Config) {
+				if cfg.ListenAddr != ":9000" || cfg.Database.Driver != DriverSQLite || cfg.Database.Path != "file.db" {
+					t.Fatalf("got %+v", cfg)
+				}
+				// Fields the file leaves out keep their defaults
+				if cfg.Database.Port != "3306" || cfg.ShutdownTimeout != 25*time.Second {
+					t.Fatalf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name: "env over file",
+			file: "listenAddr: \":9000\"\nshutdownTimeout: 5s\ndatabase:\n  path: file.db\n  autoMigrate: false\n",
+			env:  map[string]string{"LISTEN_ADDR": ":9100", "DB_AUTO_MIGRATE": "true", "CORS_ORIGINS": "a.com, b.com"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.ListenAddr != ":9100" || !cfg.Database.AutoMigrate || !slices.Equal(cfg.CorsOrigins, []string{"a.com", "b.com"}) {
+					t.Fatalf("got %+v", cfg)
+				}
+				if cfg.ShutdownTimeout != 5*time.Second || cfg.Database.Path != "file.db" {
+					t.Fatalf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name:  "flags over env and file",
+			file:  "listenAddr: \":9000\"\ntrash:\n  retention: 1h\ndatabase:\n  path: file.db\n",
+			env:   map[string]string{"LISTEN_ADDR": ":9100", "TRASH_RETENTION": "2h", "DB_PATH": "env.db"},
+			flags: []string{"-listen", ":9200", "-trash-retention", "3h"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.ListenAddr != ":9200" || cfg.Trash.Retention != 3*time.Hour {
+					t.Fatalf("got %+v", cfg)
+				}
+				// Flags that were not passed do not reset what the env set
+				if cfg.Database.Path != "env.db" {
+					t.Fatalf("got %+v", cfg)
+				}
+			},
+		},
+		{
+			name:  "false flag over env",
+			env:   map[string]string{"DB_AUTO_MIGRATE": "true"},
+			flags: []string{"-db-auto-migrate=false"},
+			check: func(t *testing.T, cfg Config) {
+				if cfg.Database.AutoMigrate {
+					t.Fatalf("got %+v", cfg)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Anything set outside the test would leak into it
+			for _, name := range []string{"JASON_CONFIG", "LISTEN_ADDR", "CORS_ORIGINS", "SHUTDOWN_TIMEOUT", "DB_DRIVER", "DB_PATH", "DB_AUTO_MIGRATE", "TRASH_RETENTION"} {
+				t.Setenv(name, "")
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			args := test.flags
+			if test.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(test.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-config", path}, args...)
+			}
+			args = append(args, "migrate", "up")
+
+			cfg, rest, err := Load(args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(rest, []string{"migrate", "up"}) {
+				t.Fatalf("got arguments %v", rest)
+			}
+			test.check(t, cfg)
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Setenv("JASON_CONFIG", "")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("listen: \":9000\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Load([]string{"-config", path}); err == nil {
+		t.Fatal("an unknown field in the file was accepted")
+	}
+
+	t.Setenv("TRASH_RETENTION", "a while")
+	if _, _, err := Load(nil); err == nil {
+		t.Fatal("an invalid duration in the env was accepted")
+	}
+}
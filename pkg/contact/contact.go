@@ -3,12 +3,47 @@ package contact
 import (
 	"context"
 	"fmt"
-	"os"
+	"html"
+	"time"
 
+	"github.com/senyc/jason/pkg/config"
 	brevo "github.com/sendinblue/APIv3-go-library/v2/lib"
 )
 
-func SendResetEmail(email string, oneTimeToken string) error {
+type Mailer struct {
+	config config.Email
+	client *brevo.APIClient
+}
+
+func NewMailer(cfg config.Email) *Mailer {
+	brevoConfig := brevo.NewConfiguration()
+	brevoConfig.AddDefaultHeader("api-key", cfg.ApiKey)
+
+	return &Mailer{config: cfg, client: brevo.NewAPIClient(brevoConfig)}
+}
+
+func (m *Mailer) send(email string, subject string, content string) error {
+	emailModel := brevo.SendSmtpEmail{
+		Sender: &brevo.SendSmtpEmailSender{
+			Name:  m.config.SenderName,
+			Email: m.config.SenderEmail,
+		},
+		To:          []brevo.SendSmtpEmailTo{{Email: email}},
+		Subject:     subject,
+		HtmlContent: content,
+	}
+
+	result, resp, err := m.client.TransactionalEmailsApi.SendTransacEmail(context.Background(), emailModel)
+
+	if err != nil {
+		fmt.Println("Error when calling TransactionalEmailsApi->send_transac_email: ", err.Error())
+		fmt.Println("Result: ", result)
+		fmt.Println("Response", resp)
+	}
+	return err
+}
+
+func (m *Mailer) SendResetEmail(email string, oneTimeToken string) error {
 	emailContent := fmt.Sprintf(
 		`<html>
 		<body>
@@ -16,36 +51,26 @@ func SendResetEmail(email string, oneTimeToken string) error {
 				Your account (%s) made a request to reset your password. If you would like to do so please click this link:
 			</p>
 			<br>
-			<a href="https://jasontasks.com/login/reset?id=%s">
+			<a href="%s?id=%s">
 				Click here
 			</a>
 		</body>
 	</html>`,
-		email, oneTimeToken)
-
-	emailModel := brevo.SendSmtpEmail{
-		Sender: &brevo.SendSmtpEmailSender{
-			Name:  "Contact",
-			Email: "contact@jasontasks.com",
-		},
-		To:          []brevo.SendSmtpEmailTo{{Email: email}},
-		Subject:     "Jasontasks forgot password request",
-		HtmlContent: emailContent,
-	}
+		email, m.config.ResetUrl, oneTimeToken)
 
-	var ctx context.Context
-	cfg := brevo.NewConfiguration()
-
-	cfg.AddDefaultHeader("api-key", os.Getenv("EMAIL_API_KEY"))
-
-	sib := brevo.NewAPIClient(cfg)
+	return m.send(email, "Jasontasks forgot password request", emailContent)
+}
 
-	result, resp, err := sib.TransactionalEmailsApi.SendTransacEmail(ctx, emailModel)
+func (m *Mailer) SendApiKeyExpiryEmail(email string, label string, expiration time.Time) error {
+	emailContent := fmt.Sprintf(
+		`<html>
+		<body>
+			<p>
+				Your api key "%s" expires on %s UTC. Requests made with it will be rejected from then on, please create a new key to replace it.
+			</p>
+		</body>
+	</html>`,
+		html.EscapeString(label), expiration.UTC().Format("2006-01-02 15:04"))
 
-	if err != nil {
-		fmt.Println("Error when calling AccountApi->get_account: ", err.Error())
-		fmt.Println("Result: ", result)
-		fmt.Println("Response", resp)
-	}
-	return err
+	return m.send(email, "Jasontasks api key expiring soon", emailContent)
 }
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+var InvalidApiKeyScopeError = errors.New("Api key scopes must be among " + strings.Join(scopeNames(types.ApiKeyScopes), ", "))
+
+// normalizeScopes puts the scopes in canonical order without duplicates, no scopes means all of them
+func normalizeScopes(scopes []types.ApiKeyScope) ([]types.ApiKeyScope, error) {
+	if len(scopes) == 0 {
+		return slices.Clone(types.ApiKeyScopes), nil
+	}
+
+	for _, scope := range scopes {
+		if !slices.Contains(types.ApiKeyScopes, scope) {
+			return nil, InvalidApiKeyScopeError
+		}
+	}
+
+	var normalized []types.ApiKeyScope
+	for _, scope := range types.ApiKeyScopes {
+		if slices.Contains(scopes, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	return normalized, nil
+}
+
+func scopeNames(scopes []types.ApiKeyScope) []string {
+	var names []string
+	for _, scope := range scopes {
+		names = append(names, string(scope))
+	}
+	return names
+}
+
+// Scopes are stored space separated
+func joinScopes(scopes []types.ApiKeyScope) string {
+	return strings.Join(scopeNames(scopes), " ")
+}
+
+func splitScopes(scopes string) []types.ApiKeyScope {
+	var result []types.ApiKeyScope
+	for _, scope := range strings.Fields(scopes) {
+		result = append(result, types.ApiKeyScope(scope))
+	}
+	return result
+}
+
+func nullableId(id sql.NullInt64) *int {
+	if !id.Valid {
+		return nil
+	}
+	result := int(id.Int64)
+	return &result
+}
+
+// RecordApiKeyUsage writes the usage of every key in one transaction, requests count towards the
+// monthly usage of the key's owner
+func (db *DB) RecordApiKeyUsage(usage map[string]types.ApiKeyUsage) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	lastUsed, err := tx.Prepare("UPDATE api_keys SET last_used = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer lastUsed.Close()
+
+	requests, err := tx.Prepare("UPDATE users SET monthly_api_key_usage = monthly_api_key_usage + ? WHERE id = (SELECT user_id FROM api_keys WHERE id = ?)")
+	if err != nil {
+		return err
+	}
+	defer requests.Close()
+
+	for id, keyUsage := range usage {
+		if _, err = lastUsed.Exec(keyUsage.LastUsed.UTC().Truncate(time.Second), id); err != nil {
+			return err
+		}
+		if _, err = requests.Exec(keyUsage.Requests, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetExpiringApiKeys lists the keys that expire before the given time and whose owners have not
+// been told yet, keys that already expired are left out
+func (db *DB) GetExpiringApiKeys(before time.Time) ([]types.ExpiringApiKey, error) {
+	var keys []types.ExpiringApiKey
+	query := `SELECT api_keys.id, api_keys.label, api_keys.expiration, users.email
+	FROM api_keys JOIN users ON users.id = api_keys.user_id
+	WHERE api_keys.expiry_notified_at IS NULL AND api_keys.expiration IS NOT NULL
+	AND ` + db.timeExpr("api_keys.expiration") + " > " + db.timeExpr("?") + `
+	AND ` + db.timeExpr("api_keys.expiration") + " <= " + db.timeExpr("?") + `
+	ORDER BY api_keys.expiration`
+
+	rows, err := db.conn.Query(query, time.Now().UTC(), before.UTC())
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key types.ExpiringApiKey
+		if err = rows.Scan(&key.Id, &key.Label, &key.Expiration, &key.Email); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ClaimApiKeyExpiryNotice marks the key as notified unless it already was, reporting whether this
+// call made the claim so only one sender emails about each key
+func (db *DB) ClaimApiKeyExpiryNotice(id string) (bool, error) {
+	query := "UPDATE api_keys SET expiry_notified_at = " + db.now() + " WHERE id = ? AND expiry_notified_at IS NULL"
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(id)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// ReleaseApiKeyExpiryNotice gives up a claim so the key is notified again on the next check
+func (db *DB) ReleaseApiKeyExpiryNotice(id string) error {
+	stmt, err := db.conn.Prepare("UPDATE api_keys SET expiry_notified_at = NULL WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(id)
+	return err
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func TestApiKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		projectId, err := store.AddProject(uuid, types.ProjectPayload{Name: "project"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = store.AddApiKey(uuid, "full", types.ApiKeyPayload{Label: "full"}); err != nil {
+			t.Fatal(err)
+		}
+		scopes := []types.ApiKeyScope{types.ScopeProjectsRead, types.ScopeTasksRead, types.ScopeTasksRead}
+		if err = store.AddApiKey(uuid, "restricted", types.ApiKeyPayload{Label: "restricted", Scopes: scopes, ProjectId: &projectId}); err != nil {
+			t.Fatal(err)
+		}
+
+		owner, full, err := store.GetApiKeyOwner("full")
+		if err != nil || owner != uuid {
+			t.Fatalf("got owner %q: %v", owner, err)
+		}
+		if !slices.Equal(full.Scopes, types.ApiKeyScopes) || full.ProjectId != nil {
+			t.Fatalf("got full key %+v", full)
+		}
+		_, restricted, err := store.GetApiKeyOwner("restricted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(restricted.Scopes, []types.ApiKeyScope{types.ScopeTasksRead, types.ScopeProjectsRead}) || restricted.ProjectId == nil || *restricted.ProjectId != projectId {
+			t.Fatalf("got restricted key %+v", restricted)
+		}
+
+		if _, _, err = store.GetApiKeyOwner("unknown"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got %v for an unknown key", err)
+		}
+		if err = store.AddApiKey(uuid, "bad", types.ApiKeyPayload{Scopes: []types.ApiKeyScope{"tasks:admin"}}); !errors.Is(err, InvalidApiKeyScopeError) {
+			t.Fatalf("got %v for an unknown scope", err)
+		}
+		unknown := projectId + 100
+		if err = store.AddApiKey(uuid, "bad", types.ApiKeyPayload{ProjectId: &unknown}); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v for an unknown project", err)
+		}
+
+		usedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+		if err = store.RecordApiKeyUsage(map[string]types.ApiKeyUsage{full.Id: {LastUsed: usedAt, Requests: 3}}); err != nil {
+			t.Fatal(err)
+		}
+		keys, err := store.GetAllApiKeyMetadata(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if (key.Id == full.Id) != (key.LastAccessed != nil && key.LastAccessed.Equal(usedAt)) {
+				t.Fatalf("key %s was last used %v", key.Id, key.LastAccessed)
+			}
+		}
+
+		// Requests count towards the owner's monthly usage
+		var monthly int
+		switch store := store.(type) {
+		case *DB:
+			err = store.conn.QueryRow("SELECT monthly_api_key_usage FROM users WHERE id = ?", uuid).Scan(&monthly)
+		case *MemoryStore:
+			monthly = store.users[uuid].monthlyApiKeyUsage
+		}
+		if err != nil || monthly != 3 {
+			t.Fatalf("got monthly usage %d: %v", monthly, err)
+		}
+
+		// Deleting the project revokes the keys restricted to it
+		if err = store.DeleteProject(uuid, strconv.Itoa(projectId)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = store.GetApiKeyOwner("restricted"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got %v for a key of a deleted project", err)
+		}
+		if _, _, err = store.GetApiKeyOwner("full"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestApiKeyExpiryNotice(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		soon := time.Now().Add(time.Hour)
+		later := time.Now().Add(30 * 24 * time.Hour)
+		expired := time.Now().Add(-time.Hour)
+		for label, expiration := range map[string]time.Time{"soon": soon, "later": later, "expired": expired} {
+			expiration := expiration
+			if err := store.AddApiKey(uuid, label, types.ApiKeyPayload{Label: label, Expiration: &expiration}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keys, err := store.GetExpiringApiKeys(time.Now().Add(24 * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0].Label != "soon" || keys[0].Email != "someone@example.com" {
+			t.Fatalf("got expiring keys %+v", keys)
+		}
+		id := keys[0].Id
+
+		if claimed, err := store.ClaimApiKeyExpiryNotice(id); err != nil || !claimed {
+			t.Fatalf("first claim got %v: %v", claimed, err)
+		}
+		if claimed, err := store.ClaimApiKeyExpiryNotice(id); err != nil || claimed {
+			t.Fatalf("second claim got %v: %v", claimed, err)
+		}
+		if keys, err = store.GetExpiringApiKeys(time.Now().Add(24 * time.Hour)); err != nil || len(keys) != 0 {
+			t.Fatalf("got claimed keys %+v: %v", keys, err)
+		}
+
+		// A released claim is listed and can be claimed again
+		if err = store.ReleaseApiKeyExpiryNotice(id); err != nil {
+			t.Fatal(err)
+		}
+		if keys, err = store.GetExpiringApiKeys(time.Now().Add(24 * time.Hour)); err != nil || len(keys) != 1 {
+			t.Fatalf("got released keys %+v: %v", keys, err)
+		}
+		if claimed, err := store.ClaimApiKeyExpiryNotice(id); err != nil || !claimed {
+			t.Fatalf("claim after release got %v: %v", claimed, err)
+		}
+	})
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+var (
+	InvalidBatchOperationError = errors.New("Operation must be create, edit, complete, uncomplete or delete")
+	BatchAbortedError          = errors.New("Not applied, another operation in the batch failed")
+)
+
+// abortBatch marks every operation but the failed one as not applied
+func abortBatch(outcomes []types.BatchOutcome, failed int) {
+	for i := range outcomes {
+		if i != failed {
+			outcomes[i].Err = BatchAbortedError
+		}
+	}
+}
+
+func (db *DB) runOperation(tx *sql.Tx, userId string, operation types.BatchOperation) (int, error) {
+	taskId := strconv.Itoa(operation.Id)
+	switch operation.Op {
+	case types.BatchCreate:
+		return db.addNewTask(tx, operation.NewTask, userId)
+	case types.BatchEdit:
+		operation.Edit.Id = operation.Id
+		return operation.Id, db.editTask(tx, userId, operation.Edit, operation.IfMatch)
+	case types.BatchComplete:
+		return operation.Id, db.markTaskCompleted(tx, userId, taskId, operation.Cascade, operation.IfMatch)
+	case types.BatchUncomplete:
+		return operation.Id, db.markTaskIncomplete(tx, userId, taskId, operation.IfMatch)
+	case types.BatchDelete:
+		return operation.Id, db.deleteTask(tx, userId, taskId, operation.IfMatch)
+	}
+	return operation.Id, InvalidBatchOperationError
+}
+
+// Outside atomic mode every operation runs within a savepoint, so a failing one is undone on its own
+func (db *DB) RunBatch(userId string, operations []types.BatchOperation, atomic bool) ([]types.BatchOutcome, error) {
+	outcomes := make([]types.BatchOutcome, len(operations))
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return outcomes, err
+	}
+	defer tx.Rollback()
+
+	for i, operation := range operations {
+		if !atomic {
+			if _, err = tx.Exec("SAVEPOINT batch_operation"); err != nil {
+				return outcomes, err
+			}
+		}
+
+		outcomes[i].Id, outcomes[i].Err = db.runOperation(tx, userId, operation)
+		if outcomes[i].Err != nil && atomic {
+			abortBatch(outcomes, i)
+			return outcomes, nil
+		}
+
+		if outcomes[i].Err != nil {
+			if _, err = tx.Exec("ROLLBACK TO SAVEPOINT batch_operation"); err != nil {
+				return outcomes, err
+			}
+		}
+		if !atomic {
+			if _, err = tx.Exec("RELEASE SAVEPOINT batch_operation"); err != nil {
+				return outcomes, err
+			}
+		}
+	}
+	return outcomes, tx.Commit()
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func TestRunBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		done := addTask(t, store, uuid, "done")
+
+		operations := []types.BatchOperation{
+			{Op: types.BatchCreate, NewTask: types.NewTaskPayload{Title: "first"}},
+			// Fails after the task was inserted, its savepoint has to undo the insert
+			{Op: types.BatchCreate, NewTask: types.NewTaskPayload{Title: "bad tag", Tags: []string{"  "}}},
+			{Op: types.BatchComplete, Id: done},
+			{Op: types.BatchDelete, Id: 404},
+			{Op: types.BatchCreate, NewTask: types.NewTaskPayload{Title: "second"}},
+		}
+		outcomes, err := store.RunBatch(uuid, operations, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if outcomes[0].Err != nil || outcomes[2].Err != nil || outcomes[4].Err != nil {
+			t.Fatalf("unexpected failures %+v", outcomes)
+		}
+		if !errors.Is(outcomes[1].Err, InvalidTagError) || !errors.Is(outcomes[3].Err, NoTasksFoundError) {
+			t.Fatalf("unexpected outcomes %+v", outcomes)
+		}
+
+		tasks, err := store.GetAllTasksByUser(uuid, types.TaskFilter{Sort: types.SortById})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, task := range tasks {
+			titles = append(titles, task.Title)
+		}
+		if len(titles) != 3 || titles[0] != "done" || titles[1] != "first" || titles[2] != "second" {
+			t.Fatalf("got tasks %v", titles)
+		}
+		// The id the failed create took is handed out again
+		if outcomes[4].Id != outcomes[0].Id+1 {
+			t.Fatalf("got ids %d and %d", outcomes[0].Id, outcomes[4].Id)
+		}
+
+		task, err := store.GetTaskById(uuid, strconv.Itoa(done))
+		if err != nil || !task.Completed {
+			t.Fatalf("task was not completed %+v: %v", task, err)
+		}
+	})
+}
+
+func TestRunBatchAtomic(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		task := addTask(t, store, uuid, "task")
+
+		before, err := store.GetTaskChanges(uuid, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		operations := []types.BatchOperation{
+			{Op: types.BatchCreate, NewTask: types.NewTaskPayload{Title: "created"}},
+			{Op: types.BatchEdit, Id: task, Edit: types.EditTaskPayload{Title: types.PatchField[string]{Set: true, Value: "edited"}}, IfMatch: []int64{before.Revision + 100}},
+			{Op: types.BatchComplete, Id: task},
+			{Op: types.BatchDelete, Id: task},
+		}
+		outcomes, err := store.RunBatch(uuid, operations, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !errors.Is(outcomes[1].Err, VersionMismatchError) {
+			t.Fatalf("got %v for the stale edit", outcomes[1].Err)
+		}
+		for _, i := range []int{0, 2, 3} {
+			if !errors.Is(outcomes[i].Err, BatchAbortedError) {
+				t.Fatalf("operation %d got %v, want BatchAbortedError", i, outcomes[i].Err)
+			}
+		}
+
+		// Nothing was applied, not even the change counter moved
+		after, err := store.GetTaskChanges(uuid, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Revision != before.Revision || len(after.Tasks) != 1 || after.Tasks[0].Completed {
+			t.Fatalf("batch was not rolled back %+v", after)
+		}
+		if next := addTask(t, store, uuid, "next"); next != task+1 {
+			t.Fatalf("got id %d after the rolled back create, want %d", next, task+1)
+		}
+
+		// The same batch with a matching version goes through
+		operations[1].IfMatch = []int64{before.Tasks[0].Revision}
+		outcomes, err = store.RunBatch(uuid, operations, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, outcome := range outcomes {
+			if outcome.Err != nil {
+				t.Fatalf("operation %d failed: %v", i, outcome.Err)
+			}
+		}
+		if _, err = store.GetTaskById(uuid, strconv.Itoa(task)); !errors.Is(err, NoTasksFoundError) {
+			t.Fatalf("task was not deleted: %v", err)
+		}
+	})
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+const maxChecklistItemLength = 255
+
+var (
+	NoChecklistItemsFoundError = errors.New("No checklist item found")
+	InvalidChecklistItemError  = errors.New("Checklist items must be between 1 and 255 characters long")
+)
+
+func normalizeChecklistItem(title string) (string, error) {
+	title = strings.TrimSpace(title)
+	if title == "" || len(title) > maxChecklistItemLength {
+		return title, InvalidChecklistItemError
+	}
+	return title, nil
+}
+
+func checklistItemExists(tx *sql.Tx, userId string, taskId int, itemId string) error {
+	var id int
+	err := tx.QueryRow("SELECT id FROM checklist_items WHERE user_id = ? AND task_id = ? AND id = ?", userId, taskId, itemId).Scan(&id)
+	if err == sql.ErrNoRows {
+		return NoChecklistItemsFoundError
+	}
+	return err
+}
+
+func (db *DB) AddChecklistItem(userId string, taskId string, item types.ChecklistItemPayload) (types.ChecklistItemResponse, error) {
+	var result types.ChecklistItemResponse
+	title, err := normalizeChecklistItem(item.Title)
+	if err != nil {
+		return result, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return result, err
+	}
+
+	inserted, err := tx.Exec("INSERT INTO checklist_items (user_id, task_id, title) VALUES (?, ?, ?)", userId, id, title)
+	if err != nil {
+		return result, err
+	}
+
+	itemId, err := inserted.LastInsertId()
+	if err != nil {
+		return result, err
+	}
+	if err = db.touchTasks(tx, userId, id); err != nil {
+		return result, err
+	}
+
+	query := "SELECT id, title, checked, time_created FROM checklist_items WHERE id = ?"
+	err = tx.QueryRow(query, itemId).Scan(&result.Id, &result.Title, &result.Checked, &result.TimeCreated)
+	if err != nil {
+		return result, err
+	}
+	return result, tx.Commit()
+}
+
+func (db *DB) GetChecklistItems(userId string, taskId string) ([]types.ChecklistItemResponse, error) {
+	var items []types.ChecklistItemResponse
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return items, err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return items, err
+	}
+
+	query := "SELECT id, title, checked, time_created FROM checklist_items WHERE user_id = ? AND task_id = ? ORDER BY id"
+	rows, err := tx.Query(query, userId, id)
+	if err != nil {
+		return items, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item types.ChecklistItemResponse
+		if err = rows.Scan(&item.Id, &item.Title, &item.Checked, &item.TimeCreated); err != nil {
+			return items, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// changeChecklistItem runs a statement on the item after making sure both the task and the item exist
+func (db *DB) changeChecklistItem(userId string, taskId string, itemId string, query string, args ...any) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return err
+	}
+
+	if err = checklistItemExists(tx, userId, id, itemId); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(query, append(args, userId, id, itemId)...); err != nil {
+		return err
+	}
+	if err = db.touchTasks(tx, userId, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) EditChecklistItem(userId string, taskId string, itemId string, item types.ChecklistItemPayload) error {
+	title, err := normalizeChecklistItem(item.Title)
+	if err != nil {
+		return err
+	}
+
+	query := "UPDATE checklist_items SET title = ? WHERE user_id = ? AND task_id = ? AND id = ?"
+	return db.changeChecklistItem(userId, taskId, itemId, query, title)
+}
+
+func (db *DB) SetChecklistItemChecked(userId string, taskId string, itemId string, checked bool) error {
+	query := "UPDATE checklist_items SET checked = ? WHERE user_id = ? AND task_id = ? AND id = ?"
+	return db.changeChecklistItem(userId, taskId, itemId, query, checked)
+}
+
+func (db *DB) DeleteChecklistItem(userId string, taskId string, itemId string) error {
+	query := "DELETE FROM checklist_items WHERE user_id = ? AND task_id = ? AND id = ?"
+	return db.changeChecklistItem(userId, taskId, itemId, query)
+}
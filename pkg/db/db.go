@@ -2,46 +2,54 @@ package db
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
-	"os"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/senyc/jason/pkg/config"
 )
 
+// Supported database drivers
+const (
+	MySQL  = config.DriverMySQL
+	SQLite = config.DriverSQLite
+	Memory = config.DriverMemory
+)
+
+// DB is the sql backed Store, the driver decides which dialect the queries are written in
 type DB struct {
-	conn *sql.DB
+	conn   *sql.DB
+	driver string
+	config config.Database
 }
 
-func (db *DB) Connect() error {
-	pass := os.Getenv("DB_PASS")
-	user := os.Getenv("DB_USER")
-	port := os.Getenv("MARIADB_SERVICE_SERVICE_PORT")
-	domain := os.Getenv("MARIADB_SERVICE_SERVICE_HOST")
-
-	if pass == "" {
-		return errors.New("No password found")
-	}
-
-	if user == "" {
-		user = "root"
-	}
+func New(cfg config.Database) *DB {
+	return &DB{driver: cfg.Driver, config: cfg}
+}
 
-	if port == "" {
-		port = "3306"
+func (db *DB) Connect() error {
+	switch db.driver {
+	case "", MySQL:
+		db.driver = MySQL
+		return db.connectMySQL()
+	case SQLite:
+		return db.connectSQLite()
+	default:
+		return fmt.Errorf("Unknown database driver %q", db.driver)
 	}
+}
 
-	if domain == "" {
-		domain = "localhost"
-	}
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
 
-	dbPath := fmt.Sprintf("%s:%s@tcp(%s:%s)/jason?parseTime=true", user, pass, domain, port)
+// now is the sql expression for the current date and time, the same clock column defaults are
+// set with. On mysql it has to be a DATETIME, CURTIME() would only be the time of day
+func (db *DB) now() string {
+	return "CURRENT_TIMESTAMP"
+}
 
-	connection, err := sql.Open("mysql", dbPath)
-	if err != nil {
-		return err
+func (db *DB) isUniqueConstraintError(err error) bool {
+	if db.driver == SQLite {
+		return isSQLiteUniqueConstraintError(err)
 	}
-
-	db.conn = connection
-	return db.conn.Ping()
+	return isMySQLUniqueConstraintError(err)
 }
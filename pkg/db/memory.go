@@ -0,0 +1,2007 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/senyc/jason/pkg/recurrence"
+	"github.com/senyc/jason/pkg/types"
+)
+
+type memoryUser struct {
+	id                 string
+	email              string
+	password           string
+	accountType        string
+	addedTasks         int
+	monthlyApiKeyUsage int
+	profilePhoto       int
+	lastAccessed       time.Time
+	timeCreated        time.Time
+	revision           int64
+}
+
+type memoryApiKey struct {
+	userId         string
+	apiKey         string
+	metadata       types.ApiKeyMetadata
+	expiryNotified bool
+}
+
+type memoryChecklistItem struct {
+	taskId int
+	item   types.ChecklistItemResponse
+}
+
+type memoryTombstone struct {
+	taskId   int
+	revision int64
+}
+
+type memorySession struct {
+	userId               string
+	refreshToken         string
+	previousRefreshToken string
+	expiresAt            time.Time
+}
+
+type memoryResetRequest struct {
+	userId string
+	token  string
+}
+
+// MemoryStore is a Store that keeps everything in process, it is safe for concurrent use
+// and is meant for tests and instances that do not need to persist anything
+type MemoryStore struct {
+	mu            sync.RWMutex
+	users         map[string]*memoryUser
+	tasks         map[string]map[int]*types.SqlTasksRow
+	apiKeys       []*memoryApiKey
+	resetRequests []memoryResetRequest
+	nextApiKeyId  int
+	// Tag names per user, including tags no task uses anymore
+	tags          map[string]map[string]bool
+	projects      map[string]map[int]*types.ProjectResponse
+	nextProjectId int
+	// Checklist items per user
+	checklistItems      map[string][]*memoryChecklistItem
+	nextChecklistItemId int
+	// Deleted tasks per user, for syncing
+	tombstones map[string][]memoryTombstone
+	// Tasks in the trash per user, kept apart so nothing else has to skip them
+	trash map[string]map[int]*types.SqlTasksRow
+	// Site logins by session id
+	sessions map[string]*memorySession
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:               map[string]*memoryUser{},
+		tasks:               map[string]map[int]*types.SqlTasksRow{},
+		nextApiKeyId:        1,
+		tags:                map[string]map[string]bool{},
+		projects:            map[string]map[int]*types.ProjectResponse{},
+		nextProjectId:       1,
+		checklistItems:      map[string][]*memoryChecklistItem{},
+		nextChecklistItemId: 1,
+		tombstones:          map[string][]memoryTombstone{},
+		trash:               map[string]map[int]*types.SqlTasksRow{},
+		sessions:            map[string]*memorySession{},
+	}
+}
+
+// Close is a no-op, there is nothing to release
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func newUuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// Version 4, variant 10
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Mirrors the column precision of the sql backends
+func memoryNow() time.Time {
+	return time.Now().UTC().Truncate(time.Second)
+}
+
+func (m *MemoryStore) userByEmail(email string) *memoryUser {
+	for _, user := range m.users {
+		if user.email == email {
+			return user
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) task(userId string, taskId string) (*types.SqlTasksRow, bool) {
+	id, err := strconv.Atoi(taskId)
+	if err != nil {
+		return nil, false
+	}
+	task, ok := m.tasks[userId][id]
+	return task, ok
+}
+
+// Copies a task so callers never share the tags slice with the store, and fills in its progress
+func (m *MemoryStore) copyTask(userId string, task *types.SqlTasksRow) types.SqlTasksRow {
+	result := *task
+	result.Tags = append([]string(nil), task.Tags...)
+
+	result.Progress = types.TaskProgress{}
+	for _, subtask := range m.tasks[userId] {
+		if subtask.ParentId.Valid && int(subtask.ParentId.Int64) == task.Id {
+			result.Progress.Subtasks++
+			if subtask.Completed {
+				result.Progress.CompletedSubtasks++
+			}
+		}
+	}
+	for _, item := range m.checklistItems[userId] {
+		if item.taskId == task.Id {
+			result.Progress.ChecklistItems++
+			if item.item.Checked {
+				result.Progress.CheckedChecklistItems++
+			}
+		}
+	}
+	return result
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAllTags(task *types.SqlTasksRow, tags []string) bool {
+	for _, tag := range tags {
+		if !containsTag(task.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesFilter checks everything in the filter but the tags, the cursor and the limit
+func matchesFilter(task *types.SqlTasksRow, filter types.TaskFilter) bool {
+	if filter.ProjectId != nil && (!task.ProjectId.Valid || int(task.ProjectId.Int64) != *filter.ProjectId) {
+		return false
+	}
+	if filter.ParentId != nil && (!task.ParentId.Valid || int(task.ParentId.Int64) != *filter.ParentId) {
+		return false
+	}
+	if (filter.MinPriority != nil && task.Priority < *filter.MinPriority) || (filter.MaxPriority != nil && task.Priority > *filter.MaxPriority) {
+		return false
+	}
+
+	hasDue := task.Due.Valid && !task.Due.Time.IsZero()
+	if filter.DueAfter != nil && (!hasDue || task.Due.Time.Before(*filter.DueAfter)) {
+		return false
+	}
+	if filter.DueBefore != nil && (!hasDue || !task.Due.Time.Before(*filter.DueBefore)) {
+		return false
+	}
+	if filter.CreatedAfter != nil && task.TimeCreated.Before(*filter.CreatedAfter) {
+		return false
+	}
+	if filter.CreatedBefore != nil && !task.TimeCreated.Before(*filter.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// Orders and pages the same way as taskOrderClause
+func (m *MemoryStore) sortedTasks(userId string, filter types.TaskFilter, include func(*types.SqlTasksRow) bool) ([]types.SqlTasksRow, error) {
+	filterTags, err := normalizeTags(filter.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flips comparisons for descending listings
+	direction := 1
+	if filter.Desc {
+		direction = -1
+	}
+
+	var tasks []types.SqlTasksRow
+	for _, task := range m.tasks[userId] {
+		if !matchesFilter(task, filter) || !include(task) || !hasAllTags(task, filterTags) {
+			continue
+		}
+		if filter.After != nil {
+			position := CursorFor(*task, filter)
+			if direction*compareTasks(filter.Sort, &position, filter.After) <= 0 {
+				continue
+			}
+		}
+		tasks = append(tasks, m.copyTask(userId, task))
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		a, b := CursorFor(tasks[i], filter), CursorFor(tasks[j], filter)
+		return direction*compareTasks(filter.Sort, &a, &b) < 0
+	})
+
+	if filter.Limit > 0 && len(tasks) > filter.Limit {
+		tasks = tasks[:filter.Limit]
+	}
+	return tasks, nil
+}
+
+// addTags attaches tags to the task, creating them for the user when needed. The caller holds the lock
+func (m *MemoryStore) addTags(userId string, task *types.SqlTasksRow, tags []string) {
+	if m.tags[userId] == nil {
+		m.tags[userId] = map[string]bool{}
+	}
+	for _, tag := range tags {
+		m.tags[userId][tag] = true
+		if !containsTag(task.Tags, tag) {
+			task.Tags = append(task.Tags, tag)
+		}
+	}
+	sort.Strings(task.Tags)
+}
+
+// removeTags detaches tags from the task, the tags themselves are kept. The caller holds the lock
+func removeTags(task *types.SqlTasksRow, tags []string) {
+	var kept []string
+	for _, taskTag := range task.Tags {
+		if !containsTag(tags, taskTag) {
+			kept = append(kept, taskTag)
+		}
+	}
+	task.Tags = kept
+}
+
+func (m *MemoryStore) GetAddedTasksCount(userId string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[userId]
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+	return user.addedTasks, nil
+}
+
+func (m *MemoryStore) AddNewTask(newTask types.NewTaskPayload, userId string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addNewTask(newTask, userId)
+}
+
+// addNewTask is AddNewTask for callers holding the lock
+func (m *MemoryStore) addNewTask(newTask types.NewTaskPayload, userId string) (int, error) {
+	rule, err := normalizeRecurrence(newTask.Recurrence, newTask.Due)
+	if err != nil {
+		return 0, err
+	}
+
+	tags, err := normalizeTags(newTask.Tags)
+	if err != nil {
+		return 0, err
+	}
+
+	user, ok := m.users[userId]
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+
+	var projectId sql.NullInt64
+	if newTask.ProjectId != nil {
+		if err = m.checkProject(userId, *newTask.ProjectId); err != nil {
+			return 0, err
+		}
+		projectId = sql.NullInt64{Int64: int64(*newTask.ProjectId), Valid: true}
+	}
+
+	var parentId sql.NullInt64
+	if newTask.ParentId != nil {
+		if err = m.checkParent(userId, *newTask.ParentId, 1); err != nil {
+			return 0, err
+		}
+		parentId = sql.NullInt64{Int64: int64(*newTask.ParentId), Valid: true}
+	}
+
+	// Gets monotonically increasing number of tasks that have been added for the user
+	taskId := user.addedTasks
+	user.addedTasks++
+	revision := m.nextRevision(userId)
+
+	if m.tasks[userId] == nil {
+		m.tasks[userId] = map[int]*types.SqlTasksRow{}
+	}
+	task := &types.SqlTasksRow{
+		Id:              taskId,
+		Title:           newTask.Title,
+		Body:            sql.NullString{String: newTask.Body, Valid: true},
+		Due:             sql.NullTime{Time: newTask.Due, Valid: true},
+		TimeCreated:     memoryNow(),
+		Priority:        newTask.Priority,
+		ProjectId:       projectId,
+		ParentId:        parentId,
+		Recurrence:      rule,
+		UpdatedAt:       memoryNow(),
+		Revision:        revision,
+		CreatedRevision: revision,
+	}
+	m.addTags(userId, task, tags)
+	m.tasks[userId][taskId] = task
+	return taskId, nil
+}
+
+func (m *MemoryStore) GetTaskById(userId string, taskId string) (types.SqlTasksRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return types.SqlTasksRow{}, NoTasksFoundError
+	}
+	return m.copyTask(userId, task), nil
+}
+
+func (m *MemoryStore) GetAllTasksByUser(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sortedTasks(uuid, filter, func(*types.SqlTasksRow) bool { return true })
+}
+
+func (m *MemoryStore) GetCompletedTasks(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sortedTasks(uuid, filter, func(task *types.SqlTasksRow) bool { return task.Completed })
+}
+
+func (m *MemoryStore) GetIncompleteTasks(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.sortedTasks(uuid, filter, func(task *types.SqlTasksRow) bool { return !task.Completed })
+}
+
+// SearchTasks ranks tasks by how often the terms appear in their title and body
+func (m *MemoryStore) SearchTasks(uuid string, search types.TaskSearch) ([]types.SqlTasksRow, error) {
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return nil, InvalidSearchQueryError
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	type match struct {
+		task  types.SqlTasksRow
+		score int
+	}
+	var matches []match
+	for _, task := range m.tasks[uuid] {
+		if search.Completed != nil && task.Completed != *search.Completed {
+			continue
+		}
+
+		score := 0
+		for _, word := range searchTerms(task.Title + " " + task.Body.String) {
+			if slices.Contains(terms, word) {
+				score++
+			}
+		}
+		if score > 0 {
+			matches = append(matches, match{m.copyTask(uuid, task), score})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].task.Id < matches[j].task.Id
+	})
+
+	var tasks []types.SqlTasksRow
+	for i := search.Offset; i < len(matches) && len(tasks) < search.Limit; i++ {
+		tasks = append(tasks, matches[i].task)
+	}
+	return tasks, nil
+}
+
+func (m *MemoryStore) GetTaskStats(uuid string) (types.TaskStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := types.TaskStats{Priorities: []types.PriorityStats{}}
+	perPeriod := map[string]map[string]int{"day": {}, "week": {}, "month": {}}
+	priorities := map[int16]*types.PriorityStats{}
+	prioritySeconds := map[int16][]float64{}
+	var seconds []float64
+	var withDue, overdue int
+
+	for _, task := range m.tasks[uuid] {
+		stats.Total++
+		priority, ok := priorities[task.Priority]
+		if !ok {
+			priority = &types.PriorityStats{Priority: task.Priority}
+			priorities[task.Priority] = priority
+		}
+		priority.Total++
+
+		if !task.Completed {
+			continue
+		}
+		stats.Completed++
+		priority.Completed++
+		if !task.CompletedDate.Valid {
+			continue
+		}
+
+		completed := task.CompletedDate.Time.UTC()
+		perPeriod["day"][completed.Format(dayFormat)]++
+		perPeriod["week"][weekStart(completed).Format(dayFormat)]++
+		perPeriod["month"][completed.Format(monthFormat)]++
+
+		duration := completed.Sub(task.TimeCreated).Seconds()
+		seconds = append(seconds, duration)
+		prioritySeconds[task.Priority] = append(prioritySeconds[task.Priority], duration)
+
+		if task.Due.Valid && !task.Due.Time.IsZero() {
+			withDue++
+			if completed.After(task.Due.Time) {
+				overdue++
+			}
+		}
+	}
+
+	counts := func(period string) []types.PeriodCount {
+		result := []types.PeriodCount{}
+		for name, count := range perPeriod[period] {
+			result = append(result, types.PeriodCount{Period: name, Completed: count})
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Period < result[j].Period })
+		return result
+	}
+	stats.CompletedPerDay = counts("day")
+	stats.CompletedPerWeek = counts("week")
+	stats.CompletedPerMonth = counts("month")
+	stats.CurrentStreak, stats.LongestStreak = streaks(stats.CompletedPerDay, statsNow())
+
+	mean := func(values []float64) *float64 {
+		if len(values) == 0 {
+			return nil
+		}
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return roundSeconds(sum / float64(len(values)))
+	}
+	stats.MeanSecondsToComplete = mean(seconds)
+	if len(seconds) > 0 {
+		sort.Float64s(seconds)
+		middle := len(seconds) / 2
+		stats.MedianSecondsToComplete = mean(seconds[middle-(1-len(seconds)%2) : middle+1])
+	}
+	if withDue > 0 {
+		ratio := float64(overdue) / float64(withDue)
+		stats.OverdueCompletionRatio = &ratio
+	}
+
+	for _, priority := range priorities {
+		priority.MeanSecondsToComplete = mean(prioritySeconds[priority.Priority])
+		stats.Priorities = append(stats.Priorities, *priority)
+	}
+	sort.Slice(stats.Priorities, func(i, j int) bool { return stats.Priorities[i].Priority < stats.Priorities[j].Priority })
+	return stats, nil
+}
+
+func (m *MemoryStore) AddNewUser(newUser types.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.userByEmail(newUser.Email) != nil {
+		return NewUserUniquenessConstraintError
+	}
+
+	id, err := newUuid()
+	if err != nil {
+		return err
+	}
+
+	now := memoryNow()
+	m.users[id] = &memoryUser{
+		id:           id,
+		email:        newUser.Email,
+		password:     newUser.Password,
+		accountType:  newUser.AccountType,
+		lastAccessed: now,
+		timeCreated:  now,
+	}
+	return nil
+}
+
+func (m *MemoryStore) MarkTaskCompleted(userId string, taskId string, cascade bool, ifMatch []int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.markTaskCompleted(userId, taskId, cascade, ifMatch); err != nil {
+		return 0, err
+	}
+	task, _ := m.task(userId, taskId)
+	return task.Revision, nil
+}
+
+// markTaskCompleted is MarkTaskCompleted for callers holding the lock
+func (m *MemoryStore) markTaskCompleted(userId string, taskId string, cascade bool, ifMatch []int64) error {
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return VersionMismatchError
+	}
+
+	ids := []int{task.Id}
+	if cascade {
+		ids, _ = m.subtree(userId, task.Id)
+	}
+
+	now := memoryNow()
+	for i, id := range ids {
+		subtask := m.tasks[userId][id]
+		// Only the task itself gets a new completion date when it is already completed
+		if subtask.Completed && i != 0 {
+			continue
+		}
+
+		spawn := !subtask.Completed && subtask.Recurrence.Valid
+		subtask.Completed = true
+		subtask.CompletedDate = sql.NullTime{Time: now, Valid: true}
+		m.touch(userId, subtask)
+		if spawn {
+			if err := m.spawnNextOccurrence(userId, subtask); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// spawnNextOccurrence mirrors DB.spawnNextOccurrence. The caller holds the lock
+func (m *MemoryStore) spawnNextOccurrence(userId string, task *types.SqlTasksRow) error {
+	rule, err := recurrence.Parse(task.Recurrence.String)
+	if err != nil {
+		return err
+	}
+
+	series := task.Recurrence
+	task.Recurrence = sql.NullString{}
+
+	due, ok := rule.Next(task.Due.Time, task.Occurrence)
+	if !ok {
+		return nil
+	}
+
+	user := m.users[userId]
+	revision := m.nextRevision(userId)
+	next := &types.SqlTasksRow{
+		Id:              user.addedTasks,
+		Title:           task.Title,
+		Body:            task.Body,
+		Due:             sql.NullTime{Time: due, Valid: true},
+		TimeCreated:     memoryNow(),
+		Priority:        task.Priority,
+		ProjectId:       task.ProjectId,
+		ParentId:        task.ParentId,
+		Recurrence:      series,
+		Occurrence:      task.Occurrence + 1,
+		Tags:            append([]string(nil), task.Tags...),
+		UpdatedAt:       memoryNow(),
+		Revision:        revision,
+		CreatedRevision: revision,
+	}
+	user.addedTasks++
+	m.tasks[userId][next.Id] = next
+
+	for _, item := range m.checklistItems[userId] {
+		if item.taskId == task.Id {
+			m.checklistItems[userId] = append(m.checklistItems[userId], &memoryChecklistItem{
+				taskId: next.Id,
+				item: types.ChecklistItemResponse{
+					Id:          m.nextChecklistItemId,
+					Title:       item.item.Title,
+					TimeCreated: memoryNow(),
+				},
+			})
+			m.nextChecklistItemId++
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) MarkTaskIncomplete(userId string, taskId string, ifMatch []int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.markTaskIncomplete(userId, taskId, ifMatch); err != nil {
+		return 0, err
+	}
+	task, _ := m.task(userId, taskId)
+	return task.Revision, nil
+}
+
+// markTaskIncomplete is MarkTaskIncomplete for callers holding the lock
+func (m *MemoryStore) markTaskIncomplete(userId string, taskId string, ifMatch []int64) error {
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return VersionMismatchError
+	}
+	task.Completed = false
+	task.CompletedDate = sql.NullTime{}
+	m.touch(userId, task)
+	return nil
+}
+
+func (m *MemoryStore) AddApiKey(uuid string, apiKey string, apiKeyMetadata types.ApiKeyPayload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		if key.apiKey == apiKey {
+			return fmt.Errorf("Duplicate api key")
+		}
+	}
+
+	scopes, err := normalizeScopes(apiKeyMetadata.Scopes)
+	if err != nil {
+		return err
+	}
+	if apiKeyMetadata.ProjectId != nil {
+		if _, ok := m.projects[uuid][*apiKeyMetadata.ProjectId]; !ok {
+			return NoProjectsFoundError
+		}
+	}
+
+	metadata := types.ApiKeyMetadata{
+		Id:           strconv.Itoa(m.nextApiKeyId),
+		Label:        apiKeyMetadata.Label,
+		Description:  apiKeyMetadata.Description,
+		CreationDate: memoryNow(),
+		Scopes:       scopes,
+		ProjectId:    apiKeyMetadata.ProjectId,
+	}
+	if apiKeyMetadata.Expiration != nil {
+		metadata.Expiration = *apiKeyMetadata.Expiration
+	}
+	m.nextApiKeyId++
+
+	m.apiKeys = append(m.apiKeys, &memoryApiKey{userId: uuid, apiKey: apiKey, metadata: metadata})
+	return nil
+}
+
+func (m *MemoryStore) GetApiKeyMetadata(encryptedApiKey string) (types.ApiKeyMetadata, error) {
+	_, metadata, err := m.GetApiKeyOwner(encryptedApiKey)
+	return metadata, err
+}
+
+func (m *MemoryStore) GetApiKeyOwner(encryptedApiKey string) (string, types.ApiKeyMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, key := range m.apiKeys {
+		if key.apiKey == encryptedApiKey {
+			return key.userId, key.metadata, nil
+		}
+	}
+	return "", types.ApiKeyMetadata{}, sql.ErrNoRows
+}
+
+func (m *MemoryStore) RecordApiKeyUsage(usage map[string]types.ApiKeyUsage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		keyUsage, ok := usage[key.metadata.Id]
+		if !ok {
+			continue
+		}
+		usedAt := keyUsage.LastUsed.UTC().Truncate(time.Second)
+		key.metadata.LastAccessed = &usedAt
+		if user, ok := m.users[key.userId]; ok {
+			user.monthlyApiKeyUsage += keyUsage.Requests
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetExpiringApiKeys(before time.Time) ([]types.ExpiringApiKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keys []types.ExpiringApiKey
+	now := time.Now()
+	for _, key := range m.apiKeys {
+		expiration := key.metadata.Expiration
+		if key.expiryNotified || expiration.IsZero() || !expiration.After(now) || expiration.After(before) {
+			continue
+		}
+
+		user, ok := m.users[key.userId]
+		if !ok {
+			continue
+		}
+		keys = append(keys, types.ExpiringApiKey{Id: key.metadata.Id, Label: key.metadata.Label, Expiration: expiration, Email: user.email})
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Expiration.Before(keys[j].Expiration)
+	})
+	return keys, nil
+}
+
+func (m *MemoryStore) ClaimApiKeyExpiryNotice(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		if key.metadata.Id == id && !key.expiryNotified {
+			key.expiryNotified = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) ReleaseApiKeyExpiryNotice(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range m.apiKeys {
+		if key.metadata.Id == id {
+			key.expiryNotified = false
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetPasswordFromLogin(login string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user := m.userByEmail(login)
+	if user == nil {
+		return "", sql.ErrNoRows
+	}
+	return user.password, nil
+}
+
+func (m *MemoryStore) GetUuidFromEmail(email string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user := m.userByEmail(email)
+	if user == nil {
+		return "", sql.ErrNoRows
+	}
+	return user.id, nil
+}
+
+func (m *MemoryStore) DeleteTask(userId string, taskId string, ifMatch []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deleteTask(userId, taskId, ifMatch)
+}
+
+// deleteTask is DeleteTask for callers holding the lock
+func (m *MemoryStore) deleteTask(userId string, taskId string, ifMatch []int64) error {
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return VersionMismatchError
+	}
+
+	ids, _ := m.subtree(userId, task.Id)
+	revision := m.nextRevision(userId)
+	if m.trash[userId] == nil {
+		m.trash[userId] = map[int]*types.SqlTasksRow{}
+	}
+	for _, id := range ids {
+		m.tasks[userId][id].DeletedAt = sql.NullTime{Time: memoryNow(), Valid: true}
+		m.trash[userId][id] = m.tasks[userId][id]
+		delete(m.tasks[userId], id)
+		m.tombstones[userId] = append(m.tombstones[userId], memoryTombstone{taskId: id, revision: revision})
+	}
+	return nil
+}
+
+func (m *MemoryStore) EditTask(userId string, taskPayload types.EditTaskPayload, ifMatch []int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.editTask(userId, taskPayload, ifMatch); err != nil {
+		return 0, err
+	}
+	return m.tasks[userId][taskPayload.Id].Revision, nil
+}
+
+// editTask is EditTask for callers holding the lock
+func (m *MemoryStore) editTask(userId string, taskPayload types.EditTaskPayload, ifMatch []int64) error {
+	if err := validateEdit(taskPayload); err != nil {
+		return err
+	}
+
+	task, ok := m.tasks[userId][taskPayload.Id]
+	if !ok {
+		return NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return VersionMismatchError
+	}
+
+	// Validated first so a bad rule leaves the task untouched
+	rule, err := editedRecurrence(*task, taskPayload)
+	if err != nil {
+		return err
+	}
+	task.Recurrence = rule
+
+	if taskPayload.Title.Set {
+		task.Title = taskPayload.Title.Value
+	}
+
+	if taskPayload.Body.Set {
+		task.Body = sql.NullString{String: taskPayload.Body.Value, Valid: !taskPayload.Body.Null}
+	}
+
+	if taskPayload.Priority.Set {
+		task.Priority = taskPayload.Priority.Value
+	}
+
+	if taskPayload.Due.Set {
+		task.Due = sql.NullTime{Time: taskPayload.Due.Value, Valid: !taskPayload.Due.Null}
+	}
+	m.touch(userId, task)
+	return nil
+}
+
+func (m *MemoryStore) GetEmailAddress(userId string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[userId]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return user.email, nil
+}
+
+func (m *MemoryStore) GetLastAccessed(userId string) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[userId]
+	if !ok {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return user.lastAccessed, nil
+}
+
+func (m *MemoryStore) GetAccountCreationDate(userId string) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[userId]
+	if !ok {
+		return time.Time{}, sql.ErrNoRows
+	}
+	return user.timeCreated, nil
+}
+
+func (m *MemoryStore) GetAllApiKeyMetadata(uuid string) ([]types.ApiKeyMetadata, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []types.ApiKeyMetadata
+	for _, key := range m.apiKeys {
+		if key.userId == uuid {
+			result = append(result, key.metadata)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStore) RevokeAllApiKeys(uuid string) error {
+	return m.DeleteAllApiKeys(uuid)
+}
+
+func (m *MemoryStore) RevokeApiKey(uuid string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.apiKeys[:0]
+	for _, key := range m.apiKeys {
+		if key.userId != uuid || key.metadata.Id != id {
+			kept = append(kept, key)
+		}
+	}
+	m.apiKeys = kept
+	return nil
+}
+
+func (m *MemoryStore) UpdateLastAccessedToNow(uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[uuid]; ok {
+		user.lastAccessed = memoryNow()
+	}
+	return nil
+}
+
+func (m *MemoryStore) ChangeEmailAddress(uuid string, newEmail string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if other := m.userByEmail(newEmail); other != nil && other.id != uuid {
+		return NewUserUniquenessConstraintError
+	}
+	if user, ok := m.users[uuid]; ok {
+		user.email = newEmail
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteAllTasks(uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.tasks, uuid)
+	delete(m.trash, uuid)
+	delete(m.checklistItems, uuid)
+	return nil
+}
+
+func (m *MemoryStore) DeleteAllApiKeys(uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := m.apiKeys[:0]
+	for _, key := range m.apiKeys {
+		if key.userId != uuid {
+			kept = append(kept, key)
+		}
+	}
+	m.apiKeys = kept
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.users, uuid)
+	delete(m.tags, uuid)
+	delete(m.projects, uuid)
+	delete(m.tombstones, uuid)
+	m.deleteSessions(uuid)
+	return nil
+}
+
+func (m *MemoryStore) GetProfilePhoto(uuid string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[uuid]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	return strconv.Itoa(user.profilePhoto), nil
+}
+
+func (m *MemoryStore) ChangeProfilePhoto(uuid string, profilePhoto int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[uuid]; ok {
+		user.profilePhoto = profilePhoto
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetForgotPasswordToken(uuid string, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// We save all password requests for logging purposes
+	m.resetRequests = append(m.resetRequests, memoryResetRequest{userId: uuid, token: token})
+	return nil
+}
+
+func (m *MemoryStore) GetResetPasswordToken(uuid string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, request := range m.resetRequests {
+		if request.userId == uuid {
+			return request.token, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (m *MemoryStore) SetNewPassword(uuid, password string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[uuid]; ok {
+		user.password = password
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetUuidFromResetPasswordToken(passwordToken string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, request := range m.resetRequests {
+		if request.token == passwordToken {
+			return request.userId, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (m *MemoryStore) AddSession(userId string, sessionId string, refreshToken string, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Expired sessions are cleaned up whenever the user logs in again
+	now := time.Now()
+	for id, session := range m.sessions {
+		if session.userId == userId && session.expiresAt.Before(now) {
+			delete(m.sessions, id)
+		}
+	}
+
+	m.sessions[sessionId] = &memorySession{userId: userId, refreshToken: refreshToken, expiresAt: expiresAt.UTC().Truncate(time.Second)}
+	return nil
+}
+
+func (m *MemoryStore) RotateSession(refreshToken string, newRefreshToken string, expiresAt time.Time) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, session := range m.sessions {
+		if session.previousRefreshToken == refreshToken {
+			delete(m.sessions, id)
+			return "", "", InvalidRefreshTokenError
+		}
+		if session.refreshToken != refreshToken {
+			continue
+		}
+
+		if !session.expiresAt.After(time.Now()) {
+			return session.userId, id, InvalidRefreshTokenError
+		}
+		session.previousRefreshToken = refreshToken
+		session.refreshToken = newRefreshToken
+		session.expiresAt = expiresAt.UTC().Truncate(time.Second)
+		return session.userId, id, nil
+	}
+	return "", "", InvalidRefreshTokenError
+}
+
+func (m *MemoryStore) SessionExists(userId string, sessionId string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.sessions[sessionId]
+	if !ok || session.userId != userId || !session.expiresAt.After(time.Now()) {
+		return NoSessionFoundError
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteSession(userId string, sessionId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, ok := m.sessions[sessionId]; ok && session.userId == userId {
+		delete(m.sessions, sessionId)
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteAllSessions(uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteSessions(uuid)
+	return nil
+}
+
+// deleteSessions is DeleteAllSessions for callers holding the lock
+func (m *MemoryStore) deleteSessions(uuid string) {
+	for id, session := range m.sessions {
+		if session.userId == uuid {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *MemoryStore) GetAllTags(uuid string) ([]types.TagResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []types.TagResponse
+	for name := range m.tags[uuid] {
+		tag := types.TagResponse{Name: name}
+		for _, task := range m.tasks[uuid] {
+			if containsTag(task.Tags, name) {
+				tag.TaskCount++
+			}
+		}
+		result = append(result, tag)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (m *MemoryStore) AddTagsToTask(userId string, taskId string, tags []string, ifMatch []int64) (int64, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return 0, VersionMismatchError
+	}
+	m.addTags(userId, task, tags)
+	m.touch(userId, task)
+	return task.Revision, nil
+}
+
+func (m *MemoryStore) RemoveTagsFromTask(userId string, taskId string, tags []string, ifMatch []int64) (int64, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return 0, VersionMismatchError
+	}
+	removeTags(task, tags)
+	m.touch(userId, task)
+	return task.Revision, nil
+}
+
+func (m *MemoryStore) RenameTag(uuid string, name string, newName string) error {
+	tags, err := normalizeTags([]string{name, newName})
+	if err != nil {
+		return err
+	}
+	// Both names normalize to the same tag
+	if len(tags) == 1 {
+		return nil
+	}
+	name, newName = strings.ToLower(strings.TrimSpace(name)), strings.ToLower(strings.TrimSpace(newName))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.tags[uuid][name] {
+		return NoTagsFoundError
+	}
+	if m.tags[uuid][newName] {
+		return TagUniquenessConstraintError
+	}
+
+	delete(m.tags[uuid], name)
+	m.tags[uuid][newName] = true
+	var tagged []*types.SqlTasksRow
+	for _, task := range m.tasks[uuid] {
+		if containsTag(task.Tags, name) {
+			removeTags(task, []string{name})
+			m.addTags(uuid, task, []string{newName})
+			tagged = append(tagged, task)
+		}
+	}
+	for _, task := range m.trash[uuid] {
+		if containsTag(task.Tags, name) {
+			removeTags(task, []string{name})
+			m.addTags(uuid, task, []string{newName})
+		}
+	}
+	m.touch(uuid, tagged...)
+	return nil
+}
+
+func (m *MemoryStore) DeleteTag(uuid string, name string) error {
+	tags, err := normalizeTags([]string{name})
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.tags[uuid][tags[0]] {
+		return NoTagsFoundError
+	}
+
+	delete(m.tags[uuid], tags[0])
+	var tagged []*types.SqlTasksRow
+	for _, task := range m.tasks[uuid] {
+		if containsTag(task.Tags, tags[0]) {
+			removeTags(task, tags)
+			tagged = append(tagged, task)
+		}
+	}
+	for _, task := range m.trash[uuid] {
+		removeTags(task, tags)
+	}
+	m.touch(uuid, tagged...)
+	return nil
+}
+
+func (m *MemoryStore) project(uuid string, projectId string) (*types.ProjectResponse, bool) {
+	id, err := strconv.Atoi(projectId)
+	if err != nil {
+		return nil, false
+	}
+	project, ok := m.projects[uuid][id]
+	return project, ok
+}
+
+// checkProject ensures tasks can be put in the project. The caller holds the lock
+func (m *MemoryStore) checkProject(uuid string, projectId int) error {
+	project, ok := m.projects[uuid][projectId]
+	if !ok {
+		return NoProjectsFoundError
+	}
+	if project.Archived {
+		return ArchivedProjectError
+	}
+	return nil
+}
+
+// Fills in the task count the same way the sql backends compute it. The caller holds the lock
+func (m *MemoryStore) projectResponse(uuid string, project *types.ProjectResponse) types.ProjectResponse {
+	result := *project
+	for _, task := range m.tasks[uuid] {
+		if task.ProjectId.Valid && int(task.ProjectId.Int64) == project.Id {
+			result.TaskCount++
+		}
+	}
+	return result
+}
+
+func (m *MemoryStore) projectNameTaken(uuid string, name string) bool {
+	for _, project := range m.projects[uuid] {
+		if project.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) AddProject(uuid string, project types.ProjectPayload) (int, error) {
+	name, err := normalizeProjectName(project.Name)
+	if err != nil {
+		return 0, err
+	}
+	color, err := normalizeProjectColor(project.Color)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.projectNameTaken(uuid, name) {
+		return 0, ProjectUniquenessConstraintError
+	}
+
+	id := m.nextProjectId
+	m.nextProjectId++
+
+	if m.projects[uuid] == nil {
+		m.projects[uuid] = map[int]*types.ProjectResponse{}
+	}
+	m.projects[uuid][id] = &types.ProjectResponse{
+		Id:          id,
+		Name:        name,
+		Color:       color,
+		TimeCreated: memoryNow(),
+	}
+	return id, nil
+}
+
+func (m *MemoryStore) GetProjectById(uuid string, projectId string) (types.ProjectResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	project, ok := m.project(uuid, projectId)
+	if !ok {
+		return types.ProjectResponse{}, NoProjectsFoundError
+	}
+	return m.projectResponse(uuid, project), nil
+}
+
+func (m *MemoryStore) GetAllProjects(uuid string, includeArchived bool) ([]types.ProjectResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []types.ProjectResponse
+	for _, project := range m.projects[uuid] {
+		if includeArchived || !project.Archived {
+			result = append(result, m.projectResponse(uuid, project))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+func (m *MemoryStore) EditProject(uuid string, projectId string, edit types.EditProjectPayload) error {
+	var name, color string
+	var err error
+	if edit.Name != "" {
+		if name, err = normalizeProjectName(edit.Name); err != nil {
+			return err
+		}
+	}
+	if edit.Color != "" {
+		if color, err = normalizeProjectColor(edit.Color); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	project, ok := m.project(uuid, projectId)
+	if !ok {
+		return NoProjectsFoundError
+	}
+
+	if name != "" && name != project.Name {
+		if m.projectNameTaken(uuid, name) {
+			return ProjectUniquenessConstraintError
+		}
+		project.Name = name
+	}
+	if color != "" {
+		project.Color = color
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetProjectArchived(uuid string, projectId string, archived bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	project, ok := m.project(uuid, projectId)
+	if !ok {
+		return NoProjectsFoundError
+	}
+	project.Archived = archived
+	return nil
+}
+
+func (m *MemoryStore) DeleteProject(uuid string, projectId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	project, ok := m.project(uuid, projectId)
+	if !ok {
+		return NoProjectsFoundError
+	}
+
+	var moved []*types.SqlTasksRow
+	for _, task := range m.tasks[uuid] {
+		if task.ProjectId.Valid && int(task.ProjectId.Int64) == project.Id {
+			task.ProjectId = sql.NullInt64{}
+			moved = append(moved, task)
+		}
+	}
+	for _, task := range m.trash[uuid] {
+		if task.ProjectId.Valid && int(task.ProjectId.Int64) == project.Id {
+			task.ProjectId = sql.NullInt64{}
+		}
+	}
+	m.touch(uuid, moved...)
+
+	// Keys restricted to the project would have nothing left to reach
+	kept := m.apiKeys[:0]
+	for _, key := range m.apiKeys {
+		if key.userId != uuid || key.metadata.ProjectId == nil || *key.metadata.ProjectId != project.Id {
+			kept = append(kept, key)
+		}
+	}
+	m.apiKeys = kept
+
+	delete(m.projects[uuid], project.Id)
+	return nil
+}
+
+func (m *MemoryStore) MoveTask(userId string, taskId string, projectId *int, ifMatch []int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return 0, VersionMismatchError
+	}
+
+	if projectId == nil {
+		task.ProjectId = sql.NullInt64{}
+		m.touch(userId, task)
+		return task.Revision, nil
+	}
+
+	if err := m.checkProject(userId, *projectId); err != nil {
+		return 0, err
+	}
+	task.ProjectId = sql.NullInt64{Int64: int64(*projectId), Valid: true}
+	m.touch(userId, task)
+	return task.Revision, nil
+}
+
+// subtree returns the task and all of its subtasks, along with how many levels the subtree spans.
+// The caller holds the lock
+func (m *MemoryStore) subtree(userId string, taskId int) ([]int, int) {
+	return subtreeIn(m.tasks[userId], taskId)
+}
+
+// subtreeIn walks down the subtasks found in tasks
+func subtreeIn(tasks map[int]*types.SqlTasksRow, taskId int) ([]int, int) {
+	ids := []int{taskId}
+	level := []int{taskId}
+	height := 1
+
+	for len(level) > 0 {
+		var children []int
+		for _, task := range tasks {
+			for _, id := range level {
+				if task.ParentId.Valid && int(task.ParentId.Int64) == id {
+					children = append(children, task.Id)
+				}
+			}
+		}
+		if len(children) == 0 {
+			break
+		}
+		ids = append(ids, children...)
+		level = children
+		height++
+	}
+	return ids, height
+}
+
+// checkParent ensures a subtree spanning height levels fits under the parent. The caller holds the lock
+func (m *MemoryStore) checkParent(userId string, parentId int, height int) error {
+	parent, ok := m.tasks[userId][parentId]
+	if !ok {
+		return NoParentTaskFoundError
+	}
+
+	depth := 1
+	for parent.ParentId.Valid {
+		parent = m.tasks[userId][int(parent.ParentId.Int64)]
+		depth++
+	}
+	if depth+height > maxTaskDepth {
+		return SubtaskDepthError
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetTaskParent(userId string, taskId string, parentId *int, ifMatch []int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return 0, VersionMismatchError
+	}
+
+	if parentId == nil {
+		task.ParentId = sql.NullInt64{}
+		m.touch(userId, task)
+		return task.Revision, nil
+	}
+
+	ids, height := m.subtree(userId, task.Id)
+	for _, id := range ids {
+		if id == *parentId {
+			return 0, SubtaskCycleError
+		}
+	}
+
+	if err := m.checkParent(userId, *parentId, height); err != nil {
+		return 0, err
+	}
+	task.ParentId = sql.NullInt64{Int64: int64(*parentId), Valid: true}
+	m.touch(userId, task)
+	return task.Revision, nil
+}
+
+// removeChecklistItems drops the user's items matching remove. The caller holds the lock
+func (m *MemoryStore) removeChecklistItems(userId string, remove func(*memoryChecklistItem) bool) {
+	var kept []*memoryChecklistItem
+	for _, item := range m.checklistItems[userId] {
+		if !remove(item) {
+			kept = append(kept, item)
+		}
+	}
+	m.checklistItems[userId] = kept
+}
+
+// checklistItem finds an item of an existing task. The caller holds the lock
+func (m *MemoryStore) checklistItem(userId string, taskId string, itemId string) (*memoryChecklistItem, error) {
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return nil, NoTasksFoundError
+	}
+
+	id, err := strconv.Atoi(itemId)
+	if err != nil {
+		return nil, NoChecklistItemsFoundError
+	}
+	for _, item := range m.checklistItems[userId] {
+		if item.taskId == task.Id && item.item.Id == id {
+			return item, nil
+		}
+	}
+	return nil, NoChecklistItemsFoundError
+}
+
+func (m *MemoryStore) AddChecklistItem(userId string, taskId string, item types.ChecklistItemPayload) (types.ChecklistItemResponse, error) {
+	title, err := normalizeChecklistItem(item.Title)
+	if err != nil {
+		return types.ChecklistItemResponse{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return types.ChecklistItemResponse{}, NoTasksFoundError
+	}
+
+	result := types.ChecklistItemResponse{
+		Id:          m.nextChecklistItemId,
+		Title:       title,
+		TimeCreated: memoryNow(),
+	}
+	m.nextChecklistItemId++
+
+	m.checklistItems[userId] = append(m.checklistItems[userId], &memoryChecklistItem{taskId: task.Id, item: result})
+	m.touch(userId, task)
+	return result, nil
+}
+
+func (m *MemoryStore) GetChecklistItems(userId string, taskId string) ([]types.ChecklistItemResponse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	task, ok := m.task(userId, taskId)
+	if !ok {
+		return nil, NoTasksFoundError
+	}
+
+	var result []types.ChecklistItemResponse
+	for _, item := range m.checklistItems[userId] {
+		if item.taskId == task.Id {
+			result = append(result, item.item)
+		}
+	}
+	return result, nil
+}
+
+func (m *MemoryStore) EditChecklistItem(userId string, taskId string, itemId string, edit types.ChecklistItemPayload) error {
+	title, err := normalizeChecklistItem(edit.Title)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.checklistItem(userId, taskId, itemId)
+	if err != nil {
+		return err
+	}
+	item.item.Title = title
+	m.touch(userId, m.tasks[userId][item.taskId])
+	return nil
+}
+
+func (m *MemoryStore) SetChecklistItemChecked(userId string, taskId string, itemId string, checked bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.checklistItem(userId, taskId, itemId)
+	if err != nil {
+		return err
+	}
+	item.item.Checked = checked
+	m.touch(userId, m.tasks[userId][item.taskId])
+	return nil
+}
+
+func (m *MemoryStore) DeleteChecklistItem(userId string, taskId string, itemId string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, err := m.checklistItem(userId, taskId, itemId)
+	if err != nil {
+		return err
+	}
+	m.removeChecklistItems(userId, func(other *memoryChecklistItem) bool { return other == item })
+	m.touch(userId, m.tasks[userId][item.taskId])
+	return nil
+}
+
+// nextRevision mirrors DB.nextRevision. The caller holds the lock
+func (m *MemoryStore) nextRevision(userId string) int64 {
+	user, ok := m.users[userId]
+	if !ok {
+		return 0
+	}
+	user.revision++
+	return user.revision
+}
+
+// touch mirrors DB.touchTasks. The caller holds the lock
+func (m *MemoryStore) touch(userId string, tasks ...*types.SqlTasksRow) {
+	if len(tasks) == 0 {
+		return
+	}
+
+	revision := m.nextRevision(userId)
+	now := memoryNow()
+	for _, task := range tasks {
+		task.Revision = revision
+		task.UpdatedAt = now
+	}
+}
+
+func (m *MemoryStore) GetTaskChanges(uuid string, since int64) (types.TaskChanges, error) {
+	var changes types.TaskChanges
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[uuid]
+	if !ok {
+		return changes, sql.ErrNoRows
+	}
+	changes.Revision = user.revision
+	if since < 0 || since > changes.Revision {
+		return changes, InvalidSyncTokenError
+	}
+
+	for _, task := range m.tasks[uuid] {
+		if task.Revision > since || since == 0 {
+			changes.Tasks = append(changes.Tasks, m.copyTask(uuid, task))
+		}
+	}
+	sort.Slice(changes.Tasks, func(i, j int) bool { return changes.Tasks[i].Id < changes.Tasks[j].Id })
+
+	if since > 0 {
+		for _, tombstone := range m.tombstones[uuid] {
+			if tombstone.revision > since {
+				changes.Deleted = append(changes.Deleted, tombstone.taskId)
+			}
+		}
+		sort.Ints(changes.Deleted)
+	}
+	return changes, nil
+}
+
+// trashedTask mirrors the sql trashedTask. The caller holds the lock
+func (m *MemoryStore) trashedTask(userId string, taskId string) (*types.SqlTasksRow, bool) {
+	id, err := strconv.Atoi(taskId)
+	if err != nil {
+		return nil, false
+	}
+	task, ok := m.trash[userId][id]
+	return task, ok
+}
+
+func (m *MemoryStore) GetTrash(uuid string) ([]types.SqlTasksRow, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var result []types.SqlTasksRow
+	for _, task := range m.trash[uuid] {
+		result = append(result, m.copyTask(uuid, task))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].DeletedAt.Time.Equal(result[j].DeletedAt.Time) {
+			return result[i].DeletedAt.Time.After(result[j].DeletedAt.Time)
+		}
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (m *MemoryStore) RestoreTask(userId string, taskId string, ifMatch []int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.trashedTask(userId, taskId)
+	if !ok {
+		return 0, NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return 0, VersionMismatchError
+	}
+
+	ids, height := m.trashedSubtree(userId, task.Id)
+	if task.ParentId.Valid {
+		err := m.checkParent(userId, int(task.ParentId.Int64), height)
+		if errors.Is(err, NoParentTaskFoundError) || errors.Is(err, SubtaskDepthError) {
+			task.ParentId = sql.NullInt64{}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	revision := m.nextRevision(userId)
+	for _, id := range ids {
+		restored := m.trash[userId][id]
+		restored.DeletedAt = sql.NullTime{}
+		restored.UpdatedAt = memoryNow()
+		restored.CreatedRevision = revision
+		restored.Revision = revision
+		m.tasks[userId][id] = restored
+		delete(m.trash[userId], id)
+	}
+
+	var kept []memoryTombstone
+	for _, tombstone := range m.tombstones[userId] {
+		if !slices.Contains(ids, tombstone.taskId) {
+			kept = append(kept, tombstone)
+		}
+	}
+	m.tombstones[userId] = kept
+	return revision, nil
+}
+
+// trashedSubtree mirrors the sql trashedSubtree, following only the subtasks that share the task's
+// tombstone revision. The caller holds the lock
+func (m *MemoryStore) trashedSubtree(userId string, taskId int) ([]int, int) {
+	var revision int64
+	for _, tombstone := range m.tombstones[userId] {
+		if tombstone.taskId == taskId {
+			revision = tombstone.revision
+		}
+	}
+
+	buried := map[int]*types.SqlTasksRow{}
+	for _, tombstone := range m.tombstones[userId] {
+		if task, ok := m.trash[userId][tombstone.taskId]; ok && tombstone.revision == revision {
+			buried[task.Id] = task
+		}
+	}
+	return subtreeIn(buried, taskId)
+}
+
+// purge drops tasks from the trash along with their checklist items. The caller holds the lock
+func (m *MemoryStore) purge(userId string, ids []int) {
+	for _, id := range ids {
+		delete(m.trash[userId], id)
+	}
+	m.removeChecklistItems(userId, func(item *memoryChecklistItem) bool {
+		return slices.Contains(ids, item.taskId)
+	})
+}
+
+func (m *MemoryStore) PurgeTask(userId string, taskId string, ifMatch []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	task, ok := m.trashedTask(userId, taskId)
+	if !ok {
+		return NoTasksFoundError
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, task.Revision) {
+		return VersionMismatchError
+	}
+
+	ids, _ := m.trashedSubtree(userId, task.Id)
+	for _, trashed := range m.trash[userId] {
+		if trashed.ParentId.Valid && !slices.Contains(ids, trashed.Id) && slices.Contains(ids, int(trashed.ParentId.Int64)) {
+			trashed.ParentId = sql.NullInt64{}
+		}
+	}
+	m.purge(userId, ids)
+	return nil
+}
+
+func (m *MemoryStore) EmptyTrash(uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id := range m.trash[uuid] {
+		ids = append(ids, id)
+	}
+	m.purge(uuid, ids)
+	return nil
+}
+
+func (m *MemoryStore) PurgeTrash(retention time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+	var purged int
+	for userId, trash := range m.trash {
+		var ids []int
+		for id, task := range trash {
+			if task.DeletedAt.Time.Before(cutoff) {
+				ids = append(ids, id)
+			}
+		}
+		m.purge(userId, ids)
+		purged += len(ids)
+	}
+	return purged, nil
+}
+
+// memorySnapshot holds what batch operations can change for a user
+type memorySnapshot struct {
+	user                memoryUser
+	tasks               map[int]*types.SqlTasksRow
+	trash               map[int]*types.SqlTasksRow
+	tags                map[string]bool
+	checklistItems      []memoryChecklistItem
+	nextChecklistItemId int
+	tombstones          []memoryTombstone
+}
+
+func copyTasks(tasks map[int]*types.SqlTasksRow) map[int]*types.SqlTasksRow {
+	result := map[int]*types.SqlTasksRow{}
+	for id, task := range tasks {
+		copied := *task
+		copied.Tags = append([]string(nil), task.Tags...)
+		result[id] = &copied
+	}
+	return result
+}
+
+// snapshot copies the user's state so restore can undo a failed batch. The caller holds the lock
+func (m *MemoryStore) snapshot(userId string) memorySnapshot {
+	snapshot := memorySnapshot{
+		tasks:               copyTasks(m.tasks[userId]),
+		trash:               copyTasks(m.trash[userId]),
+		tags:                map[string]bool{},
+		nextChecklistItemId: m.nextChecklistItemId,
+		tombstones:          slices.Clone(m.tombstones[userId]),
+	}
+	if user, ok := m.users[userId]; ok {
+		snapshot.user = *user
+	}
+	for tag := range m.tags[userId] {
+		snapshot.tags[tag] = true
+	}
+	for _, item := range m.checklistItems[userId] {
+		snapshot.checklistItems = append(snapshot.checklistItems, *item)
+	}
+	return snapshot
+}
+
+// restore puts back the state taken by snapshot. The caller holds the lock
+func (m *MemoryStore) restore(userId string, snapshot memorySnapshot) {
+	if user, ok := m.users[userId]; ok {
+		*user = snapshot.user
+	}
+	m.tasks[userId] = snapshot.tasks
+	m.trash[userId] = snapshot.trash
+	m.tags[userId] = snapshot.tags
+	m.nextChecklistItemId = snapshot.nextChecklistItemId
+	m.tombstones[userId] = snapshot.tombstones
+
+	m.checklistItems[userId] = nil
+	for _, item := range snapshot.checklistItems {
+		item := item
+		m.checklistItems[userId] = append(m.checklistItems[userId], &item)
+	}
+}
+
+// runOperation mirrors DB.runOperation. The caller holds the lock
+func (m *MemoryStore) runOperation(userId string, operation types.BatchOperation) (int, error) {
+	taskId := strconv.Itoa(operation.Id)
+	switch operation.Op {
+	case types.BatchCreate:
+		return m.addNewTask(operation.NewTask, userId)
+	case types.BatchEdit:
+		operation.Edit.Id = operation.Id
+		return operation.Id, m.editTask(userId, operation.Edit, operation.IfMatch)
+	case types.BatchComplete:
+		return operation.Id, m.markTaskCompleted(userId, taskId, operation.Cascade, operation.IfMatch)
+	case types.BatchUncomplete:
+		return operation.Id, m.markTaskIncomplete(userId, taskId, operation.IfMatch)
+	case types.BatchDelete:
+		return operation.Id, m.deleteTask(userId, taskId, operation.IfMatch)
+	}
+	return operation.Id, InvalidBatchOperationError
+}
+
+func (m *MemoryStore) RunBatch(userId string, operations []types.BatchOperation, atomic bool) ([]types.BatchOutcome, error) {
+	outcomes := make([]types.BatchOutcome, len(operations))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := m.snapshot(userId)
+	for i, operation := range operations {
+		before := start
+		if !atomic {
+			before = m.snapshot(userId)
+		}
+
+		outcomes[i].Id, outcomes[i].Err = m.runOperation(userId, operation)
+		if outcomes[i].Err == nil {
+			continue
+		}
+
+		m.restore(userId, before)
+		if atomic {
+			abortBatch(outcomes, i)
+			break
+		}
+	}
+	return outcomes, nil
+}
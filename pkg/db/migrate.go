@@ -0,0 +1,242 @@
+package db
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/<driver>/<version>_<name>.(up|down).sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var NoMigratorError = errors.New("The configured database driver does not support migrations")
+
+// Migrator is implemented by stores that keep their schema in a database
+type Migrator interface {
+	Migrate() (int, error)
+	Rollback(steps int) (int, error)
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+var _ Migrator = (*DB)(nil)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+func (db *DB) migrations() ([]migration, error) {
+	dir := path.Join("migrations", db.driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(fileName, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("Invalid migration file name %s", fileName)
+		}
+
+		versionString, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionString)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid migration version in %s", fileName)
+		}
+
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	var result []migration
+	for _, m := range byVersion {
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].version < result[j].version })
+	return result, nil
+}
+
+// Splits a migration file into single statements, the mysql driver will not run several at once
+func splitStatements(contents string) []string {
+	var lines []string
+	for _, line := range strings.Split(contents, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";\n") {
+		statement = strings.TrimSuffix(strings.TrimSpace(statement), ";")
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+func (db *DB) ensureMigrationsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INTEGER NOT NULL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`
+	_, err := db.conn.Exec(query)
+	return err
+}
+
+func (db *DB) appliedMigrations() (map[int]time.Time, error) {
+	result := map[int]time.Time{}
+	if err := db.ensureMigrationsTable(); err != nil {
+		return result, err
+	}
+
+	rows, err := db.conn.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return result, err
+		}
+		result[version] = appliedAt
+	}
+	return result, rows.Err()
+}
+
+// Runs the statements and records the new schema version together, note that mysql
+// commits ddl statements implicitly so a failed mysql migration may be partially applied
+func (db *DB) runMigration(statements string, record string, args ...any) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range splitStatements(statements) {
+		if _, err = tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	if _, err = tx.Exec(record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Migrate applies every pending migration in order and returns how many were applied
+func (db *DB) Migrate() (int, error) {
+	migrations, err := db.migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		err = db.runMigration(m.up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+		if err != nil {
+			return count, fmt.Errorf("Migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Rollback reverts the latest applied migrations and returns how many were reverted
+func (db *DB) Rollback(steps int) (int, error) {
+	migrations, err := db.migrations()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+
+		err = db.runMigration(m.down, "DELETE FROM schema_migrations WHERE version = ?", m.version)
+		if err != nil {
+			return count, fmt.Errorf("Rollback of migration %d (%s) failed: %w", m.version, m.name, err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// MigrationStatus lists every known migration, AppliedAt is nil for pending ones
+func (db *DB) MigrationStatus() ([]MigrationStatus, error) {
+	var result []MigrationStatus
+
+	migrations, err := db.migrations()
+	if err != nil {
+		return result, err
+	}
+
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return result, err
+	}
+
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.version, Name: m.name}
+		if appliedAt, ok := applied[m.version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
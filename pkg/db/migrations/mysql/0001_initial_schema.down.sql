@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS forgot_password_requests;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS tasks;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS users (
+	id CHAR(36) NOT NULL DEFAULT (UUID()),
+	email VARCHAR(255) NOT NULL,
+	password VARCHAR(255) NOT NULL DEFAULT '',
+	account_type VARCHAR(32) NOT NULL DEFAULT '',
+	added_tasks INT NOT NULL DEFAULT 0,
+	monthly_api_key_usage INT NOT NULL DEFAULT 0,
+	profile_photo INT NOT NULL DEFAULT 0,
+	last_accessed DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id),
+	UNIQUE KEY users_email (email)
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	user_id CHAR(36) NOT NULL,
+	id INT NOT NULL,
+	title VARCHAR(255) NOT NULL,
+	body TEXT,
+	due DATETIME,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	priority SMALLINT NOT NULL DEFAULT 0,
+	completed BOOLEAN NOT NULL DEFAULT FALSE,
+	completed_date DATETIME,
+	PRIMARY KEY (user_id, id),
+	CONSTRAINT tasks_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id INT NOT NULL AUTO_INCREMENT,
+	user_id CHAR(36) NOT NULL,
+	label VARCHAR(255) NOT NULL,
+	description VARCHAR(1024) NOT NULL DEFAULT '',
+	api_key VARCHAR(64) NOT NULL,
+	expiration DATETIME,
+	last_used DATETIME,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id),
+	UNIQUE KEY api_keys_api_key (api_key),
+	CONSTRAINT api_keys_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS forgot_password_requests (
+	id INT NOT NULL AUTO_INCREMENT,
+	user_id CHAR(36) NOT NULL,
+	token VARCHAR(64) NOT NULL,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id),
+	CONSTRAINT forgot_password_requests_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
@@ -0,0 +1,18 @@
+CREATE TABLE tags (
+	id INT NOT NULL AUTO_INCREMENT,
+	user_id CHAR(36) NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE KEY tags_user_name (user_id, name),
+	CONSTRAINT tags_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+CREATE TABLE task_tags (
+	user_id CHAR(36) NOT NULL,
+	task_id INT NOT NULL,
+	tag_id INT NOT NULL,
+	PRIMARY KEY (user_id, task_id, tag_id),
+	KEY task_tags_tag (tag_id),
+	CONSTRAINT task_tags_task FOREIGN KEY (user_id, task_id) REFERENCES tasks (user_id, id) ON DELETE CASCADE,
+	CONSTRAINT task_tags_tag FOREIGN KEY (tag_id) REFERENCES tags (id) ON DELETE CASCADE
+);
@@ -0,0 +1,5 @@
+ALTER TABLE tasks
+	DROP FOREIGN KEY tasks_project,
+	DROP COLUMN project_id;
+
+DROP TABLE IF EXISTS projects;
@@ -0,0 +1,15 @@
+CREATE TABLE projects (
+	id INT NOT NULL AUTO_INCREMENT,
+	user_id CHAR(36) NOT NULL,
+	name VARCHAR(255) NOT NULL,
+	color VARCHAR(7) NOT NULL DEFAULT '',
+	archived BOOLEAN NOT NULL DEFAULT FALSE,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id),
+	UNIQUE KEY projects_user_name (user_id, name),
+	CONSTRAINT projects_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
+
+ALTER TABLE tasks
+	ADD COLUMN project_id INT,
+	ADD CONSTRAINT tasks_project FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE SET NULL;
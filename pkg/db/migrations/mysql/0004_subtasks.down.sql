@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS checklist_items;
+
+ALTER TABLE tasks
+	DROP FOREIGN KEY tasks_parent,
+	DROP COLUMN parent_id;
@@ -0,0 +1,14 @@
+ALTER TABLE tasks
+	ADD COLUMN parent_id INT,
+	ADD CONSTRAINT tasks_parent FOREIGN KEY (user_id, parent_id) REFERENCES tasks (user_id, id) ON DELETE CASCADE;
+
+CREATE TABLE checklist_items (
+	id INT NOT NULL AUTO_INCREMENT,
+	user_id CHAR(36) NOT NULL,
+	task_id INT NOT NULL,
+	title VARCHAR(255) NOT NULL,
+	checked BOOLEAN NOT NULL DEFAULT FALSE,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id),
+	CONSTRAINT checklist_items_task FOREIGN KEY (user_id, task_id) REFERENCES tasks (user_id, id) ON DELETE CASCADE
+);
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS task_tombstones;
+
+ALTER TABLE tasks
+	DROP INDEX tasks_revision,
+	DROP COLUMN revision,
+	DROP COLUMN created_revision,
+	DROP COLUMN updated_at;
+
+ALTER TABLE users DROP COLUMN revision;
@@ -0,0 +1,21 @@
+-- revision is a per user counter bumped by every change, it orders changes in commit order for
+-- delta sync. Tasks keep the revision of their creation and of their latest change
+ALTER TABLE users ADD COLUMN revision BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE tasks
+	ADD COLUMN updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	ADD COLUMN created_revision BIGINT NOT NULL DEFAULT 0,
+	ADD COLUMN revision BIGINT NOT NULL DEFAULT 0,
+	ADD INDEX tasks_revision (user_id, revision);
+
+UPDATE tasks SET updated_at = time_created;
+
+CREATE TABLE task_tombstones (
+	user_id CHAR(36) NOT NULL,
+	task_id INT NOT NULL,
+	revision BIGINT NOT NULL,
+	deleted_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, task_id),
+	KEY task_tombstones_revision (user_id, revision),
+	CONSTRAINT task_tombstones_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
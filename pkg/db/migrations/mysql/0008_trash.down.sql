@@ -0,0 +1,5 @@
+DELETE FROM tasks WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE tasks
+	DROP INDEX tasks_deleted,
+	DROP COLUMN deleted_at;
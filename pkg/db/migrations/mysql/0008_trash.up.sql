@@ -0,0 +1,4 @@
+-- Deleted tasks stay in the trash until they are restored or purged
+ALTER TABLE tasks
+	ADD COLUMN deleted_at DATETIME NULL,
+	ADD INDEX tasks_deleted (deleted_at);
@@ -0,0 +1,14 @@
+-- Site logins, each holds the hash of its current refresh token. The token it replaced is kept
+-- so a rotated out token that gets used again can revoke the session
+CREATE TABLE sessions (
+	id VARCHAR(64) NOT NULL,
+	user_id CHAR(36) NOT NULL,
+	refresh_token VARCHAR(64) NOT NULL,
+	previous_refresh_token VARCHAR(64) NULL,
+	expires_at DATETIME NOT NULL,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (id),
+	UNIQUE KEY sessions_refresh_token (refresh_token),
+	KEY sessions_previous_refresh_token (previous_refresh_token),
+	CONSTRAINT sessions_user FOREIGN KEY (user_id) REFERENCES users (id)
+);
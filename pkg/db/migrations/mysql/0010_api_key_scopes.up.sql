@@ -0,0 +1,2 @@
+-- Space separated scopes, keys created before scopes existed keep full access
+ALTER TABLE api_keys ADD COLUMN scopes VARCHAR(255) NOT NULL DEFAULT 'tasks:read tasks:write tasks:delete';
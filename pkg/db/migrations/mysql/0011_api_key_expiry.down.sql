@@ -0,0 +1,3 @@
+ALTER TABLE api_keys
+	DROP INDEX api_keys_expiration,
+	DROP COLUMN expiry_notified_at;
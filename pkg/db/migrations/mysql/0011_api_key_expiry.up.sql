@@ -0,0 +1,4 @@
+-- Owners are emailed once when a key is about to expire
+ALTER TABLE api_keys
+	ADD COLUMN expiry_notified_at DATETIME NULL,
+	ADD INDEX api_keys_expiration (expiration);
@@ -0,0 +1,42 @@
+CREATE TABLE IF NOT EXISTS users (
+	id TEXT PRIMARY KEY DEFAULT (lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' || substr('89ab', 1 + (abs(random()) % 4), 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))),
+	email TEXT NOT NULL UNIQUE,
+	password TEXT NOT NULL DEFAULT '',
+	account_type TEXT NOT NULL DEFAULT '',
+	added_tasks INTEGER NOT NULL DEFAULT 0,
+	monthly_api_key_usage INTEGER NOT NULL DEFAULT 0,
+	profile_photo INTEGER NOT NULL DEFAULT 0,
+	last_accessed DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS tasks (
+	user_id TEXT NOT NULL REFERENCES users (id),
+	id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	body TEXT,
+	due DATETIME,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	priority INTEGER NOT NULL DEFAULT 0,
+	completed BOOLEAN NOT NULL DEFAULT 0,
+	completed_date DATETIME,
+	PRIMARY KEY (user_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL REFERENCES users (id),
+	label TEXT NOT NULL,
+	description TEXT NOT NULL DEFAULT '',
+	api_key TEXT NOT NULL UNIQUE,
+	expiration DATETIME,
+	last_used DATETIME,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS forgot_password_requests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL REFERENCES users (id),
+	token TEXT NOT NULL,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
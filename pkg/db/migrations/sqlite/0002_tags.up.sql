@@ -0,0 +1,16 @@
+CREATE TABLE tags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL REFERENCES users (id),
+	name TEXT NOT NULL,
+	UNIQUE (user_id, name)
+);
+
+CREATE TABLE task_tags (
+	user_id TEXT NOT NULL,
+	task_id INTEGER NOT NULL,
+	tag_id INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+	PRIMARY KEY (user_id, task_id, tag_id),
+	FOREIGN KEY (user_id, task_id) REFERENCES tasks (user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX task_tags_tag ON task_tags (tag_id);
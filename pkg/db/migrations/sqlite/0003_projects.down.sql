@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS tasks_project;
+
+ALTER TABLE tasks DROP COLUMN project_id;
+
+DROP TABLE IF EXISTS projects;
@@ -0,0 +1,15 @@
+CREATE TABLE projects (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL REFERENCES users (id),
+	name TEXT NOT NULL,
+	color TEXT NOT NULL DEFAULT '',
+	archived BOOLEAN NOT NULL DEFAULT FALSE,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, name)
+);
+
+-- No foreign key here, sqlite cannot drop a column that has one. Deleting a project
+-- unassigns its tasks in DeleteProject instead
+ALTER TABLE tasks ADD COLUMN project_id INTEGER;
+
+CREATE INDEX tasks_project ON tasks (project_id);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS checklist_items;
+
+DROP INDEX IF EXISTS tasks_parent;
+
+ALTER TABLE tasks DROP COLUMN parent_id;
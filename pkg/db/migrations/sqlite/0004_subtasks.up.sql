@@ -0,0 +1,17 @@
+-- No foreign key here, sqlite cannot drop a column that has one. DeleteTask removes
+-- subtasks itself
+ALTER TABLE tasks ADD COLUMN parent_id INTEGER;
+
+CREATE INDEX tasks_parent ON tasks (user_id, parent_id);
+
+CREATE TABLE checklist_items (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id TEXT NOT NULL,
+	task_id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	checked BOOLEAN NOT NULL DEFAULT FALSE,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id, task_id) REFERENCES tasks (user_id, id) ON DELETE CASCADE
+);
+
+CREATE INDEX checklist_items_task ON checklist_items (user_id, task_id);
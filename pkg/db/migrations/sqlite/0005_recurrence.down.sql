@@ -0,0 +1,3 @@
+ALTER TABLE tasks DROP COLUMN recurrence;
+
+ALTER TABLE tasks DROP COLUMN occurrence;
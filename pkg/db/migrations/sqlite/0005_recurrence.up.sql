@@ -0,0 +1,3 @@
+ALTER TABLE tasks ADD COLUMN recurrence TEXT;
+
+ALTER TABLE tasks ADD COLUMN occurrence INTEGER NOT NULL DEFAULT 0;
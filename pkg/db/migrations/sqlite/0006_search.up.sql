@@ -0,0 +1,16 @@
+-- Mirrors the title and body of every task, the triggers keep it in sync. Trigger bodies stay on
+-- one line since migrations are split into statements at the end of each line
+CREATE VIRTUAL TABLE tasks_search USING fts5 (
+	user_id UNINDEXED,
+	task_id UNINDEXED,
+	title,
+	body
+);
+
+INSERT INTO tasks_search (user_id, task_id, title, body) SELECT user_id, id, title, body FROM tasks;
+
+CREATE TRIGGER tasks_search_insert AFTER INSERT ON tasks BEGIN INSERT INTO tasks_search (user_id, task_id, title, body) VALUES (new.user_id, new.id, new.title, new.body); END;
+
+CREATE TRIGGER tasks_search_update AFTER UPDATE OF title, body ON tasks BEGIN UPDATE tasks_search SET title = new.title, body = new.body WHERE user_id = old.user_id AND task_id = old.id; END;
+
+CREATE TRIGGER tasks_search_delete AFTER DELETE ON tasks BEGIN DELETE FROM tasks_search WHERE user_id = old.user_id AND task_id = old.id; END;
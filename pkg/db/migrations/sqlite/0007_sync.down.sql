@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS task_tombstones;
+
+DROP INDEX IF EXISTS tasks_revision;
+
+ALTER TABLE tasks DROP COLUMN revision;
+
+ALTER TABLE tasks DROP COLUMN created_revision;
+
+ALTER TABLE tasks DROP COLUMN updated_at;
+
+ALTER TABLE users DROP COLUMN revision;
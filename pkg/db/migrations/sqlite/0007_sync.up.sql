@@ -0,0 +1,24 @@
+-- revision is a per user counter bumped by every change, it orders changes in commit order for
+-- delta sync. Tasks keep the revision of their creation and of their latest change
+ALTER TABLE users ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+
+-- Sqlite cannot add a column defaulting to CURRENT_TIMESTAMP, inserts set it instead
+ALTER TABLE tasks ADD COLUMN updated_at DATETIME;
+
+ALTER TABLE tasks ADD COLUMN created_revision INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE tasks ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;
+
+UPDATE tasks SET updated_at = time_created;
+
+CREATE INDEX tasks_revision ON tasks (user_id, revision);
+
+CREATE TABLE task_tombstones (
+	user_id TEXT NOT NULL REFERENCES users (id),
+	task_id INTEGER NOT NULL,
+	revision INTEGER NOT NULL,
+	deleted_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, task_id)
+);
+
+CREATE INDEX task_tombstones_revision ON task_tombstones (user_id, revision);
@@ -0,0 +1,5 @@
+DELETE FROM tasks WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS tasks_deleted;
+
+ALTER TABLE tasks DROP COLUMN deleted_at;
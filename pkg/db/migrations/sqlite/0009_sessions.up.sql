@@ -0,0 +1,14 @@
+-- Site logins, each holds the hash of its current refresh token. The token it replaced is kept
+-- so a rotated out token that gets used again can revoke the session
+CREATE TABLE sessions (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL REFERENCES users (id),
+	refresh_token TEXT NOT NULL UNIQUE,
+	previous_refresh_token TEXT,
+	expires_at DATETIME NOT NULL,
+	time_created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX sessions_user ON sessions (user_id);
+
+CREATE INDEX sessions_previous_refresh_token ON sessions (previous_refresh_token);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS api_keys_expiration;
+
+ALTER TABLE api_keys DROP COLUMN expiry_notified_at;
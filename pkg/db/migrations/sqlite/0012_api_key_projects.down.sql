@@ -0,0 +1,4 @@
+ALTER TABLE api_keys DROP COLUMN project_id;
+
+UPDATE api_keys SET scopes = 'tasks:read tasks:write tasks:delete'
+WHERE scopes = 'tasks:read tasks:write tasks:delete tags:write checklist:read checklist:write projects:read projects:write projects:delete';
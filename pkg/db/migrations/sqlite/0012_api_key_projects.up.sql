@@ -0,0 +1,6 @@
+-- Keys holding every scope keep full access now that projects, checklists and tags have their own
+UPDATE api_keys SET scopes = 'tasks:read tasks:write tasks:delete tags:write checklist:read checklist:write projects:read projects:write projects:delete'
+WHERE scopes = 'tasks:read tasks:write tasks:delete';
+
+-- Keys restricted to a project only reach the tasks in it, deleting the project revokes them
+ALTER TABLE api_keys ADD COLUMN project_id INTEGER;
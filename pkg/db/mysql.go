@@ -0,0 +1,32 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const uniqueConstraintErrorId = 1062
+
+func (db *DB) connectMySQL() error {
+	if db.config.Password == "" {
+		return errors.New("No password found")
+	}
+
+	dbPath := fmt.Sprintf("%s:%s@tcp(%s:%s)/jason?parseTime=true", db.config.User, db.config.Password, db.config.Host, db.config.Port)
+
+	connection, err := sql.Open("mysql", dbPath)
+	if err != nil {
+		return err
+	}
+
+	db.conn = connection
+	return db.conn.Ping()
+}
+
+func isMySQLUniqueConstraintError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == uniqueConstraintErrorId
+}
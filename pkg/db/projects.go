@@ -0,0 +1,284 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+const maxProjectNameLength = 255
+
+var (
+	NoProjectsFoundError             = errors.New("No project found")
+	InvalidProjectNameError          = errors.New("Project names must be between 1 and 255 characters long")
+	InvalidProjectColorError         = errors.New("Project colors must be hex colors like #1a2b3c")
+	ArchivedProjectError             = errors.New("Tasks cannot be added to an archived project")
+	ProjectUniquenessConstraintError = errors.New("There is already a project with this name")
+)
+
+var projectColor = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+func normalizeProjectName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxProjectNameLength {
+		return name, InvalidProjectNameError
+	}
+	return name, nil
+}
+
+// An empty color is allowed and means the client picks one
+func normalizeProjectColor(color string) (string, error) {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if color != "" && !projectColor.MatchString(color) {
+		return color, InvalidProjectColorError
+	}
+	return color, nil
+}
+
+func projectArchived(tx *sql.Tx, userId string, projectId any) (bool, error) {
+	var archived bool
+	err := tx.QueryRow("SELECT archived FROM projects WHERE user_id = ? AND id = ?", userId, projectId).Scan(&archived)
+	if err == sql.ErrNoRows {
+		return archived, NoProjectsFoundError
+	}
+	return archived, err
+}
+
+// Ensures tasks can be put in the project
+func checkProject(tx *sql.Tx, userId string, projectId int) error {
+	archived, err := projectArchived(tx, userId, projectId)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return ArchivedProjectError
+	}
+	return nil
+}
+
+func (db *DB) AddProject(uuid string, project types.ProjectPayload) (int, error) {
+	name, err := normalizeProjectName(project.Name)
+	if err != nil {
+		return 0, err
+	}
+	color, err := normalizeProjectColor(project.Color)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := db.conn.Prepare("INSERT INTO projects (user_id, name, color) VALUES (?, ?, ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	result, err := stmt.Exec(uuid, name, color)
+	if err != nil {
+		if db.isUniqueConstraintError(err) {
+			return 0, ProjectUniquenessConstraintError
+		}
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+const projectQuery = `SELECT p.id, p.name, p.color, p.archived, p.time_created, COUNT(t.id)
+	FROM projects p
+	LEFT JOIN tasks t ON t.user_id = p.user_id AND t.project_id = p.id AND t.deleted_at IS NULL
+	WHERE p.user_id = ?`
+
+const projectGroupBy = " GROUP BY p.id, p.name, p.color, p.archived, p.time_created"
+
+func scanProject(row scanner, project *types.ProjectResponse) error {
+	return row.Scan(&project.Id, &project.Name, &project.Color, &project.Archived, &project.TimeCreated, &project.TaskCount)
+}
+
+func (db *DB) GetProjectById(uuid string, projectId string) (types.ProjectResponse, error) {
+	var project types.ProjectResponse
+
+	stmt, err := db.conn.Prepare(projectQuery + " AND p.id = ?" + projectGroupBy)
+	if err != nil {
+		return project, err
+	}
+	defer stmt.Close()
+
+	err = scanProject(stmt.QueryRow(uuid, projectId), &project)
+	if err == sql.ErrNoRows {
+		return project, NoProjectsFoundError
+	}
+	return project, err
+}
+
+func (db *DB) GetAllProjects(uuid string, includeArchived bool) ([]types.ProjectResponse, error) {
+	var projects []types.ProjectResponse
+
+	query := projectQuery
+	if !includeArchived {
+		query += " AND p.archived = false"
+	}
+	query += projectGroupBy + " ORDER BY p.name"
+
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return projects, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(uuid)
+	if err != nil {
+		return projects, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var project types.ProjectResponse
+		if err = scanProject(rows, &project); err != nil {
+			return projects, err
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+func (db *DB) EditProject(uuid string, projectId string, project types.EditProjectPayload) error {
+	var payloads []any
+	var sets []string
+
+	if project.Name != "" {
+		name, err := normalizeProjectName(project.Name)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, "name = ?")
+		payloads = append(payloads, name)
+	}
+
+	if project.Color != "" {
+		color, err := normalizeProjectColor(project.Color)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, "color = ?")
+		payloads = append(payloads, color)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = projectArchived(tx, uuid, projectId); err != nil {
+		return err
+	}
+
+	if len(sets) > 0 {
+		query := "UPDATE projects SET " + strings.Join(sets, ", ") + " WHERE user_id = ? AND id = ?"
+		_, err = tx.Exec(query, append(payloads, uuid, projectId)...)
+		if db.isUniqueConstraintError(err) {
+			return ProjectUniquenessConstraintError
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *DB) SetProjectArchived(uuid string, projectId string, archived bool) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = projectArchived(tx, uuid, projectId); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE projects SET archived = ? WHERE user_id = ? AND id = ?", archived, uuid, projectId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteProject keeps the project's tasks, they are moved out of it
+func (db *DB) DeleteProject(uuid string, projectId string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = projectArchived(tx, uuid, projectId); err != nil {
+		return err
+	}
+
+	ids, err := queryIds(tx, "SELECT id FROM tasks WHERE user_id = ? AND project_id = ? AND deleted_at IS NULL", uuid, projectId)
+	if err != nil {
+		return err
+	}
+	if err = db.touchTasks(tx, uuid, ids...); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET project_id = NULL WHERE user_id = ? AND project_id = ?", uuid, projectId)
+	if err != nil {
+		return err
+	}
+
+	// Keys restricted to the project would have nothing left to reach
+	_, err = tx.Exec("DELETE FROM api_keys WHERE user_id = ? AND project_id = ?", uuid, projectId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM projects WHERE user_id = ? AND id = ?", uuid, projectId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// MoveTask puts the task in the project, or takes it out of its project when projectId is nil
+func (db *DB) MoveTask(userId string, taskId string, projectId *int, ifMatch []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return 0, err
+	}
+
+	if projectId != nil {
+		if err = checkProject(tx, userId, *projectId); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET project_id = ? WHERE user_id = ? AND id = ?", projectId, userId, id)
+	if err != nil {
+		return 0, err
+	}
+	if err = db.touchTasks(tx, userId, id); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, id)
+	if err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit()
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func projectNames(t *testing.T, store Store, uuid string, includeArchived bool) []string {
+	t.Helper()
+
+	projects, err := store.GetAllProjects(uuid, includeArchived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, project := range projects {
+		names = append(names, project.Name)
+	}
+	return names
+}
+
+func TestProjects(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+
+		workId, err := store.AddProject(uuid, types.ProjectPayload{Name: "  Work ", Color: "#AABBCC"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		work, err := store.GetProjectById(uuid, strconv.Itoa(workId))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if work.Name != "Work" || work.Color != "#aabbcc" || work.Archived || work.TaskCount != 0 {
+			t.Fatalf("got project %+v", work)
+		}
+		homeId, err := store.AddProject(uuid, types.ProjectPayload{Name: "Home"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		invalid := map[types.ProjectPayload]error{
+			{Name: " "}:                    InvalidProjectNameError,
+			{Name: "Garden", Color: "red"}: InvalidProjectColorError,
+			{Name: "Work"}:                 ProjectUniquenessConstraintError,
+		}
+		for payload, expected := range invalid {
+			if _, err = store.AddProject(uuid, payload); !errors.Is(err, expected) {
+				t.Fatalf("got %v adding %+v", err, payload)
+			}
+		}
+
+		if err = store.EditProject(uuid, strconv.Itoa(homeId), types.EditProjectPayload{Name: "Work"}); !errors.Is(err, ProjectUniquenessConstraintError) {
+			t.Fatalf("got %v renaming onto an existing project", err)
+		}
+		if err = store.EditProject(uuid, "100", types.EditProjectPayload{Name: "Garden"}); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v editing an unknown project", err)
+		}
+		if err = store.EditProject(uuid, strconv.Itoa(homeId), types.EditProjectPayload{Color: "#123456"}); err != nil {
+			t.Fatal(err)
+		}
+		home, err := store.GetProjectById(uuid, strconv.Itoa(homeId))
+		if err != nil || home.Name != "Home" || home.Color != "#123456" {
+			t.Fatalf("got project %+v: %v", home, err)
+		}
+		if names := projectNames(t, store, uuid, false); !slices.Equal(names, []string{"Home", "Work"}) {
+			t.Fatalf("got projects %v", names)
+		}
+
+		// Another user's projects are out of reach
+		other := addUser(t, store, "someone.else@example.com")
+		if _, err = store.GetProjectById(other, strconv.Itoa(workId)); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v reading another user's project", err)
+		}
+		theirs := addTask(t, store, other, "theirs")
+		if _, err = store.MoveTask(other, strconv.Itoa(theirs), &workId, nil); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v moving into another user's project", err)
+		}
+	})
+}
+
+func TestArchivedProjects(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		projectId, err := store.AddProject(uuid, types.ProjectPayload{Name: "Work"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inside, err := store.AddNewTask(types.NewTaskPayload{Title: "inside", ProjectId: &projectId}, uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outside := addTask(t, store, uuid, "outside")
+
+		if err = store.SetProjectArchived(uuid, strconv.Itoa(projectId), true); err != nil {
+			t.Fatal(err)
+		}
+		if names := projectNames(t, store, uuid, false); len(names) != 0 {
+			t.Fatalf("got archived projects %v", names)
+		}
+		if names := projectNames(t, store, uuid, true); !slices.Equal(names, []string{"Work"}) {
+			t.Fatalf("got projects %v including archived ones", names)
+		}
+
+		// Nothing new goes into an archived project, but its tasks can leave
+		if _, err = store.MoveTask(uuid, strconv.Itoa(outside), &projectId, nil); !errors.Is(err, ArchivedProjectError) {
+			t.Fatalf("got %v moving into an archived project", err)
+		}
+		if _, err = store.AddNewTask(types.NewTaskPayload{Title: "new", ProjectId: &projectId}, uuid); !errors.Is(err, ArchivedProjectError) {
+			t.Fatalf("got %v adding to an archived project", err)
+		}
+		if project := readTask(t, store, uuid, outside).ProjectId; project.Valid {
+			t.Fatalf("a refused move left the task in project %d", project.Int64)
+		}
+		if _, err = store.MoveTask(uuid, strconv.Itoa(inside), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = store.SetProjectArchived(uuid, strconv.Itoa(projectId), false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.MoveTask(uuid, strconv.Itoa(outside), &projectId, nil); err != nil {
+			t.Fatal(err)
+		}
+		if project := readTask(t, store, uuid, outside).ProjectId; !project.Valid || int(project.Int64) != projectId {
+			t.Fatalf("got project %+v after moving", project)
+		}
+		if err = store.SetProjectArchived(uuid, "100", true); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v archiving an unknown project", err)
+		}
+	})
+}
+
+func TestDeleteProject(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		projectId, err := store.AddProject(uuid, types.ProjectPayload{Name: "Work"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keptId, err := store.AddProject(uuid, types.ProjectPayload{Name: "Home"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var inside []int
+		for _, title := range []string{"first", "second"} {
+			id, err := store.AddNewTask(types.NewTaskPayload{Title: title, ProjectId: &projectId}, uuid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inside = append(inside, id)
+		}
+		kept, err := store.AddNewTask(types.NewTaskPayload{Title: "kept", ProjectId: &keptId}, uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		project, err := store.GetProjectById(uuid, strconv.Itoa(projectId))
+		if err != nil || project.TaskCount != 2 {
+			t.Fatalf("got project %+v: %v", project, err)
+		}
+
+		if err = store.AddApiKey(uuid, "restricted", types.ApiKeyPayload{Label: "restricted", ProjectId: &projectId}); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.AddApiKey(uuid, "other", types.ApiKeyPayload{Label: "other", ProjectId: &keptId}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = store.DeleteProject(uuid, strconv.Itoa(projectId)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.GetProjectById(uuid, strconv.Itoa(projectId)); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v reading a deleted project", err)
+		}
+		if err = store.DeleteProject(uuid, strconv.Itoa(projectId)); !errors.Is(err, NoProjectsFoundError) {
+			t.Fatalf("got %v deleting a deleted project", err)
+		}
+
+		// The tasks stay, outside of any project
+		for _, id := range inside {
+			if project := readTask(t, store, uuid, id).ProjectId; project.Valid {
+				t.Fatalf("task %d is still in project %d", id, project.Int64)
+			}
+		}
+		if project := readTask(t, store, uuid, kept).ProjectId; !project.Valid || int(project.Int64) != keptId {
+			t.Fatalf("a task of another project moved to %+v", project)
+		}
+
+		// Only the keys restricted to the deleted project are revoked
+		if _, _, err = store.GetApiKeyOwner("restricted"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got %v for a key of the deleted project", err)
+		}
+		if _, _, err = store.GetApiKeyOwner("other"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
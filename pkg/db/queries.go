@@ -3,19 +3,29 @@ package db
 import (
 	"database/sql"
 	"errors"
-	"fmt"
+	"strings"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/senyc/jason/pkg/types"
 )
 
 var (
 	NoTasksFoundError                = errors.New("No tasks found")
+	EmptyEditError                   = errors.New("Edits need to change at least one field")
+	InvalidTitleError                = errors.New("Tasks need a title")
 	NewUserUniquenessConstraintError = errors.New("There is already an account with this email, please use another or login")
 )
 
-const uniqueConstraintErrorId = 1062
+// Columns scanned by scanTask, in order
+const taskColumns = "id, title, body, due, time_created, priority, completed, completed_date, project_id, parent_id, recurrence, occurrence, updated_at, created_revision, revision, deleted_at"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTask(row scanner, task *types.SqlTasksRow) error {
+	return row.Scan(&task.Id, &task.Title, &task.Body, &task.Due, &task.TimeCreated, &task.Priority, &task.Completed, &task.CompletedDate, &task.ProjectId, &task.ParentId, &task.Recurrence, &task.Occurrence, &task.UpdatedAt, &task.CreatedRevision, &task.Revision, &task.DeletedAt)
+}
 
 func (db *DB) GetAddedTasksCount(userId string) (int, error) {
 	var addedTasksCount int
@@ -33,48 +43,134 @@ func (db *DB) GetAddedTasksCount(userId string) (int, error) {
 	return addedTasksCount, err
 }
 
-func (db *DB) AddNewTask(newTask types.NewTaskPayload, userId string) error {
-	query := "INSERT INTO tasks (user_id, id, title, body, priority, due) VALUES (?, ?, ?, ?, ?, ?)"
-	stmt, err := db.conn.Prepare(query)
+// Reserves the next per user task id, on mysql the users row stays locked until the transaction
+// ends and sqlite transactions are opened immediate, so concurrent callers are serialized
+func (db *DB) allocateTaskId(tx *sql.Tx, userId string) (int, error) {
+	var addedTasksCount, nextFreeId int
+
+	query := "SELECT added_tasks FROM users WHERE id = ?"
+	if db.driver == MySQL {
+		query += " FOR UPDATE"
+	}
+	err := tx.QueryRow(query, userId).Scan(&addedTasksCount)
+	if err == sql.ErrNoRows {
+		return addedTasksCount, NoTasksFoundError
+	}
 	if err != nil {
-		return err
+		return addedTasksCount, err
+	}
+
+	// Guards against a counter that has fallen behind the ids already in use
+	err = tx.QueryRow("SELECT COALESCE(MAX(id) + 1, 0) FROM tasks WHERE user_id = ?", userId).Scan(&nextFreeId)
+	if err != nil {
+		return addedTasksCount, err
+	}
+	taskId := max(addedTasksCount, nextFreeId)
+
+	_, err = tx.Exec("UPDATE users SET added_tasks = ? WHERE id = ?", taskId+1, userId)
+	return taskId, err
+}
+
+func (db *DB) AddNewTask(newTask types.NewTaskPayload, userId string) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	taskId, err := db.addNewTask(tx, newTask, userId)
+	if err != nil {
+		return taskId, err
+	}
+	return taskId, tx.Commit()
+}
+
+func (db *DB) addNewTask(tx *sql.Tx, newTask types.NewTaskPayload, userId string) (int, error) {
+	rule, err := normalizeRecurrence(newTask.Recurrence, newTask.Due)
+	if err != nil {
+		return 0, err
 	}
-	defer stmt.Close()
 
 	// Gets monotonically increasing number of tasks that have been added for the user
-	taskId, err := db.GetAddedTasksCount(userId)
+	taskId, err := db.allocateTaskId(tx, userId)
 	if err != nil {
-		return err
+		return taskId, err
 	}
 
-	_, err = stmt.Exec(userId, taskId, newTask.Title, newTask.Body, newTask.Priority, newTask.Due)
-	return err
+	if newTask.ProjectId != nil {
+		if err = checkProject(tx, userId, *newTask.ProjectId); err != nil {
+			return taskId, err
+		}
+	}
+
+	if newTask.ParentId != nil {
+		if err = checkParent(tx, userId, *newTask.ParentId, 1); err != nil {
+			return taskId, err
+		}
+	}
+
+	revision, err := db.nextRevision(tx, userId)
+	if err != nil {
+		return taskId, err
+	}
+
+	query := `INSERT INTO tasks (user_id, id, title, body, priority, due, project_id, parent_id, recurrence, updated_at, created_revision, revision)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ` + db.now() + `, ?, ?)`
+	_, err = tx.Exec(query, userId, taskId, newTask.Title, newTask.Body, newTask.Priority, newTask.Due, newTask.ProjectId, newTask.ParentId, rule, revision, revision)
+	if err != nil {
+		return taskId, err
+	}
+
+	tags, err := normalizeTags(newTask.Tags)
+	if err != nil {
+		return taskId, err
+	}
+	return taskId, db.addTags(tx, userId, taskId, tags)
 }
 
 func (db *DB) GetTaskById(userId string, taskId string) (types.SqlTasksRow, error) {
 	var task types.SqlTasksRow
 
-	query := "SELECT id, title, body, due, time_created, priority, completed, completed_date FROM tasks WHERE user_id = ? AND id = ?"
+	query := "SELECT " + taskColumns + " FROM tasks WHERE user_id = ? AND id = ? AND deleted_at IS NULL"
 	stmt, err := db.conn.Prepare(query)
 	if err != nil {
 		return task, err
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(userId, taskId).Scan(&task.Id, &task.Title, &task.Body, &task.Due, &task.TimeCreated, &task.Priority, &task.Completed, &task.CompletedDate)
+	err = scanTask(stmt.QueryRow(userId, taskId), &task)
 	if err == sql.ErrNoRows {
 		return task, NoTasksFoundError
 	}
-	return task, err
+	if err != nil {
+		return task, err
+	}
+
+	task.Tags, err = db.getTaskTags(userId, task.Id)
+	if err != nil {
+		return task, err
+	}
+
+	tasks := []types.SqlTasksRow{task}
+	err = db.attachProgress(userId, tasks)
+	return tasks[0], err
 }
 
-func (db *DB) GetAllTasksByUser(uuid string) ([]types.SqlTasksRow, error) {
+// getTasks lists the user's tasks matching condition, which is appended to the WHERE clause
+func (db *DB) getTasks(uuid string, condition string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
 	var tasks []types.SqlTasksRow
 
-	query := `SELECT id, title, body, due, time_created, priority, completed, completed_date 
-	FROM tasks 
-	WHERE user_id = ? 
-	ORDER BY due ASC`
+	filterTags, err := normalizeTags(filter.Tags)
+	if err != nil {
+		return tasks, err
+	}
+	filter.Tags = filterTags
+
+	filterClause, filterArgs := db.taskFilterClause(uuid, filter)
+	orderClause, orderArgs := db.taskOrderClause(filter)
+	query := `SELECT ` + taskColumns + `
+	FROM tasks
+	WHERE user_id = ? AND deleted_at IS NULL` + condition + filterClause + orderClause
 
 	stmt, err := db.conn.Prepare(query)
 	if err != nil {
@@ -82,83 +178,110 @@ func (db *DB) GetAllTasksByUser(uuid string) ([]types.SqlTasksRow, error) {
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(uuid)
+	args := append([]any{uuid}, filterArgs...)
+	rows, err := stmt.Query(append(args, orderArgs...)...)
 	if err != nil {
 		// Handle empty row path
 		return tasks, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var row types.SqlTasksRow
-		err = rows.Scan(&row.Id, &row.Title, &row.Body, &row.Due, &row.TimeCreated, &row.Priority, &row.Completed, &row.CompletedDate)
-		if err != nil {
+		if err = scanTask(rows, &row); err != nil {
 			return tasks, err
 		}
 		tasks = append(tasks, row)
 	}
-	return tasks, nil
-}
+	if err = rows.Err(); err != nil {
+		return tasks, err
+	}
 
-func (db *DB) GetCompletedTasks(uuid string) ([]types.SqlTasksRow, error) {
-	var tasks []types.SqlTasksRow
+	if err = db.attachTags(uuid, tasks); err != nil {
+		return tasks, err
+	}
+	return tasks, db.attachProgress(uuid, tasks)
+}
+
+// taskFilterClause builds the extra conditions for a filter along with their arguments
+func (db *DB) taskFilterClause(uuid string, filter types.TaskFilter) (string, []any) {
+	var (
+		clause string
+		args   []any
+	)
+
+	if len(filter.Tags) > 0 {
+		clause += ` AND id IN (
+		SELECT tt.task_id FROM task_tags tt JOIN tags t ON t.id = tt.tag_id
+		WHERE tt.user_id = ? AND t.name IN (` + placeholders(len(filter.Tags)) + `)
+		GROUP BY tt.task_id
+		HAVING COUNT(*) = ?)`
+		args = append(args, uuid)
+		for _, tag := range filter.Tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(filter.Tags))
+	}
 
-	query := `SELECT id, title, body, due, time_created, priority, completed, completed_date 
-	FROM tasks 
-	WHERE user_id = ? AND completed = true 
-	ORDER BY due ASC`
+	if filter.ProjectId != nil {
+		clause += " AND project_id = ?"
+		args = append(args, *filter.ProjectId)
+	}
 
-	stmt, err := db.conn.Prepare(query)
-	if err != nil {
-		return tasks, err
+	if filter.ParentId != nil {
+		clause += " AND parent_id = ?"
+		args = append(args, *filter.ParentId)
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(uuid)
-	if err != nil {
-		// Handle empty row path
-		return tasks, err
+	if filter.MinPriority != nil {
+		clause += " AND priority >= ?"
+		args = append(args, *filter.MinPriority)
 	}
 
-	for rows.Next() {
-		var row types.SqlTasksRow
-		err = rows.Scan(&row.Id, &row.Title, &row.Body, &row.Due, &row.TimeCreated, &row.Priority, &row.Completed, &row.CompletedDate)
-		if err != nil {
-			return tasks, err
-		}
-		tasks = append(tasks, row)
+	if filter.MaxPriority != nil {
+		clause += " AND priority <= ?"
+		args = append(args, *filter.MaxPriority)
 	}
-	return tasks, nil
-}
-func (db *DB) GetIncompleteTasks(uuid string) ([]types.SqlTasksRow, error) {
-	var tasks []types.SqlTasksRow
 
-	query := `
-	SELECT id, title, body, due, time_created, priority, completed, completed_date 
-	FROM tasks 
-	WHERE user_id = ? AND completed = false 
-	ORDER BY due ASC`
+	// Null due dates fail every comparison, the zero time is what tasks added without one store
+	due, created := db.timeExpr("due"), db.timeExpr("time_created")
+	if filter.DueAfter != nil {
+		clause += " AND " + due + " >= " + db.timeExpr("?")
+		args = append(args, filter.DueAfter.UTC())
+	}
 
-	stmt, err := db.conn.Prepare(query)
-	if err != nil {
-		return tasks, err
+	if filter.DueBefore != nil {
+		clause += " AND " + due + " < " + db.timeExpr("?") + " AND " + due + " > " + db.timeExpr("?")
+		args = append(args, filter.DueBefore.UTC(), time.Time{})
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(uuid)
-	if err != nil {
-		// Handle empty row path
-		return tasks, err
+	if filter.CreatedAfter != nil {
+		clause += " AND " + created + " >= " + db.timeExpr("?")
+		args = append(args, filter.CreatedAfter.UTC())
 	}
 
-	for rows.Next() {
-		var row types.SqlTasksRow
-		err = rows.Scan(&row.Id, &row.Title, &row.Body, &row.Due, &row.TimeCreated, &row.Priority, &row.Completed, &row.CompletedDate)
-		if err != nil {
-			return tasks, err
-		}
-		tasks = append(tasks, row)
+	if filter.CreatedBefore != nil {
+		clause += " AND " + created + " < " + db.timeExpr("?")
+		args = append(args, filter.CreatedBefore.UTC())
 	}
-	return tasks, nil
+
+	return clause, args
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (db *DB) GetAllTasksByUser(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
+	return db.getTasks(uuid, "", filter)
+}
+
+func (db *DB) GetCompletedTasks(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
+	return db.getTasks(uuid, " AND completed = true", filter)
+}
+
+func (db *DB) GetIncompleteTasks(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error) {
+	return db.getTasks(uuid, " AND completed = false", filter)
 }
 
 func (db *DB) AddNewUser(newUser types.User) error {
@@ -171,99 +294,144 @@ func (db *DB) AddNewUser(newUser types.User) error {
 	defer stmt.Close()
 
 	_, err = stmt.Exec(newUser.Password, newUser.Email, newUser.AccountType)
-	if err != nil {
-		if mysqlErr, ok := err.(*mysql.MySQLError); ok {
-			if mysqlErr.Number == uniqueConstraintErrorId {
-				return NewUserUniquenessConstraintError
-			}
-		}
+	if err != nil && db.isUniqueConstraintError(err) {
+		return NewUserUniquenessConstraintError
 	}
 
 	return err
 }
 
-func (db *DB) MarkTaskCompleted(userId string, taskId string) error {
-	query := "UPDATE tasks SET completed = 1, completed_date = CURTIME() WHERE user_id = ? AND id = ?"
-	stmt, err := db.conn.Prepare(query)
+// MarkTaskCompleted completes the task, and with cascade every subtask below it that is not completed yet.
+// Recurring tasks spawn their next occurrence
+func (db *DB) MarkTaskCompleted(userId string, taskId string, cascade bool, ifMatch []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
+	if err = db.markTaskCompleted(tx, userId, taskId, cascade, ifMatch); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, taskId)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer stmt.Close()
+	return revision, tx.Commit()
+}
 
-	result, err := stmt.Exec(userId, taskId)
+func (db *DB) markTaskCompleted(tx *sql.Tx, userId string, taskId string, cascade bool, ifMatch []int64) error {
+	id, err := taskExists(tx, userId, taskId)
 	if err != nil {
 		return err
 	}
 
-	if v, _ := result.RowsAffected(); v == 0 {
-		return NoTasksFoundError
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return err
+	}
+
+	ids := []int{id}
+	if cascade {
+		if ids, _, err = subtree(tx, userId, id); err != nil {
+			return err
+		}
+	}
+
+	for i, subtaskId := range ids {
+		// Only the task itself gets a new completion date when it is already completed
+		if err = db.completeTask(tx, userId, subtaskId, i == 0); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (db *DB) MarkTaskIncomplete(userId string, taskId string) error {
-	query := "UPDATE tasks SET completed = 0, completed_date = NULL WHERE user_id = ? AND id = ?"
-	stmt, err := db.conn.Prepare(query)
+func (db *DB) MarkTaskIncomplete(userId string, taskId string, ifMatch []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
+	if err = db.markTaskIncomplete(tx, userId, taskId, ifMatch); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, taskId)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer stmt.Close()
+	return revision, tx.Commit()
+}
 
-	result, err := stmt.Exec(userId, taskId)
+func (db *DB) markTaskIncomplete(tx *sql.Tx, userId string, taskId string, ifMatch []int64) error {
+	id, err := taskExists(tx, userId, taskId)
 	if err != nil {
 		return err
 	}
 
-	if v, _ := result.RowsAffected(); v == 0 {
-		return NoTasksFoundError
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return err
 	}
 
-	return nil
+	_, err = tx.Exec("UPDATE tasks SET completed = 0, completed_date = NULL WHERE user_id = ? AND id = ?", userId, id)
+	if err != nil {
+		return err
+	}
+	return db.touchTasks(tx, userId, id)
 }
 
 func (db *DB) AddApiKey(uuid string, apiKey string, apiKeyMetadata types.ApiKeyPayload) error {
-	query := "INSERT INTO api_keys (user_id, label, description, api_key, expiration) VALUES (?, ?, ?, ?, ?)"
-
-	stmt, err := db.conn.Prepare(query)
+	scopes, err := normalizeScopes(apiKeyMetadata.Scopes)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(uuid, apiKeyMetadata.Label, apiKeyMetadata.Description, apiKey, apiKeyMetadata.Expiration)
-	return err
-}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-func (db *DB) GetApiKeyMetadata(encryptedApiKey string) (types.ApiKeyMetadata, error) {
-	var result types.ApiKeyMetadata
-	query := "SELECT label, id, description, expiration, last_used, time_created FROM api_keys WHERE api_key = ?"
+	if apiKeyMetadata.ProjectId != nil {
+		if _, err = projectArchived(tx, uuid, *apiKeyMetadata.ProjectId); err != nil {
+			return err
+		}
+	}
 
-	stmt, err := db.conn.Prepare(query)
+	query := "INSERT INTO api_keys (user_id, label, description, api_key, expiration, scopes, project_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err = tx.Exec(query, uuid, apiKeyMetadata.Label, apiKeyMetadata.Description, apiKey, apiKeyMetadata.Expiration, joinScopes(scopes), apiKeyMetadata.ProjectId)
 	if err != nil {
-		return result, err
+		return err
 	}
-	defer stmt.Close()
+	return tx.Commit()
+}
 
-	err = stmt.QueryRow(encryptedApiKey).Scan(&result.Label, &result.Id, &result.Description, &result.Expiration, &result.LastAccessed, &result.CreationDate)
+func (db *DB) GetApiKeyMetadata(encryptedApiKey string) (types.ApiKeyMetadata, error) {
+	_, result, err := db.GetApiKeyOwner(encryptedApiKey)
 	return result, err
 }
 
-func (db *DB) GetUserIdFromApiKey(apiKey string) (string, error) {
-	var userId string
-
-	query := "SELECT user_id FROM api_keys WHERE api_key = ?"
+func (db *DB) GetApiKeyOwner(encryptedApiKey string) (string, types.ApiKeyMetadata, error) {
+	var (
+		userId     string
+		result     types.ApiKeyMetadata
+		expiration sql.NullTime
+		scopes     string
+		projectId  sql.NullInt64
+	)
+	query := "SELECT user_id, label, id, description, expiration, last_used, time_created, scopes, project_id FROM api_keys WHERE api_key = ?"
 
 	stmt, err := db.conn.Prepare(query)
-
 	if err != nil {
-		return userId, err
+		return userId, result, err
 	}
 	defer stmt.Close()
 
-	err = stmt.QueryRow(apiKey).Scan(&userId)
-	return userId, err
+	err = stmt.QueryRow(encryptedApiKey).Scan(&userId, &result.Label, &result.Id, &result.Description, &expiration, &result.LastAccessed, &result.CreationDate, &scopes, &projectId)
+	result.Expiration = expiration.Time
+	result.Scopes = splitScopes(scopes)
+	result.ProjectId = nullableId(projectId)
+	return userId, result, err
 }
 
 func (db *DB) GetPasswordFromLogin(login string) (string, error) {
@@ -298,68 +466,136 @@ func (db *DB) GetUuidFromEmail(email string) (string, error) {
 	return result, err
 }
 
-func (db *DB) DeleteTask(userId string, taskId string) error {
-	query := "DELETE FROM tasks WHERE user_id = ? AND id = ?"
-	stmt, err := db.conn.Prepare(query)
+// DeleteTask moves the task together with all of its subtasks to the trash, they keep their
+// checklist items and tags until they are purged
+func (db *DB) DeleteTask(userId string, taskId string, ifMatch []int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	if err = db.deleteTask(tx, userId, taskId, ifMatch); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) deleteTask(tx *sql.Tx, userId string, taskId string, ifMatch []int64) error {
+	id, err := taskExists(tx, userId, taskId)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	result, err := stmt.Exec(userId, taskId)
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return err
+	}
+
+	ids, _, err := subtree(tx, userId, id)
 	if err != nil {
 		return err
 	}
 
-	if v, _ := result.RowsAffected(); v == 0 {
-		return NoTasksFoundError
+	if err = db.buryTasks(tx, userId, ids); err != nil {
+		return err
 	}
-	return nil
+
+	args := []any{userId}
+	for _, subtaskId := range ids {
+		args = append(args, subtaskId)
+	}
+	query := "UPDATE tasks SET deleted_at = " + db.now() + " WHERE user_id = ? AND id IN (" + placeholders(len(ids)) + ")"
+	_, err = tx.Exec(query, args...)
+	return err
+}
+
+func (db *DB) EditTask(userId string, taskPayload types.EditTaskPayload, ifMatch []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err = db.editTask(tx, userId, taskPayload, ifMatch); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, taskPayload.Id)
+	if err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit()
 }
 
-func (db *DB) EditTask(userId string, taskPayload types.EditTaskPayload) error {
+func (db *DB) editTask(tx *sql.Tx, userId string, taskPayload types.EditTaskPayload, ifMatch []int64) error {
+	if err := validateEdit(taskPayload); err != nil {
+		return err
+	}
+
+	task, err := getTask(tx, userId, taskPayload.Id)
+	if err != nil {
+		return err
+	}
+
+	if err = db.checkRevision(tx, userId, taskPayload.Id, ifMatch); err != nil {
+		return err
+	}
+
+	rule, err := editedRecurrence(task, taskPayload)
+	if err != nil {
+		return err
+	}
+
 	var payloads []any
 	query := "UPDATE tasks SET"
 
-	if taskPayload.Title != "" {
-		query += fmt.Sprintf(" title = ?,")
-		payloads = append(payloads, taskPayload.Title)
+	if taskPayload.Title.Set {
+		query += " title = ?,"
+		payloads = append(payloads, taskPayload.Title.Value)
 	}
 
-	if taskPayload.Body != "" {
-		query += fmt.Sprintf(" body = ?,")
-		payloads = append(payloads, taskPayload.Body)
+	if taskPayload.Body.Set {
+		query += " body = ?,"
+		payloads = append(payloads, sql.NullString{String: taskPayload.Body.Value, Valid: !taskPayload.Body.Null})
 	}
 
-	if taskPayload.Priority != 0 {
-		query += fmt.Sprintf(" priority = ?,")
-		payloads = append(payloads, taskPayload.Priority)
+	// Clearing the priority puts it back to the default
+	if taskPayload.Priority.Set {
+		query += " priority = ?,"
+		payloads = append(payloads, taskPayload.Priority.Value)
 	}
 
-	if taskPayload.Due != nil {
-		query += fmt.Sprint(" due = ?,")
-		payloads = append(payloads, &taskPayload.Due)
+	if taskPayload.Due.Set {
+		query += " due = ?,"
+		payloads = append(payloads, sql.NullTime{Time: taskPayload.Due.Value, Valid: !taskPayload.Due.Null})
 	}
 
-	// TODO: perform this check in the handler level, we should be able to always remove last comma
-	// Removes last comma otherwise sql invalid
-	if query[len(query)-1] == ',' {
-		query = query[:len(query)-1]
+	if taskPayload.Recurrence.Set {
+		query += " recurrence = ?,"
+		payloads = append(payloads, rule)
 	}
 
-	query += " WHERE user_id = ? AND id = ?"
-	stmt, err := db.conn.Prepare(query)
+	revision, err := db.nextRevision(tx, userId)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	query += " updated_at = " + db.now() + ", revision = ? WHERE user_id = ? AND id = ? AND deleted_at IS NULL"
 
 	// Unpacks all of the values that are required in the built query
-	_, err = stmt.Exec(append(payloads, userId, taskPayload.Id)...)
+	_, err = tx.Exec(query, append(payloads, revision, userId, taskPayload.Id)...)
 	return err
 }
 
+// validateEdit rejects edits that change nothing or would leave the task without a title
+func validateEdit(taskPayload types.EditTaskPayload) error {
+	if taskPayload.IsEmpty() {
+		return EmptyEditError
+	}
+	if taskPayload.Title.Set && taskPayload.Title.Value == "" {
+		return InvalidTitleError
+	}
+	return nil
+}
+
 func (db *DB) GetEmailAddress(userId string) (string, error) {
 	var result string
 	query := "SELECT email from users WHERE id = ?"
@@ -411,7 +647,7 @@ func (db *DB) GetAccountCreationDate(userId string) (time.Time, error) {
 func (db *DB) GetAllApiKeyMetadata(uuid string) ([]types.ApiKeyMetadata, error) {
 	var result []types.ApiKeyMetadata
 
-	query := "SELECT label, id, description, expiration, last_used, time_created FROM api_keys WHERE user_id = ?"
+	query := "SELECT label, id, description, expiration, last_used, time_created, scopes, project_id FROM api_keys WHERE user_id = ?"
 
 	stmt, err := db.conn.Prepare(query)
 	if err != nil {
@@ -426,11 +662,19 @@ func (db *DB) GetAllApiKeyMetadata(uuid string) ([]types.ApiKeyMetadata, error)
 	}
 
 	for rows.Next() {
-		var row types.ApiKeyMetadata
-		err = rows.Scan(&row.Label, &row.Id, &row.Description, &row.Expiration, &row.LastAccessed, &row.CreationDate)
+		var (
+			row        types.ApiKeyMetadata
+			expiration sql.NullTime
+			scopes     string
+			projectId  sql.NullInt64
+		)
+		err = rows.Scan(&row.Label, &row.Id, &row.Description, &expiration, &row.LastAccessed, &row.CreationDate, &scopes, &projectId)
 		if err != nil {
 			return result, err
 		}
+		row.Expiration = expiration.Time
+		row.Scopes = splitScopes(scopes)
+		row.ProjectId = nullableId(projectId)
 		result = append(result, row)
 	}
 	return result, nil
@@ -463,7 +707,7 @@ func (db *DB) RevokeApiKey(uuid string, id string) error {
 }
 
 func (db *DB) UpdateLastAccessedToNow(uuid string) error {
-	query := "UPDATE users SET last_accessed = CURTIME() WHERE id = ?"
+	query := "UPDATE users SET last_accessed = " + db.now() + " WHERE id = ?"
 
 	stmt, err := db.conn.Prepare(query)
 	if err != nil {
@@ -480,10 +724,16 @@ func (db *DB) ChangeEmailAddress(uuid string, newEmail string) error {
 	if err != nil {
 		return err
 	}
+	defer stmt.Close()
+
 	_, err = stmt.Exec(newEmail, uuid)
+	if err != nil && db.isUniqueConstraintError(err) {
+		return NewUserUniquenessConstraintError
+	}
 	return err
 }
 
+// DeleteAllTasks skips the trash, it is only used when deleting the account
 func (db *DB) DeleteAllTasks(uuid string) error {
 	query := "DELETE FROM tasks where user_id = ?"
 
@@ -510,16 +760,28 @@ func (db *DB) DeleteAllApiKeys(uuid string) error {
 	return err
 }
 
+// DeleteUser removes the user along with their tags, projects, sessions and password reset requests,
+// tasks and api keys have to be deleted beforehand
 func (db *DB) DeleteUser(uuid string) error {
-	query := "DELETE FROM users WHERE id = ?"
-	stmt, err := db.conn.Prepare(query)
+	tx, err := db.conn.Begin()
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(uuid)
-	return err
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		"DELETE FROM tags WHERE user_id = ?",
+		"DELETE FROM projects WHERE user_id = ?",
+		"DELETE FROM forgot_password_requests WHERE user_id = ?",
+		"DELETE FROM task_tombstones WHERE user_id = ?",
+		"DELETE FROM sessions WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	} {
+		if _, err = tx.Exec(query, uuid); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func (db *DB) GetProfilePhoto(uuid string) (string, error) {
@@ -547,18 +809,6 @@ func (db *DB) ChangeProfilePhoto(uuid string, profilePhoto int) error {
 	return err
 }
 
-func (db *DB) IncrementApiKeyUsage(uuid string) error {
-	query := "UPDATE users set monthly_api_key_usage = monthly_api_key_usage + 1 WHERE id = ?"
-	stmt, err := db.conn.Prepare(query)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
-
-	_, err = stmt.Exec(uuid)
-	return err
-}
-
 // handle unhappy path where user does not have an account
 func (db *DB) SetForgotPasswordToken(uuid string, token string) error {
 	// We save all password requests for logging purposes
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func TestAddNewTaskConcurrently(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		other := addUser(t, store, "someone.else@example.com")
+		first := addTask(t, store, uuid, "first")
+
+		// Every insert gets its own id, no matter how the transactions interleave
+		var wg sync.WaitGroup
+		ids := make([]int, 32)
+		errs := make([]error, len(ids))
+		for i := range ids {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ids[i], errs[i] = store.AddNewTask(types.NewTaskPayload{Title: "task " + strconv.Itoa(i)}, uuid)
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		slices.Sort(ids)
+		for i, id := range ids {
+			if id != first+1+i {
+				t.Fatalf("got ids %v after %d", ids, first)
+			}
+		}
+
+		// Ids keep increasing after the concurrent inserts and are counted per user
+		if next := addTask(t, store, uuid, "last"); next != ids[len(ids)-1]+1 {
+			t.Fatalf("got id %d after %v", next, ids)
+		}
+		if id := addTask(t, store, other, "first"); id != first {
+			t.Fatalf("another user's first task got id %d", id)
+		}
+	})
+}
+
+func TestChangeEmailAddress(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		addUser(t, store, "taken@example.com")
+
+		if err := store.ChangeEmailAddress(uuid, "taken@example.com"); !errors.Is(err, NewUserUniquenessConstraintError) {
+			t.Fatalf("got %v changing to a taken email", err)
+		}
+		if err := store.ChangeEmailAddress(uuid, "someone@example.com"); err != nil {
+			t.Fatalf("keeping the same email failed: %v", err)
+		}
+		if err := store.ChangeEmailAddress(uuid, "new@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if owner, err := store.GetUuidFromEmail("new@example.com"); err != nil || owner != uuid {
+			t.Fatalf("got %q for the new email: %v", owner, err)
+		}
+	})
+}
+
+// editedFields are the members of a task a merge patch can change
+type editedFields struct {
+	title    string
+	body     sql.NullString
+	due      sql.NullTime
+	priority int16
+}
+
+func TestEditTaskPatch(t *testing.T) {
+	due := time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)
+	original := editedFields{title: "task", body: sql.NullString{String: "body", Valid: true}, due: sql.NullTime{Time: due, Valid: true}, priority: 2}
+	edited := func(edit func(fields *editedFields)) editedFields {
+		fields := original
+		edit(&fields)
+		return fields
+	}
+
+	tests := []struct {
+		name     string
+		patch    string
+		expected editedFields
+	}{
+		{"null clears the body", `{"body": null}`, edited(func(f *editedFields) { f.body = sql.NullString{} })},
+		{"null clears the due date", `{"due": null}`, edited(func(f *editedFields) { f.due = sql.NullTime{} })},
+		{"null resets the priority", `{"priority": null}`, edited(func(f *editedFields) { f.priority = 0 })},
+		{"absent members are kept", `{"title": "renamed"}`, edited(func(f *editedFields) { f.title = "renamed" })},
+		{"values replace members", `{"body": "new body", "due": "2030-02-01T10:00:00Z", "priority": 3}`, edited(func(f *editedFields) {
+			f.body = sql.NullString{String: "new body", Valid: true}
+			f.due = sql.NullTime{Time: time.Date(2030, 2, 1, 10, 0, 0, 0, time.UTC), Valid: true}
+			f.priority = 3
+		})},
+		{"empty body is not null", `{"body": ""}`, edited(func(f *editedFields) { f.body = sql.NullString{Valid: true} })},
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		addOriginal := func() int {
+			t.Helper()
+			id, err := store.AddNewTask(types.NewTaskPayload{Title: original.title, Body: original.body.String, Due: due, Priority: original.priority}, uuid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return id
+		}
+		fieldsOf := func(id int) editedFields {
+			t.Helper()
+			task := readTask(t, store, uuid, id)
+			// Compared as instants, the stores differ in the location they read times back in
+			task.Due.Time = task.Due.Time.UTC()
+			return editedFields{title: task.Title, body: task.Body, due: task.Due, priority: task.Priority}
+		}
+
+		for _, test := range tests {
+			id := addOriginal()
+			var patch types.EditTaskPayload
+			if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+			patch.Id = id
+			if _, err := store.EditTask(uuid, patch, nil); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if fields := fieldsOf(id); fields != test.expected {
+				t.Fatalf("%s: got %+v, expected %+v", test.name, fields, test.expected)
+			}
+		}
+
+		id := addOriginal()
+		for patch, expected := range map[string]error{
+			`{}`:              EmptyEditError,
+			`{"title": ""}`:   InvalidTitleError,
+			`{"title": null}`: InvalidTitleError,
+		} {
+			var edit types.EditTaskPayload
+			if err := json.Unmarshal([]byte(patch), &edit); err != nil {
+				t.Fatal(err)
+			}
+			edit.Id = id
+			if _, err := store.EditTask(uuid, edit, nil); !errors.Is(err, expected) {
+				t.Fatalf("got %v editing with %s", err, patch)
+			}
+		}
+		if fields := fieldsOf(id); fields != original {
+			t.Fatalf("rejected edits changed the task to %+v", fields)
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/senyc/jason/pkg/recurrence"
+	"github.com/senyc/jason/pkg/types"
+)
+
+var RecurrenceWithoutDueError = errors.New("Recurring tasks need a due date")
+
+// normalizeRecurrence validates a rule and stores it in canonical form, an empty rule means no recurrence
+func normalizeRecurrence(rule string, due time.Time) (sql.NullString, error) {
+	if rule == "" {
+		return sql.NullString{}, nil
+	}
+
+	parsed, err := recurrence.Parse(rule)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	if due.IsZero() {
+		return sql.NullString{}, RecurrenceWithoutDueError
+	}
+	return sql.NullString{String: parsed.String(), Valid: true}, nil
+}
+
+// editedRecurrence is the rule the task has once the edit is applied, clearing the due date of a
+// recurring task is only allowed when the edit stops it from recurring
+func editedRecurrence(task types.SqlTasksRow, edit types.EditTaskPayload) (sql.NullString, error) {
+	due := task.Due.Time
+	if edit.Due.Set {
+		due = edit.Due.Value
+	}
+
+	if edit.Recurrence.Set {
+		return normalizeRecurrence(edit.Recurrence.Value, due)
+	}
+	if task.Recurrence.Valid && due.IsZero() {
+		return task.Recurrence, RecurrenceWithoutDueError
+	}
+	return task.Recurrence, nil
+}
+
+func getTask(tx *sql.Tx, userId string, taskId int) (types.SqlTasksRow, error) {
+	var task types.SqlTasksRow
+	err := scanTask(tx.QueryRow("SELECT "+taskColumns+" FROM tasks WHERE user_id = ? AND id = ? AND deleted_at IS NULL", userId, taskId), &task)
+	if err == sql.ErrNoRows {
+		return task, NoTasksFoundError
+	}
+	return task, err
+}
+
+// completeTask marks the task completed, tasks that already are only get a new completion date when
+// force is set. Completing a recurring task spawns its next occurrence
+func (db *DB) completeTask(tx *sql.Tx, userId string, taskId int, force bool) error {
+	task, err := getTask(tx, userId, taskId)
+	if err != nil {
+		return err
+	}
+	if task.Completed && !force {
+		return nil
+	}
+
+	query := "UPDATE tasks SET completed = 1, completed_date = " + db.now() + " WHERE user_id = ? AND id = ?"
+	if _, err = tx.Exec(query, userId, taskId); err != nil {
+		return err
+	}
+	if err = db.touchTasks(tx, userId, taskId); err != nil {
+		return err
+	}
+
+	if task.Completed || !task.Recurrence.Valid {
+		return nil
+	}
+	return db.spawnNextOccurrence(tx, userId, task)
+}
+
+// spawnNextOccurrence adds the task following task in its series, with the same tags and unchecked
+// checklist items. The rule moves to the new task so completing task again does not spawn twice
+func (db *DB) spawnNextOccurrence(tx *sql.Tx, userId string, task types.SqlTasksRow) error {
+	rule, err := recurrence.Parse(task.Recurrence.String)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET recurrence = NULL WHERE user_id = ? AND id = ?", userId, task.Id)
+	if err != nil {
+		return err
+	}
+
+	due, ok := rule.Next(task.Due.Time, task.Occurrence)
+	if !ok {
+		return nil
+	}
+
+	taskId, err := db.allocateTaskId(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	revision, err := db.nextRevision(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO tasks (user_id, id, title, body, priority, due, project_id, parent_id, recurrence, occurrence, updated_at, created_revision, revision)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ` + db.now() + `, ?, ?)`
+	_, err = tx.Exec(query, userId, taskId, task.Title, task.Body, task.Priority, due, task.ProjectId, task.ParentId, task.Recurrence, task.Occurrence+1, revision, revision)
+	if err != nil {
+		return err
+	}
+
+	query = "INSERT INTO task_tags (user_id, task_id, tag_id) SELECT user_id, ?, tag_id FROM task_tags WHERE user_id = ? AND task_id = ?"
+	if _, err = tx.Exec(query, taskId, userId, task.Id); err != nil {
+		return err
+	}
+
+	query = "INSERT INTO checklist_items (user_id, task_id, title) SELECT user_id, ?, title FROM checklist_items WHERE user_id = ? AND task_id = ? ORDER BY id"
+	_, err = tx.Exec(query, taskId, userId, task.Id)
+	return err
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+var InvalidSearchQueryError = errors.New("Search queries need at least one letter or digit")
+
+// searchTerms splits text into lowercase words, the way the full text indexes tokenize it
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchQuery matches tasks containing any of the terms, on mysql in natural language mode and on sqlite
+// through the tasks_search fts5 table. Terms are quoted there so they are never read as fts5 syntax
+func (db *DB) searchQuery(uuid string, terms []string, completed *bool) (string, []any) {
+	var completedClause string
+	var completedArgs []any
+	if completed != nil {
+		completedClause = " AND completed = ?"
+		completedArgs = append(completedArgs, *completed)
+	}
+
+	if db.driver == MySQL {
+		match := strings.Join(terms, " ")
+		query := `SELECT ` + taskColumns + `
+		FROM tasks
+		WHERE user_id = ? AND deleted_at IS NULL AND MATCH (title, body) AGAINST (? IN NATURAL LANGUAGE MODE)` + completedClause + `
+		ORDER BY MATCH (title, body) AGAINST (? IN NATURAL LANGUAGE MODE) DESC, id ASC`
+		args := append([]any{uuid, match}, completedArgs...)
+		return query, append(args, match)
+	}
+
+	match := `"` + strings.Join(terms, `" OR "`) + `"`
+	// bm25 scores are lower for better matches
+	query := `SELECT ` + taskColumns + `
+	FROM tasks
+	JOIN (
+		SELECT user_id AS search_user_id, task_id, bm25(tasks_search) AS relevance
+		FROM tasks_search
+		WHERE tasks_search MATCH ?
+	) s ON s.search_user_id = tasks.user_id AND s.task_id = tasks.id
+	WHERE tasks.user_id = ? AND deleted_at IS NULL` + completedClause + `
+	ORDER BY s.relevance ASC, id ASC`
+	return query, append([]any{match, uuid}, completedArgs...)
+}
+
+func (db *DB) SearchTasks(uuid string, search types.TaskSearch) ([]types.SqlTasksRow, error) {
+	var tasks []types.SqlTasksRow
+
+	terms := searchTerms(search.Query)
+	if len(terms) == 0 {
+		return tasks, InvalidSearchQueryError
+	}
+
+	query, args := db.searchQuery(uuid, terms, search.Completed)
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, search.Limit, search.Offset)
+
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return tasks, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return tasks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row types.SqlTasksRow
+		if err = scanTask(rows, &row); err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, row)
+	}
+	if err = rows.Err(); err != nil {
+		return tasks, err
+	}
+
+	if err = db.attachTags(uuid, tasks); err != nil {
+		return tasks, err
+	}
+	return tasks, db.attachProgress(uuid, tasks)
+}
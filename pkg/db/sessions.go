@@ -0,0 +1,139 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	NoSessionFoundError      = errors.New("Session has expired or been revoked, please login again")
+	InvalidRefreshTokenError = errors.New("Refresh token is not valid, please login again")
+)
+
+// AddSession stores a new login, refresh tokens are only ever stored hashed
+func (db *DB) AddSession(userId string, sessionId string, refreshToken string, expiresAt time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Expired sessions are cleaned up whenever the user logs in again
+	query := "DELETE FROM sessions WHERE user_id = ? AND " + db.timeExpr("expires_at") + " < " + db.timeExpr("?")
+	if _, err = tx.Exec(query, userId, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	query = "INSERT INTO sessions (id, user_id, refresh_token, expires_at) VALUES (?, ?, ?, ?)"
+	if _, err = tx.Exec(query, sessionId, userId, refreshToken, expiresAt.UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RotateSession swaps the refresh token of a session for a new one and extends the session until
+// expiresAt. Reusing a refresh token that was already swapped out revokes its session, since
+// either the client or someone who stole the token is holding on to an old one
+func (db *DB) RotateSession(refreshToken string, newRefreshToken string, expiresAt time.Time) (string, string, error) {
+	var userId, sessionId string
+	var sessionExpiresAt time.Time
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return userId, sessionId, err
+	}
+	defer tx.Rollback()
+
+	// On mysql the session stays locked until the transaction ends, so a concurrent rotation with
+	// the same token waits and then finds it swapped out
+	query := "SELECT id, user_id, expires_at FROM sessions WHERE refresh_token = ?"
+	if db.driver == MySQL {
+		query += " FOR UPDATE"
+	}
+	err = tx.QueryRow(query, refreshToken).Scan(&sessionId, &userId, &sessionExpiresAt)
+	if err == sql.ErrNoRows {
+		return userId, sessionId, db.revokeReusedSession(tx, refreshToken)
+	}
+	if err != nil {
+		return userId, sessionId, err
+	}
+
+	if !sessionExpiresAt.After(time.Now()) {
+		return userId, sessionId, InvalidRefreshTokenError
+	}
+
+	// Only swaps the token it was given, losing a race to another rotation counts as reusing it
+	query = "UPDATE sessions SET previous_refresh_token = refresh_token, refresh_token = ?, expires_at = ? WHERE id = ? AND refresh_token = ?"
+	result, err := tx.Exec(query, newRefreshToken, expiresAt.UTC(), sessionId, refreshToken)
+	if err != nil {
+		return userId, sessionId, err
+	}
+	rotated, err := result.RowsAffected()
+	if err != nil {
+		return userId, sessionId, err
+	}
+	if rotated != 1 {
+		return userId, sessionId, db.revokeReusedSession(tx, refreshToken)
+	}
+	return userId, sessionId, tx.Commit()
+}
+
+// revokeReusedSession deletes the session the refresh token was swapped out of, if there is one
+func (db *DB) revokeReusedSession(tx *sql.Tx, refreshToken string) error {
+	result, err := tx.Exec("DELETE FROM sessions WHERE previous_refresh_token = ?", refreshToken)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if revoked > 0 {
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return InvalidRefreshTokenError
+}
+
+func (db *DB) SessionExists(userId string, sessionId string) error {
+	var expiresAt time.Time
+	query := "SELECT expires_at FROM sessions WHERE user_id = ? AND id = ?"
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRow(userId, sessionId).Scan(&expiresAt)
+	if err == sql.ErrNoRows || err == nil && !expiresAt.After(time.Now()) {
+		return NoSessionFoundError
+	}
+	return err
+}
+
+func (db *DB) DeleteSession(userId string, sessionId string) error {
+	query := "DELETE FROM sessions WHERE user_id = ? AND id = ?"
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(userId, sessionId)
+	return err
+}
+
+func (db *DB) DeleteAllSessions(uuid string) error {
+	query := "DELETE FROM sessions WHERE user_id = ?"
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(uuid)
+	return err
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotateSession(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		expiresAt := time.Now().Add(time.Hour)
+
+		if err := store.AddSession(uuid, "session", "first", expiresAt); err != nil {
+			t.Fatal(err)
+		}
+		userId, sessionId, err := store.RotateSession("first", "second", expiresAt)
+		if err != nil || userId != uuid || sessionId != "session" {
+			t.Fatalf("got %q and %q: %v", userId, sessionId, err)
+		}
+		if _, _, err = store.RotateSession("second", "third", expiresAt); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = store.RotateSession("unknown", "fourth", expiresAt); !errors.Is(err, InvalidRefreshTokenError) {
+			t.Fatalf("got %v for an unknown token", err)
+		}
+		if err = store.SessionExists(uuid, "session"); err != nil {
+			t.Fatalf("an unknown token revoked the session: %v", err)
+		}
+
+		// Reusing a swapped out token ends the session for the current token too
+		if _, _, err = store.RotateSession("second", "fourth", expiresAt); !errors.Is(err, InvalidRefreshTokenError) {
+			t.Fatalf("got %v reusing a token", err)
+		}
+		if err = store.SessionExists(uuid, "session"); !errors.Is(err, NoSessionFoundError) {
+			t.Fatalf("reuse did not revoke the session: %v", err)
+		}
+		if _, _, err = store.RotateSession("third", "fourth", expiresAt); !errors.Is(err, InvalidRefreshTokenError) {
+			t.Fatalf("got %v for the token of a revoked session", err)
+		}
+
+		if err = store.AddSession(uuid, "expired", "old", time.Now().Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = store.RotateSession("old", "new", expiresAt); !errors.Is(err, InvalidRefreshTokenError) {
+			t.Fatalf("got %v for an expired session", err)
+		}
+	})
+}
+
+func TestRotateSessionConcurrently(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		expiresAt := time.Now().Add(time.Hour)
+		if err := store.AddSession(uuid, "session", "token", expiresAt); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only one of the rotations can swap the token, every other one reuses it
+		var wg sync.WaitGroup
+		errs := make([]error, 8)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, _, errs[i] = store.RotateSession("token", "token"+strconv.Itoa(i), expiresAt)
+			}(i)
+		}
+		wg.Wait()
+
+		rotated := 0
+		for _, err := range errs {
+			if err == nil {
+				rotated++
+			} else if !errors.Is(err, InvalidRefreshTokenError) {
+				t.Fatal(err)
+			}
+		}
+		if rotated != 1 {
+			t.Fatalf("token was rotated %d times", rotated)
+		}
+		if err := store.SessionExists(uuid, "session"); !errors.Is(err, NoSessionFoundError) {
+			t.Fatalf("reuse did not revoke the session: %v", err)
+		}
+	})
+}
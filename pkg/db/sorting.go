@@ -0,0 +1,121 @@
+package db
+
+import (
+	"cmp"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+// timeExpr makes a time column or parameter comparable. Sqlite keeps times as text in whatever offset
+// they were written with, so they are converted to utc text with millisecond precision
+func (db *DB) timeExpr(expr string) string {
+	if db.driver == SQLite {
+		return "strftime('%Y-%m-%d %H:%M:%f', " + expr + ")"
+	}
+	return expr
+}
+
+// sortKey is the expression a listing is ordered by before the id, along with its arguments
+func (db *DB) sortKey(sort types.TaskSort) (string, []any) {
+	switch sort {
+	case types.SortByPriority:
+		return "priority", nil
+	case types.SortByCreated:
+		return db.timeExpr("time_created"), nil
+	case types.SortById:
+		return "", nil
+	}
+	// Tasks without a due date sort with the ones due at the zero time
+	return db.timeExpr("COALESCE(due, ?)"), []any{time.Time{}}
+}
+
+// taskOrderClause builds the cursor condition, ORDER BY and LIMIT for a filter along with their arguments
+func (db *DB) taskOrderClause(filter types.TaskFilter) (string, []any) {
+	var (
+		clause string
+		args   []any
+	)
+
+	direction, comparison := "ASC", ">"
+	if filter.Desc {
+		direction, comparison = "DESC", "<"
+	}
+	key, keyArgs := db.sortKey(filter.Sort)
+
+	if cursor := filter.After; cursor != nil {
+		if key == "" {
+			clause += " AND id " + comparison + " ?"
+			args = append(args, cursor.Id)
+		} else {
+			value := cursorValue(filter.Sort, cursor)
+			if _, ok := value.(time.Time); ok {
+				clause += " AND (" + key + " " + comparison + " " + db.timeExpr("?") + " OR (" + key + " = " + db.timeExpr("?") + " AND id " + comparison + " ?))"
+			} else {
+				clause += " AND (" + key + " " + comparison + " ? OR (" + key + " = ? AND id " + comparison + " ?))"
+			}
+			args = append(args, keyArgs...)
+			args = append(args, value)
+			args = append(args, keyArgs...)
+			args = append(args, value, cursor.Id)
+		}
+	}
+
+	if key == "" {
+		clause += " ORDER BY id " + direction
+	} else {
+		clause += " ORDER BY " + key + " " + direction + ", id " + direction
+		args = append(args, keyArgs...)
+	}
+
+	if filter.Limit > 0 {
+		clause += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return clause, args
+}
+
+// cursorValue is the cursor's position under the sort, in the form it is compared in
+func cursorValue(sort types.TaskSort, cursor *types.TaskCursor) any {
+	switch sort {
+	case types.SortByPriority:
+		return cursor.Priority
+	case types.SortByCreated:
+		return cursor.Created.UTC()
+	case types.SortById:
+		return cursor.Id
+	}
+	return cursor.Due.UTC()
+}
+
+// CursorFor is the position of the task in a listing sorted the same way as filter
+func CursorFor(task types.SqlTasksRow, filter types.TaskFilter) types.TaskCursor {
+	return types.TaskCursor{
+		Sort:     filter.Sort,
+		Desc:     filter.Desc,
+		Id:       task.Id,
+		Due:      task.Due.Time,
+		Priority: task.Priority,
+		Created:  task.TimeCreated,
+	}
+}
+
+// compareTasks orders two task positions the way taskOrderClause does, ignoring the direction
+func compareTasks(sort types.TaskSort, a *types.TaskCursor, b *types.TaskCursor) int {
+	switch sort {
+	case types.SortByPriority:
+		if a.Priority != b.Priority {
+			return cmp.Compare(a.Priority, b.Priority)
+		}
+	case types.SortByCreated:
+		if c := a.Created.Compare(b.Created); c != 0 {
+			return c
+		}
+	case types.SortById:
+	default:
+		if c := a.Due.Compare(b.Due); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(a.Id, b.Id)
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+func (db *DB) connectSQLite() error {
+	// Immediate transactions and a busy timeout let concurrent writers queue instead of failing
+	dbPath := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate&_time_format=sqlite", db.config.Path)
+
+	connection, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return err
+	}
+
+	db.conn = connection
+	return db.conn.Ping()
+}
+
+func isSQLiteUniqueConstraintError(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
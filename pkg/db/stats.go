@@ -0,0 +1,212 @@
+package db
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+const (
+	dayFormat   = "2006-01-02"
+	monthFormat = "2006-01"
+)
+
+// statsNow decides which day streaks are counted up to, tests pin it to a fixed day
+var statsNow = time.Now
+
+// Sqlite gives durations as fractions of a day, rounding to the millisecond keeps both backends in step
+func roundSeconds(seconds float64) *float64 {
+	rounded := math.Round(seconds*1000) / 1000
+	return &rounded
+}
+
+// weekStart is the monday of t's week
+func weekStart(t time.Time) time.Time {
+	return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+}
+
+// streaks counts runs of consecutive days in days, which are sorted and formatted like 2024-01-31
+func streaks(days []types.PeriodCount, today time.Time) (int, int) {
+	var current, longest int
+	var previous time.Time
+	for _, day := range days {
+		t, err := time.Parse(dayFormat, day.Period)
+		if err != nil {
+			continue
+		}
+		if !previous.IsZero() && t.Equal(previous.AddDate(0, 0, 1)) {
+			current++
+		} else {
+			current = 1
+		}
+		longest = max(longest, current)
+		previous = t
+	}
+
+	today = today.UTC().Truncate(24 * time.Hour)
+	if previous.IsZero() || previous.Before(today.AddDate(0, 0, -1)) {
+		current = 0
+	}
+	return current, longest
+}
+
+// periodExpr groups completion dates by day, week or month under the names described on TaskStats
+func (db *DB) periodExpr(period string) string {
+	if db.driver == SQLite {
+		switch period {
+		case "week":
+			return "date(completed_date, 'weekday 0', '-6 days')"
+		case "month":
+			return "strftime('%Y-%m', completed_date)"
+		}
+		return "date(completed_date)"
+	}
+
+	switch period {
+	case "week":
+		return "DATE_FORMAT(DATE_SUB(completed_date, INTERVAL WEEKDAY(completed_date) DAY), '%Y-%m-%d')"
+	case "month":
+		return "DATE_FORMAT(completed_date, '%Y-%m')"
+	}
+	return "DATE_FORMAT(completed_date, '%Y-%m-%d')"
+}
+
+// Seconds between creating and completing a task
+func (db *DB) durationExpr() string {
+	if db.driver == SQLite {
+		return "(julianday(completed_date) - julianday(time_created)) * 86400"
+	}
+	return "TIMESTAMPDIFF(SECOND, time_created, completed_date)"
+}
+
+func (db *DB) completedPerPeriod(uuid string, period string) ([]types.PeriodCount, error) {
+	counts := []types.PeriodCount{}
+	expr := db.periodExpr(period)
+	query := `SELECT ` + expr + `, COUNT(*)
+	FROM tasks
+	WHERE user_id = ? AND deleted_at IS NULL AND completed = true AND completed_date IS NOT NULL
+	GROUP BY ` + expr + `
+	ORDER BY ` + expr
+
+	rows, err := db.conn.Query(query, uuid)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var count types.PeriodCount
+		if err = rows.Scan(&count.Period, &count.Completed); err != nil {
+			return counts, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// medianDuration only reads the one or two durations in the middle
+func (db *DB) medianDuration(uuid string, count int) (*float64, error) {
+	if count == 0 {
+		return nil, nil
+	}
+
+	query := `SELECT ` + db.durationExpr() + ` AS duration
+	FROM tasks
+	WHERE user_id = ? AND deleted_at IS NULL AND completed = true AND completed_date IS NOT NULL
+	ORDER BY duration
+	LIMIT ? OFFSET ?`
+	limit := 2 - count%2
+	rows, err := db.conn.Query(query, uuid, limit, (count-1)/2)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sum float64
+	for rows.Next() {
+		var duration float64
+		if err = rows.Scan(&duration); err != nil {
+			return nil, err
+		}
+		sum += duration
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return roundSeconds(sum / float64(limit)), nil
+}
+
+func (db *DB) GetTaskStats(uuid string) (types.TaskStats, error) {
+	stats := types.TaskStats{Priorities: []types.PriorityStats{}}
+	duration := db.durationExpr()
+	// Tasks added without a due date store the zero time
+	hasDue := db.timeExpr("due") + " > " + db.timeExpr("?")
+	finished := "completed = true AND completed_date IS NOT NULL"
+
+	var (
+		timed, withDue, overdue int
+		mean                    sql.NullFloat64
+	)
+	query := `SELECT COUNT(*),
+		COALESCE(SUM(CASE WHEN completed THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN ` + finished + ` THEN 1 ELSE 0 END), 0),
+		AVG(CASE WHEN ` + finished + ` THEN ` + duration + ` END),
+		COALESCE(SUM(CASE WHEN ` + finished + ` AND ` + hasDue + ` THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN ` + finished + ` AND ` + hasDue + ` AND ` + db.timeExpr("completed_date") + ` > ` + db.timeExpr("due") + ` THEN 1 ELSE 0 END), 0)
+	FROM tasks
+	WHERE user_id = ? AND deleted_at IS NULL`
+	err := db.conn.QueryRow(query, time.Time{}, time.Time{}, uuid).Scan(&stats.Total, &stats.Completed, &timed, &mean, &withDue, &overdue)
+	if err != nil {
+		return stats, err
+	}
+
+	if mean.Valid {
+		stats.MeanSecondsToComplete = roundSeconds(mean.Float64)
+	}
+	if withDue > 0 {
+		ratio := float64(overdue) / float64(withDue)
+		stats.OverdueCompletionRatio = &ratio
+	}
+	if stats.MedianSecondsToComplete, err = db.medianDuration(uuid, timed); err != nil {
+		return stats, err
+	}
+
+	if stats.CompletedPerDay, err = db.completedPerPeriod(uuid, "day"); err != nil {
+		return stats, err
+	}
+	if stats.CompletedPerWeek, err = db.completedPerPeriod(uuid, "week"); err != nil {
+		return stats, err
+	}
+	if stats.CompletedPerMonth, err = db.completedPerPeriod(uuid, "month"); err != nil {
+		return stats, err
+	}
+	stats.CurrentStreak, stats.LongestStreak = streaks(stats.CompletedPerDay, statsNow())
+
+	query = `SELECT priority, COUNT(*),
+		COALESCE(SUM(CASE WHEN completed THEN 1 ELSE 0 END), 0),
+		AVG(CASE WHEN ` + finished + ` THEN ` + duration + ` END)
+	FROM tasks
+	WHERE user_id = ? AND deleted_at IS NULL
+	GROUP BY priority
+	ORDER BY priority`
+	rows, err := db.conn.Query(query, uuid)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var priority types.PriorityStats
+		var mean sql.NullFloat64
+		if err = rows.Scan(&priority.Priority, &priority.Total, &priority.Completed, &mean); err != nil {
+			return stats, err
+		}
+		if mean.Valid {
+			priority.MeanSecondsToComplete = roundSeconds(mean.Float64)
+		}
+		stats.Priorities = append(stats.Priorities, priority)
+	}
+	return stats, rows.Err()
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+// completeAt completes the task as if it had been created and completed at the given times
+func completeAt(t *testing.T, store Store, uuid string, id int, created time.Time, completed time.Time) {
+	t.Helper()
+
+	switch store := store.(type) {
+	case *DB:
+		_, err := store.conn.Exec("UPDATE tasks SET time_created = ?, completed = true, completed_date = ? WHERE user_id = ? AND id = ?", created.UTC(), completed.UTC(), uuid, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *MemoryStore:
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		task := store.tasks[uuid][id]
+		task.TimeCreated, task.Completed = created, true
+		task.CompletedDate.Time, task.CompletedDate.Valid = completed, true
+	}
+}
+
+func pinStatsNow(t *testing.T, now time.Time) {
+	t.Helper()
+
+	statsNow = func() time.Time { return now }
+	t.Cleanup(func() { statsNow = time.Now })
+}
+
+func seconds(s float64) *float64 {
+	return &s
+}
+
+func TestGetTaskStats(t *testing.T) {
+	day := func(d int, hour int, minute int) time.Time {
+		return time.Date(2030, 3, d, hour, minute, 0, 0, time.UTC)
+	}
+	// Created, completed, priority and due of every task, zero completed times stay incomplete
+	tasks := []struct {
+		created, completed time.Time
+		priority           int16
+		due                time.Time
+	}{
+		{day(10, 10, 0), day(11, 10, 0), 1, day(11, 12, 0)},
+		{day(12, 8, 0), day(12, 9, 0), 2, day(12, 8, 30)},
+		{day(1, 0, 0), day(13, 6, 0), 1, time.Time{}},
+		{day(1, 0, 0), day(4, 0, 0), 3, time.Time{}},
+		{day(1, 0, 0).AddDate(0, 0, -9), day(1, 0, 0).AddDate(0, 0, -1), 2, time.Time{}},
+		// A sunday belongs to the week starting the monday before
+		{day(10, 0, 0), day(10, 23, 30), 3, time.Time{}},
+		{day(1, 0, 0), time.Time{}, 1, time.Time{}},
+	}
+
+	expected := types.TaskStats{
+		Total:     7,
+		Completed: 6,
+		CompletedPerDay: []types.PeriodCount{
+			{Period: "2030-02-28", Completed: 1}, {Period: "2030-03-04", Completed: 1}, {Period: "2030-03-10", Completed: 1},
+			{Period: "2030-03-11", Completed: 1}, {Period: "2030-03-12", Completed: 1}, {Period: "2030-03-13", Completed: 1},
+		},
+		CompletedPerWeek: []types.PeriodCount{
+			{Period: "2030-02-25", Completed: 1}, {Period: "2030-03-04", Completed: 2}, {Period: "2030-03-11", Completed: 3},
+		},
+		CompletedPerMonth:       []types.PeriodCount{{Period: "2030-02", Completed: 1}, {Period: "2030-03", Completed: 5}},
+		MeanSecondsToComplete:   seconds(363900),
+		MedianSecondsToComplete: seconds(172800),
+		OverdueCompletionRatio:  seconds(0.5),
+		Priorities: []types.PriorityStats{
+			{Priority: 1, Total: 3, Completed: 2, MeanSecondsToComplete: seconds(572400)},
+			{Priority: 2, Total: 2, Completed: 2, MeanSecondsToComplete: seconds(347400)},
+			{Priority: 3, Total: 2, Completed: 2, MeanSecondsToComplete: seconds(171900)},
+		},
+		CurrentStreak: 4,
+		LongestStreak: 4,
+	}
+
+	forEachStore(t, func(t *testing.T, store Store) {
+		pinStatsNow(t, day(13, 20, 0))
+		uuid := addUser(t, store, "someone@example.com")
+		for i, task := range tasks {
+			id, err := store.AddNewTask(types.NewTaskPayload{Title: "task " + strconv.Itoa(i), Priority: task.priority, Due: task.due}, uuid)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !task.completed.IsZero() {
+				completeAt(t, store, uuid, id, task.created, task.completed)
+			}
+		}
+		// Tasks in the trash do not count
+		trashed := addTask(t, store, uuid, "trashed")
+		completeAt(t, store, uuid, trashed, day(13, 0, 0), day(13, 1, 0))
+		if err := store.DeleteTask(uuid, strconv.Itoa(trashed), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		stats, err := store.GetTaskStats(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(stats, expected) {
+			t.Fatalf("got stats\n%s\nwant\n%s", formatStats(stats), formatStats(expected))
+		}
+
+		// The streak still counts the day after, but not once a whole day is missed
+		pinStatsNow(t, day(14, 23, 0))
+		if stats, err = store.GetTaskStats(uuid); err != nil || stats.CurrentStreak != 4 {
+			t.Fatalf("got current streak %d the day after: %v", stats.CurrentStreak, err)
+		}
+		pinStatsNow(t, day(15, 0, 0))
+		if stats, err = store.GetTaskStats(uuid); err != nil || stats.CurrentStreak != 0 || stats.LongestStreak != 4 {
+			t.Fatalf("got streaks %d and %d two days after: %v", stats.CurrentStreak, stats.LongestStreak, err)
+		}
+	})
+}
+
+func TestGetTaskStatsEmpty(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		addTask(t, store, uuid, "open")
+
+		stats, err := store.GetTaskStats(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := types.TaskStats{
+			Total:             1,
+			CompletedPerDay:   []types.PeriodCount{},
+			CompletedPerWeek:  []types.PeriodCount{},
+			CompletedPerMonth: []types.PeriodCount{},
+			Priorities:        []types.PriorityStats{{Priority: 0, Total: 1}},
+		}
+		if !reflect.DeepEqual(stats, expected) {
+			t.Fatalf("got stats\n%s\nwant\n%s", formatStats(stats), formatStats(expected))
+		}
+	})
+}
+
+// formatStats spells out the values behind the pointers DeepEqual compares
+func formatStats(stats types.TaskStats) string {
+	j, _ := json.Marshal(stats)
+	return string(j)
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/types"
+)
+
+// Store is the persistence layer used by the server, every backend implements it
+type Store interface {
+	GetAddedTasksCount(userId string) (int, error)
+	AddNewTask(newTask types.NewTaskPayload, userId string) (int, error)
+	GetTaskById(userId string, taskId string) (types.SqlTasksRow, error)
+	GetAllTasksByUser(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error)
+	GetCompletedTasks(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error)
+	GetIncompleteTasks(uuid string, filter types.TaskFilter) ([]types.SqlTasksRow, error)
+	// SearchTasks returns the matching tasks, most relevant first
+	SearchTasks(uuid string, search types.TaskSearch) ([]types.SqlTasksRow, error)
+	GetTaskStats(uuid string) (types.TaskStats, error)
+	// GetTaskChanges lists what changed after the since revision, zero lists every task
+	GetTaskChanges(uuid string, since int64) (types.TaskChanges, error)
+	AddNewUser(newUser types.User) error
+	// Task changes taking ifMatch only apply when the task is at one of the ifMatch revisions, a nil
+	// ifMatch applies them unconditionally. Those leaving the task in place return its new revision
+	MarkTaskCompleted(userId string, taskId string, cascade bool, ifMatch []int64) (int64, error)
+	MarkTaskIncomplete(userId string, taskId string, ifMatch []int64) (int64, error)
+	AddApiKey(uuid string, apiKey string, apiKeyMetadata types.ApiKeyPayload) error
+	GetApiKeyMetadata(encryptedApiKey string) (types.ApiKeyMetadata, error)
+	// GetApiKeyOwner returns the user an api key belongs to along with the key's metadata
+	GetApiKeyOwner(encryptedApiKey string) (string, types.ApiKeyMetadata, error)
+	// RecordApiKeyUsage takes how much each key, by id, was used since usage was last recorded
+	RecordApiKeyUsage(usage map[string]types.ApiKeyUsage) error
+	// GetExpiringApiKeys lists the unexpired keys expiring before the given time whose owners
+	// have not been notified yet
+	GetExpiringApiKeys(before time.Time) ([]types.ExpiringApiKey, error)
+	// ClaimApiKeyExpiryNotice marks the key as notified, reporting false when it already was so
+	// that concurrent checks email about each key only once
+	ClaimApiKeyExpiryNotice(id string) (bool, error)
+	// ReleaseApiKeyExpiryNotice undoes a claim whose email could not be sent
+	ReleaseApiKeyExpiryNotice(id string) error
+	GetPasswordFromLogin(login string) (string, error)
+	GetUuidFromEmail(email string) (string, error)
+	// DeleteTask moves the task and its subtasks to the trash
+	DeleteTask(userId string, taskId string, ifMatch []int64) error
+	// GetTrash lists the tasks in the trash, most recently deleted first
+	GetTrash(uuid string) ([]types.SqlTasksRow, error)
+	RestoreTask(userId string, taskId string, ifMatch []int64) (int64, error)
+	PurgeTask(userId string, taskId string, ifMatch []int64) error
+	EmptyTrash(uuid string) error
+	// PurgeTrash permanently deletes every user's tasks that have been in the trash longer than
+	// retention and returns how many it deleted
+	PurgeTrash(retention time.Duration) (int, error)
+	EditTask(userId string, taskPayload types.EditTaskPayload, ifMatch []int64) (int64, error)
+	// RunBatch applies the operations in order within one transaction and reports how each one went
+	RunBatch(userId string, operations []types.BatchOperation, atomic bool) ([]types.BatchOutcome, error)
+	GetEmailAddress(userId string) (string, error)
+	GetLastAccessed(userId string) (time.Time, error)
+	GetAccountCreationDate(userId string) (time.Time, error)
+	GetAllApiKeyMetadata(uuid string) ([]types.ApiKeyMetadata, error)
+	RevokeAllApiKeys(uuid string) error
+	RevokeApiKey(uuid string, id string) error
+	UpdateLastAccessedToNow(uuid string) error
+	ChangeEmailAddress(uuid string, newEmail string) error
+	DeleteAllTasks(uuid string) error
+	DeleteAllApiKeys(uuid string) error
+	DeleteUser(uuid string) error
+	GetProfilePhoto(uuid string) (string, error)
+	ChangeProfilePhoto(uuid string, profilePhoto int) error
+	SetForgotPasswordToken(uuid string, token string) error
+	GetResetPasswordToken(uuid string) (string, error)
+	SetNewPassword(uuid, password string) error
+	GetUuidFromResetPasswordToken(passwordToken string) (string, error)
+	AddSession(userId string, sessionId string, refreshToken string, expiresAt time.Time) error
+	// RotateSession replaces the refresh token of a session and returns the user and session it
+	// belongs to, a refresh token that was already replaced revokes the session
+	RotateSession(refreshToken string, newRefreshToken string, expiresAt time.Time) (string, string, error)
+	// SessionExists fails with NoSessionFoundError once the session has expired or been revoked
+	SessionExists(userId string, sessionId string) error
+	DeleteSession(userId string, sessionId string) error
+	DeleteAllSessions(uuid string) error
+	GetAllTags(uuid string) ([]types.TagResponse, error)
+	AddTagsToTask(userId string, taskId string, tags []string, ifMatch []int64) (int64, error)
+	RemoveTagsFromTask(userId string, taskId string, tags []string, ifMatch []int64) (int64, error)
+	RenameTag(uuid string, name string, newName string) error
+	DeleteTag(uuid string, name string) error
+	AddProject(uuid string, project types.ProjectPayload) (int, error)
+	GetProjectById(uuid string, projectId string) (types.ProjectResponse, error)
+	GetAllProjects(uuid string, includeArchived bool) ([]types.ProjectResponse, error)
+	EditProject(uuid string, projectId string, project types.EditProjectPayload) error
+	SetProjectArchived(uuid string, projectId string, archived bool) error
+	// DeleteProject also revokes the api keys restricted to the project
+	DeleteProject(uuid string, projectId string) error
+	MoveTask(userId string, taskId string, projectId *int, ifMatch []int64) (int64, error)
+	SetTaskParent(userId string, taskId string, parentId *int, ifMatch []int64) (int64, error)
+	AddChecklistItem(userId string, taskId string, item types.ChecklistItemPayload) (types.ChecklistItemResponse, error)
+	GetChecklistItems(userId string, taskId string) ([]types.ChecklistItemResponse, error)
+	EditChecklistItem(userId string, taskId string, itemId string, item types.ChecklistItemPayload) error
+	SetChecklistItemChecked(userId string, taskId string, itemId string, checked bool) error
+	DeleteChecklistItem(userId string, taskId string, itemId string) error
+	Close() error
+}
+
+var _ Store = (*DB)(nil)
+
+// Open connects to the backend selected by the configured driver
+func Open(cfg config.Database) (Store, error) {
+	switch cfg.Driver {
+	case MySQL, SQLite:
+		db := New(cfg)
+		return db, db.Connect()
+	case Memory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("Unknown database driver %q", cfg.Driver)
+	}
+}
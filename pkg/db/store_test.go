@@ -0,0 +1,64 @@
+package db
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/types"
+)
+
+// forEachStore runs the test against a memory store and a migrated sqlite database, so both
+// backends are held to the same behavior
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+
+	t.Run("sqlite", func(t *testing.T) {
+		store := New(config.Database{Driver: SQLite, Path: filepath.Join(t.TempDir(), "jason.db")})
+		if err := store.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		if _, err := store.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		test(t, store)
+	})
+}
+
+// addUser creates a user and returns its id
+func addUser(t *testing.T, store Store, email string) string {
+	t.Helper()
+
+	if err := store.AddNewUser(types.User{UserLoginPayload: types.UserLoginPayload{Email: email, Password: "hash"}}); err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := store.GetUuidFromEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uuid
+}
+
+func addTask(t *testing.T, store Store, uuid string, title string) int {
+	t.Helper()
+
+	id, err := store.AddNewTask(types.NewTaskPayload{Title: title}, uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func readTask(t *testing.T, store Store, uuid string, id int) types.SqlTasksRow {
+	t.Helper()
+
+	task, err := store.GetTaskById(uuid, strconv.Itoa(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+// Counts the top level task, so a top level task can have subtasks four levels down
+const maxTaskDepth = 5
+
+var (
+	NoParentTaskFoundError = errors.New("No parent task found")
+	SubtaskDepthError      = errors.New("Subtasks cannot be nested more than 5 levels deep")
+	SubtaskCycleError      = errors.New("A task cannot be moved under itself or one of its subtasks")
+)
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func queryIds(q queryer, query string, args ...any) ([]int, error) {
+	var ids []int
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return ids, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err = rows.Scan(&id); err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// subtree returns the task and all of its subtasks, along with how many levels the subtree spans
+func subtree(q queryer, userId string, taskId int) ([]int, int, error) {
+	return subtreeWhere(q, userId, taskId, " AND deleted_at IS NULL")
+}
+
+// trashedSubtree is subtree for a task in the trash. Only the subtasks buried by the same delete,
+// which share its tombstone revision, belong to it, subtasks deleted on their own before it stay
+// in the trash
+func trashedSubtree(q queryer, userId string, taskId int) ([]int, int, error) {
+	condition := ` AND deleted_at IS NOT NULL AND id IN (SELECT task_id FROM task_tombstones WHERE user_id = ? AND revision =
+	(SELECT revision FROM task_tombstones WHERE user_id = ? AND task_id = ?))`
+	return subtreeWhere(q, userId, taskId, condition, userId, userId, taskId)
+}
+
+// subtreeWhere walks down the subtasks matching condition, which takes conditionArgs
+func subtreeWhere(q queryer, userId string, taskId int, condition string, conditionArgs ...any) ([]int, int, error) {
+	ids := []int{taskId}
+	level := []int{taskId}
+	height := 1
+
+	for {
+		args := []any{userId}
+		for _, id := range level {
+			args = append(args, id)
+		}
+		args = append(args, conditionArgs...)
+
+		children, err := queryIds(q, "SELECT id FROM tasks WHERE user_id = ? AND parent_id IN ("+placeholders(len(level))+")"+condition, args...)
+		if err != nil || len(children) == 0 {
+			return ids, height, err
+		}
+
+		ids = append(ids, children...)
+		level = children
+		height++
+		// Only reachable if the stored tree is already broken
+		if height > maxTaskDepth+1 {
+			return ids, height, SubtaskDepthError
+		}
+	}
+}
+
+// taskDepth is 1 for a top level task
+func taskDepth(q queryer, userId string, taskId int) (int, error) {
+	depth := 1
+	for {
+		var parentId sql.NullInt64
+		err := q.QueryRow("SELECT parent_id FROM tasks WHERE user_id = ? AND id = ?", userId, taskId).Scan(&parentId)
+		if err != nil || !parentId.Valid {
+			return depth, err
+		}
+
+		taskId = int(parentId.Int64)
+		depth++
+		if depth > maxTaskDepth+1 {
+			return depth, SubtaskDepthError
+		}
+	}
+}
+
+// checkParent ensures a subtree spanning height levels fits under the parent
+func checkParent(tx *sql.Tx, userId string, parentId int, height int) error {
+	if _, err := taskExists(tx, userId, parentId); err != nil {
+		if errors.Is(err, NoTasksFoundError) {
+			return NoParentTaskFoundError
+		}
+		return err
+	}
+
+	depth, err := taskDepth(tx, userId, parentId)
+	if err != nil {
+		return err
+	}
+	if depth+height > maxTaskDepth {
+		return SubtaskDepthError
+	}
+	return nil
+}
+
+// countByTask runs a query returning a task id, a total and a completed count on each row
+func (db *DB) countByTask(query string, userId string) (map[int][2]int, error) {
+	counts := map[int][2]int{}
+	rows, err := db.conn.Query(query, userId)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, total, completed int
+		if err = rows.Scan(&id, &total, &completed); err != nil {
+			return counts, err
+		}
+		counts[id] = [2]int{total, completed}
+	}
+	return counts, rows.Err()
+}
+
+// Fills in the subtask and checklist counts of every task
+func (db *DB) attachProgress(userId string, tasks []types.SqlTasksRow) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	subtasks, err := db.countByTask(`SELECT parent_id, COUNT(*), SUM(CASE WHEN completed THEN 1 ELSE 0 END)
+	FROM tasks WHERE user_id = ? AND parent_id IS NOT NULL AND deleted_at IS NULL
+	GROUP BY parent_id`, userId)
+	if err != nil {
+		return err
+	}
+
+	checklist, err := db.countByTask(`SELECT task_id, COUNT(*), SUM(CASE WHEN checked THEN 1 ELSE 0 END)
+	FROM checklist_items WHERE user_id = ?
+	GROUP BY task_id`, userId)
+	if err != nil {
+		return err
+	}
+
+	for i := range tasks {
+		progress := &tasks[i].Progress
+		progress.Subtasks, progress.CompletedSubtasks = subtasks[tasks[i].Id][0], subtasks[tasks[i].Id][1]
+		progress.ChecklistItems, progress.CheckedChecklistItems = checklist[tasks[i].Id][0], checklist[tasks[i].Id][1]
+	}
+	return nil
+}
+
+// SetTaskParent moves the task, with its subtasks, under another task or to the top level when parentId is nil
+func (db *DB) SetTaskParent(userId string, taskId string, parentId *int, ifMatch []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return 0, err
+	}
+
+	if parentId != nil {
+		ids, height, err := subtree(tx, userId, id)
+		if err != nil {
+			return 0, err
+		}
+		for _, subtaskId := range ids {
+			if subtaskId == *parentId {
+				return 0, SubtaskCycleError
+			}
+		}
+
+		if err = checkParent(tx, userId, *parentId, height); err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE tasks SET parent_id = ? WHERE user_id = ? AND id = ?", parentId, userId, id)
+	if err != nil {
+		return 0, err
+	}
+	if err = db.touchTasks(tx, userId, id); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, id)
+	if err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit()
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func setParent(t *testing.T, store Store, uuid string, id int, parentId int) {
+	t.Helper()
+
+	if _, err := store.SetTaskParent(uuid, strconv.Itoa(id), &parentId, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addChain adds n tasks, each one a subtask of the one before
+func addChain(t *testing.T, store Store, uuid string, n int) []int {
+	t.Helper()
+
+	var ids []int
+	for i := 0; i < n; i++ {
+		id := addTask(t, store, uuid, "level "+strconv.Itoa(i+1))
+		if i > 0 {
+			setParent(t, store, uuid, id, ids[i-1])
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestSubtaskDepth(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		chain := addChain(t, store, uuid, maxTaskDepth)
+
+		deepest := chain[len(chain)-1]
+		tooDeep := addTask(t, store, uuid, "too deep")
+		if _, err := store.SetTaskParent(uuid, strconv.Itoa(tooDeep), &deepest, nil); !errors.Is(err, SubtaskDepthError) {
+			t.Fatalf("got %v nesting below the depth limit", err)
+		}
+		if _, err := store.AddNewTask(types.NewTaskPayload{Title: "too deep", ParentId: &deepest}, uuid); !errors.Is(err, SubtaskDepthError) {
+			t.Fatalf("got %v adding below the depth limit", err)
+		}
+
+		// A task moves with its subtasks, so the whole subtree has to fit
+		pair := addChain(t, store, uuid, 2)
+		fits := chain[len(chain)-3]
+		if _, err := store.SetTaskParent(uuid, strconv.Itoa(pair[0]), &chain[len(chain)-2], nil); !errors.Is(err, SubtaskDepthError) {
+			t.Fatalf("got %v moving a subtree below the depth limit", err)
+		}
+		setParent(t, store, uuid, pair[0], fits)
+
+		unknown := 100
+		if _, err := store.SetTaskParent(uuid, strconv.Itoa(tooDeep), &unknown, nil); !errors.Is(err, NoParentTaskFoundError) {
+			t.Fatalf("got %v for an unknown parent", err)
+		}
+		if _, err := store.SetTaskParent(uuid, strconv.Itoa(pair[0]), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		if task := readTask(t, store, uuid, pair[0]); task.ParentId.Valid {
+			t.Fatalf("task is still under %d", task.ParentId.Int64)
+		}
+	})
+}
+
+func TestSubtaskCycles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		chain := addChain(t, store, uuid, 3)
+
+		for _, parentId := range []int{chain[0], chain[2]} {
+			if _, err := store.SetTaskParent(uuid, strconv.Itoa(chain[0]), &parentId, nil); !errors.Is(err, SubtaskCycleError) {
+				t.Fatalf("got %v moving a task under %d", err, parentId)
+			}
+		}
+		if task := readTask(t, store, uuid, chain[0]); task.ParentId.Valid {
+			t.Fatalf("a refused move left the task under %d", task.ParentId.Int64)
+		}
+	})
+}
+
+func TestSubtaskProgress(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		chain := addChain(t, store, uuid, 3)
+		parent, child, grandchild := chain[0], chain[1], chain[2]
+		sibling := addTask(t, store, uuid, "sibling")
+		setParent(t, store, uuid, sibling, parent)
+
+		for _, title := range []string{"first", "second"} {
+			if _, err := store.AddChecklistItem(uuid, strconv.Itoa(parent), types.ChecklistItemPayload{Title: title}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		items, err := store.GetChecklistItems(uuid, strconv.Itoa(parent))
+		if err != nil || len(items) != 2 {
+			t.Fatalf("got items %+v: %v", items, err)
+		}
+		if err = store.SetChecklistItemChecked(uuid, strconv.Itoa(parent), strconv.Itoa(items[0].Id), true); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.MarkTaskCompleted(uuid, strconv.Itoa(sibling), false, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		// Progress counts direct subtasks only
+		expected := types.TaskProgress{Subtasks: 2, CompletedSubtasks: 1, ChecklistItems: 2, CheckedChecklistItems: 1}
+		if progress := readTask(t, store, uuid, parent).Progress; progress != expected {
+			t.Fatalf("got progress %+v", progress)
+		}
+		if progress := readTask(t, store, uuid, child).Progress; progress != (types.TaskProgress{Subtasks: 1}) {
+			t.Fatalf("got progress %+v", progress)
+		}
+
+		// Without cascade only the task itself is completed
+		if _, err = store.MarkTaskCompleted(uuid, strconv.Itoa(child), false, nil); err != nil {
+			t.Fatal(err)
+		}
+		if readTask(t, store, uuid, grandchild).Completed {
+			t.Fatal("completing without cascade completed a subtask")
+		}
+		if _, err = store.MarkTaskCompleted(uuid, strconv.Itoa(parent), true, nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []int{parent, child, grandchild, sibling} {
+			if !readTask(t, store, uuid, id).Completed {
+				t.Fatalf("task %d was not completed with its parent", id)
+			}
+		}
+		if progress := readTask(t, store, uuid, parent).Progress; progress.CompletedSubtasks != 2 {
+			t.Fatalf("got progress %+v", progress)
+		}
+	})
+}
+
+func TestDeleteParentTask(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		chain := addChain(t, store, uuid, 3)
+		kept := addTask(t, store, uuid, "kept")
+
+		if err := store.DeleteTask(uuid, strconv.Itoa(chain[0]), nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range chain {
+			if _, err := store.GetTaskById(uuid, strconv.Itoa(id)); !errors.Is(err, NoTasksFoundError) {
+				t.Fatalf("got %v reading task %d after deleting its parent", err, id)
+			}
+		}
+		readTask(t, store, uuid, kept)
+
+		trashed, err := store.GetTrash(uuid)
+		if err != nil || len(trashed) != len(chain) {
+			t.Fatalf("got trash %+v: %v", trashed, err)
+		}
+	})
+}
+
+func TestChecklistItems(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		taskId := strconv.Itoa(addTask(t, store, uuid, "task"))
+
+		item, err := store.AddChecklistItem(uuid, taskId, types.ChecklistItemPayload{Title: "  milk "})
+		if err != nil || item.Title != "milk" || item.Checked {
+			t.Fatalf("got item %+v: %v", item, err)
+		}
+		itemId := strconv.Itoa(item.Id)
+
+		if _, err = store.AddChecklistItem(uuid, taskId, types.ChecklistItemPayload{Title: " "}); !errors.Is(err, InvalidChecklistItemError) {
+			t.Fatalf("got %v adding an empty item", err)
+		}
+		if _, err = store.AddChecklistItem(uuid, "100", types.ChecklistItemPayload{Title: "eggs"}); !errors.Is(err, NoTasksFoundError) {
+			t.Fatalf("got %v adding to an unknown task", err)
+		}
+
+		if err = store.EditChecklistItem(uuid, taskId, itemId, types.ChecklistItemPayload{Title: "oat milk"}); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.SetChecklistItemChecked(uuid, taskId, itemId, true); err != nil {
+			t.Fatal(err)
+		}
+		items, err := store.GetChecklistItems(uuid, taskId)
+		if err != nil || len(items) != 1 || items[0].Title != "oat milk" || !items[0].Checked {
+			t.Fatalf("got items %+v: %v", items, err)
+		}
+
+		if err = store.EditChecklistItem(uuid, taskId, "100", types.ChecklistItemPayload{Title: "eggs"}); !errors.Is(err, NoChecklistItemsFoundError) {
+			t.Fatalf("got %v editing an unknown item", err)
+		}
+		if err = store.DeleteChecklistItem(uuid, taskId, itemId); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.DeleteChecklistItem(uuid, taskId, itemId); !errors.Is(err, NoChecklistItemsFoundError) {
+			t.Fatalf("got %v deleting a deleted item", err)
+		}
+		if items, err = store.GetChecklistItems(uuid, taskId); err != nil || len(items) != 0 {
+			t.Fatalf("got items %+v: %v", items, err)
+		}
+	})
+}
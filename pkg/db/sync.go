@@ -0,0 +1,155 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+var (
+	InvalidSyncTokenError = errors.New("Sync token is not valid, sync again without one")
+	VersionMismatchError  = errors.New("Task has changed since it was read")
+)
+
+// nextRevision bumps the user's change counter. The users row stays locked until the transaction
+// ends on mysql and sqlite transactions are opened immediate, so revisions are handed out in commit order
+func (db *DB) nextRevision(tx *sql.Tx, userId string) (int64, error) {
+	var revision int64
+	if _, err := tx.Exec("UPDATE users SET revision = revision + 1 WHERE id = ?", userId); err != nil {
+		return revision, err
+	}
+	err := tx.QueryRow("SELECT revision FROM users WHERE id = ?", userId).Scan(&revision)
+	if err == sql.ErrNoRows {
+		return revision, NoTasksFoundError
+	}
+	return revision, err
+}
+
+// checkRevision fails unless the task is at one of the ifMatch revisions, a nil ifMatch always passes.
+// On mysql the task stays locked until the transaction ends so it cannot change before it is written
+func (db *DB) checkRevision(tx *sql.Tx, userId string, taskId int, ifMatch []int64) error {
+	if ifMatch == nil {
+		return nil
+	}
+
+	query := "SELECT revision FROM tasks WHERE user_id = ? AND id = ?"
+	if db.driver == MySQL {
+		query += " FOR UPDATE"
+	}
+	var revision int64
+	if err := tx.QueryRow(query, userId, taskId).Scan(&revision); err != nil {
+		return err
+	}
+	if !slices.Contains(ifMatch, revision) {
+		return VersionMismatchError
+	}
+	return nil
+}
+
+// taskRevision is the revision the transaction left the task at
+func taskRevision(tx *sql.Tx, userId string, taskId any) (int64, error) {
+	var revision int64
+	err := tx.QueryRow("SELECT revision FROM tasks WHERE user_id = ? AND id = ?", userId, taskId).Scan(&revision)
+	return revision, err
+}
+
+// touchTasks records a change to the tasks, so the next sync picks them up
+func (db *DB) touchTasks(tx *sql.Tx, userId string, ids ...int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	revision, err := db.nextRevision(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	args := []any{revision, userId}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := "UPDATE tasks SET revision = ?, updated_at = " + db.now() + " WHERE user_id = ? AND id IN (" + placeholders(len(ids)) + ")"
+	_, err = tx.Exec(query, args...)
+	return err
+}
+
+// buryTasks leaves tombstones for tasks that are being deleted
+func (db *DB) buryTasks(tx *sql.Tx, userId string, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	revision, err := db.nextRevision(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	var args []any
+	for _, id := range ids {
+		args = append(args, userId, id, revision)
+	}
+	values := strings.TrimSuffix(strings.Repeat("(?, ?, ?), ", len(ids)), ", ")
+	_, err = tx.Exec("INSERT INTO task_tombstones (user_id, task_id, revision) VALUES "+values, args...)
+	return err
+}
+
+// GetTaskChanges lists the tasks changed and deleted after the since revision, zero lists every task.
+// Everything is read in one transaction so the returned revision covers exactly what was listed
+func (db *DB) GetTaskChanges(uuid string, since int64) (types.TaskChanges, error) {
+	var changes types.TaskChanges
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return changes, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT revision FROM users WHERE id = ?", uuid).Scan(&changes.Revision)
+	if err != nil {
+		return changes, err
+	}
+	if since < 0 || since > changes.Revision {
+		return changes, InvalidSyncTokenError
+	}
+
+	after := "revision > ?"
+	if since == 0 {
+		// Tasks untouched since before revisions existed are still at zero
+		after = "revision >= ?"
+	}
+	query := "SELECT " + taskColumns + " FROM tasks WHERE user_id = ? AND deleted_at IS NULL AND " + after + " AND revision <= ? ORDER BY id"
+	rows, err := tx.Query(query, uuid, since, changes.Revision)
+	if err != nil {
+		return changes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row types.SqlTasksRow
+		if err = scanTask(rows, &row); err != nil {
+			return changes, err
+		}
+		changes.Tasks = append(changes.Tasks, row)
+	}
+	if err = rows.Err(); err != nil {
+		return changes, err
+	}
+
+	if since > 0 {
+		query = "SELECT task_id FROM task_tombstones WHERE user_id = ? AND revision > ? AND revision <= ? ORDER BY task_id"
+		if changes.Deleted, err = queryIds(tx, query, uuid, since, changes.Revision); err != nil {
+			return changes, err
+		}
+	}
+
+	if err = db.attachTags(uuid, changes.Tasks); err != nil {
+		return changes, err
+	}
+	if err = db.attachProgress(uuid, changes.Tasks); err != nil {
+		return changes, err
+	}
+	return changes, tx.Commit()
+}
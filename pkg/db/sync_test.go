@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func changedIds(changes types.TaskChanges) []int {
+	var ids []int
+	for _, task := range changes.Tasks {
+		ids = append(ids, task.Id)
+	}
+	return ids
+}
+
+func TestGetTaskChanges(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		other := addUser(t, store, "other@example.com")
+
+		kept := addTask(t, store, uuid, "kept")
+		edited := addTask(t, store, uuid, "edited")
+		deleted := addTask(t, store, uuid, "deleted")
+		addTask(t, store, other, "not mine")
+
+		all, err := store.GetTaskChanges(uuid, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := changedIds(all); !slices.Equal(ids, []int{kept, edited, deleted}) || len(all.Deleted) != 0 {
+			t.Fatalf("got %v and deleted %v", ids, all.Deleted)
+		}
+
+		edit := types.EditTaskPayload{Id: edited, Title: types.PatchField[string]{Set: true, Value: "was edited"}}
+		if _, err = store.EditTask(uuid, edit, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = store.DeleteTask(uuid, strconv.Itoa(deleted), nil); err != nil {
+			t.Fatal(err)
+		}
+		added := addTask(t, store, uuid, "added")
+
+		changes, err := store.GetTaskChanges(uuid, all.Revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := changedIds(changes); !slices.Equal(ids, []int{edited, added}) {
+			t.Fatalf("got changed %v", ids)
+		}
+		if !slices.Equal(changes.Deleted, []int{deleted}) {
+			t.Fatalf("got deleted %v", changes.Deleted)
+		}
+		for _, task := range changes.Tasks {
+			if task.Revision <= all.Revision || task.Revision > changes.Revision {
+				t.Fatalf("task %d has revision %d outside (%d, %d]", task.Id, task.Revision, all.Revision, changes.Revision)
+			}
+			if (task.Id == added) != (task.CreatedRevision > all.Revision) {
+				t.Fatalf("task %d has created revision %d", task.Id, task.CreatedRevision)
+			}
+		}
+
+		// Purging the task keeps its tombstone
+		if err = store.PurgeTask(uuid, strconv.Itoa(deleted), nil); err != nil {
+			t.Fatal(err)
+		}
+		if changes, err = store.GetTaskChanges(uuid, all.Revision); err != nil || !slices.Equal(changes.Deleted, []int{deleted}) {
+			t.Fatalf("got deleted %v after purging: %v", changes.Deleted, err)
+		}
+
+		if _, err = store.GetTaskChanges(uuid, changes.Revision+1); !errors.Is(err, InvalidSyncTokenError) {
+			t.Fatalf("got %v for a token from the future", err)
+		}
+	})
+}
+
+func TestConditionalChanges(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		id := strconv.Itoa(addTask(t, store, uuid, "task"))
+
+		changes := []func(ifMatch []int64) (int64, error){
+			func(ifMatch []int64) (int64, error) { return store.MarkTaskCompleted(uuid, id, false, ifMatch) },
+			func(ifMatch []int64) (int64, error) { return store.MarkTaskIncomplete(uuid, id, ifMatch) },
+			func(ifMatch []int64) (int64, error) { return store.AddTagsToTask(uuid, id, []string{"home"}, ifMatch) },
+			func(ifMatch []int64) (int64, error) {
+				return store.RemoveTagsFromTask(uuid, id, []string{"home"}, ifMatch)
+			},
+			func(ifMatch []int64) (int64, error) { return store.MoveTask(uuid, id, nil, ifMatch) },
+			func(ifMatch []int64) (int64, error) { return store.SetTaskParent(uuid, id, nil, ifMatch) },
+		}
+		for i, change := range changes {
+			task, err := store.GetTaskById(uuid, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = change([]int64{task.Revision + 100}); !errors.Is(err, VersionMismatchError) {
+				t.Fatalf("change %d got %v for a stale version", i, err)
+			}
+
+			revision, err := change([]int64{task.Revision})
+			if err != nil {
+				t.Fatalf("change %d: %v", i, err)
+			}
+			if changed, _ := store.GetTaskById(uuid, id); revision <= task.Revision || revision != changed.Revision {
+				t.Fatalf("change %d returned revision %d, task is at %d", i, revision, changed.Revision)
+			}
+		}
+
+		task, err := store.GetTaskById(uuid, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = store.DeleteTask(uuid, id, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.RestoreTask(uuid, id, []int64{task.Revision + 100}); !errors.Is(err, VersionMismatchError) {
+			t.Fatalf("got %v restoring a stale version", err)
+		}
+		if err = store.PurgeTask(uuid, id, []int64{task.Revision + 100}); !errors.Is(err, VersionMismatchError) {
+			t.Fatalf("got %v purging a stale version", err)
+		}
+		revision, err := store.RestoreTask(uuid, id, []int64{task.Revision})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored, _ := store.GetTaskById(uuid, id); revision != restored.Revision {
+			t.Fatalf("restore returned revision %d, task is at %d", revision, restored.Revision)
+		}
+	})
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+const maxTagLength = 64
+
+var (
+	NoTagsFoundError             = errors.New("No tag found with this name")
+	InvalidTagError              = errors.New("Tags must be between 1 and 64 characters long")
+	TagUniquenessConstraintError = errors.New("There is already a tag with this name")
+)
+
+// normalizeTags trims, lowercases and deduplicates tag names so every backend compares them the same way
+func normalizeTags(tags []string) ([]string, error) {
+	var result []string
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxTagLength {
+			return nil, InvalidTagError
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// insertIgnore starts an insert that silently skips rows violating a unique constraint
+func (db *DB) insertIgnore() string {
+	if db.driver == SQLite {
+		return "INSERT OR IGNORE"
+	}
+	return "INSERT IGNORE"
+}
+
+// Creates any missing tags and attaches all of them to the task
+func (db *DB) addTags(tx *sql.Tx, userId string, taskId int, tags []string) error {
+	for _, tag := range tags {
+		_, err := tx.Exec(db.insertIgnore()+" INTO tags (user_id, name) VALUES (?, ?)", userId, tag)
+		if err != nil {
+			return err
+		}
+
+		query := db.insertIgnore() + " INTO task_tags (user_id, task_id, tag_id) SELECT ?, ?, id FROM tags WHERE user_id = ? AND name = ?"
+		if _, err = tx.Exec(query, userId, taskId, userId, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) getTaskTags(userId string, taskId int) ([]string, error) {
+	var result []string
+	query := `SELECT t.name FROM task_tags tt JOIN tags t ON t.id = tt.tag_id
+	WHERE tt.user_id = ? AND tt.task_id = ?
+	ORDER BY t.name`
+
+	rows, err := db.conn.Query(query, userId, taskId)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return result, err
+		}
+		result = append(result, name)
+	}
+	return result, rows.Err()
+}
+
+// Listings without a limit can hold more tasks than a statement takes parameters
+const attachTagsChunk = 500
+
+// Fills in the tags of every task, querying only the task_tags rows of the given tasks
+func (db *DB) attachTags(userId string, tasks []types.SqlTasksRow) error {
+	for start := 0; start < len(tasks); start += attachTagsChunk {
+		end := min(start+attachTagsChunk, len(tasks))
+		if err := db.attachTagsChunk(userId, tasks[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) attachTagsChunk(userId string, tasks []types.SqlTasksRow) error {
+	byId := map[int]*types.SqlTasksRow{}
+	args := []any{userId}
+	for i := range tasks {
+		byId[tasks[i].Id] = &tasks[i]
+		args = append(args, tasks[i].Id)
+	}
+
+	query := `SELECT tt.task_id, t.name FROM task_tags tt JOIN tags t ON t.id = tt.tag_id
+	WHERE tt.user_id = ? AND tt.task_id IN (` + placeholders(len(tasks)) + `)
+	ORDER BY t.name`
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			taskId int
+			name   string
+		)
+		if err = rows.Scan(&taskId, &name); err != nil {
+			return err
+		}
+		if task, ok := byId[taskId]; ok {
+			task.Tags = append(task.Tags, name)
+		}
+	}
+	return rows.Err()
+}
+
+func taskExists(tx *sql.Tx, userId string, taskId any) (int, error) {
+	var id int
+	err := tx.QueryRow("SELECT id FROM tasks WHERE user_id = ? AND id = ? AND deleted_at IS NULL", userId, taskId).Scan(&id)
+	if err == sql.ErrNoRows {
+		return id, NoTasksFoundError
+	}
+	return id, err
+}
+
+func (db *DB) AddTagsToTask(userId string, taskId string, tags []string, ifMatch []int64) (int64, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return 0, err
+	}
+
+	if err = db.addTags(tx, userId, id, tags); err != nil {
+		return 0, err
+	}
+	if err = db.touchTasks(tx, userId, id); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, id)
+	if err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit()
+}
+
+func (db *DB) RemoveTagsFromTask(userId string, taskId string, tags []string, ifMatch []int64) (int64, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := taskExists(tx, userId, taskId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return 0, err
+	}
+
+	if len(tags) > 0 {
+		query := `DELETE FROM task_tags WHERE user_id = ? AND task_id = ? AND tag_id IN (
+		SELECT id FROM tags WHERE user_id = ? AND name IN (` + placeholders(len(tags)) + `))`
+		args := []any{userId, id, userId}
+		for _, tag := range tags {
+			args = append(args, tag)
+		}
+		if _, err = tx.Exec(query, args...); err != nil {
+			return 0, err
+		}
+	}
+	if err = db.touchTasks(tx, userId, id); err != nil {
+		return 0, err
+	}
+	revision, err := taskRevision(tx, userId, id)
+	if err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit()
+}
+
+func (db *DB) GetAllTags(uuid string) ([]types.TagResponse, error) {
+	var result []types.TagResponse
+	query := `SELECT t.name, COUNT(k.id) FROM tags t
+	LEFT JOIN task_tags tt ON tt.tag_id = t.id
+	LEFT JOIN tasks k ON k.user_id = tt.user_id AND k.id = tt.task_id AND k.deleted_at IS NULL
+	WHERE t.user_id = ?
+	GROUP BY t.id, t.name
+	ORDER BY t.name`
+
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(uuid)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row types.TagResponse
+		if err = rows.Scan(&row.Name, &row.TaskCount); err != nil {
+			return result, err
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// taggedTasks lists the ids of the tasks outside the trash the tag is attached to
+func taggedTasks(tx *sql.Tx, userId string, name string) ([]int, error) {
+	query := `SELECT tt.task_id FROM task_tags tt
+	JOIN tags t ON t.id = tt.tag_id
+	JOIN tasks k ON k.user_id = tt.user_id AND k.id = tt.task_id
+	WHERE t.user_id = ? AND t.name = ? AND k.deleted_at IS NULL`
+	return queryIds(tx, query, userId, name)
+}
+
+func (db *DB) RenameTag(uuid string, name string, newName string) error {
+	tags, err := normalizeTags([]string{name, newName})
+	if err != nil {
+		return err
+	}
+	// Both names normalize to the same tag
+	if len(tags) == 1 {
+		return nil
+	}
+	name, newName = strings.ToLower(strings.TrimSpace(name)), strings.ToLower(strings.TrimSpace(newName))
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE tags SET name = ? WHERE user_id = ? AND name = ?", newName, uuid, name)
+	if err != nil {
+		if db.isUniqueConstraintError(err) {
+			return TagUniquenessConstraintError
+		}
+		return err
+	}
+
+	if v, _ := result.RowsAffected(); v == 0 {
+		return NoTagsFoundError
+	}
+
+	ids, err := taggedTasks(tx, uuid, newName)
+	if err != nil {
+		return err
+	}
+	if err = db.touchTasks(tx, uuid, ids...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) DeleteTag(uuid string, name string) error {
+	tags, err := normalizeTags([]string{name})
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ids, err := taggedTasks(tx, uuid, tags[0])
+	if err != nil {
+		return err
+	}
+
+	// Attached tasks lose the tag through the cascading foreign key
+	result, err := tx.Exec("DELETE FROM tags WHERE user_id = ? AND name = ?", uuid, tags[0])
+	if err != nil {
+		return err
+	}
+
+	if v, _ := result.RowsAffected(); v == 0 {
+		return NoTagsFoundError
+	}
+	if err = db.touchTasks(tx, uuid, ids...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func taggedIds(t *testing.T, store Store, uuid string, tags ...string) []int {
+	t.Helper()
+
+	tasks, err := store.GetAllTasksByUser(uuid, types.TaskFilter{Tags: tags, Sort: types.SortById})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+	return ids
+}
+
+func TestTags(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		first := addTask(t, store, uuid, "first")
+		second := addTask(t, store, uuid, "second")
+		untagged := addTask(t, store, uuid, "untagged")
+
+		// Names are trimmed, lowercased, deduplicated and sorted
+		if _, err := store.AddTagsToTask(uuid, strconv.Itoa(first), []string{" Work ", "work", "HOME"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if tags := readTask(t, store, uuid, first).Tags; !slices.Equal(tags, []string{"home", "work"}) {
+			t.Fatalf("got tags %v", tags)
+		}
+		if _, err := store.AddTagsToTask(uuid, strconv.Itoa(second), []string{"work"}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, bad := range [][]string{{""}, {"  "}, {strings.Repeat("a", maxTagLength+1)}} {
+			if _, err := store.AddTagsToTask(uuid, strconv.Itoa(first), bad, nil); !errors.Is(err, InvalidTagError) {
+				t.Fatalf("got %v adding %q", err, bad)
+			}
+		}
+		if _, err := store.AddTagsToTask(uuid, "100", []string{"work"}, nil); !errors.Is(err, NoTasksFoundError) {
+			t.Fatalf("got %v tagging an unknown task", err)
+		}
+
+		// Filtering needs every tag, in any spelling
+		if ids := taggedIds(t, store, uuid, "WORK"); !slices.Equal(ids, []int{first, second}) {
+			t.Fatalf("got %v tagged work", ids)
+		}
+		if ids := taggedIds(t, store, uuid, "work", "home"); !slices.Equal(ids, []int{first}) {
+			t.Fatalf("got %v tagged work and home", ids)
+		}
+		if ids := taggedIds(t, store, uuid); !slices.Equal(ids, []int{first, second, untagged}) {
+			t.Fatalf("got %v without a filter", ids)
+		}
+
+		// A page carries the tags of its own tasks
+		page, err := store.GetAllTasksByUser(uuid, types.TaskFilter{Sort: types.SortById, Desc: true, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != 2 || len(page[0].Tags) != 0 || !slices.Equal(page[1].Tags, []string{"work"}) {
+			t.Fatalf("got page %+v", page)
+		}
+
+		tags, err := store.GetAllTags(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(tags, []types.TagResponse{{Name: "home", TaskCount: 1}, {Name: "work", TaskCount: 2}}) {
+			t.Fatalf("got tags %+v", tags)
+		}
+
+		if _, err = store.RemoveTagsFromTask(uuid, strconv.Itoa(first), []string{"HOME"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if tags := readTask(t, store, uuid, first).Tags; !slices.Equal(tags, []string{"work"}) {
+			t.Fatalf("got tags %v after removing home", tags)
+		}
+	})
+}
+
+func TestRenameAndDeleteTags(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		other := addUser(t, store, "someone.else@example.com")
+		first := addTask(t, store, uuid, "first")
+		second := addTask(t, store, uuid, "second")
+		theirs := addTask(t, store, other, "theirs")
+
+		if _, err := store.AddTagsToTask(uuid, strconv.Itoa(first), []string{"home", "work"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.AddTagsToTask(uuid, strconv.Itoa(second), []string{"work"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.AddTagsToTask(other, strconv.Itoa(theirs), []string{"work"}, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.RenameTag(uuid, "home", "Work"); !errors.Is(err, TagUniquenessConstraintError) {
+			t.Fatalf("got %v renaming onto an existing tag", err)
+		}
+		if err := store.RenameTag(uuid, "missing", "other"); !errors.Is(err, NoTagsFoundError) {
+			t.Fatalf("got %v renaming an unknown tag", err)
+		}
+		if err := store.RenameTag(uuid, "home", ""); !errors.Is(err, InvalidTagError) {
+			t.Fatalf("got %v renaming to an empty tag", err)
+		}
+		if err := store.RenameTag(uuid, "home", " HOME "); err != nil {
+			t.Fatalf("renaming to the same tag failed: %v", err)
+		}
+
+		if err := store.RenameTag(uuid, "work", "Office"); err != nil {
+			t.Fatal(err)
+		}
+		if tags := readTask(t, store, uuid, first).Tags; !slices.Equal(tags, []string{"home", "office"}) {
+			t.Fatalf("got tags %v after renaming", tags)
+		}
+		if ids := taggedIds(t, store, uuid, "office"); !slices.Equal(ids, []int{first, second}) {
+			t.Fatalf("got %v tagged office", ids)
+		}
+		// Tags belong to their user
+		if tags := readTask(t, store, other, theirs).Tags; !slices.Equal(tags, []string{"work"}) {
+			t.Fatalf("another user's tags became %v", tags)
+		}
+
+		// Deleting a tag takes it off every task
+		if err := store.DeleteTag(uuid, "OFFICE"); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteTag(uuid, "office"); !errors.Is(err, NoTagsFoundError) {
+			t.Fatalf("got %v deleting a deleted tag", err)
+		}
+		if tags := readTask(t, store, uuid, first).Tags; !slices.Equal(tags, []string{"home"}) {
+			t.Fatalf("got tags %v after deleting", tags)
+		}
+		if tags := readTask(t, store, uuid, second).Tags; len(tags) != 0 {
+			t.Fatalf("got tags %v after deleting", tags)
+		}
+		if ids := taggedIds(t, store, uuid, "office"); len(ids) != 0 {
+			t.Fatalf("got %v tagged with a deleted tag", ids)
+		}
+		tags, err := store.GetAllTags(uuid)
+		if err != nil || !slices.Equal(tags, []types.TagResponse{{Name: "home", TaskCount: 1}}) {
+			t.Fatalf("got tags %+v: %v", tags, err)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+// trashedTask returns the parent of a task in the trash
+func trashedTask(tx *sql.Tx, userId string, taskId any) (int, sql.NullInt64, error) {
+	var id int
+	var parentId sql.NullInt64
+	err := tx.QueryRow("SELECT id, parent_id FROM tasks WHERE user_id = ? AND id = ? AND deleted_at IS NOT NULL", userId, taskId).Scan(&id, &parentId)
+	if err == sql.ErrNoRows {
+		return id, parentId, NoTasksFoundError
+	}
+	return id, parentId, err
+}
+
+// olderThan matches rows whose column lies more than a number of seconds in the past, the cutoff is
+// taken from the database clock since that is the one deleted_at was set with
+func (db *DB) olderThan(column string) string {
+	if db.driver == SQLite {
+		return db.timeExpr(column) + " < " + db.timeExpr("datetime('now', ?)")
+	}
+	return column + " < " + db.now() + " - INTERVAL ? SECOND"
+}
+
+func (db *DB) GetTrash(uuid string) ([]types.SqlTasksRow, error) {
+	var tasks []types.SqlTasksRow
+	query := "SELECT " + taskColumns + " FROM tasks WHERE user_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id ASC"
+
+	stmt, err := db.conn.Prepare(query)
+	if err != nil {
+		return tasks, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(uuid)
+	if err != nil {
+		return tasks, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row types.SqlTasksRow
+		if err = scanTask(rows, &row); err != nil {
+			return tasks, err
+		}
+		tasks = append(tasks, row)
+	}
+	if err = rows.Err(); err != nil {
+		return tasks, err
+	}
+
+	if err = db.attachTags(uuid, tasks); err != nil {
+		return tasks, err
+	}
+	return tasks, db.attachProgress(uuid, tasks)
+}
+
+// RestoreTask brings the task back from the trash along with the subtasks deleted with it. A task
+// whose parent is gone, or that no longer fits under it, comes back at the top level. Syncing
+// clients see the restored tasks as created
+func (db *DB) RestoreTask(userId string, taskId string, ifMatch []int64) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, parentId, err := trashedTask(tx, userId, taskId)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return 0, err
+	}
+
+	ids, height, err := trashedSubtree(tx, userId, id)
+	if err != nil {
+		return 0, err
+	}
+
+	if parentId.Valid {
+		err = checkParent(tx, userId, int(parentId.Int64), height)
+		if errors.Is(err, NoParentTaskFoundError) || errors.Is(err, SubtaskDepthError) {
+			_, err = tx.Exec("UPDATE tasks SET parent_id = NULL WHERE user_id = ? AND id = ?", userId, id)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	revision, err := db.nextRevision(tx, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	args := []any{revision, revision, userId}
+	for _, subtaskId := range ids {
+		args = append(args, subtaskId)
+	}
+	query := "UPDATE tasks SET deleted_at = NULL, updated_at = " + db.now() + ", created_revision = ?, revision = ? WHERE user_id = ? AND id IN (" + placeholders(len(ids)) + ")"
+	if _, err = tx.Exec(query, args...); err != nil {
+		return 0, err
+	}
+
+	query = "DELETE FROM task_tombstones WHERE user_id = ? AND task_id IN (" + placeholders(len(ids)) + ")"
+	if _, err = tx.Exec(query, args[2:]...); err != nil {
+		return 0, err
+	}
+	return revision, tx.Commit()
+}
+
+// PurgeTask permanently deletes a task in the trash together with the subtasks deleted with it.
+// Subtasks that were deleted on their own stay in the trash and come back at the top level
+func (db *DB) PurgeTask(userId string, taskId string, ifMatch []int64) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, _, err := trashedTask(tx, userId, taskId)
+	if err != nil {
+		return err
+	}
+
+	if err = db.checkRevision(tx, userId, id, ifMatch); err != nil {
+		return err
+	}
+
+	ids, _, err := trashedSubtree(tx, userId, id)
+	if err != nil {
+		return err
+	}
+
+	args := []any{userId}
+	for _, subtaskId := range ids {
+		args = append(args, subtaskId)
+	}
+	// Detached first, mysql would otherwise cascade the delete to them
+	query := "UPDATE tasks SET parent_id = NULL WHERE user_id = ? AND parent_id IN (" + placeholders(len(ids)) + ") AND id NOT IN (" + placeholders(len(ids)) + ")"
+	if _, err = tx.Exec(query, append(args, args[1:]...)...); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM tasks WHERE user_id = ? AND id IN ("+placeholders(len(ids))+")", args...)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *DB) EmptyTrash(uuid string) error {
+	stmt, err := db.conn.Prepare("DELETE FROM tasks WHERE user_id = ? AND deleted_at IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(uuid)
+	return err
+}
+
+// Subtasks go to the trash with or before their parent, so they are purged no later than it
+func (db *DB) PurgeTrash(retention time.Duration) (int, error) {
+	var arg any = int64(retention.Seconds())
+	if db.driver == SQLite {
+		arg = fmt.Sprintf("-%d seconds", int64(retention.Seconds()))
+	}
+
+	result, err := db.conn.Exec("DELETE FROM tasks WHERE deleted_at IS NOT NULL AND "+db.olderThan("deleted_at"), arg)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
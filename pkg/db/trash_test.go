@@ -0,0 +1,223 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+func trashIds(t *testing.T, store Store, uuid string) []int {
+	t.Helper()
+
+	trash, err := store.GetTrash(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, task := range trash {
+		ids = append(ids, task.Id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func deleteTask(t *testing.T, store Store, uuid string, id int) {
+	t.Helper()
+
+	if err := store.DeleteTask(uuid, strconv.Itoa(id), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addFamily adds a parent with two subtasks
+func addFamily(t *testing.T, store Store, uuid string) (int, int, int) {
+	t.Helper()
+
+	parent := addTask(t, store, uuid, "parent")
+	first := addTask(t, store, uuid, "first")
+	second := addTask(t, store, uuid, "second")
+	setParent(t, store, uuid, first, parent)
+	setParent(t, store, uuid, second, parent)
+	return parent, first, second
+}
+
+func TestRestoreTask(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		parent, first, second := addFamily(t, store, uuid)
+
+		// The first subtask is deleted on its own before its parent
+		deleteTask(t, store, uuid, first)
+		deleteTask(t, store, uuid, parent)
+		if ids := trashIds(t, store, uuid); !slices.Equal(ids, []int{parent, first, second}) {
+			t.Fatalf("got trash %v", ids)
+		}
+
+		trashed, err := store.GetTrash(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = store.RestoreTask(uuid, strconv.Itoa(parent), []int64{trashed[0].Revision + 100}); !errors.Is(err, VersionMismatchError) {
+			t.Fatalf("got %v restoring a changed task", err)
+		}
+		if _, err = store.RestoreTask(uuid, "100", nil); !errors.Is(err, NoTasksFoundError) {
+			t.Fatalf("got %v restoring an unknown task", err)
+		}
+
+		// Only what the parent's delete took comes back with it
+		if _, err = store.RestoreTask(uuid, strconv.Itoa(parent), nil); err != nil {
+			t.Fatal(err)
+		}
+		if ids := trashIds(t, store, uuid); !slices.Equal(ids, []int{first}) {
+			t.Fatalf("got trash %v after restoring the parent", ids)
+		}
+		if task := readTask(t, store, uuid, second); !task.ParentId.Valid || int(task.ParentId.Int64) != parent {
+			t.Fatalf("restored subtask has parent %+v", task.ParentId)
+		}
+		if _, err = store.RestoreTask(uuid, strconv.Itoa(parent), nil); !errors.Is(err, NoTasksFoundError) {
+			t.Fatalf("got %v restoring a task outside the trash", err)
+		}
+
+		// Restored on its own, the subtask goes back under its parent
+		if _, err = store.RestoreTask(uuid, strconv.Itoa(first), nil); err != nil {
+			t.Fatal(err)
+		}
+		if task := readTask(t, store, uuid, first); !task.ParentId.Valid || int(task.ParentId.Int64) != parent {
+			t.Fatalf("restored subtask has parent %+v", task.ParentId)
+		}
+		if progress := readTask(t, store, uuid, parent).Progress; progress.Subtasks != 2 {
+			t.Fatalf("got progress %+v", progress)
+		}
+	})
+}
+
+func TestRestoreSubtaskWithoutParent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		parent, first, _ := addFamily(t, store, uuid)
+
+		// A subtask whose parent is still in the trash comes back at the top level
+		deleteTask(t, store, uuid, first)
+		deleteTask(t, store, uuid, parent)
+		if _, err := store.RestoreTask(uuid, strconv.Itoa(first), nil); err != nil {
+			t.Fatal(err)
+		}
+		if task := readTask(t, store, uuid, first); task.ParentId.Valid {
+			t.Fatalf("restored subtask is under %d", task.ParentId.Int64)
+		}
+	})
+}
+
+func TestPurgeTask(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		parent, first, second := addFamily(t, store, uuid)
+		if _, err := store.AddChecklistItem(uuid, strconv.Itoa(second), types.ChecklistItemPayload{Title: "item"}); err != nil {
+			t.Fatal(err)
+		}
+
+		deleteTask(t, store, uuid, first)
+		deleteTask(t, store, uuid, parent)
+		if err := store.PurgeTask(uuid, strconv.Itoa(addTask(t, store, uuid, "live")), nil); !errors.Is(err, NoTasksFoundError) {
+			t.Fatalf("got %v purging a task outside the trash", err)
+		}
+
+		// The subtask deleted on its own survives its parent being purged
+		if err := store.PurgeTask(uuid, strconv.Itoa(parent), nil); err != nil {
+			t.Fatal(err)
+		}
+		if ids := trashIds(t, store, uuid); !slices.Equal(ids, []int{first}) {
+			t.Fatalf("got trash %v after purging the parent", ids)
+		}
+		for _, id := range []int{parent, second} {
+			if _, err := store.RestoreTask(uuid, strconv.Itoa(id), nil); !errors.Is(err, NoTasksFoundError) {
+				t.Fatalf("got %v restoring purged task %d", err, id)
+			}
+		}
+
+		if _, err := store.RestoreTask(uuid, strconv.Itoa(first), nil); err != nil {
+			t.Fatal(err)
+		}
+		if task := readTask(t, store, uuid, first); task.ParentId.Valid {
+			t.Fatalf("subtask of a purged task is under %d", task.ParentId.Int64)
+		}
+	})
+}
+
+func TestEmptyTrash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		uuid := addUser(t, store, "someone@example.com")
+		other := addUser(t, store, "someone.else@example.com")
+		parent, _, _ := addFamily(t, store, uuid)
+		live := addTask(t, store, uuid, "live")
+		deleteTask(t, store, uuid, parent)
+		theirs := addTask(t, store, other, "theirs")
+		deleteTask(t, store, other, theirs)
+
+		if err := store.EmptyTrash(uuid); err != nil {
+			t.Fatal(err)
+		}
+		if ids := trashIds(t, store, uuid); len(ids) != 0 {
+			t.Fatalf("got trash %v after emptying it", ids)
+		}
+		readTask(t, store, uuid, live)
+		if ids := trashIds(t, store, other); !slices.Equal(ids, []int{theirs}) {
+			t.Fatalf("emptying the trash changed another user's trash to %v", ids)
+		}
+	})
+}
+
+// trashAt moves the time a trashed task was deleted
+func trashAt(t *testing.T, store Store, uuid string, id int, deletedAt time.Time) {
+	t.Helper()
+
+	switch store := store.(type) {
+	case *DB:
+		if _, err := store.conn.Exec("UPDATE tasks SET deleted_at = ? WHERE user_id = ? AND id = ?", deletedAt.UTC(), uuid, id); err != nil {
+			t.Fatal(err)
+		}
+	case *MemoryStore:
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		store.trash[uuid][id].DeletedAt.Time = deletedAt
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		const retention = 24 * time.Hour
+		cutoff := time.Now().Add(-retention)
+
+		var expired []int
+		for _, email := range []string{"someone@example.com", "someone.else@example.com"} {
+			uuid := addUser(t, store, email)
+			old, recent := addTask(t, store, uuid, "old"), addTask(t, store, uuid, "recent")
+			deleteTask(t, store, uuid, old)
+			deleteTask(t, store, uuid, recent)
+			trashAt(t, store, uuid, old, cutoff.Add(-time.Minute))
+			trashAt(t, store, uuid, recent, cutoff.Add(time.Minute))
+			expired = append(expired, old)
+
+			defer func(uuid string, recent int) {
+				if ids := trashIds(t, store, uuid); !slices.Equal(ids, []int{recent}) {
+					t.Errorf("got trash %v after purging", ids)
+				}
+			}(uuid, recent)
+		}
+
+		purged, err := store.PurgeTrash(retention)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if purged != len(expired) {
+			t.Fatalf("purged %d tasks, expected %d", purged, len(expired))
+		}
+		if purged, err = store.PurgeTrash(retention); err != nil || purged != 0 {
+			t.Fatalf("purged %d more tasks: %v", purged, err)
+		}
+	})
+}
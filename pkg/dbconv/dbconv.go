@@ -1,11 +1,28 @@
 package dbconv
 
 import (
+	"database/sql"
 	"time"
 
 	"github.com/senyc/jason/pkg/types"
 )
 
+// Tags are always sent as a list, even when a task has none
+func tags(r types.SqlTasksRow) []string {
+	if r.Tags == nil {
+		return []string{}
+	}
+	return r.Tags
+}
+
+func nullableId(id sql.NullInt64) *int {
+	if !id.Valid {
+		return nil
+	}
+	result := int(id.Int64)
+	return &result
+}
+
 func ToTaskResponse(r types.SqlTasksRow) (types.TaskReponse, error) {
 	var completedDate *time.Time
 	result := types.TaskReponse{
@@ -16,10 +33,17 @@ func ToTaskResponse(r types.SqlTasksRow) (types.TaskReponse, error) {
 		Priority:      r.Priority,
 		Completed:     r.Completed,
 		CompletedDate: completedDate,
+		TimeCreated:   r.TimeCreated,
+		ProjectId:     nullableId(r.ProjectId),
+		ParentId:      nullableId(r.ParentId),
+		Recurrence:    r.Recurrence.String,
+		UpdatedAt:     r.UpdatedAt,
+		Tags:          tags(r),
+		Progress:      r.Progress,
 	}
 
 	if r.Due.Valid {
-		result.Due = types.NullTime{r.Due.Time}
+		result.Due = types.NullTime{Time: r.Due.Time}
 	}
 
 	if r.Body.Valid {
@@ -30,6 +54,10 @@ func ToTaskResponse(r types.SqlTasksRow) (types.TaskReponse, error) {
 		result.CompletedDate = &r.CompletedDate.Time
 	}
 
+	if r.DeletedAt.Valid {
+		result.DeletedAt = &r.DeletedAt.Time
+	}
+
 	return result, nil
 }
 
@@ -41,10 +69,14 @@ func ToCompletedTaskResponse(r types.SqlTasksRow) (types.CompletedTaskResponse,
 		Due:           types.NullTime{},
 		Priority:      r.Priority,
 		CompletedDate: time.Time{},
+		ProjectId:     nullableId(r.ProjectId),
+		ParentId:      nullableId(r.ParentId),
+		Recurrence:    r.Recurrence.String,
+		Tags:          tags(r),
 	}
 
 	if r.Due.Valid {
-		result.Due = types.NullTime{r.Due.Time}
+		result.Due = types.NullTime{Time: r.Due.Time}
 	}
 
 	if r.CompletedDate.Valid {
@@ -60,15 +92,19 @@ func ToCompletedTaskResponse(r types.SqlTasksRow) (types.CompletedTaskResponse,
 
 func ToIncompleteTaskResponse(r types.SqlTasksRow) (types.IncompleteTaskResponse, error) {
 	result := types.IncompleteTaskResponse{
-		Id:       r.Id,
-		Title:    r.Title,
-		Body:     "",
-		Due:      types.NullTime{},
-		Priority: r.Priority,
+		Id:         r.Id,
+		Title:      r.Title,
+		Body:       "",
+		Due:        types.NullTime{},
+		Priority:   r.Priority,
+		ProjectId:  nullableId(r.ProjectId),
+		ParentId:   nullableId(r.ParentId),
+		Recurrence: r.Recurrence.String,
+		Tags:       tags(r),
 	}
 
 	if r.Due.Valid {
-		result.Due = types.NullTime{r.Due.Time}
+		result.Due = types.NullTime{Time: r.Due.Time}
 	}
 
 	if r.Body.Valid {
@@ -0,0 +1,284 @@
+package recurrence
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Supports the subset of RFC 5545 RRULEs made of FREQ (DAILY, WEEKLY, MONTHLY or YEARLY),
+// INTERVAL, BYDAY without ordinals and one of UNTIL or COUNT
+
+var InvalidRuleError = errors.New("Invalid recurrence rule")
+
+type Frequency string
+
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+	Yearly  Frequency = "YEARLY"
+)
+
+var weekdays = map[string]time.Weekday{
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+	"SU": time.Sunday,
+}
+
+// Weeks start on monday, the RFC 5545 default for WKST
+var weekdayNames = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+const untilFormat = "20060102T150405Z"
+
+// Gives up on rules that can never produce another occurrence, like the 30th of february
+const maxSteps = 1000
+
+type Rule struct {
+	Freq     Frequency
+	Interval int
+	// Empty means every day the frequency lands on
+	ByDay []time.Weekday
+	// Zero means no end date
+	Until time.Time
+	// Zero means no limit on the number of occurrences
+	Count int
+}
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", InvalidRuleError, fmt.Sprintf(format, args...))
+}
+
+// Parse reads a rule like "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", the RRULE: prefix is optional
+func Parse(rule string) (Rule, error) {
+	result := Rule{Interval: 1}
+	rule = strings.TrimSpace(rule)
+	if strings.HasPrefix(strings.ToUpper(rule), "RRULE:") {
+		rule = rule[len("RRULE:"):]
+	}
+
+	seen := map[string]bool{}
+	for _, part := range strings.Split(rule, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		key = strings.ToUpper(strings.TrimSpace(key))
+		value = strings.ToUpper(strings.TrimSpace(value))
+		if !ok || value == "" {
+			return result, invalid("%q is not a KEY=VALUE pair", part)
+		}
+		if seen[key] {
+			return result, invalid("%s is given more than once", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			result.Freq = Frequency(value)
+			if result.Freq != Daily && result.Freq != Weekly && result.Freq != Monthly && result.Freq != Yearly {
+				return result, invalid("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return result, invalid("INTERVAL must be a positive number")
+			}
+			result.Interval = interval
+		case "BYDAY":
+			for _, name := range strings.Split(value, ",") {
+				day, ok := weekdays[strings.TrimSpace(name)]
+				if !ok {
+					return result, invalid("BYDAY only supports plain weekdays like MO or SU, not %q", name)
+				}
+				result.ByDay = append(result.ByDay, day)
+			}
+		case "UNTIL":
+			until, err := parseUntil(value)
+			if err != nil {
+				return result, err
+			}
+			result.Until = until
+		case "COUNT":
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 1 {
+				return result, invalid("COUNT must be a positive number")
+			}
+			result.Count = count
+		default:
+			return result, invalid("%s is not supported", key)
+		}
+	}
+
+	if result.Freq == "" {
+		return result, invalid("FREQ is required")
+	}
+	if !result.Until.IsZero() && result.Count != 0 {
+		return result, invalid("UNTIL and COUNT cannot be used together")
+	}
+	return result, nil
+}
+
+// Dates without a time end at the last second of the day, times without a zone are taken as UTC
+func parseUntil(value string) (time.Time, error) {
+	if until, err := time.Parse("20060102", value); err == nil {
+		return until.Add(24*time.Hour - time.Second), nil
+	}
+	if until, err := time.Parse(untilFormat, value); err == nil {
+		return until, nil
+	}
+	if until, err := time.Parse("20060102T150405", value); err == nil {
+		return until, nil
+	}
+	return time.Time{}, invalid("UNTIL must look like 20240131 or 20240131T090000Z")
+}
+
+// String formats the rule in a canonical form, so equal rules are stored the same way
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, name := range weekdayNames {
+			if r.onDay(weekdays[name]) {
+				days = append(days, name)
+			}
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format(untilFormat))
+	}
+	if r.Count != 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	return strings.Join(parts, ";")
+}
+
+func (r Rule) onDay(day time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, d := range r.ByDay {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the occurrence following current, where occurrence is the zero based position of
+// current in the series. It returns false once the series is over
+func (r Rule) Next(current time.Time, occurrence int) (time.Time, bool) {
+	if r.Count != 0 && occurrence+1 >= r.Count {
+		return time.Time{}, false
+	}
+
+	next, ok := r.next(current)
+	if !ok || (!r.Until.IsZero() && next.After(r.Until)) {
+		return time.Time{}, false
+	}
+	return next, true
+}
+
+// Occurrences returns up to n occurrences following current
+func (r Rule) Occurrences(current time.Time, occurrence int, n int) []time.Time {
+	var result []time.Time
+	for len(result) < n {
+		next, ok := r.Next(current, occurrence)
+		if !ok {
+			break
+		}
+		result = append(result, next)
+		current = next
+		occurrence++
+	}
+	return result
+}
+
+// Keeps the time of day and location of t
+func date(t time.Time, year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+func (r Rule) next(current time.Time) (time.Time, bool) {
+	year, month, day := current.Date()
+
+	switch {
+	case r.Freq == Daily:
+		for step := 1; step <= maxSteps; step++ {
+			candidate := date(current, year, month, day+step*r.Interval)
+			if r.onDay(candidate.Weekday()) {
+				return candidate, true
+			}
+		}
+
+	case len(r.ByDay) == 0 && r.Freq == Weekly:
+		return date(current, year, month, day+7*r.Interval), true
+
+	// Months and years without the day are skipped rather than clamped, as RFC 5545 requires
+	case len(r.ByDay) == 0 && r.Freq == Monthly:
+		for step := 1; step <= maxSteps; step++ {
+			candidate := date(current, year, month+time.Month(step*r.Interval), day)
+			if candidate.Day() == day {
+				return candidate, true
+			}
+		}
+
+	case len(r.ByDay) == 0 && r.Freq == Yearly:
+		for step := 1; step <= maxSteps; step++ {
+			candidate := date(current, year+step*r.Interval, month, day)
+			if candidate.Month() == month && candidate.Day() == day {
+				return candidate, true
+			}
+		}
+
+	// With BYDAY every matching day of the week, month or year is an occurrence, the rest of the
+	// current period is searched first and then the period interval steps ahead
+	default:
+		var periodStart, periodEnd time.Time
+		switch r.Freq {
+		case Weekly:
+			// Days since monday
+			offset := (int(current.Weekday()) + 6) % 7
+			periodStart = date(current, year, month, day-offset)
+			periodEnd = periodStart.AddDate(0, 0, 7)
+		case Monthly:
+			periodStart = date(current, year, month, 1)
+			periodEnd = periodStart.AddDate(0, 1, 0)
+		case Yearly:
+			periodStart = date(current, year, time.January, 1)
+			periodEnd = periodStart.AddDate(1, 0, 0)
+		}
+
+		for candidate := current.AddDate(0, 0, 1); candidate.Before(periodEnd); candidate = candidate.AddDate(0, 0, 1) {
+			if r.onDay(candidate.Weekday()) {
+				return candidate, true
+			}
+		}
+
+		switch r.Freq {
+		case Weekly:
+			periodStart = periodStart.AddDate(0, 0, 7*r.Interval)
+		case Monthly:
+			periodStart = periodStart.AddDate(0, r.Interval, 0)
+		case Yearly:
+			periodStart = periodStart.AddDate(r.Interval, 0, 0)
+		}
+		// Every weekday occurs within the first week of any period
+		for candidate := periodStart; ; candidate = candidate.AddDate(0, 0, 1) {
+			if r.onDay(candidate.Weekday()) {
+				return candidate, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
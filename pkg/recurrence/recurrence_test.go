@@ -0,0 +1,126 @@
+package recurrence
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"FREQ=DAILY", "FREQ=DAILY"},
+		{"RRULE:freq=weekly;interval=2;byday=th,mo", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH"},
+		{"FREQ=MONTHLY;INTERVAL=1", "FREQ=MONTHLY"},
+		{"FREQ=YEARLY;COUNT=3", "FREQ=YEARLY;COUNT=3"},
+		{"FREQ=DAILY;UNTIL=20240131", "FREQ=DAILY;UNTIL=20240131T235959Z"},
+		{"FREQ=DAILY;UNTIL=20240131T090000Z;", "FREQ=DAILY;UNTIL=20240131T090000Z"},
+	}
+	for _, test := range tests {
+		rule, err := Parse(test.rule)
+		if err != nil {
+			t.Errorf("Parse(%q) failed: %v", test.rule, err)
+			continue
+		}
+		if got := rule.String(); got != test.want {
+			t.Errorf("Parse(%q) = %q, want %q", test.rule, got, test.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=DAILY;COUNT=2;UNTIL=20240131",
+		"FREQ=DAILY;UNTIL=tomorrow",
+		"FREQ=DAILY;BYMONTH=1",
+		"FREQ",
+	} {
+		if _, err := Parse(rule); !errors.Is(err, InvalidRuleError) {
+			t.Errorf("Parse(%q) = %v, want InvalidRuleError", rule, err)
+		}
+	}
+}
+
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 9, 30, 0, 0, time.UTC)
+}
+
+func TestOccurrences(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		start time.Time
+		want  []time.Time
+	}{
+		{
+			"daily", "FREQ=DAILY;INTERVAL=2", day(2024, time.January, 30),
+			[]time.Time{day(2024, time.February, 1), day(2024, time.February, 3), day(2024, time.February, 5)},
+		},
+		{
+			"weekdays", "FREQ=DAILY;BYDAY=MO,TU,WE,TH,FR", day(2024, time.February, 1),
+			[]time.Time{day(2024, time.February, 2), day(2024, time.February, 5), day(2024, time.February, 6)},
+		},
+		{
+			// 2024-02-01 is a thursday
+			"weekly by day", "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", day(2024, time.February, 1),
+			[]time.Time{day(2024, time.February, 12), day(2024, time.February, 15), day(2024, time.February, 26)},
+		},
+		{
+			"months without the day are skipped", "FREQ=MONTHLY", day(2024, time.January, 31),
+			[]time.Time{day(2024, time.March, 31), day(2024, time.May, 31), day(2024, time.July, 31)},
+		},
+		{
+			"leap day", "FREQ=YEARLY", day(2024, time.February, 29),
+			[]time.Time{day(2028, time.February, 29), day(2032, time.February, 29), day(2036, time.February, 29)},
+		},
+		{
+			"until", "FREQ=WEEKLY;UNTIL=20240215", day(2024, time.February, 1),
+			[]time.Time{day(2024, time.February, 8), day(2024, time.February, 15)},
+		},
+		{
+			"never again", "FREQ=YEARLY;BYDAY=MO;UNTIL=20240101", day(2024, time.January, 1),
+			nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := Parse(test.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := rule.Occurrences(test.start, 0, 3)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if !got[i].Equal(test.want[i]) {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNextCount(t *testing.T) {
+	rule, err := Parse("FREQ=DAILY;COUNT=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The series starts with the occurrence at position 0, so two more follow it
+	start := day(2024, time.January, 1)
+	if got := rule.Occurrences(start, 0, 5); len(got) != 2 {
+		t.Fatalf("got %v, want two occurrences", got)
+	}
+	if _, ok := rule.Next(day(2024, time.January, 3), 2); ok {
+		t.Fatal("the third occurrence should end the series")
+	}
+}
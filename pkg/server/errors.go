@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+// Machine readable codes sent in every error response
+const (
+	codeBadRequest         = "bad_request"
+	codeInvalidBody        = "invalid_body"
+	codeMissingId          = "missing_id"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codeNotApplied         = "not_applied"
+	codePreconditionFailed = "precondition_failed"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeInsufficientScope  = "insufficient_scope"
+	codeInternal           = "internal_error"
+)
+
+// apiError is what handlers return when a request fails, Err is the underlying cause
+// which is logged but never sent to the client
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *apiError) Unwrap() error {
+	return e.Err
+}
+
+// handlerFunc is a handler that reports failures by returning them instead of writing them
+type handlerFunc func(w http.ResponseWriter, req *http.Request) error
+
+func newApiError(status int, code string, err error) *apiError {
+	return &apiError{Status: status, Code: code, Message: err.Error(), Err: err}
+}
+
+func badRequest(err error) *apiError {
+	return newApiError(http.StatusBadRequest, codeBadRequest, err)
+}
+
+func invalidBody(err error) *apiError {
+	return &apiError{Status: http.StatusBadRequest, Code: codeInvalidBody, Message: invalidBodyError.Error(), Err: err}
+}
+
+func notFound(err error) *apiError {
+	return newApiError(http.StatusNotFound, codeNotFound, err)
+}
+
+func unauthorized(err error) *apiError {
+	return newApiError(http.StatusUnauthorized, codeUnauthorized, err)
+}
+
+func forbidden(err error) *apiError {
+	return &apiError{Status: http.StatusForbidden, Code: codeForbidden, Message: "Forbidden", Err: err}
+}
+
+func internalError(err error) *apiError {
+	return &apiError{Status: http.StatusInternalServerError, Code: codeInternal, Message: "Internal server error", Err: err}
+}
+
+// handle adapts a handlerFunc to net/http, any returned error is written as an ErrResponse
+func (s *Server) handle(h handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := h(w, req); err != nil {
+			s.writeError(w, req, err)
+		}
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, req *http.Request, err error) {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		apiErr = internalError(err)
+	}
+
+	requestId := requestIdFromContext(req.Context())
+	if apiErr.Status >= http.StatusInternalServerError {
+		s.logger.Printf("request %s failed: %v", requestId, apiErr)
+	}
+
+	res := types.ErrResponse{
+		Code:      apiErr.Code,
+		Message:   apiErr.Message,
+		Status:    apiErr.Status,
+		RequestId: requestId,
+	}
+	j, err := json.Marshal(res)
+	if err != nil {
+		s.logger.Println(err)
+		http.Error(w, http.StatusText(apiErr.Status), apiErr.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	w.Write(j)
+}
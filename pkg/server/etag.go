@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	etagHeader    = "ETag"
+	ifMatchHeader = "If-Match"
+)
+
+// A task's revision changes whenever the task does, so it doubles as its version
+func etag(revision int64) string {
+	return `"` + strconv.FormatInt(revision, 10) + `"`
+}
+
+// ifMatchFromHeader returns the revisions listed in If-Match, or nil when any version will do.
+// Weak and malformed tags are skipped since If-Match compares strongly, if nothing is left the
+// request can never match
+func ifMatchFromHeader(req *http.Request) []int64 {
+	values := req.Header.Values(ifMatchHeader)
+	if len(values) == 0 {
+		return nil
+	}
+
+	revisions := []int64{}
+	for _, tag := range strings.Split(strings.Join(values, ","), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+		if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			continue
+		}
+		if revision, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64); err == nil {
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions
+}
@@ -1,14 +1,21 @@
 package server
 
 import (
+	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/senyc/jason/pkg/auth"
-	"github.com/senyc/jason/pkg/contact"
 	"github.com/senyc/jason/pkg/db"
 	"github.com/senyc/jason/pkg/dbconv"
+	"github.com/senyc/jason/pkg/recurrence"
 
 	"github.com/senyc/jason/pkg/types"
 )
@@ -18,817 +25,1550 @@ var (
 	noIdFound         error = errors.New("No identification provided")
 	incorrectPassword error = errors.New("Incorrect password, please try again")
 	noLoginExists     error = errors.New("No login exists for this email address, please try again")
-	noPasswordExists     error = errors.New("Password has been reset, please enter a new password")
+	noPasswordExists  error = errors.New("Password has been reset, please enter a new password")
+	invalidBodyError  error = errors.New("Request body is not valid json for this endpoint")
+	invalidResetToken error = errors.New("Password reset link is invalid or has already been used")
+	invalidProjectId  error = errors.New("Project id must be a number")
+	noItemIdFound     error = errors.New("No checklist item identification provided")
+	notRecurring      error = errors.New("Task does not recur")
+	invalidPreviewN   error = errors.New("n must be a number between 1 and 100")
+	noSearchQuery     error = errors.New("No search query provided")
+	invalidCompleted  error = errors.New("completed must be true or false")
+	invalidLimit      error = errors.New("limit must be a number between 1 and 100")
+	invalidPriority   error = errors.New("minPriority and maxPriority must be numbers")
+	invalidTime       error = errors.New("Dates must look like 2024-01-31 or 2024-01-31T09:00:00Z")
+	invalidSort       error = errors.New("sort must be due, priority, created or id")
+	invalidOrder      error = errors.New("order must be asc or desc")
+	invalidCursor     error = errors.New("Cursor is not valid for this sort order")
+	invalidSearchPage error = errors.New("Cursor is not valid for this search")
+	invalidBatchSize  error = fmt.Errorf("A batch needs between 1 and %d operations", maxBatchOperations)
+	noBatchTask       error = errors.New("create and edit operations need a valid task")
+	batchTaskId       error = errors.New("edit operations take the task id from the operation, not from the task")
 )
 
-func (s *Server) getCompletedTasks(w http.ResponseWriter, req *http.Request) {
-	var res []types.CompletedTaskResponse
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
+func userIdFromContext(req *http.Request) (string, error) {
+	uuid, ok := req.Context().Value("userId").(string)
 	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+		return uuid, internalError(noContext)
+	}
+	return uuid, nil
+}
+
+func sessionIdFromContext(req *http.Request) (string, error) {
+	sessionId, ok := req.Context().Value("sessionId").(string)
+	if !ok {
+		return sessionId, internalError(noContext)
+	}
+	return sessionId, nil
+}
+
+func idFromQuery(req *http.Request) (string, error) {
+	id := req.URL.Query().Get("id")
+	if id == "" {
+		return id, newApiError(http.StatusBadRequest, codeMissingId, noIdFound)
+	}
+	return id, nil
+}
+
+func itemIdFromQuery(req *http.Request) (string, error) {
+	id := req.URL.Query().Get("item")
+	if id == "" {
+		return id, newApiError(http.StatusBadRequest, codeMissingId, noItemIdFound)
+	}
+	return id, nil
+}
+
+func decodeBody(req *http.Request, v any) error {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		return invalidBody(err)
+	}
+	return nil
+}
+
+// decodePatch is decodeBody for merge patches, which are rejected when they have members the
+// endpoint does not know
+func decodePatch(r io.Reader, v any) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return invalidBody(err)
+	}
+	return nil
+}
+
+// writeJson only fails before anything has been sent, so the caller can still respond with an error
+func writeJson(w http.ResponseWriter, status int, v any) error {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+	return nil
+}
+
+// Maps the store errors shared by every task endpoint
+func taskError(err error) error {
+	switch {
+	case errors.Is(err, db.NoTasksFoundError), errors.Is(err, db.NoTagsFoundError), errors.Is(err, db.NoProjectsFoundError),
+		errors.Is(err, db.NoParentTaskFoundError), errors.Is(err, db.NoChecklistItemsFoundError):
+		return notFound(err)
+	case errors.Is(err, db.InvalidTagError), errors.Is(err, db.InvalidProjectNameError), errors.Is(err, db.InvalidProjectColorError),
+		errors.Is(err, db.SubtaskDepthError), errors.Is(err, db.SubtaskCycleError), errors.Is(err, db.InvalidChecklistItemError),
+		errors.Is(err, recurrence.InvalidRuleError), errors.Is(err, db.RecurrenceWithoutDueError), errors.Is(err, db.InvalidSearchQueryError),
+		errors.Is(err, db.InvalidSyncTokenError), errors.Is(err, db.EmptyEditError), errors.Is(err, db.InvalidTitleError):
+		return badRequest(err)
+	case errors.Is(err, db.TagUniquenessConstraintError), errors.Is(err, db.ProjectUniquenessConstraintError), errors.Is(err, db.ArchivedProjectError):
+		return newApiError(http.StatusConflict, codeConflict, err)
+	case errors.Is(err, db.VersionMismatchError):
+		return newApiError(http.StatusPreconditionFailed, codePreconditionFailed, err)
+	}
+	return err
+}
+
+// Every ?tag= parameter has to match, so tag=work&tag=urgent only lists tasks tagged with both.
+// Sorting and paging parameters are read by pageFromQuery
+func taskFilterFromQuery(req *http.Request) (types.TaskFilter, error) {
+	query := req.URL.Query()
+	filter := types.TaskFilter{Tags: query["tag"]}
+
+	if project := query.Get("project"); project != "" {
+		projectId, err := strconv.Atoi(project)
+		if err != nil {
+			return filter, badRequest(invalidProjectId)
+		}
+		filter.ProjectId = &projectId
+	}
+	// Keys restricted to a project only list its tasks
+	if keyProject, ok := apiKeyProject(req); ok {
+		if filter.ProjectId != nil && *filter.ProjectId != keyProject {
+			return filter, newApiError(http.StatusForbidden, codeInsufficientScope, outsideKeyProject)
+		}
+		filter.ProjectId = &keyProject
+	}
+
+	var err error
+	if filter.MinPriority, err = priorityFromQuery(query, "minPriority"); err != nil {
+		return filter, err
+	}
+	if filter.MaxPriority, err = priorityFromQuery(query, "maxPriority"); err != nil {
+		return filter, err
+	}
+	if filter.DueAfter, err = timeFromQuery(query, "dueAfter"); err != nil {
+		return filter, err
+	}
+	if filter.DueBefore, err = timeFromQuery(query, "dueBefore"); err != nil {
+		return filter, err
+	}
+	if filter.CreatedAfter, err = timeFromQuery(query, "createdAfter"); err != nil {
+		return filter, err
+	}
+	if filter.CreatedBefore, err = timeFromQuery(query, "createdBefore"); err != nil {
+		return filter, err
+	}
+
+	return pageFromQuery(req, filter)
+}
+
+func (s *Server) getCompletedTasks(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	filter, err := taskFilterFromQuery(req)
+	if err != nil {
+		return err
+	}
+
+	completedTasks, err := s.db.GetCompletedTasks(uuid, withPeek(filter))
+	if err != nil {
+		return taskError(err)
+	}
+	completedTasks, nextCursor := paginate(filter, completedTasks)
+	res := []types.CompletedTaskResponse{}
+
+	for _, row := range completedTasks {
+		task, _ := dbconv.ToCompletedTaskResponse(row)
+		res = append(res, task)
+	}
+
+	if err = s.db.UpdateLastAccessedToNow(uuid); err != nil {
+		return err
+	}
+
+	return writeListing(w, filter, res, nextCursor)
+}
+
+func (s *Server) getIncompleteTasks(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	filter, err := taskFilterFromQuery(req)
+	if err != nil {
+		return err
+	}
+
+	incompleteTasks, err := s.db.GetIncompleteTasks(uuid, withPeek(filter))
+	if err != nil {
+		return taskError(err)
+	}
+	incompleteTasks, nextCursor := paginate(filter, incompleteTasks)
+	res := []types.IncompleteTaskResponse{}
+
+	for _, row := range incompleteTasks {
+		task, _ := dbconv.ToIncompleteTaskResponse(row)
+		res = append(res, task)
+	}
+
+	if err = s.db.UpdateLastAccessedToNow(uuid); err != nil {
+		return err
+	}
+
+	return writeListing(w, filter, res, nextCursor)
+}
+
+const defaultSearchLimit = 20
+
+// searchFromQuery reads ?q=, ?completed=, ?limit= and ?cursor=
+func searchFromQuery(req *http.Request) (types.TaskSearch, error) {
+	query := req.URL.Query()
+	search := types.TaskSearch{Query: query.Get("q"), Limit: defaultSearchLimit}
+	if strings.TrimSpace(search.Query) == "" {
+		return search, badRequest(noSearchQuery)
+	}
+
+	if param := query.Get("completed"); param != "" {
+		completed, err := strconv.ParseBool(param)
+		if err != nil {
+			return search, badRequest(invalidCompleted)
+		}
+		search.Completed = &completed
+	}
+
+	if param := query.Get("limit"); param != "" {
+		limit, err := limitFromParam(param)
+		if err != nil {
+			return search, err
+		}
+		search.Limit = limit
+	}
+
+	if param := query.Get("cursor"); param != "" {
+		cursor, err := decodeCursor[types.SearchCursor](param)
+		if err != nil {
+			return search, err
+		}
+		// A cursor only means something for the search it was made for
+		if cursor.Query != search.Query || !equalCompleted(cursor.Completed, search.Completed) || cursor.Offset < 0 {
+			return search, badRequest(invalidSearchPage)
+		}
+		search.Offset = cursor.Offset
+	}
+	return search, nil
+}
+
+func equalCompleted(a *bool, b *bool) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
+
+func (s *Server) searchTasks(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	search, err := searchFromQuery(req)
+	if err != nil {
+		return err
+	}
+
+	// One extra task tells whether there is another page
+	limit := search.Limit
+	search.Limit++
+	tasks, err := s.db.SearchTasks(uuid, search)
+	if err != nil {
+		return taskError(err)
+	}
+
+	res := types.Page[types.TaskReponse]{Items: []types.TaskReponse{}}
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+		cursor := encodeCursor(types.SearchCursor{Query: search.Query, Completed: search.Completed, Offset: search.Offset + limit})
+		res.NextCursor = &cursor
+	}
+	for _, row := range tasks {
+		task, _ := dbconv.ToTaskResponse(row)
+		res.Items = append(res.Items, task)
+	}
+
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) getTaskStats(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	stats, err := s.db.GetTaskStats(uuid)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, stats)
+}
+
+// getSync lists what changed since the ?since= token from the previous sync, without one it lists every task
+func (s *Server) getSync(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	var since int64
+	if param := req.URL.Query().Get("since"); param != "" {
+		if since, err = strconv.ParseInt(param, 10, 64); err != nil {
+			return badRequest(db.InvalidSyncTokenError)
+		}
+	}
+
+	changes, err := s.db.GetTaskChanges(uuid, since)
+	if err != nil {
+		return taskError(err)
+	}
+
+	res := types.SyncResponse{
+		Created: []types.TaskReponse{},
+		Updated: []types.TaskReponse{},
+		Deleted: []int{},
+		Token:   strconv.FormatInt(changes.Revision, 10),
+	}
+	for _, row := range changes.Tasks {
+		task, _ := dbconv.ToTaskResponse(row)
+		if since == 0 || row.CreatedRevision > since {
+			res.Created = append(res.Created, task)
+		} else {
+			res.Updated = append(res.Updated, task)
+		}
+	}
+	res.Deleted = append(res.Deleted, changes.Deleted...)
+
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) getAllTasks(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	filter, err := taskFilterFromQuery(req)
+	if err != nil {
+		return err
+	}
+
+	allTasks, err := s.db.GetAllTasksByUser(uuid, withPeek(filter))
+	if err != nil {
+		return taskError(err)
+	}
+	allTasks, nextCursor := paginate(filter, allTasks)
+	res := []types.TaskReponse{}
+
+	for _, row := range allTasks {
+		task, _ := dbconv.ToTaskResponse(row)
+		res = append(res, task)
+	}
+
+	if err = s.db.UpdateLastAccessedToNow(uuid); err != nil {
+		return err
+	}
+
+	return writeListing(w, filter, res, nextCursor)
+}
+
+func (s *Server) addNewTask(w http.ResponseWriter, req *http.Request) error {
+	var newTask types.NewTaskPayload
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	if err = decodeBody(req, &newTask); err != nil {
+		return err
+	}
+	if newTask.ProjectId, err = keepInKeyProject(req, newTask.ProjectId); err != nil {
+		return err
+	}
+
+	taskId, err := s.db.AddNewTask(newTask, uuid)
+	if err != nil {
+		return taskError(err)
+	}
+
+	id := strconv.Itoa(taskId)
+	task, err := s.db.GetTaskById(uuid, id)
+	if err != nil {
+		return err
+	}
+
+	res, _ := dbconv.ToTaskResponse(task)
+
+	// Points at the byId route of whichever tree (api or site) the task was created through
+	w.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/new")+"/byId?id="+id)
+	return writeJson(w, http.StatusCreated, res)
+}
+
+func (s *Server) getTaskById(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	task, err := s.db.GetTaskById(uuid, id)
+	if err != nil {
+		return taskError(err)
+	}
+
+	res, _ := dbconv.ToTaskResponse(task)
+	w.Header().Set(etagHeader, etag(task.Revision))
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) newApiKey(w http.ResponseWriter, req *http.Request) error {
+	var apiKeyPayload types.ApiKeyPayload
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	if err = decodeBody(req, &apiKeyPayload); err != nil {
+		return err
+	}
+
+	apiKey, err := auth.GetSecureRandomString()
+	if err != nil {
+		return err
+	}
+
+	err = s.db.AddApiKey(uuid, auth.EncryptApiKey(apiKey), apiKeyPayload)
+	if errors.Is(err, db.InvalidApiKeyScopeError) {
+		return badRequest(err)
+	}
+	if err != nil {
+		return taskError(err)
+	}
+
+	// Gets the id of the api key in case the user wants to immediately delete it
+	keyMetadata, err := s.db.GetApiKeyMetadata(auth.EncryptApiKey(apiKey))
+	if err != nil {
+		return err
+	}
+
+	response := types.ApiKeyResponse{ApiKey: apiKey, ApiKeyId: keyMetadata.Id}
+	return writeJson(w, http.StatusOK, response)
+}
+
+func (s *Server) addNewUser(w http.ResponseWriter, req *http.Request) error {
+	var newUser types.User
+	if err := decodeBody(req, &newUser); err != nil {
+		return err
+	}
+
+	// Encrypt password
+	encryptedPassword, err := auth.EncryptPassword(newUser.Password)
+	if err != nil {
+		return badRequest(err)
+	}
+	newUser.Password = encryptedPassword
+
+	err = s.db.AddNewUser(newUser)
+	if errors.Is(err, db.NewUserUniquenessConstraintError) {
+		return newApiError(http.StatusConflict, codeConflict, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	uuid, err := s.db.GetUuidFromEmail(newUser.Email)
+	if err != nil {
+		return err
+	}
+	return s.sendJwt(w, uuid)
+}
+
+func (s *Server) markAsCompleted(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	// With cascade=true every subtask is completed as well
+	cascade, _ := strconv.ParseBool(req.URL.Query().Get("cascade"))
+	revision, err := s.db.MarkTaskCompleted(uuid, id, cascade, ifMatchFromHeader(req))
+	if err != nil {
+		return taskError(err)
+	}
+
+	w.Header().Set(etagHeader, etag(revision))
+	return nil
+}
+
+func (s *Server) markAsIncomplete(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	revision, err := s.db.MarkTaskIncomplete(uuid, id, ifMatchFromHeader(req))
+	if err != nil {
+		return taskError(err)
+	}
+
+	w.Header().Set(etagHeader, etag(revision))
+	return nil
+}
+
+// sendJwt starts a new session for the user
+func (s *Server) sendJwt(w http.ResponseWriter, uuid string) error {
+	sessionId, err := auth.GetSecureRandomString()
+	if err != nil {
+		return err
+	}
+	refreshToken, err := auth.GetSecureRandomString()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(s.config.Auth.RefreshTokenTtl)
+	if err = s.db.AddSession(uuid, sessionId, auth.EncryptApiKey(refreshToken), expiresAt); err != nil {
+		return err
+	}
+	return s.writeTokens(w, uuid, sessionId, refreshToken)
+}
+
+func (s *Server) writeTokens(w http.ResponseWriter, uuid string, sessionId string, refreshToken string) error {
+	ttl := s.config.Auth.AccessTokenTtl
+	token, err := auth.GetNewJWT(s.keyring, uuid, sessionId, ttl)
+	if err != nil {
+		return err
+	}
+
+	response := types.JwtResponse{Jwt: token, RefreshToken: refreshToken, ExpiresIn: int(ttl.Seconds())}
+	return writeJson(w, http.StatusOK, response)
+}
+
+// getJwks publishes the public keys jwts can be verified with
+func (s *Server) getJwks(w http.ResponseWriter, req *http.Request) error {
+	// Other services can hold on to the keys for a while, new keys only sign tokens once
+	// they have been published
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return writeJson(w, http.StatusOK, s.keyring.Jwks())
+}
+
+// refreshJwt trades a refresh token for a new jwt and a new refresh token
+func (s *Server) refreshJwt(w http.ResponseWriter, req *http.Request) error {
+	var refreshPayload types.RefreshPayload
+	if err := decodeBody(req, &refreshPayload); err != nil {
+		return err
+	}
+	if refreshPayload.RefreshToken == "" {
+		return unauthorized(db.InvalidRefreshTokenError)
+	}
+
+	refreshToken, err := auth.GetSecureRandomString()
+	if err != nil {
+		return err
 	}
 
-	completedTasks, err := s.db.GetCompletedTasks(uuid)
+	expiresAt := time.Now().Add(s.config.Auth.RefreshTokenTtl)
+	uuid, sessionId, err := s.db.RotateSession(auth.EncryptApiKey(refreshPayload.RefreshToken), auth.EncryptApiKey(refreshToken), expiresAt)
+	if errors.Is(err, db.InvalidRefreshTokenError) {
+		return unauthorized(err)
+	}
+	if err != nil {
+		return err
+	}
+	return s.writeTokens(w, uuid, sessionId, refreshToken)
+}
 
+// logout ends the session the jwt belongs to
+func (s *Server) logout(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
+	}
+	sessionId, err := sessionIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
-	for _, row := range completedTasks {
-		task, _ := dbconv.ToCompletedTaskResponse(row)
-		res = append(res, task)
+	return s.db.DeleteSession(uuid, sessionId)
+}
+
+// logoutAll ends every session of the user, including the current one
+func (s *Server) logoutAll(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	return s.db.DeleteAllSessions(uuid)
+}
+
+func (s *Server) login(w http.ResponseWriter, req *http.Request) error {
+	var userAuth types.UserLoginPayload
+	if err := decodeBody(req, &userAuth); err != nil {
+		return err
+	}
+
+	encryptedPass, err := s.db.GetPasswordFromLogin(userAuth.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return unauthorized(noLoginExists)
+	}
+	if err != nil {
+		return err
+	}
+	if encryptedPass == "" {
+		return unauthorized(noPasswordExists)
 	}
 
-	err = s.db.UpdateLastAccessedToNow(uuid)
+	if err = auth.IsAuthorized(userAuth.Password, encryptedPass); err != nil {
+		return &apiError{Status: http.StatusUnauthorized, Code: codeUnauthorized, Message: incorrectPassword.Error(), Err: err}
+	}
+
+	uuid, err := s.db.GetUuidFromEmail(userAuth.Email)
+	if err != nil {
+		return err
+	}
+	return s.sendJwt(w, uuid)
+}
+
+func (s *Server) deleteTask(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	return taskError(s.db.DeleteTask(uuid, id, ifMatchFromHeader(req)))
+}
+
+// Most operations one batch can hold, they all run within a single transaction
+const maxBatchOperations = 100
+
+// batchFromPayload checks every operation up front, so a malformed one rejects the whole batch
+func batchFromPayload(payload types.BatchPayload) ([]types.BatchOperation, error) {
+	if len(payload.Operations) == 0 || len(payload.Operations) > maxBatchOperations {
+		return nil, badRequest(invalidBatchSize)
+	}
+
+	var operations []types.BatchOperation
+	for i, item := range payload.Operations {
+		operation := types.BatchOperation{Op: item.Op, Cascade: item.Cascade}
+		var err error
+		switch item.Op {
+		case types.BatchCreate:
+			err = json.Unmarshal(item.Task, &operation.NewTask)
+		case types.BatchEdit:
+			// The task is a patch like the edit endpoint's, except the id belongs to the operation
+			var fields map[string]json.RawMessage
+			if json.Unmarshal(item.Task, &fields) == nil && fields["id"] != nil {
+				return nil, badRequest(fmt.Errorf("Operation %d: %w", i, batchTaskId))
+			}
+			err = decodePatch(bytes.NewReader(item.Task), &operation.Edit)
+		case types.BatchComplete, types.BatchUncomplete, types.BatchDelete:
+		default:
+			return nil, badRequest(fmt.Errorf("Operation %d: %w", i, db.InvalidBatchOperationError))
+		}
+		if err != nil {
+			return nil, badRequest(fmt.Errorf("Operation %d: %w", i, noBatchTask))
+		}
+
+		if item.Op != types.BatchCreate {
+			if item.Id == nil {
+				return nil, badRequest(fmt.Errorf("Operation %d: %w", i, noIdFound))
+			}
+			operation.Id = *item.Id
+		}
+		if item.Version != nil {
+			operation.IfMatch = []int64{*item.Version}
+		}
+		operations = append(operations, operation)
+	}
+	return operations, nil
+}
+
+// batchError is the error an operation would have gotten from its own endpoint
+func (s *Server) batchError(err error) *apiError {
+	if errors.Is(err, db.BatchAbortedError) {
+		return newApiError(http.StatusFailedDependency, codeNotApplied, err)
 	}
 
-	j, err := json.Marshal(res)
+	var apiErr *apiError
+	if errors.As(taskError(err), &apiErr) {
+		return apiErr
+	}
+	s.logger.Printf("batch operation failed: %v", err)
+	return internalError(err)
+}
 
+func (s *Server) runBatch(w http.ResponseWriter, req *http.Request) error {
+	var payload types.BatchPayload
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(j)
+	if err = decodeBody(req, &payload); err != nil {
+		return err
+	}
+
+	operations, err := batchFromPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	// Batches are posted with tasks:write, deleting through one takes tasks:delete as well
+	for i, operation := range operations {
+		if operation.Op == types.BatchDelete && !hasScope(req, types.ScopeTasksDelete) {
+			return missingScope(types.ScopeTasksDelete)
+		}
 
+		if operation.Op == types.BatchCreate {
+			operations[i].NewTask.ProjectId, err = keepInKeyProject(req, operation.NewTask.ProjectId)
+		} else {
+			err = s.checkTaskProject(req, uuid, strconv.Itoa(operation.Id))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	outcomes, err := s.db.RunBatch(uuid, operations, payload.Atomic)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
+	}
+
+	res := types.BatchResponse{Committed: true, Results: []types.BatchResult{}}
+	for i, outcome := range outcomes {
+		result := types.BatchResult{Op: operations[i].Op, Status: http.StatusOK}
+		if operations[i].Op == types.BatchCreate {
+			result.Status = http.StatusCreated
+		}
+		// Failed creates never got an id
+		if outcome.Err == nil || operations[i].Op != types.BatchCreate {
+			id := outcome.Id
+			result.Id = &id
+		}
+
+		if outcome.Err != nil {
+			apiErr := s.batchError(outcome.Err)
+			result.Status, result.Code, result.Message = apiErr.Status, apiErr.Code, apiErr.Message
+			if payload.Atomic {
+				res.Committed = false
+			}
+		}
+		res.Results = append(res.Results, result)
 	}
+
+	return writeJson(w, http.StatusOK, res)
 }
 
-func (s *Server) getIncompleteTasks(w http.ResponseWriter, req *http.Request) {
-	var res []types.IncompleteTaskResponse
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) getTrash(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
-	incompleteTasks, err := s.db.GetIncompleteTasks(uuid)
+	trash, err := s.db.GetTrash(uuid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return taskError(err)
 	}
 
-	for _, row := range incompleteTasks {
-		task, _ := dbconv.ToIncompleteTaskResponse(row)
+	res := []types.TaskReponse{}
+	for _, row := range trash {
+		task, _ := dbconv.ToTaskResponse(row)
 		res = append(res, task)
 	}
 
-	err = s.db.UpdateLastAccessedToNow(uuid)
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) restoreTask(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	revision, err := s.db.RestoreTask(uuid, id, ifMatchFromHeader(req))
 	if err != nil {
-		s.logger.Panic(err)
+		return taskError(err)
 	}
 
-	j, err := json.Marshal(res)
+	w.Header().Set(etagHeader, etag(revision))
+	return nil
+}
 
+func (s *Server) purgeTask(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(j)
+	return taskError(s.db.PurgeTask(uuid, id, ifMatchFromHeader(req)))
+}
 
+func (s *Server) emptyTrash(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
 	}
+
+	return s.db.EmptyTrash(uuid)
 }
 
-func (s *Server) getAllTasks(w http.ResponseWriter, req *http.Request) {
-	var res []types.TaskReponse
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) editTask(w http.ResponseWriter, req *http.Request) error {
+	var editPayload types.EditTaskPayload
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	if err = decodePatch(req.Body, &editPayload); err != nil {
+		return err
+	}
+	if err = s.checkTaskProject(req, uuid, strconv.Itoa(editPayload.Id)); err != nil {
+		return err
 	}
 
-	allTasks, err := s.db.GetAllTasksByUser(uuid)
+	revision, err := s.db.EditTask(uuid, editPayload, ifMatchFromHeader(req))
 	if err != nil {
-		s.logger.Panic(err)
+		return taskError(err)
 	}
 
+	w.Header().Set(etagHeader, etag(revision))
+	return nil
+}
+
+func (s *Server) getAllTags(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
-	for _, row := range allTasks {
-		task, _ := dbconv.ToTaskResponse(row)
-		res = append(res, task)
+	tags, err := s.db.GetAllTags(uuid)
+	if err != nil {
+		return err
+	}
+
+	if tags == nil {
+		tags = []types.TagResponse{}
+	}
+	return writeJson(w, http.StatusOK, tags)
+}
+
+// Responds with the task after its tags changed
+func (s *Server) changeTaskTags(w http.ResponseWriter, req *http.Request, change func(uuid, id string, tags []string, ifMatch []int64) (int64, error)) error {
+	var tagsPayload types.TagsPayload
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
-	j, err := json.Marshal(res)
+	if err = decodeBody(req, &tagsPayload); err != nil {
+		return err
+	}
 
-	err = s.db.UpdateLastAccessedToNow(uuid)
+	revision, err := change(uuid, id, tagsPayload.Tags, ifMatchFromHeader(req))
 	if err != nil {
-		s.logger.Panic(err)
+		return taskError(err)
+	}
+	w.Header().Set(etagHeader, etag(revision))
+
+	task, err := s.db.GetTaskById(uuid, id)
+	if err != nil {
+		return taskError(err)
+	}
+
+	res, _ := dbconv.ToTaskResponse(task)
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) addTaskTags(w http.ResponseWriter, req *http.Request) error {
+	return s.changeTaskTags(w, req, s.db.AddTagsToTask)
+}
+
+func (s *Server) removeTaskTags(w http.ResponseWriter, req *http.Request) error {
+	return s.changeTaskTags(w, req, s.db.RemoveTagsFromTask)
+}
+
+func (s *Server) renameTag(w http.ResponseWriter, req *http.Request) error {
+	var renameTagPayload types.RenameTagPayload
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	if err = decodeBody(req, &renameTagPayload); err != nil {
+		return err
+	}
+
+	if err = s.db.RenameTag(uuid, renameTagPayload.Name, renameTagPayload.NewName); err != nil {
+		return taskError(err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(j)
+	return nil
+}
 
+func (s *Server) deleteTag(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
+	}
+
+	if err = s.db.DeleteTag(uuid, req.URL.Query().Get("name")); err != nil {
+		return taskError(err)
 	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
-func (s *Server) addNewTask(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) moveTask(w http.ResponseWriter, req *http.Request) error {
+	var movePayload types.MoveTaskPayload
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	if err = decodeBody(req, &movePayload); err != nil {
+		return err
 	}
-	var newTask types.NewTaskPayload
 
-	err := json.NewDecoder(req.Body).Decode(&newTask)
+	revision, err := s.db.MoveTask(uuid, id, movePayload.ProjectId, ifMatchFromHeader(req))
 	if err != nil {
-		s.logger.Panic(err)
+		return taskError(err)
 	}
-	err = s.db.AddNewTask(newTask, uuid)
+	w.Header().Set(etagHeader, etag(revision))
+
+	task, err := s.db.GetTaskById(uuid, id)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return taskError(err)
 	}
-	w.WriteHeader(http.StatusOK)
+
+	res, _ := dbconv.ToTaskResponse(task)
+	return writeJson(w, http.StatusOK, res)
 }
 
-func (s *Server) getTaskById(w http.ResponseWriter, req *http.Request) {
-	var res types.TaskReponse
-	id := req.URL.Query().Get("id")
-	if id == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		res := types.ErrResponse{Message: noIdFound.Error()}
-		j, err := json.Marshal(res)
-		if err != nil {
-			s.logger.Panic(err)
+func (s *Server) setTaskParent(w http.ResponseWriter, req *http.Request) error {
+	var parentPayload types.ParentPayload
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	if err = decodeBody(req, &parentPayload); err != nil {
+		return err
+	}
+	if parentPayload.ParentId != nil {
+		if err = s.checkTaskProject(req, uuid, strconv.Itoa(*parentPayload.ParentId)); err != nil {
+			return err
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
 	}
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
 
+	revision, err := s.db.SetTaskParent(uuid, id, parentPayload.ParentId, ifMatchFromHeader(req))
+	if err != nil {
+		return taskError(err)
 	}
+	w.Header().Set(etagHeader, etag(revision))
 
 	task, err := s.db.GetTaskById(uuid, id)
 	if err != nil {
-		if err == db.NoTasksFoundError {
-			w.WriteHeader(http.StatusBadRequest)
+		return taskError(err)
+	}
 
-			res := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(res)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(j)
-			return
-		} else {
-			s.logger.Panic(err)
+	res, _ := dbconv.ToTaskResponse(task)
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) getSubtasks(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	// Tells an unknown task apart from one without subtasks
+	task, err := s.db.GetTaskById(uuid, id)
+	if err != nil {
+		return taskError(err)
+	}
+
+	filter, err := taskFilterFromQuery(req)
+	if err != nil {
+		return err
+	}
+	filter.ParentId = &task.Id
+
+	subtasks, err := s.db.GetAllTasksByUser(uuid, withPeek(filter))
+	if err != nil {
+		return taskError(err)
+	}
+	subtasks, nextCursor := paginate(filter, subtasks)
+	res := []types.TaskReponse{}
+
+	for _, row := range subtasks {
+		task, _ := dbconv.ToTaskResponse(row)
+		res = append(res, task)
+	}
+
+	return writeListing(w, filter, res, nextCursor)
+}
+
+const (
+	defaultPreviewOccurrences = 5
+	maxPreviewOccurrences     = 100
+)
+
+// getRecurrencePreview lists the next ?n= occurrences of a recurring task
+func (s *Server) getRecurrencePreview(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	n := defaultPreviewOccurrences
+	if param := req.URL.Query().Get("n"); param != "" {
+		n, err = strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxPreviewOccurrences {
+			return badRequest(invalidPreviewN)
 		}
 	}
 
-	res, _ = dbconv.ToTaskResponse(task)
-	j, err := json.Marshal(res)
-
+	task, err := s.db.GetTaskById(uuid, id)
+	if err != nil {
+		return taskError(err)
+	}
+	if !task.Recurrence.Valid {
+		return badRequest(notRecurring)
+	}
+
+	rule, err := recurrence.Parse(task.Recurrence.String)
+	if err != nil {
+		return err
+	}
+
+	res := types.OccurrencesResponse{
+		Recurrence:  rule.String(),
+		Occurrences: rule.Occurrences(task.Due.Time, task.Occurrence, n),
+	}
+	if res.Occurrences == nil {
+		res.Occurrences = []time.Time{}
+	}
+	return writeJson(w, http.StatusOK, res)
+}
+
+func (s *Server) getChecklistItems(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
+	}
+
+	items, err := s.db.GetChecklistItems(uuid, id)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return taskError(err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(j)
+	if items == nil {
+		items = []types.ChecklistItemResponse{}
+	}
+	return writeJson(w, http.StatusOK, items)
+}
 
+func (s *Server) addChecklistItem(w http.ResponseWriter, req *http.Request) error {
+	var itemPayload types.ChecklistItemPayload
+	id, err := idFromQuery(req)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
+	}
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
-}
 
-func (s *Server) newApiKey(w http.ResponseWriter, req *http.Request) {
-	var apiKeyPayload types.ApiKeyPayload
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+	if err = decodeBody(req, &itemPayload); err != nil {
+		return err
 	}
 
-	err := json.NewDecoder(req.Body).Decode(&apiKeyPayload)
+	item, err := s.db.AddChecklistItem(uuid, id, itemPayload)
 	if err != nil {
-		s.logger.Panic(err)
+		return taskError(err)
 	}
 
-	apiKey, err := auth.GetSecureRandomString()
+	return writeJson(w, http.StatusCreated, item)
+}
+
+func (s *Server) editChecklistItem(w http.ResponseWriter, req *http.Request) error {
+	var itemPayload types.ChecklistItemPayload
+	id, err := idFromQuery(req)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
 	}
-
-	err = s.db.AddApiKey(uuid, auth.EncryptApiKey(apiKey), apiKeyPayload)
+	itemId, err := itemIdFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		s.logger.Panic(err)
+		return err
 	}
-
-	// Gets the id of the api key in case the user wants to immediately delete it
-	keyMetadata, err := s.db.GetApiKeyMetadata(auth.EncryptApiKey(apiKey))
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusForbidden)
-		s.logger.Panic(err)
+		return err
 	}
 
-	response := types.ApiKeyResponse{ApiKey: apiKey, ApiKeyId: keyMetadata.Id}
+	if err = decodeBody(req, &itemPayload); err != nil {
+		return err
+	}
 
-	j, err := json.Marshal(response)
+	return taskError(s.db.EditChecklistItem(uuid, id, itemId, itemPayload))
+}
+
+func (s *Server) setChecklistItemChecked(w http.ResponseWriter, req *http.Request, checked bool) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(j)
+	itemId, err := itemIdFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		s.logger.Panic(err)
+		return err
 	}
+
+	return taskError(s.db.SetChecklistItemChecked(uuid, id, itemId, checked))
 }
 
-func (s *Server) addNewUser(w http.ResponseWriter, req *http.Request) {
-	var newUser types.User
-	err := json.NewDecoder(req.Body).Decode(&newUser)
+func (s *Server) checkChecklistItem(w http.ResponseWriter, req *http.Request) error {
+	return s.setChecklistItemChecked(w, req, true)
+}
 
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
-	}
+func (s *Server) uncheckChecklistItem(w http.ResponseWriter, req *http.Request) error {
+	return s.setChecklistItemChecked(w, req, false)
+}
 
-	// Encrypt password
-	newUser.Password, err = auth.EncryptPassword(newUser.Password)
+func (s *Server) deleteChecklistItem(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-
-	err = s.db.AddNewUser(newUser)
+	itemId, err := itemIdFromQuery(req)
 	if err != nil {
-		if err == db.NewUserUniquenessConstraintError {
-			w.WriteHeader(http.StatusBadRequest)
-			errResponse := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(errResponse)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			_, err = w.Write(j)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-		}
-		s.logger.Panic(err)
+		return err
 	}
-
-	uuid, err := s.db.GetUuidFromEmail(newUser.Email)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		s.logger.Panic(err)
+		return err
 	}
-	sendJwt(w, uuid)
+
+	return taskError(s.db.DeleteChecklistItem(uuid, id, itemId))
 }
 
-func (s *Server) markAsCompleted(w http.ResponseWriter, req *http.Request) {
-	id := req.URL.Query().Get("id")
-	if id == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		res := types.ErrResponse{Message: noIdFound.Error()}
-		j, err := json.Marshal(res)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
+func (s *Server) addNewProject(w http.ResponseWriter, req *http.Request) error {
+	var projectPayload types.ProjectPayload
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+
+	if err = decodeBody(req, &projectPayload); err != nil {
+		return err
 	}
 
-	err := s.db.MarkTaskCompleted(uuid, id)
+	projectId, err := s.db.AddProject(uuid, projectPayload)
 	if err != nil {
-		if err == db.NoTasksFoundError {
-			w.WriteHeader(http.StatusBadRequest)
+		return taskError(err)
+	}
 
-			res := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(res)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(j)
-			return
-		} else {
-			s.logger.Panic(err)
-		}
+	id := strconv.Itoa(projectId)
+	project, err := s.db.GetProjectById(uuid, id)
+	if err != nil {
+		return err
 	}
+
+	w.Header().Set("Location", strings.TrimSuffix(req.URL.Path, "/new")+"/byId?id="+id)
+	return writeJson(w, http.StatusCreated, project)
 }
 
-func (s *Server) markAsIncomplete(w http.ResponseWriter, req *http.Request) {
-	id := req.URL.Query().Get("id")
-	if id == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		res := types.ErrResponse{Message: noIdFound.Error()}
-		j, err := json.Marshal(res)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
-	}
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) getAllProjects(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
-	err := s.db.MarkTaskIncomplete(uuid, id)
+	// Archived projects are hidden unless asked for
+	includeArchived, _ := strconv.ParseBool(req.URL.Query().Get("archived"))
+	projects, err := s.db.GetAllProjects(uuid, includeArchived)
 	if err != nil {
-		if err == db.NoTasksFoundError {
-			w.WriteHeader(http.StatusBadRequest)
+		return err
+	}
 
-			res := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(res)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(j)
-		} else {
-			s.logger.Panic(err)
-		}
+	if projects == nil {
+		projects = []types.ProjectResponse{}
 	}
+	return writeJson(w, http.StatusOK, projects)
 }
 
-func sendJwt(w http.ResponseWriter, uuid string) error {
-	token, err := auth.GetNewJWT(uuid)
+func (s *Server) getProjectById(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
 		return err
 	}
-	res := types.JwtResponse{Jwt: token}
-	j, err := json.Marshal(res)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
 		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
-	return nil
+	project, err := s.db.GetProjectById(uuid, id)
+	if err != nil {
+		return taskError(err)
+	}
+	return writeJson(w, http.StatusOK, project)
 }
 
-func (s *Server) login(w http.ResponseWriter, req *http.Request) {
-	var userAuth types.UserLoginPayload
-
-	err := json.NewDecoder(req.Body).Decode(&userAuth)
+func (s *Server) getProjectTasks(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	encryptedPass, err := s.db.GetPasswordFromLogin(userAuth.Email)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		errResponse := types.ErrResponse{Message: noLoginExists.Error()}
-		j, err := json.Marshal(errResponse)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write(j)
-		return
-	} else if encryptedPass == "" {
-		errResponse := types.ErrResponse{Message: noPasswordExists.Error()}
-		j, err := json.Marshal(errResponse)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
+		return err
 	}
-	
-	err = auth.IsAuthorized(userAuth.Password, encryptedPass)
+
+	// Tells an unknown project apart from an empty one
+	project, err := s.db.GetProjectById(uuid, id)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		errResponse := types.ErrResponse{Message: incorrectPassword.Error()}
-		j, err := json.Marshal(errResponse)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
+		return taskError(err)
 	}
-	uuid, err := s.db.GetUuidFromEmail(userAuth.Email)
+
+	filter, err := taskFilterFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		s.logger.Panic(err)
+		return err
 	}
-	err = sendJwt(w, uuid)
+	filter.ProjectId = &project.Id
+
+	projectTasks, err := s.db.GetAllTasksByUser(uuid, withPeek(filter))
 	if err != nil {
-		s.logger.Panic(err)
+		return taskError(err)
 	}
-}
+	projectTasks, nextCursor := paginate(filter, projectTasks)
+	res := []types.TaskReponse{}
 
-func (s *Server) deleteTask(w http.ResponseWriter, req *http.Request) {
-	id := req.URL.Query().Get("id")
-	if id == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		res := types.ErrResponse{Message: noIdFound.Error()}
-		j, err := json.Marshal(res)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
-	}
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+	for _, row := range projectTasks {
+		task, _ := dbconv.ToTaskResponse(row)
+		res = append(res, task)
 	}
 
-	err := s.db.DeleteTask(uuid, id)
+	return writeListing(w, filter, res, nextCursor)
+}
+
+func (s *Server) editProject(w http.ResponseWriter, req *http.Request) error {
+	var editPayload types.EditProjectPayload
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
+	}
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		if err == db.NoTasksFoundError {
-			w.WriteHeader(http.StatusBadRequest)
+		return err
+	}
 
-			res := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(res)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(j)
-			return
-		} else {
-			s.logger.Panic(err)
-		}
+	if err = decodeBody(req, &editPayload); err != nil {
+		return err
 	}
+
+	return taskError(s.db.EditProject(uuid, id, editPayload))
 }
 
-func (s *Server) editTask(w http.ResponseWriter, req *http.Request) {
-	var editPayload types.EditTaskPayload
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
-	}
-	err := json.NewDecoder(req.Body).Decode(&editPayload)
+func (s *Server) setProjectArchived(w http.ResponseWriter, req *http.Request, archived bool) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	err = s.db.EditTask(uuid, editPayload)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		if err == db.NoTasksFoundError {
-			w.WriteHeader(http.StatusBadRequest)
-
-			res := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(res)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(j)
-		} else {
-			s.logger.Panic(err)
-		}
+		return err
 	}
+
+	return taskError(s.db.SetProjectArchived(uuid, id, archived))
 }
 
-func (s *Server) getEmail(w http.ResponseWriter, req *http.Request) {
-	var emailResponse types.EmailResponse
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
-	}
-	email, err := s.db.GetEmailAddress(uuid)
+func (s *Server) archiveProject(w http.ResponseWriter, req *http.Request) error {
+	return s.setProjectArchived(w, req, true)
+}
+
+func (s *Server) unarchiveProject(w http.ResponseWriter, req *http.Request) error {
+	return s.setProjectArchived(w, req, false)
+}
 
+func (s *Server) deleteProject(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	emailResponse.Email = email
-	j, err := json.Marshal(emailResponse)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+
+	return taskError(s.db.DeleteProject(uuid, id))
 }
 
-func (s *Server) getSyncTime(w http.ResponseWriter, req *http.Request) {
-	var syncTimeResponse types.SyncTimeResponse
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) getEmail(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
-	syncTime, err := s.db.GetLastAccessed(uuid)
 
+	email, err := s.db.GetEmailAddress(uuid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	syncTimeResponse.SyncTime = syncTime
-	j, err := json.Marshal(syncTimeResponse)
+	return writeJson(w, http.StatusOK, types.EmailResponse{Email: email})
+}
+
+func (s *Server) getSyncTime(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
-}
 
-func (s *Server) getAccountCreationDate(w http.ResponseWriter, req *http.Request) {
-	var syncTimeResponse types.AccountCreationDateResponse
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+	syncTime, err := s.db.GetLastAccessed(uuid)
+	if err != nil {
+		return err
 	}
-	accountDate, err := s.db.GetAccountCreationDate(uuid)
+	return writeJson(w, http.StatusOK, types.SyncTimeResponse{SyncTime: syncTime})
+}
 
+func (s *Server) getAccountCreationDate(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	syncTimeResponse.AccountCreationDate = accountDate
-	j, err := json.Marshal(syncTimeResponse)
+
+	accountDate, err := s.db.GetAccountCreationDate(uuid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+	return writeJson(w, http.StatusOK, types.AccountCreationDateResponse{AccountCreationDate: accountDate})
 }
 
-func (s *Server) getAllApiKeys(w http.ResponseWriter, req *http.Request) {
-	var apiKeyMetadataResponse []types.ApiKeyMetadata
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
-	}
-	apiKeyMetadataResponse, err := s.db.GetAllApiKeyMetadata(uuid)
+func (s *Server) getAllApiKeys(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	j, err := json.Marshal(apiKeyMetadataResponse)
+
+	apiKeyMetadataResponse, err := s.db.GetAllApiKeyMetadata(uuid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+	return writeJson(w, http.StatusOK, apiKeyMetadataResponse)
 }
 
-func (s *Server) revokeAllApiKeys(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
-	}
-	err := s.db.RevokeAllApiKeys(uuid)
+func (s *Server) revokeAllApiKeys(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
+
+	return s.db.RevokeAllApiKeys(uuid)
 }
 
-func (s *Server) revokeApiKey(w http.ResponseWriter, req *http.Request) {
-	id := req.URL.Query().Get("id")
-	if id == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		res := types.ErrResponse{Message: noIdFound.Error()}
-		j, err := json.Marshal(res)
-		if err != nil {
-			s.logger.Panic(err)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(j)
-		return
-	}
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) revokeApiKey(w http.ResponseWriter, req *http.Request) error {
+	id, err := idFromQuery(req)
+	if err != nil {
+		return err
 	}
-
-	err := s.db.RevokeApiKey(uuid, id)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		if err == db.NoTasksFoundError {
-			w.WriteHeader(http.StatusBadRequest)
-
-			res := types.ErrResponse{Message: err.Error()}
-			j, err := json.Marshal(res)
-			if err != nil {
-				s.logger.Panic(err)
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(j)
-			return
-		} else {
-			s.logger.Panic(err)
-		}
+		return err
 	}
+
+	return s.db.RevokeApiKey(uuid, id)
 }
 
-func (s *Server) changeEmailAddress(w http.ResponseWriter, req *http.Request) {
+func (s *Server) changeEmailAddress(w http.ResponseWriter, req *http.Request) error {
 	var payload types.ChangeEmailAddressPayload
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
-	err := json.NewDecoder(req.Body).Decode(&payload)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if err = decodeBody(req, &payload); err != nil {
+		return err
 	}
 
 	err = s.db.ChangeEmailAddress(uuid, payload.NewEmail)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if errors.Is(err, db.NewUserUniquenessConstraintError) {
+		return newApiError(http.StatusConflict, codeConflict, err)
 	}
-	w.WriteHeader(http.StatusOK)
+	return err
 }
 
-func (s *Server) deleteAccount(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
-	}
-
-	err := s.db.DeleteAllTasks(uuid)
+func (s *Server) deleteAccount(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
-	err = s.db.DeleteAllApiKeys(uuid)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if err = s.db.DeleteAllTasks(uuid); err != nil {
+		return err
 	}
 
-	err = s.db.DeleteUser(uuid)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if err = s.db.DeleteAllApiKeys(uuid); err != nil {
+		return err
 	}
-	w.WriteHeader(http.StatusOK)
-}
 
-func (s *Server) getProfilePhoto(w http.ResponseWriter, req *http.Request) {
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
+	return s.db.DeleteUser(uuid)
+}
 
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
+func (s *Server) getProfilePhoto(w http.ResponseWriter, req *http.Request) error {
+	uuid, err := userIdFromContext(req)
+	if err != nil {
+		return err
 	}
 
 	profilePhoto, err := s.db.GetProfilePhoto(uuid)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
-	}
-	j, err := json.Marshal(types.ProfilePhotoResponse{ProfilePhoto: profilePhoto})
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(j)
+	return writeJson(w, http.StatusOK, types.ProfilePhotoResponse{ProfilePhoto: profilePhoto})
 }
 
-func (s *Server) changeProfilePhoto(w http.ResponseWriter, req *http.Request) {
+func (s *Server) changeProfilePhoto(w http.ResponseWriter, req *http.Request) error {
 	var payload types.ProfilePhotoPayload
-	ctx := req.Context()
-	uuid, ok := ctx.Value("userId").(string)
-	if !ok {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(noContext)
-	}
-
-	err := json.NewDecoder(req.Body).Decode(&payload)
+	uuid, err := userIdFromContext(req)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
-	err = s.db.ChangeProfilePhoto(uuid, payload.ProfilePhoto)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if err = decodeBody(req, &payload); err != nil {
+		return err
 	}
-	w.WriteHeader(http.StatusOK)
+
+	return s.db.ChangeProfilePhoto(uuid, payload.ProfilePhoto)
 }
 
-func (s *Server) sendForgotPasswordRequest(w http.ResponseWriter, req *http.Request) {
+func (s *Server) sendForgotPasswordRequest(w http.ResponseWriter, req *http.Request) error {
 	var forgotPasswordEmailPayload types.SendForgotPasswordEmailPayload
-
-	err := json.NewDecoder(req.Body).Decode(&forgotPasswordEmailPayload)
-
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if err := decodeBody(req, &forgotPasswordEmailPayload); err != nil {
+		return err
 	}
 	email := forgotPasswordEmailPayload.Email
 
 	uuid, err := s.db.GetUuidFromEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return notFound(noLoginExists)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
-	userToken, _ := auth.GetSecureRandomString()
-	err = s.db.SetForgotPasswordToken(uuid, userToken)
+	userToken, err := auth.GetSecureRandomString()
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
-	err = contact.SendResetEmail(email, userToken)
-
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	if err = s.db.SetForgotPasswordToken(uuid, userToken); err != nil {
+		return err
 	}
+
+	return s.mailer.SendResetEmail(email, userToken)
 }
 
-func (s *Server) resetUserPassword(w http.ResponseWriter, req *http.Request) {
+func (s *Server) resetUserPassword(w http.ResponseWriter, req *http.Request) error {
 	var passwordResetRequest types.ResetPasswordPayload
+	if err := decodeBody(req, &passwordResetRequest); err != nil {
+		return err
+	}
 
-	err := json.NewDecoder(req.Body).Decode(&passwordResetRequest)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+	// Used tokens are cleared to an empty string, so an empty token must never match
+	if passwordResetRequest.ResetToken == "" {
+		return badRequest(invalidResetToken)
 	}
 
 	uuid, err := s.db.GetUuidFromResetPasswordToken(passwordResetRequest.ResetToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return badRequest(invalidResetToken)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return err
 	}
 
 	// Remove reset password token
-	err = s.db.SetForgotPasswordToken(uuid, "")
+	if err = s.db.SetForgotPasswordToken(uuid, ""); err != nil {
+		return err
+	}
 
-	newPassword, _ := auth.EncryptPassword(passwordResetRequest.NewPassword)
-	err = s.db.SetNewPassword(uuid, newPassword)
+	newPassword, err := auth.EncryptPassword(passwordResetRequest.NewPassword)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		s.logger.Panic(err)
+		return badRequest(err)
+	}
+	if err = s.db.SetNewPassword(uuid, newPassword); err != nil {
+		return err
 	}
+
+	// Whoever knew the old password should not stay logged in
+	return s.db.DeleteAllSessions(uuid)
 }
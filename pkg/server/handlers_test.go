@@ -0,0 +1,1293 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"github.com/senyc/jason/pkg/auth"
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/db"
+	"github.com/senyc/jason/pkg/types"
+)
+
+// newTestServer returns a server backed by a memory store, with a fresh signing key and nothing
+// logged
+func newTestServer(t *testing.T) (*Server, *db.MemoryStore) {
+	t.Helper()
+
+	privateKey, err := auth.GenerateJwtPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := auth.EncodeJwtPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemPath := filepath.Join(t.TempDir(), "jwt.pem")
+	if err = os.WriteFile(pemPath, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.Default()
+	cfg.Database.Driver = config.DriverMemory
+	cfg.Auth.JwtPemPath = pemPath
+
+	store := db.NewMemoryStore()
+	s := New(cfg, store)
+	s.logger = log.New(io.Discard, "", 0)
+	if s.keyring, err = auth.LoadKeyring("", pemPath); err != nil {
+		t.Fatal(err)
+	}
+	return s, store
+}
+
+// request is one call against the handler, auth is sent as the Authorization header as is
+type request struct {
+	method  string
+	path    string
+	auth    string
+	body    any
+	headers map[string]string
+}
+
+func serve(t *testing.T, h http.Handler, r request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body io.Reader
+	switch b := r.body.(type) {
+	case nil:
+	case string:
+		body = bytes.NewBufferString(b)
+	default:
+		j, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(j)
+	}
+
+	req := httptest.NewRequest(r.method, r.path, body)
+	if r.auth != "" {
+		req.Header.Set("Authorization", r.auth)
+	}
+	for name, value := range r.headers {
+		req.Header.Set(name, value)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("got status %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+// expectError checks the response is an error envelope with the given status and code
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, status int, code string) types.ErrResponse {
+	t.Helper()
+
+	expectStatus(t, rec, status)
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("got content type %q, want application/json", contentType)
+	}
+	res := decodeResponse[types.ErrResponse](t, rec)
+	if res.Code != code || res.Status != status || res.Message == "" || res.RequestId == "" {
+		t.Fatalf("got error %+v, want status %d and code %s", res, status, code)
+	}
+	return res
+}
+
+// signUp creates a user and returns the bearer token of its first session
+func signUp(t *testing.T, h http.Handler, email string) types.JwtResponse {
+	t.Helper()
+
+	user := types.User{UserLoginPayload: types.UserLoginPayload{Email: email, Password: "hunter22"}}
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/user/new", body: user})
+	expectStatus(t, rec, http.StatusOK)
+	return decodeResponse[types.JwtResponse](t, rec)
+}
+
+// logIn starts another session for a user who signed up
+func logIn(t *testing.T, h http.Handler, email string) types.JwtResponse {
+	t.Helper()
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/user/login", body: types.UserLoginPayload{Email: email, Password: "hunter22"}})
+	expectStatus(t, rec, http.StatusOK)
+	return decodeResponse[types.JwtResponse](t, rec)
+}
+
+func bearer(tokens types.JwtResponse) string {
+	return "Bearer " + tokens.Jwt
+}
+
+func newApiKey(t *testing.T, h http.Handler, tokens types.JwtResponse, payload types.ApiKeyPayload) string {
+	t.Helper()
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/site/tasks/key/new", auth: bearer(tokens), body: payload})
+	expectStatus(t, rec, http.StatusOK)
+	return decodeResponse[types.ApiKeyResponse](t, rec).ApiKey
+}
+
+func addTask(t *testing.T, h http.Handler, auth string, task types.NewTaskPayload) types.TaskReponse {
+	t.Helper()
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: auth, body: task})
+	expectStatus(t, rec, http.StatusCreated)
+	return decodeResponse[types.TaskReponse](t, rec)
+}
+
+func getTask(t *testing.T, h http.Handler, auth string, id int) types.TaskReponse {
+	t.Helper()
+
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/byId?id=" + strconv.Itoa(id), auth: auth})
+	expectStatus(t, rec, http.StatusOK)
+	return decodeResponse[types.TaskReponse](t, rec)
+}
+
+// taskVersion reads the version of a task from its ETag
+func taskVersion(t *testing.T, h http.Handler, auth string, id int) int64 {
+	t.Helper()
+
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/byId?id=" + strconv.Itoa(id), auth: auth})
+	expectStatus(t, rec, http.StatusOK)
+	tag, err := strconv.Unquote(rec.Header().Get(etagHeader))
+	if err != nil {
+		t.Fatalf("invalid etag %q", rec.Header().Get(etagHeader))
+	}
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSignUpAndLogin(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+
+	tokens := signUp(t, h, "someone@example.com")
+	if tokens.Jwt == "" || tokens.RefreshToken == "" || tokens.ExpiresIn != int(s.config.Auth.AccessTokenTtl.Seconds()) {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+
+	user := types.User{UserLoginPayload: types.UserLoginPayload{Email: "someone@example.com", Password: "hunter22"}}
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/user/new", body: user})
+	expectError(t, rec, http.StatusConflict, codeConflict)
+
+	rec = serve(t, h, request{method: http.MethodPost, path: "/api/user/login", body: user.UserLoginPayload})
+	expectStatus(t, rec, http.StatusOK)
+	login := decodeResponse[types.JwtResponse](t, rec)
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(login)})
+	expectStatus(t, rec, http.StatusOK)
+	if email := decodeResponse[types.EmailResponse](t, rec).Email; email != "someone@example.com" {
+		t.Fatalf("got email %q", email)
+	}
+
+	wrongPassword := types.UserLoginPayload{Email: "someone@example.com", Password: "hunter23"}
+	rec = serve(t, h, request{method: http.MethodPost, path: "/api/user/login", body: wrongPassword})
+	if res := expectError(t, rec, http.StatusUnauthorized, codeUnauthorized); res.Message != incorrectPassword.Error() {
+		t.Fatalf("got message %q", res.Message)
+	}
+
+	unknown := types.UserLoginPayload{Email: "nobody@example.com", Password: "hunter22"}
+	rec = serve(t, h, request{method: http.MethodPost, path: "/api/user/login", body: unknown})
+	expectError(t, rec, http.StatusUnauthorized, codeUnauthorized)
+}
+
+func TestRefreshTokens(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+
+	refresh := func(refreshToken string) *httptest.ResponseRecorder {
+		return serve(t, h, request{method: http.MethodPost, path: "/api/user/login/refresh", body: types.RefreshPayload{RefreshToken: refreshToken}})
+	}
+
+	rec := refresh(tokens.RefreshToken)
+	expectStatus(t, rec, http.StatusOK)
+	rotated := decodeResponse[types.JwtResponse](t, rec)
+	if rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh token was not rotated %+v", rotated)
+	}
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(rotated)})
+	expectStatus(t, rec, http.StatusOK)
+
+	expectError(t, refresh(""), http.StatusUnauthorized, codeUnauthorized)
+	expectError(t, refresh("not a token"), http.StatusUnauthorized, codeUnauthorized)
+
+	// Replaying the first token revokes the whole session, even the jwt from the rotation
+	expectError(t, refresh(tokens.RefreshToken), http.StatusUnauthorized, codeUnauthorized)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(rotated)})
+	expectError(t, rec, http.StatusUnauthorized, codeUnauthorized)
+	expectError(t, refresh(rotated.RefreshToken), http.StatusUnauthorized, codeUnauthorized)
+
+	// Logging out ends only the session it is called from
+	first := logIn(t, h, "someone@example.com")
+	second := logIn(t, h, "someone@example.com")
+	rec = serve(t, h, request{method: http.MethodPost, path: "/site/tasks/logout", auth: bearer(first)})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(first)})
+	expectError(t, rec, http.StatusUnauthorized, codeUnauthorized)
+	expectError(t, refresh(first.RefreshToken), http.StatusUnauthorized, codeUnauthorized)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(second)})
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = serve(t, h, request{method: http.MethodPost, path: "/site/tasks/logout/all", auth: bearer(second)})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(second)})
+	expectError(t, rec, http.StatusUnauthorized, codeUnauthorized)
+}
+
+func TestAuthorization(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+		code   string
+	}{
+		{"no api key", "/api/tasks/all", "", http.StatusForbidden, codeForbidden},
+		{"unknown api key", "/api/tasks/all", "not a key", http.StatusForbidden, codeForbidden},
+		{"no bearer", "/site/tasks/all", "", http.StatusForbidden, codeForbidden},
+		{"malformed jwt", "/site/tasks/all", "Bearer not.a.jwt", http.StatusForbidden, codeForbidden},
+		{"jwt as api key", "/api/tasks/all", tokens.Jwt, http.StatusForbidden, codeForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serve(t, h, request{method: http.MethodGet, path: test.path, auth: test.auth})
+			expectError(t, rec, test.status, test.code)
+		})
+	}
+
+	apiKey := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "cli"})
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/all", auth: bearer(tokens)})
+	expectStatus(t, rec, http.StatusOK)
+
+	// Users only ever see their own tasks
+	task := addTask(t, h, apiKey, types.NewTaskPayload{Title: "mine"})
+	otherKey := newApiKey(t, h, signUp(t, h, "other@example.com"), types.ApiKeyPayload{Label: "cli"})
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/byId?id=" + strconv.Itoa(task.Id), auth: otherKey})
+	expectError(t, rec, http.StatusNotFound, codeNotFound)
+}
+
+func TestTaskCrud(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	due := time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: apiKey, body: types.NewTaskPayload{Title: "write tests", Body: "for the handlers", Due: due, Priority: 2}})
+	expectStatus(t, rec, http.StatusCreated)
+	created := decodeResponse[types.TaskReponse](t, rec)
+	if created.Title != "write tests" || created.Body != "for the handlers" || !created.Due.Equal(due) || created.Priority != 2 || created.Completed {
+		t.Fatalf("unexpected task %+v", created)
+	}
+	if location := rec.Header().Get("Location"); location != "/api/tasks/byId?id="+strconv.Itoa(created.Id) {
+		t.Fatalf("got location %q", location)
+	}
+
+	if task := getTask(t, h, apiKey, created.Id); task.Title != created.Title {
+		t.Fatalf("got task %+v", task)
+	}
+
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/edit", auth: apiKey, body: map[string]any{"id": created.Id, "title": "write more tests", "due": nil}})
+	expectStatus(t, rec, http.StatusOK)
+	edited := getTask(t, h, apiKey, created.Id)
+	if edited.Title != "write more tests" || !edited.Due.IsZero() || edited.Body != "for the handlers" {
+		t.Fatalf("unexpected task after edit %+v", edited)
+	}
+
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + strconv.Itoa(created.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if task := getTask(t, h, apiKey, created.Id); !task.Completed || task.CompletedDate == nil {
+		t.Fatalf("task was not completed %+v", task)
+	}
+
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/markIncomplete?id=" + strconv.Itoa(created.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if task := getTask(t, h, apiKey, created.Id); task.Completed {
+		t.Fatalf("task is still completed %+v", task)
+	}
+
+	rec = serve(t, h, request{method: http.MethodDelete, path: "/api/tasks/delete?id=" + strconv.Itoa(created.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/byId?id=" + strconv.Itoa(created.Id), auth: apiKey})
+	expectError(t, rec, http.StatusNotFound, codeNotFound)
+}
+
+func TestEditTaskPatch(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	due := time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)
+	task := addTask(t, h, apiKey, types.NewTaskPayload{Title: "task", Body: "body", Due: due, Priority: 2})
+	edit := func(patch map[string]any) *httptest.ResponseRecorder {
+		patch["id"] = task.Id
+		return serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/edit", auth: apiKey, body: patch})
+	}
+
+	// Null clears a member and an absent one is left alone
+	expectStatus(t, edit(map[string]any{"body": nil, "priority": nil}), http.StatusOK)
+	if edited := getTask(t, h, apiKey, task.Id); edited.Title != "task" || edited.Body != "" || !edited.Due.Equal(due) || edited.Priority != 0 {
+		t.Fatalf("unexpected task after clearing the body and priority %+v", edited)
+	}
+	expectStatus(t, edit(map[string]any{"due": nil, "title": "renamed"}), http.StatusOK)
+	if edited := getTask(t, h, apiKey, task.Id); edited.Title != "renamed" || !edited.Due.IsZero() || edited.Body != "" {
+		t.Fatalf("unexpected task after clearing the due date %+v", edited)
+	}
+
+	expectError(t, edit(map[string]any{"title": "renamed", "owner": "me"}), http.StatusBadRequest, codeInvalidBody)
+	if res := expectError(t, edit(map[string]any{}), http.StatusBadRequest, codeBadRequest); res.Message != db.EmptyEditError.Error() {
+		t.Fatalf("got message %q for an empty patch", res.Message)
+	}
+	for _, title := range []any{"", nil} {
+		if res := expectError(t, edit(map[string]any{"title": title}), http.StatusBadRequest, codeBadRequest); res.Message != db.InvalidTitleError.Error() {
+			t.Fatalf("got message %q for title %v", res.Message, title)
+		}
+	}
+	if edited := getTask(t, h, apiKey, task.Id); edited.Title != "renamed" {
+		t.Fatalf("rejected patches changed the task to %+v", edited)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   any
+		status int
+		code   string
+	}{
+		{"invalid json", http.MethodPost, "/api/tasks/new", "{", http.StatusBadRequest, codeInvalidBody},
+		{"missing id", http.MethodGet, "/api/tasks/byId", nil, http.StatusBadRequest, codeMissingId},
+		{"unknown task", http.MethodGet, "/api/tasks/byId?id=404", nil, http.StatusNotFound, codeNotFound},
+		{"unknown edit member", http.MethodPatch, "/api/tasks/edit", `{"id": 1, "owner": "me"}`, http.StatusBadRequest, codeInvalidBody},
+		{"empty edit", http.MethodPatch, "/api/tasks/edit", `{"id": 1}`, http.StatusBadRequest, codeBadRequest},
+		{"invalid limit", http.MethodGet, "/api/tasks/all?limit=0", nil, http.StatusBadRequest, codeBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := serve(t, h, request{method: test.method, path: test.path, auth: apiKey, body: test.body})
+			expectError(t, rec, test.status, test.code)
+		})
+	}
+
+	// The request id a proxy sent is echoed in the header and the body
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/byId", auth: apiKey, headers: map[string]string{requestIdHeader: "abc123"}})
+	res := expectError(t, rec, http.StatusBadRequest, codeMissingId)
+	if res.RequestId != "abc123" || rec.Header().Get(requestIdHeader) != "abc123" {
+		t.Fatalf("got request id %q and header %q", res.RequestId, rec.Header().Get(requestIdHeader))
+	}
+
+	// Invalid bodies get a fixed message instead of the decoder's
+	rec = serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: apiKey, body: "{"})
+	if res := expectError(t, rec, http.StatusBadRequest, codeInvalidBody); res.Message != invalidBodyError.Error() {
+		t.Fatalf("got message %q", res.Message)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.requestIdMiddleware(s.recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+
+	rec := serve(t, h, request{method: http.MethodGet, path: "/"})
+	res := expectError(t, rec, http.StatusInternalServerError, codeInternal)
+	// The panic value is logged, never sent
+	if res.Message != "Internal server error" {
+		t.Fatalf("got message %q", res.Message)
+	}
+}
+
+func TestServeOverHttp(t *testing.T) {
+	s, _ := newTestServer(t)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	tokens := signUp(t, ts.Config.Handler, "someone@example.com")
+	apiKey := newApiKey(t, ts.Config.Handler, tokens, types.ApiKeyPayload{Label: "cli"})
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/tasks/new", bytes.NewBufferString(`{"title": "over the wire"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", apiKey)
+	req.Header.Set("Origin", "https://jasontasks.com")
+
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Access-Control-Allow-Origin") == "" || resp.Header.Get(requestIdHeader) == "" {
+		t.Fatalf("missing cors or request id headers %v", resp.Header)
+	}
+	var task types.TaskReponse
+	if err = json.NewDecoder(resp.Body).Decode(&task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Title != "over the wire" {
+		t.Fatalf("got task %+v", task)
+	}
+}
+
+func TestRecurringTasks(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: apiKey, body: types.NewTaskPayload{Title: "standup", Recurrence: "FREQ=DAILY"}})
+	expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+	rec = serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: apiKey, body: types.NewTaskPayload{Title: "standup", Due: time.Now(), Recurrence: "FREQ=HOURLY"}})
+	expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+
+	// 2030-01-31 is a thursday
+	due := time.Date(2030, 1, 31, 9, 0, 0, 0, time.UTC)
+	task := addTask(t, h, apiKey, types.NewTaskPayload{Title: "standup", Due: due, Recurrence: "rrule:freq=weekly;byday=fr,mo;count=3"})
+	if task.Recurrence != "FREQ=WEEKLY;BYDAY=MO,FR;COUNT=3" {
+		t.Fatalf("rule was not stored canonically: %q", task.Recurrence)
+	}
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/recurrence/preview?n=5&id=" + strconv.Itoa(task.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	preview := decodeResponse[types.OccurrencesResponse](t, rec)
+	want := []time.Time{due.AddDate(0, 0, 1), due.AddDate(0, 0, 4)}
+	if len(preview.Occurrences) != len(want) || !preview.Occurrences[0].Equal(want[0]) || !preview.Occurrences[1].Equal(want[1]) {
+		t.Fatalf("got preview %v, want %v", preview.Occurrences, want)
+	}
+
+	// Completing an occurrence creates the next one and ends the series on the completed task
+	for i, next := range want {
+		rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + strconv.Itoa(task.Id+i), auth: apiKey})
+		expectStatus(t, rec, http.StatusOK)
+
+		completed := getTask(t, h, apiKey, task.Id+i)
+		if !completed.Completed || completed.Recurrence != "" {
+			t.Fatalf("unexpected completed occurrence %+v", completed)
+		}
+		spawned := getTask(t, h, apiKey, task.Id+i+1)
+		if spawned.Title != "standup" || spawned.Completed || !spawned.Due.Equal(next) || spawned.Recurrence != task.Recurrence {
+			t.Fatalf("unexpected next occurrence %+v", spawned)
+		}
+	}
+
+	// The third occurrence was the last
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + strconv.Itoa(task.Id+2), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/byId?id=" + strconv.Itoa(task.Id+3), auth: apiKey})
+	expectError(t, rec, http.StatusNotFound, codeNotFound)
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/recurrence/preview?id=" + strconv.Itoa(task.Id), auth: apiKey})
+	expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+}
+
+func TestSearchTasks(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	addTask(t, h, apiKey, types.NewTaskPayload{Title: "Buy milk"})
+	best := addTask(t, h, apiKey, types.NewTaskPayload{Title: "Milk the cows", Body: "milk, then more milk"})
+	addTask(t, h, apiKey, types.NewTaskPayload{Title: "Walk the dog"})
+	done := addTask(t, h, apiKey, types.NewTaskPayload{Title: "Milk chocolate"})
+	rec := serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + strconv.Itoa(done.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+
+	search := func(query string) types.Page[types.TaskReponse] {
+		t.Helper()
+		rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/search?" + query, auth: apiKey})
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[types.Page[types.TaskReponse]](t, rec)
+	}
+
+	page := search("q=MILK")
+	if len(page.Items) != 3 || page.Items[0].Id != best.Id || page.NextCursor != nil {
+		t.Fatalf("unexpected results %+v", page)
+	}
+	if page = search("q=milk&completed=true"); len(page.Items) != 1 || page.Items[0].Id != done.Id {
+		t.Fatalf("unexpected completed results %+v", page)
+	}
+	if page = search("q=nothing"); page.Items == nil || len(page.Items) != 0 {
+		t.Fatalf("expected an empty page %+v", page)
+	}
+
+	// Paging through returns every match once, in the same order
+	var ids []int
+	query := "q=milk&limit=2"
+	for {
+		page = search(query)
+		for _, task := range page.Items {
+			ids = append(ids, task.Id)
+		}
+		if page.NextCursor == nil {
+			break
+		}
+		query = "q=milk&limit=2&cursor=" + *page.NextCursor
+	}
+	if len(ids) != 3 || ids[0] != best.Id {
+		t.Fatalf("got ids %v", ids)
+	}
+
+	first := search("q=milk&limit=1")
+	for _, query := range []string{
+		"q=dog&cursor=" + *first.NextCursor,
+		"q=milk&completed=false&cursor=" + *first.NextCursor,
+		"q=milk&cursor=garbage",
+	} {
+		rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/search?" + query, auth: apiKey})
+		expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+	}
+
+	for _, query := range []string{"", "q=%20", "q=...", "q=milk&completed=maybe", "q=milk&limit=101"} {
+		rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/search?" + query, auth: apiKey})
+		expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+	}
+}
+
+// listAll pages through a listing and returns the ids in the order they were listed
+func listAll(t *testing.T, h http.Handler, auth string, path string) []int {
+	t.Helper()
+
+	var ids []int
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("pagination does not end")
+		}
+		rec := serve(t, h, request{method: http.MethodGet, path: path + cursor, auth: auth})
+		expectStatus(t, rec, http.StatusOK)
+		page := decodeResponse[types.Page[types.TaskReponse]](t, rec)
+		for _, task := range page.Items {
+			ids = append(ids, task.Id)
+		}
+		if page.NextCursor == nil {
+			return ids
+		}
+		cursor = "&cursor=" + *page.NextCursor
+	}
+}
+
+func TestCursorPagination(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	day := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Ties on due and priority, and tasks without a due date, have to page like any other
+	tasks := []types.NewTaskPayload{
+		{Title: "a", Due: day.AddDate(0, 0, 2), Priority: 1},
+		{Title: "b", Due: day, Priority: 3},
+		{Title: "c", Priority: 2},
+		{Title: "d", Due: day, Priority: 1},
+		{Title: "e", Due: day.AddDate(0, 0, 1), Priority: 3},
+		{Title: "f", Priority: 2},
+		{Title: "g", Due: day.AddDate(0, 0, 2), Priority: 1},
+	}
+	var ids []int
+	for _, task := range tasks {
+		ids = append(ids, addTask(t, h, apiKey, task).Id)
+	}
+
+	// Tasks are listed by their position in tasks, counting from 1
+	tests := []struct {
+		query string
+		want  []int
+	}{
+		{"sort=due", []int{3, 6, 2, 4, 5, 1, 7}},
+		{"sort=due&order=desc", []int{7, 1, 5, 4, 2, 6, 3}},
+		{"sort=priority", []int{1, 4, 7, 3, 6, 2, 5}},
+		{"sort=priority&order=desc", []int{5, 2, 6, 3, 7, 4, 1}},
+		{"sort=id&order=desc", []int{7, 6, 5, 4, 3, 2, 1}},
+		{"sort=created", []int{1, 2, 3, 4, 5, 6, 7}},
+		{"sort=priority&minPriority=2&maxPriority=2", []int{3, 6}},
+		{"sort=id&dueAfter=2030-01-02&dueBefore=2030-01-03", []int{5}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			var want []int
+			for _, position := range test.want {
+				want = append(want, ids[position-1])
+			}
+			for _, limit := range []string{"1", "2", "3", "100"} {
+				got := listAll(t, h, apiKey, "/api/tasks/all?limit="+limit+"&"+test.query)
+				if !slices.Equal(got, want) {
+					t.Fatalf("limit %s: got %v, want %v", limit, got, want)
+				}
+			}
+		})
+	}
+
+	// Without a limit everything is listed at once, as the bare array clients have always read
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/incomplete", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if incomplete := decodeResponse[[]types.IncompleteTaskResponse](t, rec); len(incomplete) != len(tasks) {
+		t.Fatalf("unexpected listing %+v", incomplete)
+	}
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all?sort=id", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if all := decodeResponse[[]types.TaskReponse](t, rec); len(all) != len(tasks) || all[0].Id != ids[0] {
+		t.Fatalf("unexpected listing %+v", all)
+	}
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/complete", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if body := strings.TrimSpace(rec.Body.String()); body != "[]" {
+		t.Fatalf("expected an empty array, got %s", body)
+	}
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/complete?limit=5", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if completed := decodeResponse[types.Page[types.CompletedTaskResponse]](t, rec); completed.Items == nil || len(completed.Items) != 0 || completed.NextCursor != nil {
+		t.Fatalf("expected an empty page %+v", completed)
+	}
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all?limit=2&sort=priority", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	cursor := *decodeResponse[types.Page[types.TaskReponse]](t, rec).NextCursor
+	for _, query := range []string{
+		"limit=2&sort=due&cursor=" + cursor,
+		"limit=2&sort=priority&order=desc&cursor=" + cursor,
+		"limit=2&cursor=bm90IGpzb24",
+		"sort=title",
+		"order=up",
+		"limit=101",
+		"dueAfter=tomorrow",
+		"minPriority=high",
+		"project=inbox",
+	} {
+		rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all?" + query, auth: apiKey})
+		expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+	}
+}
+
+func taskIds(tasks []types.TaskReponse) []int {
+	ids := []int{}
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+	return ids
+}
+
+func TestSync(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	sync := func(token string) types.SyncResponse {
+		t.Helper()
+		rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/sync?since=" + token, auth: apiKey})
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[types.SyncResponse](t, rec)
+	}
+
+	first := sync("")
+	if len(first.Created) != 0 || len(first.Updated) != 0 || len(first.Deleted) != 0 {
+		t.Fatalf("expected nothing to sync %+v", first)
+	}
+
+	kept := addTask(t, h, apiKey, types.NewTaskPayload{Title: "kept"})
+	edited := addTask(t, h, apiKey, types.NewTaskPayload{Title: "edited"})
+	deleted := addTask(t, h, apiKey, types.NewTaskPayload{Title: "deleted"})
+
+	// Without a token every task is listed as created
+	full := sync("")
+	if ids := taskIds(full.Created); !slices.Equal(ids, []int{kept.Id, edited.Id, deleted.Id}) || len(full.Updated) != 0 {
+		t.Fatalf("unexpected full sync %+v", full)
+	}
+	if again := sync(full.Token); len(again.Created)+len(again.Updated)+len(again.Deleted) != 0 || again.Token != full.Token {
+		t.Fatalf("expected nothing new %+v", again)
+	}
+
+	rec := serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/edit", auth: apiKey, body: map[string]any{"id": edited.Id, "title": "was edited"}})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodDelete, path: "/api/tasks/delete?id=" + strconv.Itoa(deleted.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	added := addTask(t, h, apiKey, types.NewTaskPayload{Title: "added"})
+	// Created and deleted between two syncs, it only shows up as deleted
+	shortLived := addTask(t, h, apiKey, types.NewTaskPayload{Title: "short lived"})
+	rec = serve(t, h, request{method: http.MethodDelete, path: "/api/tasks/delete?id=" + strconv.Itoa(shortLived.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+
+	delta := sync(full.Token)
+	if ids := taskIds(delta.Created); !slices.Equal(ids, []int{added.Id}) {
+		t.Fatalf("got created %v", ids)
+	}
+	if ids := taskIds(delta.Updated); !slices.Equal(ids, []int{edited.Id}) || delta.Updated[0].Title != "was edited" {
+		t.Fatalf("got updated %+v", delta.Updated)
+	}
+	if !slices.Equal(delta.Deleted, []int{deleted.Id, shortLived.Id}) {
+		t.Fatalf("got deleted %v", delta.Deleted)
+	}
+
+	// Clients dropped the task when it was deleted, so restoring it creates it again
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/trash/restore?id=" + strconv.Itoa(deleted.Id), auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	restored := sync(delta.Token)
+	if ids := taskIds(restored.Created); !slices.Equal(ids, []int{deleted.Id}) || len(restored.Updated) != 0 || len(restored.Deleted) != 0 {
+		t.Fatalf("unexpected sync after restore %+v", restored)
+	}
+
+	for _, token := range []string{"abc", "-1", "1000000"} {
+		rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/sync?since=" + token, auth: apiKey})
+		expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+	task := addTask(t, h, apiKey, types.NewTaskPayload{Title: "task"})
+
+	runBatch := func(body any) types.BatchResponse {
+		t.Helper()
+		rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/batch", auth: apiKey, body: body})
+		expectStatus(t, rec, http.StatusOK)
+		return decodeResponse[types.BatchResponse](t, rec)
+	}
+	statuses := func(res types.BatchResponse) []int {
+		var statuses []int
+		for _, result := range res.Results {
+			statuses = append(statuses, result.Status)
+		}
+		return statuses
+	}
+
+	version := taskVersion(t, h, apiKey, task.Id)
+	res := runBatch(map[string]any{"operations": []map[string]any{
+		{"op": "create", "task": map[string]any{"title": "created"}},
+		{"op": "edit", "id": task.Id, "version": version, "task": map[string]any{"title": "edited"}},
+		{"op": "complete", "id": task.Id, "version": version},
+		{"op": "delete", "id": 404},
+	}})
+	if !res.Committed || !slices.Equal(statuses(res), []int{http.StatusCreated, http.StatusOK, http.StatusPreconditionFailed, http.StatusNotFound}) {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	if res.Results[2].Code != codePreconditionFailed || res.Results[3].Code != codeNotFound || res.Results[0].Id == nil {
+		t.Fatalf("unexpected results %+v", res)
+	}
+	if created := getTask(t, h, apiKey, *res.Results[0].Id); created.Title != "created" {
+		t.Fatalf("got created task %+v", created)
+	}
+	if edited := getTask(t, h, apiKey, task.Id); edited.Title != "edited" || edited.Completed {
+		t.Fatalf("got edited task %+v", edited)
+	}
+
+	// In atomic mode one failure rolls back every operation
+	res = runBatch(map[string]any{"atomic": true, "operations": []map[string]any{
+		{"op": "complete", "id": task.Id},
+		{"op": "create", "task": map[string]any{"title": "never"}},
+		{"op": "uncomplete", "id": 404},
+	}})
+	if res.Committed || !slices.Equal(statuses(res), []int{http.StatusFailedDependency, http.StatusFailedDependency, http.StatusNotFound}) {
+		t.Fatalf("unexpected atomic results %+v", res)
+	}
+	if res.Results[0].Code != codeNotApplied || res.Results[1].Id != nil {
+		t.Fatalf("unexpected atomic results %+v", res)
+	}
+	if task := getTask(t, h, apiKey, task.Id); task.Completed {
+		t.Fatal("atomic batch was not rolled back")
+	}
+
+	tooMany := make([]map[string]any, maxBatchOperations+1)
+	for i := range tooMany {
+		tooMany[i] = map[string]any{"op": "complete", "id": task.Id}
+	}
+	for _, body := range []any{
+		map[string]any{"operations": []map[string]any{}},
+		map[string]any{"operations": tooMany},
+		map[string]any{"operations": []map[string]any{{"op": "archive", "id": task.Id}}},
+		map[string]any{"operations": []map[string]any{{"op": "complete"}}},
+		map[string]any{"operations": []map[string]any{{"op": "edit", "id": task.Id, "task": map[string]any{"owner": "me"}}}},
+	} {
+		rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/batch", auth: apiKey, body: body})
+		expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+	}
+
+	// The id of an edit comes from the operation alone, even when the task repeats it
+	for _, id := range []any{task.Id, 0, nil} {
+		rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/batch", auth: apiKey, body: map[string]any{"operations": []map[string]any{
+			{"op": "edit", "id": task.Id, "task": map[string]any{"id": id, "title": "renamed"}},
+		}}})
+		if res := expectError(t, rec, http.StatusBadRequest, codeBadRequest); res.Message != "Operation 0: "+batchTaskId.Error() {
+			t.Fatalf("got message %q", res.Message)
+		}
+	}
+	if edited := getTask(t, h, apiKey, task.Id); edited.Title != "edited" {
+		t.Fatalf("rejected edit renamed the task to %q", edited.Title)
+	}
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/batch", auth: apiKey, body: map[string]any{"operations": tooMany}})
+	if res := expectError(t, rec, http.StatusBadRequest, codeBadRequest); res.Message != "A batch needs between 1 and 100 operations" {
+		t.Fatalf("got message %q", res.Message)
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+	task := addTask(t, h, apiKey, types.NewTaskPayload{Title: "task"})
+	id := strconv.Itoa(task.Id)
+
+	writes := []request{
+		{method: http.MethodPatch, path: "/api/tasks/edit", body: map[string]any{"id": task.Id, "title": "edited"}},
+		{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + id},
+		{method: http.MethodPatch, path: "/api/tasks/markIncomplete?id=" + id},
+		{method: http.MethodPatch, path: "/api/tasks/tags/add?id=" + id, body: types.TagsPayload{Tags: []string{"home"}}},
+		{method: http.MethodPatch, path: "/api/tasks/tags/remove?id=" + id, body: types.TagsPayload{Tags: []string{"home"}}},
+		{method: http.MethodPatch, path: "/api/tasks/move?id=" + id, body: types.MoveTaskPayload{}},
+		{method: http.MethodPatch, path: "/api/tasks/parent?id=" + id, body: types.ParentPayload{}},
+	}
+	for _, write := range writes {
+		current := etag(taskVersion(t, h, apiKey, task.Id))
+		write.auth = apiKey
+
+		write.headers = map[string]string{ifMatchHeader: etag(0)}
+		expectError(t, serve(t, h, write), http.StatusPreconditionFailed, codePreconditionFailed)
+
+		// The ETag of a write is the version the next conditional write has to send
+		write.headers = map[string]string{ifMatchHeader: current}
+		rec := serve(t, h, write)
+		expectStatus(t, rec, http.StatusOK)
+		next := rec.Header().Get(etagHeader)
+		if next == "" || next == current || next != etag(taskVersion(t, h, apiKey, task.Id)) {
+			t.Fatalf("%s answered with etag %q after %q", write.path, next, current)
+		}
+	}
+
+	version := taskVersion(t, h, apiKey, task.Id)
+	rec := serve(t, h, request{method: http.MethodDelete, path: "/api/tasks/delete?id=" + id, auth: apiKey, headers: map[string]string{ifMatchHeader: etag(version)}})
+	expectStatus(t, rec, http.StatusOK)
+
+	// A task in the trash keeps the version it was deleted at
+	for _, write := range []request{
+		{method: http.MethodPatch, path: "/api/tasks/trash/restore?id=" + id},
+		{method: http.MethodDelete, path: "/api/tasks/trash/purge?id=" + id},
+	} {
+		write.auth = apiKey
+		write.headers = map[string]string{ifMatchHeader: etag(version - 1)}
+		expectError(t, serve(t, h, write), http.StatusPreconditionFailed, codePreconditionFailed)
+	}
+
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/trash/restore?id=" + id, auth: apiKey, headers: map[string]string{ifMatchHeader: etag(version)}})
+	expectStatus(t, rec, http.StatusOK)
+	if restored := rec.Header().Get(etagHeader); restored != etag(taskVersion(t, h, apiKey, task.Id)) {
+		t.Fatalf("restore answered with etag %q", restored)
+	}
+}
+
+func addProject(t *testing.T, h http.Handler, tokens types.JwtResponse, name string) types.ProjectResponse {
+	t.Helper()
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/site/tasks/projects/new", auth: bearer(tokens), body: types.ProjectPayload{Name: name}})
+	expectStatus(t, rec, http.StatusCreated)
+	return decodeResponse[types.ProjectResponse](t, rec)
+}
+
+func TestTags(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	apiKey := newApiKey(t, h, signUp(t, h, "someone@example.com"), types.ApiKeyPayload{Label: "cli"})
+
+	first := addTask(t, h, apiKey, types.NewTaskPayload{Title: "first"})
+	second := addTask(t, h, apiKey, types.NewTaskPayload{Title: "second", Tags: []string{"Work"}})
+	rec := serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/tags/add?id=" + strconv.Itoa(first.Id), auth: apiKey, body: types.TagsPayload{Tags: []string{" HOME", "work"}}})
+	expectStatus(t, rec, http.StatusOK)
+	if tags := decodeResponse[types.TaskReponse](t, rec).Tags; !slices.Equal(tags, []string{"home", "work"}) {
+		t.Fatalf("got tags %v", tags)
+	}
+
+	if ids := listAll(t, h, apiKey, "/api/tasks/all?limit=10&sort=id&tag=work"); !slices.Equal(ids, []int{first.Id, second.Id}) {
+		t.Fatalf("got %v tagged work", ids)
+	}
+	if ids := listAll(t, h, apiKey, "/api/tasks/all?limit=10&sort=id&tag=work&tag=home"); !slices.Equal(ids, []int{first.Id}) {
+		t.Fatalf("got %v tagged work and home", ids)
+	}
+
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/tags/rename", auth: apiKey, body: types.RenameTagPayload{Name: "home", NewName: "work"}})
+	expectError(t, rec, http.StatusConflict, codeConflict)
+	rec = serve(t, h, request{method: http.MethodPatch, path: "/api/tasks/tags/add?id=" + strconv.Itoa(first.Id), auth: apiKey, body: types.TagsPayload{Tags: []string{""}}})
+	expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+
+	rec = serve(t, h, request{method: http.MethodDelete, path: "/api/tasks/tags/delete?name=work", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if ids := listAll(t, h, apiKey, "/api/tasks/all?limit=10&tag=work"); len(ids) != 0 {
+		t.Fatalf("got %v tagged with a deleted tag", ids)
+	}
+	rec = serve(t, h, request{method: http.MethodDelete, path: "/api/tasks/tags/delete?name=work", auth: apiKey})
+	expectError(t, rec, http.StatusNotFound, codeNotFound)
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/tags/all", auth: apiKey})
+	expectStatus(t, rec, http.StatusOK)
+	if tags := decodeResponse[[]types.TagResponse](t, rec); !slices.Equal(tags, []types.TagResponse{{Name: "home", TaskCount: 1}}) {
+		t.Fatalf("got tags %+v", tags)
+	}
+}
+
+func TestListingShapes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+	apiKey := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "cli"})
+	project := addProject(t, h, tokens, "work")
+
+	parent := addTask(t, h, apiKey, types.NewTaskPayload{Title: "parent", ProjectId: &project.Id})
+	for _, title := range []string{"first", "second"} {
+		addTask(t, h, apiKey, types.NewTaskPayload{Title: title, ParentId: &parent.Id, ProjectId: &project.Id})
+	}
+
+	for path, count := range map[string]int{
+		"/api/tasks/subtasks?id=" + strconv.Itoa(parent.Id):        2,
+		"/api/tasks/projects/tasks?id=" + strconv.Itoa(project.Id): 3,
+	} {
+		// Unpaginated listings stay bare arrays
+		rec := serve(t, h, request{method: http.MethodGet, path: path, auth: apiKey})
+		expectStatus(t, rec, http.StatusOK)
+		if tasks := decodeResponse[[]types.TaskReponse](t, rec); len(tasks) != count {
+			t.Fatalf("%s listed %+v", path, tasks)
+		}
+
+		if ids := listAll(t, h, apiKey, path+"&limit=1"); len(ids) != count {
+			t.Fatalf("%s paged through %v", path, ids)
+		}
+	}
+}
+
+func TestApiRoutesHaveScopes(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	registered := map[string]bool{}
+	err := s.router().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/tasks/") {
+			return nil
+		}
+		if _, err = route.GetMethods(); err != nil {
+			return nil
+		}
+		registered[template] = true
+		if access, ok := apiRoutes[template]; !ok || len(access.scopes) == 0 {
+			t.Errorf("%s has no scopes", template)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for template := range apiRoutes {
+		if !registered[template] {
+			t.Errorf("%s has scopes but no route", template)
+		}
+	}
+}
+
+func TestApiKeyScopes(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+	fullKey := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "full"})
+	task := addTask(t, h, fullKey, types.NewTaskPayload{Title: "task"})
+	id := strconv.Itoa(task.Id)
+
+	readKey := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "dashboard", Scopes: []types.ApiKeyScope{types.ScopeTasksRead}})
+	writeKey := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "writer", Scopes: []types.ApiKeyScope{types.ScopeTasksRead, types.ScopeTasksWrite}})
+
+	tests := []struct {
+		name  string
+		key   string
+		route request
+		scope types.ApiKeyScope
+	}{
+		{"read key listing tasks", readKey, request{method: http.MethodGet, path: "/api/tasks/all"}, ""},
+		{"read key creating a task", readKey, request{method: http.MethodPost, path: "/api/tasks/new", body: types.NewTaskPayload{Title: "no"}}, types.ScopeTasksWrite},
+		{"read key listing checklist", readKey, request{method: http.MethodGet, path: "/api/tasks/checklist/all?id=" + id}, types.ScopeChecklistRead},
+		{"read key listing projects", readKey, request{method: http.MethodGet, path: "/api/tasks/projects/all"}, types.ScopeProjectsRead},
+		{"write key completing a task", writeKey, request{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + id}, ""},
+		{"write key creating a project", writeKey, request{method: http.MethodPost, path: "/api/tasks/projects/new", body: types.ProjectPayload{Name: "no"}}, types.ScopeProjectsWrite},
+		{"write key adding a checklist item", writeKey, request{method: http.MethodPost, path: "/api/tasks/checklist/new?id=" + id, body: types.ChecklistItemPayload{Title: "no"}}, types.ScopeChecklistWrite},
+		{"write key renaming a tag", writeKey, request{method: http.MethodPatch, path: "/api/tasks/tags/rename", body: types.RenameTagPayload{Name: "a", NewName: "b"}}, types.ScopeTagsWrite},
+		{"write key deleting a task", writeKey, request{method: http.MethodDelete, path: "/api/tasks/delete?id=" + id}, types.ScopeTasksDelete},
+		{"write key deleting through a batch", writeKey, request{method: http.MethodPost, path: "/api/tasks/batch", body: map[string]any{"operations": []map[string]any{{"op": "delete", "id": task.Id}}}}, types.ScopeTasksDelete},
+		{"full key creating a project", fullKey, request{method: http.MethodPost, path: "/api/tasks/projects/new", body: types.ProjectPayload{Name: "yes"}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.route.auth = test.key
+			rec := serve(t, h, test.route)
+			if test.scope == "" {
+				if rec.Code >= 300 {
+					t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			if res := expectError(t, rec, http.StatusForbidden, codeInsufficientScope); !strings.Contains(res.Message, string(test.scope)) {
+				t.Fatalf("got message %q, want it to name %s", res.Message, test.scope)
+			}
+		})
+	}
+
+	rec := serve(t, h, request{method: http.MethodPost, path: "/site/tasks/key/new", auth: bearer(tokens), body: types.ApiKeyPayload{Label: "bad", Scopes: []types.ApiKeyScope{"tasks:admin"}}})
+	expectError(t, rec, http.StatusBadRequest, codeBadRequest)
+}
+
+func TestProjectApiKeys(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+	fullKey := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "full"})
+
+	mine := addProject(t, h, tokens, "mine")
+	other := addProject(t, h, tokens, "other")
+	inside := addTask(t, h, fullKey, types.NewTaskPayload{Title: "inside", ProjectId: &mine.Id})
+	outside := addTask(t, h, fullKey, types.NewTaskPayload{Title: "outside", ProjectId: &other.Id})
+	loose := addTask(t, h, fullKey, types.NewTaskPayload{Title: "loose"})
+
+	key := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "project", ProjectId: &mine.Id})
+
+	if ids := listAll(t, h, key, "/api/tasks/all?limit=10"); !slices.Equal(ids, []int{inside.Id}) {
+		t.Fatalf("listed %v", ids)
+	}
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all?project=" + strconv.Itoa(other.Id), auth: key})
+	expectError(t, rec, http.StatusForbidden, codeInsufficientScope)
+
+	getTask(t, h, key, inside.Id)
+	for _, id := range []int{outside.Id, loose.Id} {
+		for _, route := range []request{
+			{method: http.MethodGet, path: "/api/tasks/byId?id=" + strconv.Itoa(id)},
+			{method: http.MethodPatch, path: "/api/tasks/markComplete?id=" + strconv.Itoa(id)},
+			{method: http.MethodPatch, path: "/api/tasks/edit", body: map[string]any{"id": id, "title": "taken"}},
+			{method: http.MethodGet, path: "/api/tasks/checklist/all?id=" + strconv.Itoa(id)},
+			{method: http.MethodPatch, path: "/api/tasks/parent?id=" + strconv.Itoa(inside.Id), body: types.ParentPayload{ParentId: &id}},
+			{method: http.MethodPost, path: "/api/tasks/batch", body: map[string]any{"operations": []map[string]any{{"op": "complete", "id": id}}}},
+		} {
+			route.auth = key
+			expectError(t, serve(t, h, route), http.StatusNotFound, codeNotFound)
+		}
+	}
+	if task := getTask(t, h, fullKey, outside.Id); task.Completed || task.Title != "outside" {
+		t.Fatalf("task outside the project was changed %+v", task)
+	}
+
+	// New tasks land in the key's project
+	created := addTask(t, h, key, types.NewTaskPayload{Title: "created"})
+	if created.ProjectId == nil || *created.ProjectId != mine.Id {
+		t.Fatalf("created task is in project %v", created.ProjectId)
+	}
+	rec = serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: key, body: types.NewTaskPayload{Title: "elsewhere", ProjectId: &other.Id}})
+	expectError(t, rec, http.StatusForbidden, codeInsufficientScope)
+
+	for _, route := range []request{
+		{method: http.MethodGet, path: "/api/tasks/search?q=task"},
+		{method: http.MethodGet, path: "/api/tasks/sync"},
+		{method: http.MethodGet, path: "/api/tasks/trash"},
+		{method: http.MethodGet, path: "/api/tasks/projects/all"},
+		{method: http.MethodPatch, path: "/api/tasks/move?id=" + strconv.Itoa(inside.Id), body: types.MoveTaskPayload{}},
+	} {
+		route.auth = key
+		expectError(t, serve(t, h, route), http.StatusForbidden, codeInsufficientScope)
+	}
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/projects/byId?id=" + strconv.Itoa(mine.Id), auth: key})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/projects/tasks?id=" + strconv.Itoa(other.Id), auth: key})
+	expectError(t, rec, http.StatusNotFound, codeNotFound)
+
+	unknown := other.Id + 100
+	rec = serve(t, h, request{method: http.MethodPost, path: "/site/tasks/key/new", auth: bearer(tokens), body: types.ApiKeyPayload{Label: "nowhere", ProjectId: &unknown}})
+	expectError(t, rec, http.StatusNotFound, codeNotFound)
+
+	// Deleting the project revokes its keys
+	rec = serve(t, h, request{method: http.MethodDelete, path: "/site/tasks/projects/delete?id=" + strconv.Itoa(mine.Id), auth: bearer(tokens)})
+	expectStatus(t, rec, http.StatusOK)
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all", auth: key})
+	expectError(t, rec, http.StatusForbidden, codeForbidden)
+}
+
+// failingStore fails every api key lookup the way an unreachable database would
+type failingStore struct {
+	*db.MemoryStore
+}
+
+func (failingStore) GetApiKeyOwner(string) (string, types.ApiKeyMetadata, error) {
+	return "", types.ApiKeyMetadata{}, errors.New("connection refused")
+}
+
+func TestApiKeyUsage(t *testing.T) {
+	s, store := newTestServer(t)
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+	key := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "dashboard", Scopes: []types.ApiKeyScope{types.ScopeTasksRead}})
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all", auth: key}), http.StatusOK)
+	}
+	// Requests the key was not allowed to make are not counted
+	rec := serve(t, h, request{method: http.MethodPost, path: "/api/tasks/new", auth: key, body: types.NewTaskPayload{Title: "no"}})
+	expectError(t, rec, http.StatusForbidden, codeInsufficientScope)
+
+	usage := s.apiKeyUsage.take()
+	if len(usage) != 1 {
+		t.Fatalf("got usage %+v", usage)
+	}
+	for id, keyUsage := range usage {
+		if keyUsage.Requests != 2 || keyUsage.LastUsed.IsZero() {
+			t.Fatalf("got usage %+v", keyUsage)
+		}
+		// Put back so the flush writes it
+		s.apiKeyUsage.add(id, keyUsage)
+	}
+	s.writeApiKeyUsage()
+
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/key/all", auth: bearer(tokens)})
+	expectStatus(t, rec, http.StatusOK)
+	if keys := decodeResponse[[]types.ApiKeyMetadata](t, rec); len(keys) != 1 || keys[0].LastAccessed == nil {
+		t.Fatalf("last use was not written %+v", keys)
+	}
+
+	// Only a key that does not exist is forbidden, a failing lookup is the server's fault
+	s.db = failingStore{store}
+	rec = serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all", auth: key})
+	expectError(t, rec, http.StatusInternalServerError, codeInternal)
+}
+
+// stubMailer records the expiry emails it is asked to send and fails while err is set
+type stubMailer struct {
+	err    error
+	labels []string
+}
+
+func (m *stubMailer) SendResetEmail(email string, oneTimeToken string) error {
+	return m.err
+}
+
+func (m *stubMailer) SendApiKeyExpiryEmail(email string, label string, expiration time.Time) error {
+	if m.err == nil {
+		m.labels = append(m.labels, label)
+	}
+	return m.err
+}
+
+func TestApiKeyExpiry(t *testing.T) {
+	s, _ := newTestServer(t)
+	mailer := &stubMailer{err: errors.New("mail is down")}
+	s.mailer = mailer
+	h := s.Handler()
+	tokens := signUp(t, h, "someone@example.com")
+
+	expired := time.Now().Add(-time.Minute)
+	key := newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "expired", Expiration: &expired})
+	rec := serve(t, h, request{method: http.MethodGet, path: "/api/tasks/all", auth: key})
+	expectError(t, rec, http.StatusUnauthorized, codeUnauthorized)
+
+	soon := time.Now().Add(time.Hour)
+	newApiKey(t, h, tokens, types.ApiKeyPayload{Label: "soon", Expiration: &soon})
+
+	// A failed email gives the claim back so the next check sends it
+	s.sendApiKeyExpiryNotices(context.Background())
+	if len(mailer.labels) != 0 {
+		t.Fatalf("sent %v while mail was down", mailer.labels)
+	}
+	mailer.err = nil
+	s.sendApiKeyExpiryNotices(context.Background())
+	s.sendApiKeyExpiryNotices(context.Background())
+	if !slices.Equal(mailer.labels, []string{"soon"}) {
+		t.Fatalf("sent %v", mailer.labels)
+	}
+}
+
+// jwtKid is the kid header of a jwt, which is not verified here
+func jwtKid(t *testing.T, token string) string {
+	t.Helper()
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &types.JwtClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestJwks(t *testing.T) {
+	s, _ := newTestServer(t)
+	h := s.Handler()
+	key, err := auth.GetJwtPrivateKey(s.config.Auth.JwtPemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(t, h, request{method: http.MethodGet, path: "/.well-known/jwks.json"})
+	expectStatus(t, rec, http.StatusOK)
+	jwks := decodeResponse[types.JwkSet](t, rec)
+	if len(jwks.Keys) != 1 {
+		t.Fatalf("got jwks %+v", jwks)
+	}
+
+	// Without a keyring the kid of the single key is its RFC 7638 thumbprint
+	jwk := jwks.Keys[0]
+	if jwk.Kid != auth.KeyId(&key.PublicKey) || jwk.Kty != "EC" || jwk.Crv != "P-256" || jwk.Alg != "ES256" || jwk.Use != "sig" {
+		t.Fatalf("got jwk %+v", jwk)
+	}
+	for _, coordinate := range []struct {
+		encoded  string
+		expected *big.Int
+	}{{jwk.X, key.X}, {jwk.Y, key.Y}} {
+		decoded, err := base64.RawURLEncoding.DecodeString(coordinate.encoded)
+		if err != nil || new(big.Int).SetBytes(decoded).Cmp(coordinate.expected) != 0 {
+			t.Fatalf("jwk coordinate %q does not match the key: %v", coordinate.encoded, err)
+		}
+	}
+
+	if kid := jwtKid(t, signUp(t, h, "someone@example.com").Jwt); kid != jwk.Kid {
+		t.Fatalf("jwt was signed with kid %q, the jwks has %q", kid, jwk.Kid)
+	}
+}
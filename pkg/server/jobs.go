@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/senyc/jason/pkg/types"
+)
+
+// apiKeyUsage collects when and how often each api key was used, so it is written in batches
+// instead of on every request
+type apiKeyUsage struct {
+	mu    sync.Mutex
+	usage map[string]types.ApiKeyUsage
+}
+
+// record counts one request made with the key
+func (u *apiKeyUsage) record(id string, usedAt time.Time) {
+	u.add(id, types.ApiKeyUsage{LastUsed: usedAt, Requests: 1})
+}
+
+func (u *apiKeyUsage) add(id string, usage types.ApiKeyUsage) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.usage == nil {
+		u.usage = map[string]types.ApiKeyUsage{}
+	}
+	keyUsage := u.usage[id]
+	if usage.LastUsed.After(keyUsage.LastUsed) {
+		keyUsage.LastUsed = usage.LastUsed
+	}
+	keyUsage.Requests += usage.Requests
+	u.usage[id] = keyUsage
+}
+
+// take empties the collected usage and returns it
+func (u *apiKeyUsage) take() map[string]types.ApiKeyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	usage := u.usage
+	u.usage = nil
+	return usage
+}
+
+// purgeTrash permanently deletes tasks that have outlived the trash retention, once at startup and
+// then on every purge interval
+func (s *Server) purgeTrash(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Trash.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.db.PurgeTrash(s.config.Trash.Retention)
+		if err != nil {
+			s.logger.Printf("purging the trash failed: %v", err)
+		} else if purged > 0 {
+			s.logger.Printf("purged %d tasks from the trash", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reloadKeyring reads the jwt signing keys again whenever the process receives SIGHUP, so keys
+// can be rotated without a restart
+func (s *Server) reloadKeyring(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+
+		if err := s.keyring.Reload(); err != nil {
+			s.logger.Printf("reloading the keyring failed, keeping the current keys: %v", err)
+		} else {
+			s.logger.Println("reloaded the keyring")
+		}
+	}
+}
+
+// flushApiKeyUsage writes the collected api key usage on every flush interval, and once more when
+// stopping so nothing recorded before shutdown is lost
+func (s *Server) flushApiKeyUsage(ctx context.Context) {
+	ticker := time.NewTicker(s.config.ApiKeys.LastUsedFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.writeApiKeyUsage()
+			return
+		case <-ticker.C:
+			s.writeApiKeyUsage()
+		}
+	}
+}
+
+func (s *Server) writeApiKeyUsage() {
+	usage := s.apiKeyUsage.take()
+	if len(usage) == 0 {
+		return
+	}
+
+	if err := s.db.RecordApiKeyUsage(usage); err != nil {
+		s.logger.Printf("recording api key usage failed: %v", err)
+		// Kept for the next flush, merged with anything recorded in the meantime
+		for id, keyUsage := range usage {
+			s.apiKeyUsage.add(id, keyUsage)
+		}
+	}
+}
+
+// notifyExpiringApiKeys emails the owners of api keys expiring within the expiry notice, once per
+// key, at startup and then on every check interval
+func (s *Server) notifyExpiringApiKeys(ctx context.Context) {
+	ticker := time.NewTicker(s.config.ApiKeys.ExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		s.sendApiKeyExpiryNotices(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendApiKeyExpiryNotices makes a single pass over the keys expiring within the expiry notice
+func (s *Server) sendApiKeyExpiryNotices(ctx context.Context) {
+	keys, err := s.db.GetExpiringApiKeys(time.Now().Add(s.config.ApiKeys.ExpiryNotice))
+	if err != nil {
+		s.logger.Printf("looking for expiring api keys failed: %v", err)
+		return
+	}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		// Claimed before sending so that servers checking at the same time email only once
+		claimed, err := s.db.ClaimApiKeyExpiryNotice(key.Id)
+		if err != nil {
+			s.logger.Printf("claiming the expiry notice of api key %s failed: %v", key.Id, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		// Keys whose email failed are released and tried again on the next check
+		if err = s.mailer.SendApiKeyExpiryEmail(key.Email, key.Label, key.Expiration); err != nil {
+			s.logger.Printf("emailing about expiring api key %s failed: %v", key.Id, err)
+			if err = s.db.ReleaseApiKeyExpiryNotice(key.Id); err != nil {
+				s.logger.Printf("releasing the expiry notice of api key %s failed: %v", key.Id, err)
+			}
+		}
+	}
+}
@@ -2,15 +2,100 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
 	"github.com/senyc/jason/pkg/auth"
+	"github.com/senyc/jason/pkg/db"
 	"github.com/senyc/jason/pkg/types"
 )
 
+const requestIdHeader = "X-Request-Id"
+
+var (
+	noApiKey          error = errors.New("No api key provided")
+	invalidApiKey     error = errors.New("Api key is not valid")
+	noBearer          error = errors.New("No bearer token provided")
+	keyExpired        error = errors.New("Api key has expired")
+	noApiKeyRoute     error = errors.New("This route cannot be used with an api key")
+	projectKeyRoute   error = errors.New("This route cannot be used with an api key restricted to a project")
+	outsideKeyProject error = errors.New("This api key only reaches the tasks of its project")
+)
+
+// statusRecorder remembers whether a response has been started so a recovered panic
+// only writes an error when the client has not received anything yet
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value("requestId").(string)
+	return requestId
+}
+
+// Reuses the id set by a proxy in front of us so logs can be correlated across services
+func (s *Server) requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId := r.Header.Get(requestIdHeader)
+		if requestId == "" || len(requestId) > 64 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			requestId = hex.EncodeToString(b)
+		}
+
+		w.Header().Set(requestIdHeader, requestId)
+		ctx := context.WithValue(r.Context(), "requestId", requestId)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			s.logger.Printf("request %s panicked: %v\n%s", requestIdFromContext(r.Context()), recovered, debug.Stack())
+			if recorder.status == 0 {
+				s.writeError(recorder, r, internalError(fmt.Errorf("%v", recovered)))
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		s.logger.Println(r.RequestURI)
@@ -21,45 +106,241 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 func (s *Server) authorizationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		key := r.Header.Get("Authorization")
-		userId, err := s.db.GetUserIdFromApiKey(auth.EncryptApiKey(key))
-		if err == nil {
-			err = s.db.IncrementApiKeyUsage(userId)
+		if key == "" {
+			s.writeError(w, r, forbidden(noApiKey))
+			return
+		}
+
+		userId, apiKey, err := s.db.GetApiKeyOwner(auth.EncryptApiKey(key))
+		if errors.Is(err, sql.ErrNoRows) {
+			s.writeError(w, r, forbidden(invalidApiKey))
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, internalError(err))
+			return
+		}
+
+		now := time.Now()
+		if !apiKey.Expiration.IsZero() && !apiKey.Expiration.After(now) {
+			s.writeError(w, r, unauthorized(keyExpired))
+			return
 		}
 
-		if err == nil {
-			ctx := context.WithValue(r.Context(), "userId", userId)
-			next.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			s.logger.Panic(err)
-			http.Error(w, "Forbidden", http.StatusForbidden)
+		access, ok := apiRoutes[routeTemplate(r)]
+		if !ok {
+			s.writeError(w, r, newApiError(http.StatusForbidden, codeInsufficientScope, noApiKeyRoute))
+			return
+		}
+		for _, scope := range access.scopes {
+			if !slices.Contains(apiKey.Scopes, scope) {
+				s.writeError(w, r, missingScope(scope))
+				return
+			}
 		}
+
+		ctx := context.WithValue(r.Context(), "userId", userId)
+		ctx = context.WithValue(ctx, "apiKeyScopes", apiKey.Scopes)
+		if apiKey.ProjectId != nil {
+			ctx = context.WithValue(ctx, "apiKeyProject", *apiKey.ProjectId)
+			if err = s.checkRouteProject(r.WithContext(ctx), userId, access.project); err != nil {
+				s.writeError(w, r, err)
+				return
+			}
+		}
+
+		// Only requests the key was allowed to make count as using it
+		s.apiKeyUsage.record(apiKey.Id, now)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// projectAccess is how a route keeps api keys restricted to a project within that project
+type projectAccess int
+
+const (
+	// The route reaches beyond a single project, restricted keys cannot use it
+	projectDenied projectAccess = iota
+	// ?id= is a task, which has to be in the key's project
+	projectTask
+	// ?id= is a project, which has to be the key's project
+	projectItself
+	// The handler keeps the request within the key's project
+	projectHandled
+)
+
+type routeAccess struct {
+	// Every one of these is needed
+	scopes  []types.ApiKeyScope
+	project projectAccess
+}
+
+// apiRoutes is what an api key needs for each route, a route missing here cannot be used with an
+// api key at all
+var apiRoutes = map[string]routeAccess{
+	"/api/tasks/all":                {[]types.ApiKeyScope{types.ScopeTasksRead}, projectHandled},
+	"/api/tasks/complete":           {[]types.ApiKeyScope{types.ScopeTasksRead}, projectHandled},
+	"/api/tasks/incomplete":         {[]types.ApiKeyScope{types.ScopeTasksRead}, projectHandled},
+	"/api/tasks/byId":               {[]types.ApiKeyScope{types.ScopeTasksRead}, projectTask},
+	"/api/tasks/search":             {[]types.ApiKeyScope{types.ScopeTasksRead}, projectDenied},
+	"/api/tasks/stats":              {[]types.ApiKeyScope{types.ScopeTasksRead}, projectDenied},
+	"/api/tasks/sync":               {[]types.ApiKeyScope{types.ScopeTasksRead}, projectDenied},
+	"/api/tasks/trash":              {[]types.ApiKeyScope{types.ScopeTasksRead}, projectDenied},
+	"/api/tasks/subtasks":           {[]types.ApiKeyScope{types.ScopeTasksRead}, projectTask},
+	"/api/tasks/recurrence/preview": {[]types.ApiKeyScope{types.ScopeTasksRead}, projectTask},
+	"/api/tasks/tags/all":           {[]types.ApiKeyScope{types.ScopeTasksRead}, projectDenied},
+	"/api/tasks/new":                {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectHandled},
+	"/api/tasks/edit":               {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectHandled},
+	"/api/tasks/markComplete":       {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectTask},
+	"/api/tasks/markIncomplete":     {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectTask},
+	"/api/tasks/tags/add":           {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectTask},
+	"/api/tasks/tags/remove":        {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectTask},
+	"/api/tasks/parent":             {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectTask},
+	"/api/tasks/move":               {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectDenied},
+	"/api/tasks/trash/restore":      {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectDenied},
+	// Deleting through a batch takes tasks:delete as well
+	"/api/tasks/batch":              {[]types.ApiKeyScope{types.ScopeTasksWrite}, projectHandled},
+	"/api/tasks/delete":             {[]types.ApiKeyScope{types.ScopeTasksDelete}, projectTask},
+	"/api/tasks/trash/purge":        {[]types.ApiKeyScope{types.ScopeTasksDelete}, projectDenied},
+	"/api/tasks/trash/empty":        {[]types.ApiKeyScope{types.ScopeTasksDelete}, projectDenied},
+	"/api/tasks/tags/rename":        {[]types.ApiKeyScope{types.ScopeTagsWrite}, projectDenied},
+	"/api/tasks/tags/delete":        {[]types.ApiKeyScope{types.ScopeTagsWrite}, projectDenied},
+	"/api/tasks/checklist/all":      {[]types.ApiKeyScope{types.ScopeChecklistRead}, projectTask},
+	"/api/tasks/checklist/new":      {[]types.ApiKeyScope{types.ScopeChecklistWrite}, projectTask},
+	"/api/tasks/checklist/edit":     {[]types.ApiKeyScope{types.ScopeChecklistWrite}, projectTask},
+	"/api/tasks/checklist/check":    {[]types.ApiKeyScope{types.ScopeChecklistWrite}, projectTask},
+	"/api/tasks/checklist/uncheck":  {[]types.ApiKeyScope{types.ScopeChecklistWrite}, projectTask},
+	"/api/tasks/checklist/delete":   {[]types.ApiKeyScope{types.ScopeChecklistWrite}, projectTask},
+	"/api/tasks/projects/all":       {[]types.ApiKeyScope{types.ScopeProjectsRead}, projectDenied},
+	"/api/tasks/projects/byId":      {[]types.ApiKeyScope{types.ScopeProjectsRead}, projectItself},
+	"/api/tasks/projects/tasks":     {[]types.ApiKeyScope{types.ScopeProjectsRead, types.ScopeTasksRead}, projectItself},
+	"/api/tasks/projects/new":       {[]types.ApiKeyScope{types.ScopeProjectsWrite}, projectDenied},
+	"/api/tasks/projects/edit":      {[]types.ApiKeyScope{types.ScopeProjectsWrite}, projectDenied},
+	"/api/tasks/projects/archive":   {[]types.ApiKeyScope{types.ScopeProjectsWrite}, projectDenied},
+	"/api/tasks/projects/unarchive": {[]types.ApiKeyScope{types.ScopeProjectsWrite}, projectDenied},
+	"/api/tasks/projects/delete":    {[]types.ApiKeyScope{types.ScopeProjectsDelete}, projectDenied},
+}
+
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, _ := route.GetPathTemplate()
+	return template
+}
+
+// checkRouteProject keeps a request made with an api key restricted to a project within it
+func (s *Server) checkRouteProject(req *http.Request, uuid string, access projectAccess) error {
+	switch access {
+	case projectTask:
+		id, err := idFromQuery(req)
+		if err != nil {
+			return err
+		}
+		return s.checkTaskProject(req, uuid, id)
+	case projectItself:
+		id, err := idFromQuery(req)
+		if err != nil {
+			return err
+		}
+		if projectId, _ := apiKeyProject(req); id != strconv.Itoa(projectId) {
+			return notFound(db.NoProjectsFoundError)
+		}
+		return nil
+	case projectHandled:
+		return nil
+	}
+	return newApiError(http.StatusForbidden, codeInsufficientScope, projectKeyRoute)
+}
+
+// apiKeyProject is the project the request's api key is restricted to, if it is
+func apiKeyProject(req *http.Request) (int, bool) {
+	projectId, ok := req.Context().Value("apiKeyProject").(int)
+	return projectId, ok
+}
+
+// checkTaskProject hides the tasks outside the project the request's api key is restricted to, as
+// if they did not exist
+func (s *Server) checkTaskProject(req *http.Request, uuid string, id string) error {
+	projectId, ok := apiKeyProject(req)
+	if !ok {
+		return nil
+	}
+
+	task, err := s.db.GetTaskById(uuid, id)
+	if err != nil {
+		return taskError(err)
+	}
+	if !task.ProjectId.Valid || int(task.ProjectId.Int64) != projectId {
+		return notFound(db.NoTasksFoundError)
+	}
+	return nil
+}
+
+// keepInKeyProject puts new tasks in the project the request's api key is restricted to, any
+// other project is refused
+func keepInKeyProject(req *http.Request, projectId *int) (*int, error) {
+	keyProject, ok := apiKeyProject(req)
+	if !ok {
+		return projectId, nil
+	}
+	if projectId != nil && *projectId != keyProject {
+		return nil, newApiError(http.StatusForbidden, codeInsufficientScope, outsideKeyProject)
+	}
+	return &keyProject, nil
+}
+
+func missingScope(scope types.ApiKeyScope) *apiError {
+	return newApiError(http.StatusForbidden, codeInsufficientScope, fmt.Errorf("This api key does not have the %s scope", scope))
+}
+
+// hasScope is always true for requests that were not made with an api key
+func hasScope(req *http.Request, scope types.ApiKeyScope) bool {
+	scopes, ok := req.Context().Value("apiKeyScopes").([]types.ApiKeyScope)
+	return !ok || slices.Contains(scopes, scope)
+}
+
 func (s *Server) jwtAuthorizationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var (
-			decodedJwt *jwt.Token
-			err        error
-		)
 		bearerToken := r.Header.Get("Authorization")
 		if !strings.HasPrefix(bearerToken, "Bearer") {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-		} else {
-			token := strings.TrimPrefix(bearerToken, "Bearer")
-			token = strings.TrimSpace(token)
-			decodedJwt, err = jwt.ParseWithClaims(token, &types.JwtClaims{}, func(tok *jwt.Token) (any, error) {
-				privateKey, err := auth.GetJwtPrivateKey()
-				return &privateKey.PublicKey, err
-			})
-			if err != nil {
-				http.Error(w, "Forbidden", http.StatusForbidden)
-				s.logger.Panic(fmt.Errorf("jwt auth failure %v", err))
-			}
-			if claims, ok := decodedJwt.Claims.(*types.JwtClaims); ok && decodedJwt.Valid {
-				ctx := context.WithValue(r.Context(), "userId", claims.Uuid)
-				next.ServeHTTP(w, r.WithContext(ctx))
-			}
+			s.writeError(w, r, forbidden(noBearer))
+			return
 		}
+
+		token := strings.TrimPrefix(bearerToken, "Bearer")
+		token = strings.TrimSpace(token)
+		decodedJwt, err := jwt.ParseWithClaims(token, &types.JwtClaims{}, s.keyring.Keyfunc, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithExpirationRequired(), jwt.WithIssuedAt())
+		// An expired jwt is the cue for the client to refresh it
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			s.writeError(w, r, unauthorized(fmt.Errorf("jwt auth failure %v", err)))
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, forbidden(fmt.Errorf("jwt auth failure %v", err)))
+			return
+		}
+
+		claims, ok := decodedJwt.Claims.(*types.JwtClaims)
+		if !ok || !decodedJwt.Valid {
+			s.writeError(w, r, forbidden(errors.New("jwt auth failure invalid claims")))
+			return
+		}
+
+		// Logging out revokes the session before its jwts expire
+		err = s.db.SessionExists(claims.Uuid, claims.SessionId)
+		if errors.Is(err, db.NoSessionFoundError) {
+			s.writeError(w, r, unauthorized(err))
+			return
+		}
+		if err != nil {
+			s.writeError(w, r, internalError(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "userId", claims.Uuid)
+		ctx = context.WithValue(ctx, "sessionId", claims.SessionId)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
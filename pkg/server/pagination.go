@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/senyc/jason/pkg/db"
+	"github.com/senyc/jason/pkg/types"
+)
+
+const maxLimit = 100
+
+func limitFromParam(param string) (int, error) {
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 || limit > maxLimit {
+		return limit, badRequest(invalidLimit)
+	}
+	return limit, nil
+}
+
+func priorityFromQuery(query url.Values, param string) (*int16, error) {
+	value := query.Get(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	priority, err := strconv.ParseInt(value, 10, 16)
+	if err != nil {
+		return nil, badRequest(invalidPriority)
+	}
+	result := int16(priority)
+	return &result, nil
+}
+
+// Dates without a time are taken as midnight utc
+func timeFromQuery(query url.Values, param string) (*time.Time, error) {
+	value := query.Get(param)
+	if value == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, badRequest(invalidTime)
+}
+
+// Cursors are opaque to clients, they are the json of a TaskCursor or SearchCursor
+func encodeCursor(cursor any) string {
+	j, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(j)
+}
+
+func decodeCursor[T any](param string) (T, error) {
+	var cursor T
+	j, err := base64.RawURLEncoding.DecodeString(param)
+	if err != nil {
+		return cursor, badRequest(invalidCursor)
+	}
+	if err = json.Unmarshal(j, &cursor); err != nil {
+		return cursor, badRequest(invalidCursor)
+	}
+	return cursor, nil
+}
+
+// pageFromQuery reads ?sort=, ?order=, ?limit= and ?cursor= into the filter. Listings without a
+// limit are not paginated
+func pageFromQuery(req *http.Request, filter types.TaskFilter) (types.TaskFilter, error) {
+	query := req.URL.Query()
+
+	filter.Sort = types.SortByDue
+	if param := query.Get("sort"); param != "" {
+		filter.Sort = types.TaskSort(param)
+		switch filter.Sort {
+		case types.SortByDue, types.SortByPriority, types.SortByCreated, types.SortById:
+		default:
+			return filter, badRequest(invalidSort)
+		}
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, badRequest(invalidOrder)
+	}
+
+	if param := query.Get("limit"); param != "" {
+		limit, err := limitFromParam(param)
+		if err != nil {
+			return filter, err
+		}
+		filter.Limit = limit
+	}
+
+	if param := query.Get("cursor"); param != "" {
+		cursor, err := decodeCursor[types.TaskCursor](param)
+		if err != nil {
+			return filter, err
+		}
+		// A cursor only means something in the order it was made for
+		if cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+			return filter, badRequest(invalidCursor)
+		}
+		filter.After = &cursor
+	}
+	return filter, nil
+}
+
+// withPeek asks the store for one task more than the page holds, so paginate can tell whether
+// another page follows
+func withPeek(filter types.TaskFilter) types.TaskFilter {
+	if filter.Limit > 0 {
+		filter.Limit++
+	}
+	return filter
+}
+
+// paginate drops the task withPeek asked for and returns the cursor of the next page, which is nil
+// on the last page
+func paginate(filter types.TaskFilter, tasks []types.SqlTasksRow) ([]types.SqlTasksRow, *string) {
+	if filter.Limit == 0 || len(tasks) <= filter.Limit {
+		return tasks, nil
+	}
+
+	tasks = tasks[:filter.Limit]
+	cursor := encodeCursor(db.CursorFor(tasks[len(tasks)-1], filter))
+	return tasks, &cursor
+}
+
+// writeListing responds with the bare array listings have always returned, only paginated requests
+// get a page so the next cursor has somewhere to go
+func writeListing[T any](w http.ResponseWriter, filter types.TaskFilter, items []T, nextCursor *string) error {
+	if filter.Limit == 0 && filter.After == nil {
+		return writeJson(w, http.StatusOK, items)
+	}
+	return writeJson(w, http.StatusOK, types.Page[T]{Items: items, NextCursor: nextCursor})
+}
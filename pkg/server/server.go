@@ -1,94 +1,303 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/senyc/jason/pkg/auth"
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/contact"
 	"github.com/senyc/jason/pkg/db"
 )
 
+// emailSender is what the server needs from contact.Mailer
+type emailSender interface {
+	SendResetEmail(email string, oneTimeToken string) error
+	SendApiKeyExpiryEmail(email string, label string, expiration time.Time) error
+}
+
 type Server struct {
-	db     *db.DB
-	server *http.Server
-	logger *log.Logger
+	config  config.Config
+	db      db.Store
+	keyring *auth.Keyring
+	mailer  emailSender
+	server  *http.Server
+	logger  *log.Logger
+
+	apiKeyUsage apiKeyUsage
+
+	// Background workers are stopped by cancelling workerCtx during shutdown
+	workerCtx    context.Context
+	stopWorkers  context.CancelFunc
+	workersGroup sync.WaitGroup
+}
+
+// New returns a server for the given configuration, when store is nil Start opens
+// the database described by the configuration
+func New(cfg config.Config, store db.Store) *Server {
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	return &Server{
+		config:      cfg,
+		db:          store,
+		mailer:      contact.NewMailer(cfg.Email),
+		logger:      log.New(os.Stdout, "log: ", log.LstdFlags|log.Lshortfile),
+		workerCtx:   workerCtx,
+		stopWorkers: stopWorkers,
+	}
 }
 
-func (s *Server) Start() error {
-	s.db = new(db.DB)
+// Start serves until ctx is cancelled, then shuts down gracefully within the configured timeout
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.setup(); err != nil {
+		return err
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.server.ListenAndServe()
+	}()
 
-	err := s.db.Connect()
+	select {
+	case err := <-serveErr:
+		s.stopWorkers()
+		s.workersGroup.Wait()
+		return errors.Join(err, s.db.Close())
+	case <-ctx.Done():
+	}
+
+	s.logger.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	return s.Shutdown(shutdownCtx)
+}
 
+// setup opens the store and prepares everything needed before accepting connections
+func (s *Server) setup() error {
+	keyring, err := auth.LoadKeyring(s.config.Auth.KeyringPath, s.config.Auth.JwtPemPath)
 	if err != nil {
 		return err
 	}
-	s.logger = log.New(os.Stdout, "log: ", log.LstdFlags|log.Lshortfile)
+	s.keyring = keyring
+
+	if s.db == nil {
+		store, err := db.Open(s.config.Database)
+		if err != nil {
+			return err
+		}
+		s.db = store
+	}
+
+	if s.config.Database.AutoMigrate {
+		migrator, ok := s.db.(db.Migrator)
+		if !ok {
+			return db.NoMigratorError
+		}
+		applied, err := migrator.Migrate()
+		if err != nil {
+			return err
+		}
+		s.logger.Printf("applied %d migrations", applied)
+	} else if migrator, ok := s.db.(db.Migrator); ok {
+		// A fresh database has no tables at all, serving it would fail every request
+		statuses, err := migrator.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		pending := 0
+		for _, status := range statuses {
+			if status.AppliedAt == nil {
+				pending++
+			}
+		}
+		if pending > 0 {
+			return fmt.Errorf("The database has %d pending migrations, run jason migrate up or enable autoMigrate", pending)
+		}
+	}
+
+	s.server = &http.Server{
+		Addr:    s.config.ListenAddr,
+		Handler: s.Handler(),
+	}
 
+	s.runWorker(s.purgeTrash)
+	s.runWorker(s.reloadKeyring)
+	s.runWorker(s.flushApiKeyUsage)
+	if s.config.Email.ApiKey != "" {
+		s.runWorker(s.notifyExpiringApiKeys)
+	} else {
+		s.logger.Println("no email api key configured, not sending api key expiry notices")
+	}
+	return nil
+}
+
+// runWorker starts fn in the background, fn must return once ctx is cancelled
+func (s *Server) runWorker(fn func(ctx context.Context)) {
+	s.workersGroup.Add(1)
+	go func() {
+		defer s.workersGroup.Done()
+		fn(s.workerCtx)
+	}()
+}
+
+// Handler builds the full route tree, it can be served directly with net/http/httptest
+func (s *Server) Handler() http.Handler {
+	originsOk := handlers.AllowedOrigins(s.config.CorsOrigins)
+	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization", requestIdHeader, ifMatchHeader})
+	exposedOk := handlers.ExposedHeaders([]string{"Location", requestIdHeader, etagHeader})
+	methodsOk := handlers.AllowedMethods([]string{http.MethodPost, http.MethodGet, http.MethodDelete, http.MethodPut, http.MethodPatch, http.MethodOptions, http.MethodHead})
+
+	return handlers.CORS(originsOk, headersOk, methodsOk, exposedOk)(s.router())
+}
+
+func (s *Server) router() *mux.Router {
 	r := mux.NewRouter()
 
 	tasks := r.PathPrefix("/api/tasks/").Subrouter()
 	user := r.PathPrefix("/api/user/").Subrouter()
+	r.HandleFunc("/.well-known/jwks.json", s.handle(s.getJwks)).Methods(http.MethodGet)
 	site := r.PathPrefix("/site/tasks/").Subrouter()
 
-	r.Use(s.loggingMiddleware)
+	r.Use(s.requestIdMiddleware, s.recoveryMiddleware, s.loggingMiddleware)
 
 	tasks.Use(s.authorizationMiddleware)
-	tasks.HandleFunc("/all", s.getAllTasks).Methods(http.MethodGet)
-	tasks.HandleFunc("/complete", s.getCompletedTasks).Methods(http.MethodGet)
-	tasks.HandleFunc("/incomplete", s.getIncompleteTasks).Methods(http.MethodGet)
-	tasks.HandleFunc("/byId", s.getTaskById).Methods(http.MethodGet)
-	tasks.HandleFunc("/markComplete", s.markAsCompleted).Methods(http.MethodPatch)
-	tasks.HandleFunc("/markIncomplete", s.markAsIncomplete).Methods(http.MethodPatch)
-	tasks.HandleFunc("/new", s.addNewTask).Methods(http.MethodPost)
-	tasks.HandleFunc("/delete", s.deleteTask).Methods(http.MethodDelete)
-	tasks.HandleFunc("/edit", s.editTask).Methods(http.MethodPatch)
+	tasks.HandleFunc("/all", s.handle(s.getAllTasks)).Methods(http.MethodGet)
+	tasks.HandleFunc("/complete", s.handle(s.getCompletedTasks)).Methods(http.MethodGet)
+	tasks.HandleFunc("/incomplete", s.handle(s.getIncompleteTasks)).Methods(http.MethodGet)
+	tasks.HandleFunc("/byId", s.handle(s.getTaskById)).Methods(http.MethodGet)
+	tasks.HandleFunc("/search", s.handle(s.searchTasks)).Methods(http.MethodGet)
+	tasks.HandleFunc("/stats", s.handle(s.getTaskStats)).Methods(http.MethodGet)
+	tasks.HandleFunc("/sync", s.handle(s.getSync)).Methods(http.MethodGet)
+	tasks.HandleFunc("/markComplete", s.handle(s.markAsCompleted)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/markIncomplete", s.handle(s.markAsIncomplete)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/new", s.handle(s.addNewTask)).Methods(http.MethodPost)
+	tasks.HandleFunc("/delete", s.handle(s.deleteTask)).Methods(http.MethodDelete)
+	tasks.HandleFunc("/trash", s.handle(s.getTrash)).Methods(http.MethodGet)
+	tasks.HandleFunc("/trash/restore", s.handle(s.restoreTask)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/trash/purge", s.handle(s.purgeTask)).Methods(http.MethodDelete)
+	tasks.HandleFunc("/trash/empty", s.handle(s.emptyTrash)).Methods(http.MethodDelete)
+	tasks.HandleFunc("/edit", s.handle(s.editTask)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/batch", s.handle(s.runBatch)).Methods(http.MethodPost)
+	tasks.HandleFunc("/tags/all", s.handle(s.getAllTags)).Methods(http.MethodGet)
+	tasks.HandleFunc("/tags/add", s.handle(s.addTaskTags)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/tags/remove", s.handle(s.removeTaskTags)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/tags/rename", s.handle(s.renameTag)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/tags/delete", s.handle(s.deleteTag)).Methods(http.MethodDelete)
+	tasks.HandleFunc("/move", s.handle(s.moveTask)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/parent", s.handle(s.setTaskParent)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/subtasks", s.handle(s.getSubtasks)).Methods(http.MethodGet)
+	tasks.HandleFunc("/recurrence/preview", s.handle(s.getRecurrencePreview)).Methods(http.MethodGet)
+	tasks.HandleFunc("/checklist/all", s.handle(s.getChecklistItems)).Methods(http.MethodGet)
+	tasks.HandleFunc("/checklist/new", s.handle(s.addChecklistItem)).Methods(http.MethodPost)
+	tasks.HandleFunc("/checklist/edit", s.handle(s.editChecklistItem)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/checklist/check", s.handle(s.checkChecklistItem)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/checklist/uncheck", s.handle(s.uncheckChecklistItem)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/checklist/delete", s.handle(s.deleteChecklistItem)).Methods(http.MethodDelete)
+	tasks.HandleFunc("/projects/new", s.handle(s.addNewProject)).Methods(http.MethodPost)
+	tasks.HandleFunc("/projects/all", s.handle(s.getAllProjects)).Methods(http.MethodGet)
+	tasks.HandleFunc("/projects/byId", s.handle(s.getProjectById)).Methods(http.MethodGet)
+	tasks.HandleFunc("/projects/tasks", s.handle(s.getProjectTasks)).Methods(http.MethodGet)
+	tasks.HandleFunc("/projects/edit", s.handle(s.editProject)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/projects/archive", s.handle(s.archiveProject)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/projects/unarchive", s.handle(s.unarchiveProject)).Methods(http.MethodPatch)
+	tasks.HandleFunc("/projects/delete", s.handle(s.deleteProject)).Methods(http.MethodDelete)
 
 	site.Use(s.jwtAuthorizationMiddleware)
-	site.HandleFunc("/all", s.getAllTasks).Methods(http.MethodGet)
-	site.HandleFunc("/complete", s.getCompletedTasks).Methods(http.MethodGet)
-	site.HandleFunc("/incomplete", s.getIncompleteTasks).Methods(http.MethodGet)
-	site.HandleFunc("/byId", s.getTaskById).Methods(http.MethodGet)
-	site.HandleFunc("/markComplete", s.markAsCompleted).Methods(http.MethodPatch)
-	site.HandleFunc("/markIncomplete", s.markAsIncomplete).Methods(http.MethodPatch)
-	site.HandleFunc("/new", s.addNewTask).Methods(http.MethodPost)
-	site.HandleFunc("/delete", s.deleteTask).Methods(http.MethodDelete)
-	site.HandleFunc("/edit", s.editTask).Methods(http.MethodPatch)
-	site.HandleFunc("/getEmail", s.getEmail).Methods(http.MethodGet)
-	site.HandleFunc("/getSyncTime", s.getSyncTime).Methods(http.MethodGet)
-	site.HandleFunc("/getAccountCreationDate", s.getAccountCreationDate).Methods(http.MethodGet)
-	site.HandleFunc("/changeEmailAddress", s.changeEmailAddress).Methods(http.MethodPost)
-	site.HandleFunc("/deleteAccount", s.deleteAccount).Methods(http.MethodDelete)
-	site.HandleFunc("/getProfilePhoto", s.getProfilePhoto).Methods(http.MethodGet)
-	site.HandleFunc("/changeProfilePhoto", s.changeProfilePhoto).Methods(http.MethodPost)
-
-	site.HandleFunc("/key/new", s.newApiKey).Methods(http.MethodPost)
-	site.HandleFunc("/key/all", s.getAllApiKeys).Methods(http.MethodGet)
-	site.HandleFunc("/key/revoke", s.revokeApiKey).Methods(http.MethodDelete)
-	site.HandleFunc("/key/revoke/all", s.revokeAllApiKeys).Methods(http.MethodDelete)
-
-	user.HandleFunc("/new", s.addNewUser).Methods(http.MethodPost)
-	user.HandleFunc("/login", s.login).Methods(http.MethodPost)
+	site.HandleFunc("/all", s.handle(s.getAllTasks)).Methods(http.MethodGet)
+	site.HandleFunc("/complete", s.handle(s.getCompletedTasks)).Methods(http.MethodGet)
+	site.HandleFunc("/incomplete", s.handle(s.getIncompleteTasks)).Methods(http.MethodGet)
+	site.HandleFunc("/byId", s.handle(s.getTaskById)).Methods(http.MethodGet)
+	site.HandleFunc("/search", s.handle(s.searchTasks)).Methods(http.MethodGet)
+	site.HandleFunc("/stats", s.handle(s.getTaskStats)).Methods(http.MethodGet)
+	site.HandleFunc("/sync", s.handle(s.getSync)).Methods(http.MethodGet)
+	site.HandleFunc("/markComplete", s.handle(s.markAsCompleted)).Methods(http.MethodPatch)
+	site.HandleFunc("/markIncomplete", s.handle(s.markAsIncomplete)).Methods(http.MethodPatch)
+	site.HandleFunc("/new", s.handle(s.addNewTask)).Methods(http.MethodPost)
+	site.HandleFunc("/delete", s.handle(s.deleteTask)).Methods(http.MethodDelete)
+	site.HandleFunc("/trash", s.handle(s.getTrash)).Methods(http.MethodGet)
+	site.HandleFunc("/trash/restore", s.handle(s.restoreTask)).Methods(http.MethodPatch)
+	site.HandleFunc("/trash/purge", s.handle(s.purgeTask)).Methods(http.MethodDelete)
+	site.HandleFunc("/trash/empty", s.handle(s.emptyTrash)).Methods(http.MethodDelete)
+	site.HandleFunc("/edit", s.handle(s.editTask)).Methods(http.MethodPatch)
+	site.HandleFunc("/batch", s.handle(s.runBatch)).Methods(http.MethodPost)
+	site.HandleFunc("/tags/all", s.handle(s.getAllTags)).Methods(http.MethodGet)
+	site.HandleFunc("/tags/add", s.handle(s.addTaskTags)).Methods(http.MethodPatch)
+	site.HandleFunc("/tags/remove", s.handle(s.removeTaskTags)).Methods(http.MethodPatch)
+	site.HandleFunc("/tags/rename", s.handle(s.renameTag)).Methods(http.MethodPatch)
+	site.HandleFunc("/tags/delete", s.handle(s.deleteTag)).Methods(http.MethodDelete)
+	site.HandleFunc("/move", s.handle(s.moveTask)).Methods(http.MethodPatch)
+	site.HandleFunc("/parent", s.handle(s.setTaskParent)).Methods(http.MethodPatch)
+	site.HandleFunc("/subtasks", s.handle(s.getSubtasks)).Methods(http.MethodGet)
+	site.HandleFunc("/recurrence/preview", s.handle(s.getRecurrencePreview)).Methods(http.MethodGet)
+	site.HandleFunc("/checklist/all", s.handle(s.getChecklistItems)).Methods(http.MethodGet)
+	site.HandleFunc("/checklist/new", s.handle(s.addChecklistItem)).Methods(http.MethodPost)
+	site.HandleFunc("/checklist/edit", s.handle(s.editChecklistItem)).Methods(http.MethodPatch)
+	site.HandleFunc("/checklist/check", s.handle(s.checkChecklistItem)).Methods(http.MethodPatch)
+	site.HandleFunc("/checklist/uncheck", s.handle(s.uncheckChecklistItem)).Methods(http.MethodPatch)
+	site.HandleFunc("/checklist/delete", s.handle(s.deleteChecklistItem)).Methods(http.MethodDelete)
+	site.HandleFunc("/projects/new", s.handle(s.addNewProject)).Methods(http.MethodPost)
+	site.HandleFunc("/projects/all", s.handle(s.getAllProjects)).Methods(http.MethodGet)
+	site.HandleFunc("/projects/byId", s.handle(s.getProjectById)).Methods(http.MethodGet)
+	site.HandleFunc("/projects/tasks", s.handle(s.getProjectTasks)).Methods(http.MethodGet)
+	site.HandleFunc("/projects/edit", s.handle(s.editProject)).Methods(http.MethodPatch)
+	site.HandleFunc("/projects/archive", s.handle(s.archiveProject)).Methods(http.MethodPatch)
+	site.HandleFunc("/projects/unarchive", s.handle(s.unarchiveProject)).Methods(http.MethodPatch)
+	site.HandleFunc("/projects/delete", s.handle(s.deleteProject)).Methods(http.MethodDelete)
+	site.HandleFunc("/getEmail", s.handle(s.getEmail)).Methods(http.MethodGet)
+	site.HandleFunc("/getSyncTime", s.handle(s.getSyncTime)).Methods(http.MethodGet)
+	site.HandleFunc("/getAccountCreationDate", s.handle(s.getAccountCreationDate)).Methods(http.MethodGet)
+	site.HandleFunc("/changeEmailAddress", s.handle(s.changeEmailAddress)).Methods(http.MethodPost)
+	site.HandleFunc("/deleteAccount", s.handle(s.deleteAccount)).Methods(http.MethodDelete)
+	site.HandleFunc("/getProfilePhoto", s.handle(s.getProfilePhoto)).Methods(http.MethodGet)
+	site.HandleFunc("/changeProfilePhoto", s.handle(s.changeProfilePhoto)).Methods(http.MethodPost)
+
+	site.HandleFunc("/logout", s.handle(s.logout)).Methods(http.MethodPost)
+	site.HandleFunc("/logout/all", s.handle(s.logoutAll)).Methods(http.MethodPost)
+
+	site.HandleFunc("/key/new", s.handle(s.newApiKey)).Methods(http.MethodPost)
+	site.HandleFunc("/key/all", s.handle(s.getAllApiKeys)).Methods(http.MethodGet)
+	site.HandleFunc("/key/revoke", s.handle(s.revokeApiKey)).Methods(http.MethodDelete)
+	site.HandleFunc("/key/revoke/all", s.handle(s.revokeAllApiKeys)).Methods(http.MethodDelete)
+
+	user.HandleFunc("/new", s.handle(s.addNewUser)).Methods(http.MethodPost)
+	user.HandleFunc("/login", s.handle(s.login)).Methods(http.MethodPost)
+	user.HandleFunc("/login/refresh", s.handle(s.refreshJwt)).Methods(http.MethodPost)
 
 	// Reset/forgot password process
-	user.HandleFunc("/login/password/sendResetEmail", s.sendForgotPasswordRequest).Methods(http.MethodPost)
-	user.HandleFunc("/login/password/reset", s.resetUserPassword).Methods(http.MethodPost)
+	user.HandleFunc("/login/password/sendResetEmail", s.handle(s.sendForgotPasswordRequest)).Methods(http.MethodPost)
+	user.HandleFunc("/login/password/reset", s.handle(s.resetUserPassword)).Methods(http.MethodPost)
 
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	headersOk := handlers.AllowedHeaders([]string{"Content-Type", "Authorization"})
-	methodsOk := handlers.AllowedMethods([]string{http.MethodPost, http.MethodGet, http.MethodDelete, http.MethodPut, http.MethodPatch, http.MethodOptions, http.MethodHead})
+	return r
+}
 
-	s.server = &http.Server{
-		Addr:    ":8080",
-		Handler: handlers.CORS(originsOk, headersOk, methodsOk)(r),
+// Shutdown stops accepting connections, waits for in flight requests and background workers
+// until ctx expires and then closes the store
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		// Drops whatever is still running once the timeout is reached
+		s.server.Close()
 	}
 
-	err = s.server.ListenAndServe()
-	return err
-}
+	s.stopWorkers()
+	workersDone := make(chan struct{})
+	go func() {
+		s.workersGroup.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-ctx.Done():
+		err = errors.Join(err, errors.New("Timed out waiting for background workers"))
+	}
 
-func (s *Server) Shutdown() error {
-	// also close the db from here
-	return s.server.Close()
+	return errors.Join(err, s.db.Close())
 }
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/senyc/jason/pkg/auth"
+	"github.com/senyc/jason/pkg/config"
+	"github.com/senyc/jason/pkg/db"
+	"github.com/senyc/jason/pkg/types"
+)
+
+func TestSetupRequiresMigrations(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.db = nil
+	s.config.Database = config.Database{Driver: config.DriverSQLite, Path: filepath.Join(t.TempDir(), "jason.db")}
+
+	err := s.setup()
+	if err == nil || !strings.Contains(err.Error(), "jason migrate up") {
+		t.Fatalf("got %v starting on an empty database", err)
+	}
+	s.db.Close()
+
+	s.db = nil
+	s.config.Database.AutoMigrate = true
+	if err = s.setup(); err != nil {
+		t.Fatal(err)
+	}
+	s.stopWorkers()
+	s.workersGroup.Wait()
+	if err = s.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closeRecorder remembers whether the server closed its store
+type closeRecorder struct {
+	*db.MemoryStore
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+// serveBlocking serves a handler that waits for release, entered is closed once a request is in it
+func serveBlocking(t *testing.T, s *Server) (url string, entered chan struct{}, release chan struct{}) {
+	t.Helper()
+
+	entered = make(chan struct{})
+	release = make(chan struct{})
+	s.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(entered)
+		<-release
+		io.WriteString(w, "done")
+	})}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.server.Serve(listener)
+	return "http://" + listener.Addr().String(), entered, release
+}
+
+func TestShutdown(t *testing.T) {
+	s, memory := newTestServer(t)
+	store := &closeRecorder{MemoryStore: memory}
+	s.db = store
+	url, entered, release := serveBlocking(t, s)
+
+	var workerStopped atomic.Bool
+	s.runWorker(func(ctx context.Context) {
+		<-ctx.Done()
+		workerStopped.Store(true)
+	})
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+	<-entered
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- s.Shutdown(context.Background())
+	}()
+
+	// Shutting down waits for the request in flight
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("shut down with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if store.closed.Load() {
+		t.Fatal("the store was closed with a request in flight")
+	}
+
+	close(release)
+	if resp := <-responses; resp.err != nil || resp.body != "done" {
+		t.Fatalf("got %q: %v", resp.body, resp.err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Fatal(err)
+	}
+	if !workerStopped.Load() || !store.closed.Load() {
+		t.Fatalf("worker stopped %v, store closed %v", workerStopped.Load(), store.closed.Load())
+	}
+
+	// New connections are refused once shut down
+	if _, err := http.Get(url); err == nil {
+		t.Fatal("a request was served after shutting down")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	s, memory := newTestServer(t)
+	store := &closeRecorder{MemoryStore: memory}
+	s.db = store
+	url, entered, release := serveBlocking(t, s)
+	defer close(release)
+
+	go http.Get(url)
+	<-entered
+
+	// A request still running at the deadline is dropped, the store is closed regardless
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v after the timeout", err)
+	}
+	if !store.closed.Load() {
+		t.Fatal("the store was not closed")
+	}
+}
+
+// writeJwtKey stores a new signing key at path
+func writeJwtKey(t *testing.T, path string) {
+	t.Helper()
+
+	key, err := auth.GenerateJwtPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := auth.EncodeJwtPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadKeyringOnHangup(t *testing.T) {
+	// Registered before the worker so a hangup sent too early cannot end the test binary
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	dir := t.TempDir()
+	writeJwtKey(t, filepath.Join(dir, "first.pem"))
+	writeJwtKey(t, filepath.Join(dir, "second.pem"))
+	keyringPath := filepath.Join(dir, "keyring.yaml")
+	first := auth.KeyringEntry{Kid: "first", Pem: "first.pem"}
+	if err := auth.WriteKeyringFile(keyringPath, auth.KeyringFile{Active: "first", Keys: []auth.KeyringEntry{first}}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestServer(t)
+	var err error
+	if s.keyring, err = auth.LoadKeyring(keyringPath, ""); err != nil {
+		t.Fatal(err)
+	}
+	h := s.Handler()
+	before := signUp(t, h, "someone@example.com")
+	if kid := jwtKid(t, before.Jwt); kid != "first" {
+		t.Fatalf("jwt was signed with kid %q", kid)
+	}
+
+	s.runWorker(s.reloadKeyring)
+	defer func() {
+		s.stopWorkers()
+		s.workersGroup.Wait()
+	}()
+
+	keyringFile := auth.KeyringFile{Active: "second", Keys: []auth.KeyringEntry{first, {Kid: "second", Pem: "second.pem"}}}
+	if err = auth.WriteKeyringFile(keyringPath, keyringFile); err != nil {
+		t.Fatal(err)
+	}
+	// The worker may not be listening for the first hangup yet, so it is sent until the keys change
+	deadline := time.Now().Add(5 * time.Second)
+	for jwtKid(t, logIn(t, h, "someone@example.com").Jwt) != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("keyring was not reloaded on SIGHUP")
+		}
+		if err = syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	rec := serve(t, h, request{method: http.MethodGet, path: "/.well-known/jwks.json"})
+	expectStatus(t, rec, http.StatusOK)
+	if jwks := decodeResponse[types.JwkSet](t, rec); len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "first" || jwks.Keys[1].Kid != "second" {
+		t.Fatalf("got jwks %+v after rotating", jwks)
+	}
+	// Jwts signed before the rotation stay valid while their key is in the keyring
+	rec = serve(t, h, request{method: http.MethodGet, path: "/site/tasks/getEmail", auth: bearer(before)})
+	expectStatus(t, rec, http.StatusOK)
+}
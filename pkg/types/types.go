@@ -2,6 +2,7 @@ package types
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -19,6 +20,23 @@ func (t NullTime) MarshalJSON() ([]byte, error) {
 	}
 }
 
+// PatchField is a member of a JSON merge patch, it is only set when the member is present and
+// null when it is present as null, in which case value is left zero
+type PatchField[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+func (f *PatchField[T]) UnmarshalJSON(data []byte) error {
+	f.Set = true
+	if string(data) == "null" {
+		f.Null = true
+		return nil
+	}
+	return json.Unmarshal(data, &f.Value)
+}
+
 type SqlTasksRow struct {
 	Id            int
 	Title         string
@@ -28,16 +46,45 @@ type SqlTasksRow struct {
 	Priority      int16
 	Completed     bool
 	CompletedDate sql.NullTime
+	ProjectId     sql.NullInt64
+	ParentId      sql.NullInt64
+	Recurrence    sql.NullString
+	// Zero based position of the task in its recurring series
+	Occurrence int
+	UpdatedAt  time.Time
+	// Revisions of the user's change counter, see the sync endpoint
+	CreatedRevision int64
+	Revision        int64
+	// Set while the task is in the trash
+	DeletedAt sql.NullTime
+	Tags      []string
+	Progress  TaskProgress
+}
+
+// TaskProgress counts a task's direct subtasks and checklist items
+type TaskProgress struct {
+	Subtasks              int `json:"subtasks"`
+	CompletedSubtasks     int `json:"completedSubtasks"`
+	ChecklistItems        int `json:"checklistItems"`
+	CheckedChecklistItems int `json:"checkedChecklistItems"`
 }
 
 type TaskReponse struct {
-	Id            int        `json:"id"`
-	Title         string     `json:"title"`
-	Body          string     `json:"body"`
-	Due           NullTime   `json:"due"`
-	Priority      int16      `json:"priority"`
-	Completed     bool       `json:"completed"`
-	CompletedDate *time.Time `json:"completedDate,omitempty"`
+	Id            int          `json:"id"`
+	Title         string       `json:"title"`
+	Body          string       `json:"body"`
+	Due           NullTime     `json:"due"`
+	Priority      int16        `json:"priority"`
+	Completed     bool         `json:"completed"`
+	CompletedDate *time.Time   `json:"completedDate,omitempty"`
+	TimeCreated   time.Time    `json:"timeCreated"`
+	ProjectId     *int         `json:"projectId"`
+	ParentId      *int         `json:"parentId"`
+	Recurrence    string       `json:"recurrence"`
+	UpdatedAt     time.Time    `json:"updatedAt"`
+	DeletedAt     *time.Time   `json:"deletedAt,omitempty"`
+	Tags          []string     `json:"tags"`
+	Progress      TaskProgress `json:"progress"`
 }
 
 type CompletedTaskResponse struct {
@@ -47,35 +94,315 @@ type CompletedTaskResponse struct {
 	Due           NullTime  `json:"due"`
 	Priority      int16     `json:"priority"`
 	CompletedDate time.Time `json:"completedDate,omitempty"`
+	ProjectId     *int      `json:"projectId"`
+	ParentId      *int      `json:"parentId"`
+	Recurrence    string    `json:"recurrence"`
+	Tags          []string  `json:"tags"`
 }
 
 type IncompleteTaskResponse struct {
-	Id       int      `json:"id"`
-	Title    string   `json:"title"`
-	Body     string   `json:"body"`
-	Due      NullTime `json:"due"`
-	Priority int16    `json:"priority"`
+	Id         int      `json:"id"`
+	Title      string   `json:"title"`
+	Body       string   `json:"body"`
+	Due        NullTime `json:"due"`
+	Priority   int16    `json:"priority"`
+	ProjectId  *int     `json:"projectId"`
+	ParentId   *int     `json:"parentId"`
+	Recurrence string   `json:"recurrence"`
+	Tags       []string `json:"tags"`
 }
 
-type NewTaskPayload struct {
-	Title    string    `json:"title"`
-	Body     string    `json:"body"`
+// TaskFilter narrows and orders the task listing endpoints, zero values do not filter
+type TaskFilter struct {
+	// Tasks must have every one of these tags
+	Tags []string
+	// Tasks must belong to this project
+	ProjectId *int
+	// Tasks must be direct subtasks of this task
+	ParentId *int
+	// Both bounds are inclusive
+	MinPriority *int16
+	MaxPriority *int16
+	// Ranges include their start and exclude their end, tasks without a due date never match a due range
+	DueAfter      *time.Time
+	DueBefore     *time.Time
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// Defaults to SortByDue, ties are broken by id in the same direction
+	Sort TaskSort
+	Desc bool
+	// Zero lists every task
+	Limit int
+	// Only tasks after this position in the sort order are listed
+	After *TaskCursor
+}
+
+type TaskSort string
+
+const (
+	SortByDue      TaskSort = "due"
+	SortByPriority TaskSort = "priority"
+	SortByCreated  TaskSort = "created"
+	SortById       TaskSort = "id"
+)
+
+// TaskCursor is the position of a task in a sorted listing, tasks without a due date sort as the zero time
+type TaskCursor struct {
+	Sort     TaskSort  `json:"sort"`
+	Desc     bool      `json:"desc"`
+	Id       int       `json:"id"`
 	Due      time.Time `json:"due"`
-	Priority int16     `json:"priority,omitempty"`
+	Priority int16     `json:"priority"`
+	Created  time.Time `json:"created"`
+}
+
+// TaskSearch is a full text search over task titles and bodies
+type TaskSearch struct {
+	Query string
+	// Nil matches both completed and incomplete tasks
+	Completed *bool
+	Limit     int
+	Offset    int
+}
+
+// SearchCursor is the position in a search. Results are ranked by relevance, which has no stable
+// key to page on, so the cursor holds the offset along with the search it belongs to
+type SearchCursor struct {
+	Query     string `json:"query"`
+	Completed *bool  `json:"completed,omitempty"`
+	Offset    int    `json:"offset"`
+}
+
+// Page is one page of a paginated listing
+type Page[T any] struct {
+	Items []T `json:"items"`
+	// Passed back as ?cursor= to fetch the next page, null on the last page
+	NextCursor *string `json:"nextCursor"`
+}
+
+type NewTaskPayload struct {
+	Title     string    `json:"title"`
+	Body      string    `json:"body"`
+	Due       time.Time `json:"due"`
+	Priority  int16     `json:"priority,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	ProjectId *int      `json:"projectId,omitempty"`
+	ParentId  *int      `json:"parentId,omitempty"`
+	// An RRULE like FREQ=WEEKLY;BYDAY=MO, recurring tasks need a due date
+	Recurrence string `json:"recurrence,omitempty"`
 }
 
+type TagsPayload struct {
+	Tags []string `json:"tags"`
+}
+
+type RenameTagPayload struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName"`
+}
+
+type TagResponse struct {
+	Name      string `json:"name"`
+	TaskCount int    `json:"taskCount"`
+}
+
+type ParentPayload struct {
+	// A null parent makes the task a top level task
+	ParentId *int `json:"parentId"`
+}
+
+type ChecklistItemPayload struct {
+	Title string `json:"title"`
+}
+
+type ChecklistItemResponse struct {
+	Id          int       `json:"id"`
+	Title       string    `json:"title"`
+	Checked     bool      `json:"checked"`
+	TimeCreated time.Time `json:"timeCreated"`
+}
+
+type ProjectPayload struct {
+	Name  string `json:"name"`
+	Color string `json:"color,omitempty"`
+}
+
+type EditProjectPayload struct {
+	Name  string `json:"name,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+type MoveTaskPayload struct {
+	// A null project moves the task out of its project
+	ProjectId *int `json:"projectId"`
+}
+
+type ProjectResponse struct {
+	Id          int       `json:"id"`
+	Name        string    `json:"name"`
+	Color       string    `json:"color"`
+	Archived    bool      `json:"archived"`
+	TimeCreated time.Time `json:"timeCreated"`
+	TaskCount   int       `json:"taskCount"`
+}
+
+// EditTaskPayload is a JSON merge patch of the task, absent members are left alone and null
+// members are cleared
 type EditTaskPayload struct {
-	Id       int        `json:"id"`
-	Title    string     `json:"title,omitempty"`
-	Body     string     `json:"body,omitempty"`
-	Due      *time.Time `json:"due,omitempty"`
-	Priority int16      `json:"priority,omitempty"`
+	Id       int                   `json:"id"`
+	Title    PatchField[string]    `json:"title"`
+	Body     PatchField[string]    `json:"body"`
+	Due      PatchField[time.Time] `json:"due"`
+	Priority PatchField[int16]     `json:"priority"`
+	// An empty or null rule stops the task from recurring
+	Recurrence PatchField[string] `json:"recurrence"`
+}
+
+func (p EditTaskPayload) IsEmpty() bool {
+	return !p.Title.Set && !p.Body.Set && !p.Due.Set && !p.Priority.Set && !p.Recurrence.Set
+}
+
+// TaskStats summarizes how many tasks a user completes and how fast, durations are in seconds
+// and periods in utc
+type TaskStats struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	// Periods are named by their first day for weeks, which start on monday, like 2024-01-29,
+	// by the day itself like 2024-01-31 and by the month like 2024-01
+	CompletedPerDay   []PeriodCount `json:"completedPerDay"`
+	CompletedPerWeek  []PeriodCount `json:"completedPerWeek"`
+	CompletedPerMonth []PeriodCount `json:"completedPerMonth"`
+	// Null without completed tasks
+	MeanSecondsToComplete   *float64 `json:"meanSecondsToComplete"`
+	MedianSecondsToComplete *float64 `json:"medianSecondsToComplete"`
+	// Share of the completed tasks with a due date that were completed after it, null without any
+	OverdueCompletionRatio *float64        `json:"overdueCompletionRatio"`
+	Priorities             []PriorityStats `json:"priorities"`
+	// Consecutive days with at least one completion, the current streak still counts when nothing
+	// has been completed yet today
+	CurrentStreak int `json:"currentStreak"`
+	LongestStreak int `json:"longestStreak"`
+}
+
+type PeriodCount struct {
+	Period    string `json:"period"`
+	Completed int    `json:"completed"`
+}
+
+type PriorityStats struct {
+	Priority              int16    `json:"priority"`
+	Total                 int      `json:"total"`
+	Completed             int      `json:"completed"`
+	MeanSecondsToComplete *float64 `json:"meanSecondsToComplete"`
+}
+
+// TaskChanges is what changed for a user up to Revision
+type TaskChanges struct {
+	Tasks    []SqlTasksRow
+	Deleted  []int
+	Revision int64
+}
+
+// SyncResponse lists what changed since the token a client passed, tasks created and then deleted
+// within that time only show up as deleted
+type SyncResponse struct {
+	Created []TaskReponse `json:"created"`
+	Updated []TaskReponse `json:"updated"`
+	Deleted []int         `json:"deleted"`
+	// Passed as ?since= on the next sync
+	Token string `json:"token"`
+}
+
+type BatchOp string
+
+const (
+	BatchCreate     BatchOp = "create"
+	BatchEdit       BatchOp = "edit"
+	BatchComplete   BatchOp = "complete"
+	BatchUncomplete BatchOp = "uncomplete"
+	BatchDelete     BatchOp = "delete"
+)
+
+// BatchPayload runs every operation in one transaction. Without atomic each operation is applied or
+// rejected on its own, with it a single failure rejects them all
+type BatchPayload struct {
+	Atomic     bool                    `json:"atomic"`
+	Operations []BatchOperationPayload `json:"operations"`
+}
+
+// BatchOperationPayload takes a NewTaskPayload as task for create and an EditTaskPayload, without
+// its id, for edit. Every other operation only needs the id
+type BatchOperationPayload struct {
+	Op      BatchOp         `json:"op"`
+	Id      *int            `json:"id,omitempty"`
+	Cascade bool            `json:"cascade,omitempty"`
+	Task    json.RawMessage `json:"task,omitempty"`
+	// Works like If-Match, the operation fails unless the task is still at this version
+	Version *int64 `json:"version,omitempty"`
+}
+
+type BatchOperation struct {
+	Op      BatchOp
+	Id      int
+	Cascade bool
+	NewTask NewTaskPayload
+	Edit    EditTaskPayload
+	IfMatch []int64
+}
+
+// BatchOutcome is the created task's id for create, otherwise the id the operation was given
+type BatchOutcome struct {
+	Id  int
+	Err error
+}
+
+type BatchResult struct {
+	Op      BatchOp `json:"op"`
+	Id      *int    `json:"id,omitempty"`
+	Status  int     `json:"status"`
+	Code    string  `json:"code,omitempty"`
+	Message string  `json:"message,omitempty"`
+}
+
+type BatchResponse struct {
+	// False when an atomic batch was rolled back
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+type OccurrencesResponse struct {
+	Recurrence  string      `json:"recurrence"`
+	Occurrences []time.Time `json:"occurrences"`
+}
+
+// ApiKeyScope limits what an api key can do, every api route names the scopes it takes
+type ApiKeyScope string
+
+const (
+	ScopeTasksRead      ApiKeyScope = "tasks:read"
+	ScopeTasksWrite     ApiKeyScope = "tasks:write"
+	ScopeTasksDelete    ApiKeyScope = "tasks:delete"
+	ScopeTagsWrite      ApiKeyScope = "tags:write"
+	ScopeChecklistRead  ApiKeyScope = "checklist:read"
+	ScopeChecklistWrite ApiKeyScope = "checklist:write"
+	ScopeProjectsRead   ApiKeyScope = "projects:read"
+	ScopeProjectsWrite  ApiKeyScope = "projects:write"
+	ScopeProjectsDelete ApiKeyScope = "projects:delete"
+)
+
+var ApiKeyScopes = []ApiKeyScope{
+	ScopeTasksRead, ScopeTasksWrite, ScopeTasksDelete, ScopeTagsWrite, ScopeChecklistRead, ScopeChecklistWrite,
+	ScopeProjectsRead, ScopeProjectsWrite, ScopeProjectsDelete,
 }
 
 type ApiKeyPayload struct {
 	Label       string     `json:"label"`
 	Description string     `json:"description,omitempty"`
 	Expiration  *time.Time `json:"expiration,omitempty"`
+	// Keys created without scopes get all of them
+	Scopes []ApiKeyScope `json:"scopes,omitempty"`
+	// Keys restricted to a project only reach the tasks in it
+	ProjectId *int `json:"projectId,omitempty"`
 }
 
 type UserLoginPayload struct {
@@ -102,12 +429,29 @@ type ApiKeyResponse struct {
 }
 
 type ApiKeyMetadata struct {
-	Id           string     `json:"id"`
-	Label        string     `json:"label"`
-	Description  string     `json:"description"`
-	Expiration   time.Time  `json:"expiration"`
-	LastAccessed *time.Time `json:"lastAccessed"`
-	CreationDate time.Time  `json:"creationDate"`
+	Id           string        `json:"id"`
+	Label        string        `json:"label"`
+	Description  string        `json:"description"`
+	Expiration   time.Time     `json:"expiration"`
+	LastAccessed *time.Time    `json:"lastAccessed"`
+	CreationDate time.Time     `json:"creationDate"`
+	Scopes       []ApiKeyScope `json:"scopes"`
+	ProjectId    *int          `json:"projectId"`
+}
+
+// ApiKeyUsage is how much a key was used since its usage was last written
+type ApiKeyUsage struct {
+	LastUsed time.Time
+	Requests int
+}
+
+// ExpiringApiKey is an api key whose owner is about to be told it expires
+type ExpiringApiKey struct {
+	Id         string
+	Label      string
+	Expiration time.Time
+	// Of the owner
+	Email string
 }
 
 type Email struct {
@@ -116,11 +460,36 @@ type Email struct {
 
 type JwtClaims struct {
 	jwt.RegisteredClaims
-	Uuid string `json:"uuid"`
+	Uuid      string `json:"uuid"`
+	SessionId string `json:"sid"`
 }
 
+// JwtResponse holds a short lived jwt and the refresh token that gets the next one, every refresh
+// token can only be used once
 type JwtResponse struct {
-	Jwt string `json:"jwt"`
+	Jwt          string `json:"jwt"`
+	RefreshToken string `json:"refreshToken"`
+	// Seconds until the jwt expires
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// Jwk is an EC public key as published in the jwks
+type Jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+}
+
+type JwkSet struct {
+	Keys []Jwk `json:"keys"`
+}
+
+type RefreshPayload struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 type SyncTimeResponse struct {
@@ -132,7 +501,10 @@ type AccountCreationDateResponse struct {
 }
 
 type ErrResponse struct {
-	Message string `json:"message"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Status    int    `json:"status"`
+	RequestId string `json:"requestId"`
 }
 
 type ProfilePhotoResponse struct {
@@ -144,7 +516,7 @@ type ProfilePhotoPayload struct {
 }
 
 type ResetPasswordPayload struct {
-	ResetToken string `json:"token"`
+	ResetToken  string `json:"token"`
 	NewPassword string `json:"password"`
 }
 